@@ -2,18 +2,21 @@ package cloud
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/dns"
 	"github.com/cockroachdb/roachprod/vm"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 )
 
-const vmNameFormat = "user-<clusterid>-<nodeid>"
-
 type Cloud struct {
 	Clusters map[string]*CloudCluster `json:"clusters"`
 	// Any VM in this list can be expected to have at least one element
@@ -60,32 +63,7 @@ func newCloud() *Cloud {
 //
 // TODO(benesch): unify with syncedCluster.
 type CloudCluster struct {
-	Name string `json:"name"`
-	User string `json:"user"`
-	// This is the earliest creation and shortest lifetime across VMs.
-	CreatedAt time.Time     `json:"created_at"`
-	Lifetime  time.Duration `json:"lifetime"`
-	VMs       vm.List       `json:"vms"`
-}
-
-// Clouds returns the names of all of the various cloud providers used
-// by the VMs in the cluster.
-func (c *CloudCluster) Clouds() []string {
-	present := make(map[string]bool)
-	for _, m := range c.VMs {
-		present[m.Provider] = true
-	}
-
-	var ret []string
-	for provider := range present {
-		ret = append(ret, provider)
-	}
-	sort.Strings(ret)
-	return ret
-}
-
-func (c *CloudCluster) ExpiresAt() time.Time {
-	return c.CreatedAt.Add(c.Lifetime)
+	vm.Cluster
 }
 
 func (c *CloudCluster) GCAt() time.Time {
@@ -99,132 +77,1067 @@ func (c *CloudCluster) LifetimeRemaining() time.Duration {
 	return time.Until(c.GCAt())
 }
 
+// expiringSoon is the remaining lifetime below which a cluster is highlighted
+// as expiring.
+const expiringSoon = time.Hour
+
+// LifetimeStatus describes the remaining lifetime of the cluster, highlighting
+// clusters that have expired or will expire within the hour.
+func (c *CloudCluster) LifetimeStatus() string {
+	if !c.HasExpiration() {
+		return "no expiration"
+	}
+	l := c.LifetimeRemaining().Round(time.Second)
+	switch {
+	case l <= 0:
+		return fmt.Sprintf("EXPIRED %s ago", -l)
+	case l < expiringSoon:
+		return fmt.Sprintf("%s remaining, EXPIRING SOON", l)
+	default:
+		return fmt.Sprintf("%s remaining", l)
+	}
+}
+
+// MarshalJSON implements json.Marshaler, adding the time at which the cluster
+// expires. It is null if the cluster has no expiration.
+func (c *CloudCluster) MarshalJSON() ([]byte, error) {
+	// The alias type drops the MarshalJSON method to avoid infinite recursion.
+	type clusterAlias CloudCluster
+	var expiresAt *time.Time
+	if c.HasExpiration() {
+		t := c.ExpiresAt()
+		expiresAt = &t
+	}
+	return json.Marshal(struct {
+		*clusterAlias
+		ExpiresAt *time.Time `json:"expires_at"`
+	}{(*clusterAlias)(c), expiresAt})
+}
+
 func (c *CloudCluster) String() string {
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "%s: %d", c.Name, len(c.VMs))
 	if !c.IsLocal() {
-		fmt.Fprintf(&buf, " (%s)", c.LifetimeRemaining().Round(time.Second))
+		fmt.Fprintf(&buf, " (%s)", c.LifetimeStatus())
 	}
 	return buf.String()
 }
 
 func (c *CloudCluster) PrintDetails() {
 	fmt.Printf("%s: %s ", c.Name, c.Clouds())
-	if !c.IsLocal() {
-		l := c.LifetimeRemaining().Round(time.Second)
-		if l <= 0 {
-			fmt.Printf("expired %s ago\n", -l)
-		} else {
-			fmt.Printf("%s remaining\n", l)
-		}
+	if c.HasExpiration() {
+		fmt.Printf("%s\n", c.LifetimeStatus())
 	} else {
 		fmt.Printf("(no expiration)\n")
 	}
 	for _, vm := range c.VMs {
-		fmt.Printf("  %s\t%s\t%s\t%s\n", vm.Name, vm.DNS, vm.PrivateIP, vm.PublicIP)
+		fmt.Printf("  %s\t%s\t%s\t%s\t%s\t%s\n", vm.Name, vm.DNS, vm.PrivateIP, vm.PublicIP,
+			vm.Status, formatLabels(vm.Labels))
 	}
 }
 
-func (c *CloudCluster) IsLocal() bool {
-	return c.Name == config.Local
+// formatLabels renders labels as a sorted, comma-separated list of
+// key=value pairs.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
 
-func namesFromVM(v vm.VM) (string, string, error) {
-	if v.IsLocal() {
-		return config.Local, config.Local, nil
+// ListCloud queries all of the providers, returning the VMs whose labels
+// match the filter. A nil filter matches all VMs.
+func ListCloud(ctx context.Context, filter vm.LabelFilter) (*Cloud, error) {
+	cloud := newCloud()
+	dnsProvider, err := dns.Active()
+	if err != nil {
+		return nil, err
+	}
+
+	var all vm.List
+	for _, p := range vm.AllProviders() {
+		vms, err := vm.CachedList(ctx, p, filter)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, filter.Apply(vms)...)
 	}
-	name := v.Name
-	parts := strings.Split(name, "-")
-	if len(parts) < 3 {
-		return "", "", fmt.Errorf("expected VM name in the form %s, got %s", vmNameFormat, name)
+
+	// Anything with an error gets tossed into the BadInstances slice, and we'll
+	// correct the problem later on.
+	clusters, bad := vm.GroupClusters(all)
+	for name, c := range clusters {
+		setDNSNames(dnsProvider, c)
+		cloud.Clusters[name] = &CloudCluster{Cluster: *c}
 	}
-	return parts[0], strings.Join(parts[:len(parts)-1], "-"), nil
+	cloud.BadInstances = bad
+
+	return cloud, nil
 }
 
-func ListCloud() (*Cloud, error) {
-	cloud := newCloud()
+// setDNSNames sets the DNS names of the VMs of the cluster to their
+// registered names, with the DNS integration.
+func setDNSNames(dnsProvider dns.Provider, c *vm.Cluster) {
+	if dnsProvider == nil || c.Name == config.Local {
+		return
+	}
+	for i := range c.VMs {
+		if node, err := vm.NodeNumber(c.VMs[i].Name); err == nil {
+			c.VMs[i].DNS = dns.RecordName(c.Name, node)
+		}
+	}
+}
 
-	for _, p := range vm.Providers {
-		vms, err := p.List()
-		if err != nil {
+// ResolveCluster returns the named cluster with only the VMs of the given
+// names, which are looked up on the named providers via vm.ResolveNames
+// rather than by listing all of the VMs of every provider, as ListCloud does.
+func ResolveCluster(ctx context.Context, name string, vmNames, providers []string) (*CloudCluster, error) {
+	dnsProvider, err := dns.Active()
+	if err != nil {
+		return nil, err
+	}
+	vms, err := vm.ResolveNames(ctx, vmNames, providers)
+	if err != nil {
+		return nil, err
+	}
+	clusters, bad := vm.GroupClusters(vms)
+	if len(bad) > 0 {
+		return nil, errors.Errorf("%s: %s", bad[0].Name, bad[0].Errors[0])
+	}
+	c, ok := clusters[name]
+	if !ok || len(clusters) > 1 {
+		return nil, errors.Errorf("VMs %v do not all belong to cluster %s", vmNames, name)
+	}
+	setDNSNames(dnsProvider, c)
+	return &CloudCluster{Cluster: *c}, nil
+}
+
+// CreateCluster creates the nodes of the named cluster, which are allocated
+// round-robin over opts.VMProviders. The cluster may already exist, e.g. if a
+// previous attempt to create it was interrupted, in which case its existing
+// VMs are kept and only the missing ones are created, provided that the
+// existing VMs match opts. The names of the VMs which were to be created are
+// returned, even if some of them could not be created.
+func CreateCluster(
+	ctx context.Context, name string, nodes int, existing *CloudCluster, opts vm.CreateOpts,
+) ([]string, error) {
+	providerCount := len(opts.VMProviders)
+	if providerCount == 0 {
+		return nil, errors.New("no VMProviders configured")
+	}
+
+	found := make(map[string]vm.VM)
+	if existing != nil {
+		for _, v := range existing.VMs {
+			found[v.Name] = v
+		}
+	}
+
+	// Allocate vm names over the configured providers
+	vmLocations := map[string][]string{}
+	present := map[string]vm.List{}
+	var created []string
+	for i, p := 1, 0; i <= nodes; i++ {
+		pName := opts.VMProviders[p]
+		vmName := vm.Name(name, i)
+		if err := vm.ValidateName(vmName); err != nil {
 			return nil, err
 		}
+		if v, ok := found[vmName]; ok {
+			if v.Provider != pName {
+				return nil, errors.Errorf("%s already exists on %s rather than %s", vmName, v.Provider, pName)
+			}
+			present[pName] = append(present[pName], v)
+			delete(found, vmName)
+		} else {
+			vmLocations[pName] = append(vmLocations[pName], vmName)
+			created = append(created, vmName)
+		}
 
-		for _, v := range vms {
-			// Parse cluster/user from VM name, but only for non-local VMs
-			userName, clusterName, err := namesFromVM(v)
+		p = (p + 1) % providerCount
+	}
+	if len(found) > 0 {
+		extra := make([]string, 0, len(found))
+		for vmName := range found {
+			extra = append(extra, vmName)
+		}
+		sort.Strings(extra)
+		return nil, errors.Errorf("cluster %s already has VMs %v beyond the %d requested nodes", name, extra, nodes)
+	}
+
+	if config.MaxLifetime > 0 && opts.Lifetime > config.MaxLifetime {
+		return nil, errors.Errorf("a lifetime of %s exceeds --max-lifetime (%s)", opts.Lifetime, config.MaxLifetime)
+	}
+	specNodes := make([]int, 0, len(opts.NodeSpecs))
+	for node := range opts.NodeSpecs {
+		if node > nodes {
+			return nil, errors.Errorf("cluster %s has no node %d to apply its node spec to", name, node)
+		}
+		specNodes = append(specNodes, node)
+	}
+	sort.Ints(specNodes)
+
+	// Reject the options which any of the providers cannot honor, the zones
+	// which they do not offer, and the existing VMs which do not match the
+	// options, before creating any VMs.
+	err := vm.ProvidersSequential(ctx, opts.VMProviders, func(ctx context.Context, p vm.Provider) error {
+		if err := vm.CheckCreateOpts(p, opts); err != nil {
+			return err
+		}
+		for _, node := range specNodes {
+			if err := vm.CheckCreateOpts(p, opts.NodeSpecs[node].Apply(opts)); err != nil {
+				return errors.Wrapf(err, "node spec of node %d", node)
+			}
+		}
+		if err := checkExistingVMs(p, present[p.Name()], opts); err != nil {
+			return err
+		}
+		if len(vmLocations[p.Name()]) == 0 {
+			return nil
+		}
+		// The groups of VMs with node specs are created separately, with
+		// options of their own.
+		groups := vm.GroupByNodeSpec(vmLocations[p.Name()], opts)
+		for _, group := range groups {
+			zones, err := p.CreatedZones(ctx, vm.NodeOpts(group[0], opts), len(group))
 			if err != nil {
-				v.Errors = append(v.Errors, vm.ErrInvalidName)
+				return err
 			}
+			if err := vm.ValidateZones(ctx, p, zones); err != nil {
+				return err
+			}
+		}
+		if opts.SkipQuotaCheck {
+			return nil
+		}
+		for _, group := range groups {
+			if err := p.CheckQuota(ctx, vm.NodeOpts(group[0], opts), len(group)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var providers []string
+	for _, pName := range opts.VMProviders {
+		if len(vmLocations[pName]) > 0 {
+			providers = append(providers, pName)
+		}
+		for _, v := range present[pName] {
+			vm.Infof("%s already exists, skipping it", v.Name)
+		}
+	}
 
-			// Anything with an error gets tossed into the BadInstances slice, and we'll correct
-			// the problem later on.
-			if len(v.Errors) > 0 {
-				cloud.BadInstances = append(cloud.BadInstances, v)
-				continue
+	// The providers print what they would do in a dry run, so they run one at
+	// a time for the output to be stable.
+	run := vm.ProvidersParallel
+	if config.DryRun {
+		run = vm.ProvidersSequential
+	}
+	err = run(ctx, providers, func(ctx context.Context, p vm.Provider) error {
+		defer vm.InvalidateListCache(p.Name())
+		return vm.CreateWithNodeSpecs(ctx, p, vmLocations[p.Name()], opts)
+	})
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return created, errors.Wrapf(err, "creation of cluster %s timed out", name)
+	} else if err != nil && ctx.Err() != nil {
+		return created, errors.Wrapf(err, "creation of cluster %s was interrupted", name)
+	}
+	return created, err
+}
+
+// checkExistingVMs returns an error if any of the existing VMs of the
+// provider p does not have the machine type or preemptibility with which p
+// would create it given opts and its node spec, if any.
+func checkExistingVMs(p vm.Provider, vms vm.List, opts vm.CreateOpts) error {
+	for _, v := range vms {
+		machineTypes, err := p.CreatedMachineTypes(vm.NodeOpts(v.Name, opts))
+		if err != nil {
+			return err
+		}
+		matches := len(machineTypes) == 0
+		for _, machineType := range machineTypes {
+			matches = matches || strings.EqualFold(v.MachineType, machineType)
+		}
+		if !matches {
+			return errors.Errorf("%s already exists with machine type %s rather than %s",
+				v.Name, v.MachineType, strings.Join(machineTypes, " or "))
+		}
+		if v.Preemptible != opts.Preemptible {
+			return errors.Errorf("%s already exists with preemptible=%t rather than %t",
+				v.Name, v.Preemptible, opts.Preemptible)
+		}
+	}
+	return nil
+}
+
+// reservedLabels are the labels (GCE) and tags (AWS) which the providers
+// set themselves and which must not be passed in vm.CreateOpts.Labels.
+var reservedLabels = map[string]bool{
+	"lifetime":  true,
+	"Lifetime":  true,
+	"Name":      true,
+	"Roachprod": true,
+	// Set from vm.CreateOpts.StaticIP; see staticIPOpts.
+	vm.StaticIPLabel: true,
+	// Set from vm.CreateOpts.Firewall and Placement.
+	vm.FirewallLabel:  true,
+	vm.PlacementLabel: true,
+	// Set from vm.CreateOpts.SSHUser; see sshUser.
+	vm.SSHUserLabel: true,
+}
+
+// GrowCluster adds n VMs to the cluster, continuing its name sequence. The new
+// VMs are given the machine type, labels and lifetime of the existing VMs,
+// public and static IPs, of the same network tier, if the existing VMs have
+// them, and the existing firewall and placement group of the cluster if it
+// has them, and are placed in the zones which currently hold the fewest VMs.
+// The names of the new VMs are returned, even if some of them could not be
+// created.
+func GrowCluster(ctx context.Context, c *CloudCluster, n int, opts vm.CreateOpts) ([]string, error) {
+	if len(c.VMs) == 0 {
+		return nil, errors.Errorf("cluster %s has no VMs", c.Name)
+	}
+
+	// Group the existing VMs by provider, zone and machine type.
+	type placement struct {
+		provider, zone, machineType string
+	}
+	counts := map[placement]int{}
+	last := 0
+	for _, v := range c.VMs {
+		counts[placement{v.Provider, v.Zone, v.MachineType}]++
+		i, err := vm.NodeNumber(v.Name)
+		if err != nil {
+			return nil, err
+		}
+		if i > last {
+			last = i
+		}
+	}
+	placements := make([]placement, 0, len(counts))
+	for p := range counts {
+		placements = append(placements, p)
+	}
+	sort.Slice(placements, func(i, j int) bool {
+		a, b := placements[i], placements[j]
+		if a.provider != b.provider {
+			return a.provider < b.provider
+		}
+		if a.zone != b.zone {
+			return a.zone < b.zone
+		}
+		return a.machineType < b.machineType
+	})
+
+	// Assign each new VM to the least-populated placement.
+	var names []string
+	byPlacement := map[placement][]string{}
+	for i := 1; i <= n; i++ {
+		best := placements[0]
+		for _, p := range placements[1:] {
+			if counts[p] < counts[best] {
+				best = p
 			}
+		}
+		counts[best]++
+		name := vm.Name(c.Name, last+i)
+		names = append(names, name)
+		byPlacement[best] = append(byPlacement[best], name)
+	}
+
+	opts.Labels = clusterLabels(c)
+	opts.Lifetime = c.Lifetime
+	opts.GeoDistributed = false
+	opts.GeoWeights = nil
+	opts.NoPublicIP = !hasPublicIPs(c)
+	staticIPOpts(c, &opts)
+	// The new VMs join the firewall of the cluster, which already exists.
+	opts.Firewall = c.VMs[0].Labels[vm.FirewallLabel] != ""
+	opts.Ingress = nil
+	opts.Placement = c.VMs[0].Labels[vm.PlacementLabel]
+
+	for pl := range byPlacement {
+		opts := opts
+		opts.NetworkTier = networkTier(c, pl.provider)
+		err := vm.ForProvider(ctx, pl.provider, func(ctx context.Context, p vm.Provider) error {
+			return vm.CheckCreateOpts(p, opts)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var g errgroup.Group
+	for pl, plNames := range byPlacement {
+		pl, plNames := pl, plNames
+		opts := opts
+		opts.MachineType = pl.machineType
+		opts.Zones = []string{pl.zone}
+		opts.NetworkTier = networkTier(c, pl.provider)
+		opts.SSHUser = sshUser(c, pl.provider)
+		schedulingOpts(&opts, c.VMs, pl.provider)
+		g.Go(func() error {
+			return vm.ForProvider(ctx, pl.provider, func(ctx context.Context, p vm.Provider) error {
+				defer vm.InvalidateListCache(p.Name())
+				return p.Create(ctx, plNames, opts)
+			})
+		})
+	}
+	return names, g.Wait()
+}
+
+// clusterLabels returns the labels of the cluster which are to be copied to
+// new VMs. Those set by the providers, and those identifying the cluster and
+// its owner, are omitted, as is the metadata of vm.Provider.SetMetadata, e.g.
+// the lock of a cluster, which belongs to the VMs it was set on.
+func clusterLabels(c *CloudCluster) map[string]string {
+	labels := vmLabels(c.VMs[0])
+	for k := range labels {
+		if strings.HasPrefix(k, vm.MetadataPrefix) {
+			delete(labels, k)
+		}
+	}
+	return labels
+}
 
-			if _, ok := cloud.Clusters[clusterName]; !ok {
-				cloud.Clusters[clusterName] = &CloudCluster{
-					Name:      clusterName,
-					User:      userName,
-					CreatedAt: v.CreatedAt,
-					Lifetime:  v.Lifetime,
-					VMs:       nil,
-				}
+// vmLabels returns the labels of the VM which are to be copied to new VMs, as
+// for clusterLabels, except that the metadata is kept, so that a VM which is
+// recreated keeps its own.
+func vmLabels(v vm.VM) map[string]string {
+	labels := map[string]string{}
+	for k, v := range v.Labels {
+		switch {
+		case reservedLabels[k]:
+		case k == vm.UserLabel, k == vm.ClusterLabel, k == vm.CreatedLabel,
+			k == vm.VersionLabel, k == vm.HostLabel:
+		default:
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// hasPublicIPs returns true if any of the VMs of the cluster has a public IP
+// address, in which case it was not created with vm.CreateOpts.NoPublicIP.
+func hasPublicIPs(c *CloudCluster) bool {
+	for _, v := range c.VMs {
+		if v.PublicIP != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// networkTier returns the network tier of the public IPs of the cluster's VMs
+// on the provider, which is empty if the provider has no network tiers or the
+// VMs have no public IPs.
+func networkTier(c *CloudCluster, provider string) string {
+	for _, v := range c.VMs {
+		if v.Provider == provider && v.NetworkTier != "" {
+			return v.NetworkTier
+		}
+	}
+	return ""
+}
+
+// sshUser returns the user as which the cluster's VMs on the provider are
+// logged into, if it was recorded when they were created, so that new VMs
+// are created for the same user.
+func sshUser(c *CloudCluster, provider string) string {
+	for _, v := range c.VMs {
+		if v.Provider == provider && v.Labels[vm.SSHUserLabel] != "" {
+			return v.Labels[vm.SSHUserLabel]
+		}
+	}
+	return ""
+}
+
+// schedulingOpts sets the maintenance policy of opts to that of the first of
+// the VMs on the provider with the preemptibility of opts, and disables
+// automatic restarts if that VM has them disabled, so that new VMs are
+// scheduled like the existing ones. Automatic restarts are otherwise left to
+// the provider, which enables them for the VMs which it can restart.
+func schedulingOpts(opts *vm.CreateOpts, vms vm.List, provider string) {
+	for _, v := range vms {
+		if v.Provider != provider || v.Preemptible != opts.Preemptible || v.Scheduling == nil {
+			continue
+		}
+		opts.MaintenancePolicy = v.Scheduling.MaintenancePolicy
+		opts.AutoRestart = nil
+		if !v.Scheduling.AutoRestart {
+			autoRestart := false
+			opts.AutoRestart = &autoRestart
+		}
+		return
+	}
+}
+
+// staticIPOpts sets the StaticIP and KeepStaticIP options to those with which
+// the VMs of the cluster were created, so that new VMs get static IPs of
+// their own if the existing VMs have them.
+func staticIPOpts(c *CloudCluster, opts *vm.CreateOpts) {
+	policy := c.VMs[0].Labels[vm.StaticIPLabel]
+	opts.StaticIP = policy != ""
+	opts.KeepStaticIP = policy == vm.StaticIPKeep
+}
+
+// diskLayout is the layout of the disks of a VM, as far as its provider
+// reports it. localSSDs is -1 if the VM has local SSDs of unknown number.
+type diskLayout struct {
+	bootDiskSizeGB int
+	bootDiskType   string
+	localSSDs      int
+	dataDisks      int
+	dataDiskSizeGB int
+	dataDiskType   string
+}
+
+// diskLayoutOf returns the layout of the disks of v, or false if its provider
+// does not report them. The persistent disks besides the boot disk, including
+// the data disk which some providers attach by default, are data disks.
+func diskLayoutOf(v vm.VM, caps vm.ProviderCapabilities) (diskLayout, bool) {
+	if len(v.Disks) == 0 {
+		return diskLayout{}, false
+	}
+	var l diskLayout
+	for _, d := range v.Disks {
+		switch {
+		case d.Boot:
+			l.bootDiskSizeGB, l.bootDiskType = d.SizeGB, d.Type
+		case d.Local:
+			l.localSSDs++
+		default:
+			l.dataDisks++
+			l.dataDiskSizeGB, l.dataDiskType = d.SizeGB, d.Type
+		}
+	}
+	if l.localSSDs == 0 && l.dataDisks == 0 && !caps.ListsLocalSSDs {
+		// The data directory can only be on local SSDs, whose number is not
+		// known.
+		l.localSSDs = -1
+	}
+	return l, true
+}
+
+// apply sets the disk options of opts to those which create a VM with the
+// layout. The number of local SSDs is left to opts if it is not known.
+func (l diskLayout) apply(opts *vm.CreateOpts) {
+	opts.BootDiskSizeGB, opts.BootDiskType = l.bootDiskSizeGB, l.bootDiskType
+	opts.UseLocalSSD = l.localSSDs != 0
+	if l.localSSDs > 0 {
+		opts.LocalSSDCount = l.localSSDs
+	}
+	opts.DataDiskCount, opts.DataDiskSizeGB, opts.DataDiskType = l.dataDisks, l.dataDiskSizeGB, l.dataDiskType
+	opts.ExistingDisks, opts.KeepExistingDisks = nil, false
+}
+
+// CloneCluster creates a cluster named name with the shape of c: each node of
+// c is cloned into the node of the new cluster with the same number, which is
+// created in the same zone and with the same machine type, OS image,
+// preemptibility and disks. The labels and lifetime of c are copied as well,
+// and the clones have public and static IPs, of the same network tier, if the
+// VMs of c have them, and a firewall and placement group of their own if c
+// has them, while the ingress rules are configured by opts. Those of the
+// disks which the provider does not report, if any, are configured by opts as
+// well. The providers
+// create their VMs in parallel. The new names of the VMs of c are returned,
+// even if some of them could not be created.
+func CloneCluster(
+	ctx context.Context, c *CloudCluster, name string, opts vm.CreateOpts,
+) (map[string]string, error) {
+	if len(c.VMs) == 0 {
+		return nil, errors.Errorf("cluster %s has no VMs", c.Name)
+	}
+
+	type placement struct {
+		provider, zone, machineType, osImage string
+		preemptible                          bool
+		disks                                diskLayout
+		hasDisks                             bool
+	}
+	clones := make(map[string]string, len(c.VMs))
+	byPlacement := map[placement][]string{}
+	for _, v := range c.VMs {
+		p, ok := vm.LookupProvider(v.Provider)
+		if !ok {
+			return nil, errors.Errorf("unknown vm provider: %s", v.Provider)
+		}
+		i, err := vm.NodeNumber(v.Name)
+		if err != nil {
+			return nil, err
+		}
+		clone := vm.Name(name, i)
+		if err := vm.ValidateName(clone); err != nil {
+			return nil, err
+		}
+		clones[v.Name] = clone
+		disks, hasDisks := diskLayoutOf(v, p.Capabilities())
+		pl := placement{v.Provider, v.Zone, v.MachineType, v.OSImage, v.Preemptible, disks, hasDisks}
+		byPlacement[pl] = append(byPlacement[pl], clone)
+	}
+
+	opts.Labels = clusterLabels(c)
+	opts.Lifetime = c.Lifetime
+	opts.GeoDistributed = false
+	opts.GeoWeights = nil
+	opts.NoPublicIP = !hasPublicIPs(c)
+	staticIPOpts(c, &opts)
+	// The firewall of c admits only the VMs of c, so the clones need one of
+	// their own, whose rules must be given.
+	if c.VMs[0].Labels[vm.FirewallLabel] != "" {
+		if len(opts.Ingress) == 0 {
+			return nil, errors.Errorf("cluster %s has a firewall; the ingress rules of the clones must be given "+
+				"with --ingress or --ingress-cidr", c.Name)
+		}
+		opts.Firewall = true
+	}
+	opts.Placement = c.VMs[0].Labels[vm.PlacementLabel]
+
+	placementOpts := func(pl placement) vm.CreateOpts {
+		ret := opts
+		ret.MachineType = pl.machineType
+		ret.Zones = []string{pl.zone}
+		ret.OSImage = pl.osImage
+		ret.Preemptible = pl.preemptible
+		if pl.hasDisks {
+			pl.disks.apply(&ret)
+		}
+		ret.NetworkTier = networkTier(c, pl.provider)
+		ret.SSHUser = sshUser(c, pl.provider)
+		schedulingOpts(&ret, c.VMs, pl.provider)
+		return ret
+	}
+	for pl := range byPlacement {
+		err := vm.ForProvider(ctx, pl.provider, func(ctx context.Context, p vm.Provider) error {
+			return vm.CheckCreateOpts(p, placementOpts(pl))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var g errgroup.Group
+	for pl, plNames := range byPlacement {
+		pl, plNames := pl, plNames
+		opts := placementOpts(pl)
+		g.Go(func() error {
+			return vm.ForProvider(ctx, pl.provider, func(ctx context.Context, p vm.Provider) error {
+				defer vm.InvalidateListCache(p.Name())
+				return p.Create(ctx, plNames, opts)
+			})
+		})
+	}
+	return clones, g.Wait()
+}
+
+// RecreatePreempted replaces the VMs of the cluster which their provider
+// reclaimed (see vm.StatusPreempted) with new VMs of the same names, which
+// keep their node numbers. Each new VM is created in the zone, and with the
+// machine type, OS image, labels and expiration, of the VM it replaces, and
+// behind the firewall and in the placement group of the cluster if it has
+// them, while the disks are configured by opts. Static IPs are kept for the
+// new VMs. The VMs which have already expired are left to be garbage
+// collected. The names of the recreated VMs are returned, even if some of
+// them could not be created; the cluster must be refreshed afterwards, since
+// the new VMs have new network addresses.
+func RecreatePreempted(ctx context.Context, c *CloudCluster, opts vm.CreateOpts) ([]string, error) {
+	now := time.Now()
+	var preempted vm.List
+	for _, v := range c.VMs {
+		if v.Status != vm.StatusPreempted {
+			continue
+		}
+		if v.Lifetime > 0 && !v.CreatedAt.Add(v.Lifetime).After(now) {
+			vm.Warningf("%s was preempted but has expired, not recreating it", v.Name)
+			continue
+		}
+		preempted = append(preempted, v)
+	}
+	if len(preempted) == 0 {
+		return nil, nil
+	}
+	// The firewall and placement group of the cluster are deleted along with
+	// its last VM, and the new VMs reuse them rather than racing to create
+	// them again.
+	if len(preempted) == len(c.VMs) &&
+		(c.VMs[0].Labels[vm.FirewallLabel] != "" || c.VMs[0].Labels[vm.PlacementLabel] != "") {
+		return nil, errors.Errorf("all of the VMs of cluster %s were preempted, "+
+			"so it has to be destroyed and created again", c.Name)
+	}
+
+	opts.GeoDistributed = false
+	opts.GeoWeights = nil
+	opts.NoPublicIP = !hasPublicIPs(c)
+	staticIPOpts(c, &opts)
+	opts.Firewall = c.VMs[0].Labels[vm.FirewallLabel] != ""
+	opts.Ingress = nil
+	opts.Placement = c.VMs[0].Labels[vm.PlacementLabel]
+	vmOpts := func(v vm.VM) vm.CreateOpts {
+		ret := opts
+		ret.Labels = vmLabels(v)
+		if v.Lifetime > 0 {
+			// The new VM expires along with the one it replaces.
+			ret.Lifetime = v.CreatedAt.Add(v.Lifetime).Sub(now).Round(time.Minute)
+		}
+		ret.MachineType = v.MachineType
+		ret.Zones = []string{v.Zone}
+		ret.OSImage = v.OSImage
+		ret.Preemptible = v.Preemptible
+		ret.NetworkTier = networkTier(c, v.Provider)
+		ret.SSHUser = v.Labels[vm.SSHUserLabel]
+		schedulingOpts(&ret, vm.List{v}, v.Provider)
+		return ret
+	}
+	for _, v := range preempted {
+		err := vm.ForProvider(ctx, v.Provider, func(ctx context.Context, p vm.Provider) error {
+			return vm.CheckCreateOpts(p, vmOpts(v))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The static IPs of the preempted VMs are kept by deleting them as if
+	// they had been created with --keep-static-ip, so that the new VMs reuse
+	// them.
+	deleted := make(vm.List, len(preempted))
+	names := make([]string, len(preempted))
+	for i, v := range preempted {
+		if v.Labels[vm.StaticIPLabel] != "" {
+			labels := make(map[string]string, len(v.Labels))
+			for key, value := range v.Labels {
+				labels[key] = value
 			}
+			labels[vm.StaticIPLabel] = vm.StaticIPKeep
+			v.Labels = labels
+		}
+		deleted[i] = v
+		names[i] = v.Name
+	}
+	err := vm.FanOut(ctx, deleted, func(ctx context.Context, p vm.Provider, vms vm.List) error {
+		defer vm.InvalidateListCache(p.Name())
+		return p.Delete(ctx, vms)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to delete the preempted VMs")
+	}
 
-			// Bound the cluster creation time and overall lifetime to the earliest and/or shortest VM
-			c := cloud.Clusters[clusterName]
-			c.VMs = append(c.VMs, v)
-			if v.CreatedAt.Before(c.CreatedAt) {
-				c.CreatedAt = v.CreatedAt
+	var g errgroup.Group
+	for _, v := range preempted {
+		v := v
+		opts := vmOpts(v)
+		g.Go(func() error {
+			return vm.ForProvider(ctx, v.Provider, func(ctx context.Context, p vm.Provider) error {
+				defer vm.InvalidateListCache(p.Name())
+				return p.Create(ctx, []string{v.Name}, opts)
+			})
+		})
+	}
+	return names, g.Wait()
+}
+
+// RegisterClusterDNS creates DNS records for the VMs of the cluster if the
+// DNS integration is enabled.
+func RegisterClusterDNS(ctx context.Context, c *CloudCluster) error {
+	p, err := dns.Active()
+	if err != nil || p == nil {
+		return err
+	}
+	records := make([]dns.Record, 0, len(c.VMs))
+	for _, v := range c.VMs {
+		node, err := vm.NodeNumber(v.Name)
+		if err != nil {
+			return err
+		}
+		if v.Host() == "" {
+			return errors.Errorf("VM %s has no IP address", v.Name)
+		}
+		records = append(records, dns.Record{Name: dns.RecordName(c.Name, node), IP: v.Host()})
+	}
+	return p.CreateRecords(ctx, records)
+}
+
+// DestroyCluster deletes the VMs of the cluster along with their DNS records,
+// if the DNS integration is enabled. The records are deleted even if some
+// of the VMs could not be, and the VMs are deleted first, so that a DNS
+// error never leaves the VMs running.
+func DestroyCluster(ctx context.Context, c *CloudCluster) error {
+	if config.DryRun {
+		// As in CreateCluster, the providers run one at a time.
+		byProvider := make(map[string]vm.List)
+		var names []string
+		for _, v := range c.VMs {
+			if _, ok := byProvider[v.Provider]; !ok {
+				names = append(names, v.Provider)
 			}
-			if v.Lifetime < c.Lifetime {
-				c.Lifetime = v.Lifetime
+			byProvider[v.Provider] = append(byProvider[v.Provider], v)
+		}
+		sort.Strings(names)
+		return vm.ProvidersSequential(ctx, names, func(ctx context.Context, p vm.Provider) error {
+			return p.Delete(ctx, byProvider[p.Name()])
+		})
+	}
+
+	deleteErr := vm.FanOut(ctx, c.VMs, func(ctx context.Context, p vm.Provider, vms vm.List) error {
+		defer vm.InvalidateListCache(p.Name())
+		return p.Delete(ctx, vms)
+	})
+	var dnsErr error
+	if p, err := dns.Active(); err != nil {
+		dnsErr = err
+	} else if p != nil {
+		var names []string
+		for _, v := range c.VMs {
+			if node, err := vm.NodeNumber(v.Name); err == nil {
+				names = append(names, dns.RecordName(c.Name, node))
 			}
 		}
+		if err := p.DeleteRecords(ctx, names); err != nil {
+			dnsErr = errors.Wrap(err, "unable to delete DNS records")
+		}
 	}
+	return vm.CombineErrors([]error{deleteErr, dnsErr})
+}
 
-	// Sort VMs for each cluster. We want to make sure we always have the same order.
-	for _, c := range cloud.Clusters {
-		sort.Sort(c.VMs)
+// ShrinkCluster destroys the last n VMs of the cluster, as DestroyCluster
+// does, and leaves the others alone. Only the last VMs can be removed, so that
+// the remaining VMs keep their node numbers, which the DNS records and
+// GrowCluster derive from their names, and node 1 always remains.
+func ShrinkCluster(ctx context.Context, c *CloudCluster, n int) error {
+	if n < 1 || n >= len(c.VMs) {
+		return errors.Errorf("cannot remove %d of the %d nodes of cluster %s, which must keep node 1",
+			n, len(c.VMs), c.Name)
 	}
+	removed := *c
+	removed.VMs = c.VMs[len(c.VMs)-n:]
+	return DestroyCluster(ctx, &removed)
+}
 
-	return cloud, nil
+// DestroyClusters destroys the clusters in parallel, as DestroyCluster does,
+// and returns the error of each cluster which could not be destroyed, keyed
+// by its name. In a dry run, the clusters are destroyed one at a time.
+func DestroyClusters(ctx context.Context, clusters []*CloudCluster) map[string]error {
+	errs := make([]error, len(clusters))
+	if config.DryRun {
+		for i, c := range clusters {
+			errs[i] = DestroyCluster(ctx, c)
+		}
+	} else {
+		var wg sync.WaitGroup
+		for i, c := range clusters {
+			i, c := i, c
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = DestroyCluster(ctx, c)
+			}()
+		}
+		wg.Wait()
+	}
+	ret := make(map[string]error)
+	for i, err := range errs {
+		if err != nil {
+			ret[clusters[i].Name] = err
+		}
+	}
+	return ret
 }
 
-func CreateCluster(name string, nodes int, opts vm.CreateOpts) error {
-	providerCount := len(opts.VMProviders)
-	if providerCount == 0 {
-		return errors.New("no VMProviders configured")
+// ExtendCluster extends the lifetime of the cluster by extension. The
+// lifetimes of VMs which would exceed their maximum (see vm.MaxLifetime) are
+// capped, which is reported by the returned clamps, or, if
+// config.RejectLongLifetimes is set, rejected before any VM is extended.
+func ExtendCluster(
+	ctx context.Context, c *CloudCluster, extension time.Duration,
+) ([]vm.LifetimeClamp, error) {
+	newLifetime := c.Lifetime + extension
+
+	var clamps []vm.LifetimeClamp
+	lifetimes := make(map[string]time.Duration, len(c.VMs))
+	for _, v := range c.VMs {
+		err := vm.ForProvider(ctx, v.Provider, func(ctx context.Context, p vm.Provider) error {
+			lifetime, clamp, err := vm.ClampLifetime(p, v, newLifetime)
+			if err != nil {
+				return err
+			}
+			if clamp != nil {
+				clamps = append(clamps, *clamp)
+			}
+			lifetimes[v.Name] = lifetime
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Allocate vm names over the configured providers
-	vmLocations := map[string][]string{}
-	for i, p := 1, 0; i <= nodes; i++ {
-		pName := opts.VMProviders[p]
-		vmName := fmt.Sprintf("%s-%0.4d", name, i)
-		vmLocations[pName] = append(vmLocations[pName], vmName)
+	// Extend takes a single lifetime, so the VMs of each provider are
+	// extended in groups of the same lifetime.
+	return clamps, vm.FanOut(ctx, c.VMs, func(ctx context.Context, p vm.Provider, vms vm.List) error {
+		defer vm.InvalidateListCache(p.Name())
+		byLifetime := make(map[time.Duration]vm.List)
+		for _, v := range vms {
+			byLifetime[lifetimes[v.Name]] = append(byLifetime[lifetimes[v.Name]], v)
+		}
+		for lifetime, vms := range byLifetime {
+			if err := p.Extend(ctx, vms, lifetime); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-		p = (p + 1) % providerCount
+func RebootCluster(ctx context.Context, c *CloudCluster) error {
+	return vm.FanOut(ctx, c.VMs, func(ctx context.Context, p vm.Provider, vms vm.List) error {
+		defer vm.InvalidateListCache(p.Name())
+		return p.Reboot(ctx, vms)
+	})
+}
+
+func ResizeCluster(ctx context.Context, c *CloudCluster, machineType string) error {
+	return vm.FanOut(ctx, c.VMs, func(ctx context.Context, p vm.Provider, vms vm.List) error {
+		defer vm.InvalidateListCache(p.Name())
+		return p.Resize(ctx, vms, machineType)
+	})
+}
+
+// StopCluster stops the VMs of the cluster, which keep their persistent
+// disks.
+func StopCluster(ctx context.Context, c *CloudCluster) error {
+	err := vm.FanOut(ctx, c.VMs, func(ctx context.Context, p vm.Provider, vms vm.List) error {
+		defer vm.InvalidateListCache(p.Name())
+		return p.Stop(ctx, vms)
+	})
+	if err != nil {
+		return err
+	}
+	for i := range c.VMs {
+		c.VMs[i].Status = vm.StatusStopped
 	}
+	return nil
+}
 
-	return vm.ProvidersParallel(opts.VMProviders, func(p vm.Provider) error {
-		return p.Create(vmLocations[p.Name()], opts)
+// StartCluster starts the stopped VMs of the cluster, which are then
+// refreshed (see RefreshCluster), since they may have new IP addresses.
+func StartCluster(ctx context.Context, c *CloudCluster) ([]string, error) {
+	err := vm.FanOut(ctx, c.VMs, func(ctx context.Context, p vm.Provider, vms vm.List) error {
+		defer vm.InvalidateListCache(p.Name())
+		return p.Start(ctx, vms)
 	})
+	if err != nil {
+		return nil, err
+	}
+	return RefreshCluster(ctx, c)
 }
 
-func DestroyCluster(c *CloudCluster) error {
-	return vm.FanOut(c.VMs, func(p vm.Provider, vms vm.List) error {
-		return p.Delete(vms)
+// RefreshCluster re-lists the VMs of the cluster and updates their status,
+// network addresses and DNS names, which may change when a VM is stopped and
+// started.
+// The providers' cached VMs are replaced along the way. If any address
+// changed, the cluster's DNS records are registered again. The names of the
+// VMs whose addresses changed are returned.
+func RefreshCluster(ctx context.Context, c *CloudCluster) ([]string, error) {
+	dnsProvider, err := dns.Active()
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	current := make(map[string]vm.VM)
+	err = vm.ProvidersParallel(ctx, c.Clouds(), func(ctx context.Context, p vm.Provider) error {
+		vm.InvalidateListCache(p.Name())
+		vms, err := vm.CachedList(ctx, p, nil)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, v := range vms {
+			current[p.Name()+"/"+v.Name] = v
+		}
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for i := range c.VMs {
+		v := &c.VMs[i]
+		cur, ok := current[v.Provider+"/"+v.Name]
+		if !ok {
+			return nil, errors.Errorf("VM %s no longer exists", v.Name)
+		}
+		v.Status = cur.Status
+		// With the DNS integration, the VMs keep their registered names.
+		dnsName := cur.DNS
+		if dnsProvider != nil {
+			dnsName = v.DNS
+		}
+		if v.PublicIP == cur.PublicIP && v.PrivateIP == cur.PrivateIP &&
+			v.PublicIPv6 == cur.PublicIPv6 && v.PrivateIPv6 == cur.PrivateIPv6 && v.DNS == dnsName {
+			continue
+		}
+		v.PublicIP, v.PrivateIP = cur.PublicIP, cur.PrivateIP
+		v.PublicIPv6, v.PrivateIPv6 = cur.PublicIPv6, cur.PrivateIPv6
+		v.DNS = dnsName
+		changed = append(changed, v.Name)
+	}
+	if len(changed) > 0 {
+		if err := RegisterClusterDNS(ctx, c); err != nil {
+			return nil, errors.Wrap(err, "unable to register DNS records")
+		}
+	}
+	return changed, nil
 }
 
-func ExtendCluster(c *CloudCluster, extension time.Duration) error {
-	newLifetime := c.Lifetime + extension
+// CreateClusterImages captures an image of each VM in the cluster and returns
+// a map of VM names to the provider-specific image identifiers.
+func CreateClusterImages(ctx context.Context, c *CloudCluster, imageName string) (map[string]string, error) {
+	var mu sync.Mutex
+	ret := make(map[string]string, len(c.VMs))
+	err := vm.FanOut(ctx, c.VMs, func(ctx context.Context, p vm.Provider, vms vm.List) error {
+		ids, err := p.CreateImage(ctx, vms, imageName)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for i, id := range ids {
+			ret[vms[i].Name] = id
+		}
+		return nil
+	})
+	return ret, err
+}
 
-	return vm.FanOut(c.VMs, func(p vm.Provider, vms vm.List) error {
-		return p.Extend(vms, newLifetime)
+// EstimateClusterCost returns the estimated hourly cost of the cluster in
+// USD, along with any VMs which could not be included in the estimate.
+func EstimateClusterCost(ctx context.Context, c *CloudCluster) (float64, vm.List, error) {
+	var mu sync.Mutex
+	var total float64
+	var unpriced vm.List
+	err := vm.FanOut(ctx, c.VMs, func(ctx context.Context, p vm.Provider, vms vm.List) error {
+		cost, err := p.CostEstimate(vms)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		total += cost
+		for _, v := range vms {
+			if len(v.Errors) > 0 {
+				unpriced = append(unpriced, v)
+			}
+		}
+		return nil
 	})
+	sort.Sort(unpriced)
+	return total, unpriced, err
 }
@@ -0,0 +1,242 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/cockroachdb/roachprod/vm/fake"
+)
+
+// newFakeCluster registers a fake provider, seeded with the VMs of a cluster
+// whose second node is preemptible, and returns it along with the cluster
+// as listed.
+func newFakeCluster(t *testing.T, lifetime time.Duration) (*fake.Provider, *CloudCluster) {
+	p := fake.Register()
+	t.Cleanup(fake.Unregister)
+	p.Caps.MaxPreemptibleLifetime = 24 * time.Hour
+	now := time.Now().UTC()
+	for _, v := range []vm.VM{
+		{Name: "fake-user-test-1"},
+		{Name: "fake-user-test-2", Preemptible: true},
+		{Name: "fake-user-test-3"},
+	} {
+		v.CreatedAt = now
+		v.Lifetime = lifetime
+		v.Labels = map[string]string{vm.ClusterLabel: "fake-user-test"}
+		p.Seed(v)
+	}
+	vms, err := p.List(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &CloudCluster{vm.Cluster{
+		Name:      "fake-user-test",
+		User:      "fake-user",
+		CreatedAt: now,
+		Lifetime:  lifetime,
+		VMs:       vms,
+	}}
+	return p, c
+}
+
+// setLifetimeLimits sets config.MaxLifetime and config.RejectLongLifetimes
+// for the duration of the test.
+func setLifetimeLimits(t *testing.T, max time.Duration, reject bool) {
+	oldMax, oldReject := config.MaxLifetime, config.RejectLongLifetimes
+	config.MaxLifetime, config.RejectLongLifetimes = max, reject
+	t.Cleanup(func() {
+		config.MaxLifetime, config.RejectLongLifetimes = oldMax, oldReject
+	})
+}
+
+func TestExtendClusterClamps(t *testing.T) {
+	setLifetimeLimits(t, 48*time.Hour, false)
+	p, c := newFakeCluster(t, 12*time.Hour)
+
+	clamps, err := ExtendCluster(context.Background(), c, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clamps) != 1 {
+		t.Fatalf("expected one clamp, got %v", clamps)
+	}
+	if cl := clamps[0]; cl.VM != "fake-user-test-2" || cl.Requested != 36*time.Hour ||
+		cl.Applied != 24*time.Hour || cl.Reason != "preemptible fake VMs" {
+		t.Errorf("unexpected clamp %s", cl)
+	}
+
+	// The lifetimes are read back from the provider.
+	vms, err := p.List(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]time.Duration{
+		"fake-user-test-1": 36 * time.Hour,
+		"fake-user-test-2": 24 * time.Hour,
+		"fake-user-test-3": 36 * time.Hour,
+	}
+	for _, v := range vms {
+		if v.Lifetime != expected[v.Name] {
+			t.Errorf("%s has lifetime %s, expected %s", v.Name, v.Lifetime, expected[v.Name])
+		}
+	}
+}
+
+func TestExtendClusterRejectsLongLifetimes(t *testing.T) {
+	setLifetimeLimits(t, 30*time.Hour, true)
+	p, c := newFakeCluster(t, 12*time.Hour)
+
+	if _, err := ExtendCluster(context.Background(), c, 24*time.Hour); err == nil {
+		t.Fatal("expected the extension to be rejected")
+	}
+	if calls := p.CallsTo("Extend"); len(calls) != 0 {
+		t.Errorf("expected no VMs to be extended, got %v", calls)
+	}
+	vms, err := p.List(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vms {
+		if v.Lifetime != 12*time.Hour {
+			t.Errorf("%s has lifetime %s, expected it to be unchanged", v.Name, v.Lifetime)
+		}
+	}
+}
+
+// TestClusterLabels checks that the labels which are copied to the VMs added
+// to a cluster omit those identifying it and its metadata.
+func TestClusterLabels(t *testing.T) {
+	c := &CloudCluster{vm.Cluster{VMs: vm.List{{Labels: map[string]string{
+		vm.ClusterLabel:                "user-test",
+		vm.MetadataPrefix + "lock":     "user, 2020-01-02",
+		vm.MetadataPrefix + "security": "shielded-vm",
+		"team":                         "storage",
+	}}}}}
+	labels := clusterLabels(c)
+	if len(labels) != 1 || labels["team"] != "storage" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+	if labels := vmLabels(c.VMs[0]); labels[vm.MetadataPrefix+"lock"] == "" {
+		t.Errorf("expected vmLabels to keep the metadata, got %v", labels)
+	}
+}
+
+// TestCloneClusterDisks checks that the clones of the nodes of a cluster get
+// the disks of their nodes, rather than those of the options.
+func TestCloneClusterDisks(t *testing.T) {
+	for _, listsLocalSSDs := range []bool{false, true} {
+		p, c := newFakeCluster(t, 12*time.Hour)
+		p.Caps.ListsLocalSSDs = listsLocalSSDs
+		p.Caps.LocalSSD, p.Caps.BootDisks, p.Caps.DataDisks, p.Caps.Preemptible = true, true, true, true
+		disks := map[string][]vm.Disk{
+			// Local SSDs, which are only listed if the provider lists them.
+			"fake-user-test-1": {{Boot: true, SizeGB: 10}},
+			// Data disks.
+			"fake-user-test-2": {{Boot: true, SizeGB: 10}, {SizeGB: 500, Type: "ssd"}, {SizeGB: 500, Type: "ssd"}},
+			// No disks reported.
+			"fake-user-test-3": nil,
+		}
+		if listsLocalSSDs {
+			disks["fake-user-test-1"] = append(disks["fake-user-test-1"], vm.Disk{Local: true}, vm.Disk{Local: true})
+		}
+		for i := range c.VMs {
+			c.VMs[i].Disks = disks[c.VMs[i].Name]
+			c.VMs[i].PublicIP = "203.0.113.1"
+		}
+
+		opts := vm.CreateOpts{UseLocalSSD: false, DataDiskCount: 1, DataDiskSizeGB: 20, LocalSSDCount: 1}
+		clones, err := CloneCluster(context.Background(), c, "fake-user-clone", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vms, err := p.List(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byName := make(map[string]vm.VM, len(vms))
+		for _, v := range vms {
+			byName[v.Name] = v
+		}
+		caps := p.Capabilities()
+		for src, clone := range clones {
+			expected, ok := diskLayoutOf(vm.VM{Disks: disks[src]}, caps)
+			if !ok {
+				// The clone gets the disks of the options.
+				expected = diskLayout{dataDisks: 1, dataDiskSizeGB: 20}
+			}
+			if actual, _ := diskLayoutOf(byName[clone], caps); actual != expected {
+				t.Errorf("lists local SSDs %t: %s has disks %+v, expected those of %s, %+v",
+					listsLocalSSDs, clone, actual, src, expected)
+			}
+		}
+	}
+}
+
+// TestResolveCluster checks that ResolveCluster returns only the named VMs of
+// a cluster, including those which predate the ClusterLabel, and fails for
+// the names of VMs which do not exist.
+func TestResolveCluster(t *testing.T) {
+	p, _ := newFakeCluster(t, 12*time.Hour)
+	p.Seed(vm.VM{Name: "fake-user-test-4", CreatedAt: time.Now().UTC(), Lifetime: 12 * time.Hour})
+	p.Seed(vm.VM{Name: "fake-user-other-1", CreatedAt: time.Now().UTC(), Lifetime: 12 * time.Hour,
+		Labels: map[string]string{vm.ClusterLabel: "fake-user-other"}})
+
+	ctx := context.Background()
+	c, err := ResolveCluster(ctx, "fake-user-test",
+		[]string{"fake-user-test-4", "fake-user-test-1"}, []string{fake.ProviderName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "fake-user-test" {
+		t.Errorf("unexpected cluster %s", c.Name)
+	}
+	if names := c.VMs.Names(); len(names) != 2 || names[0] != "fake-user-test-1" || names[1] != "fake-user-test-4" {
+		t.Errorf("unexpected VMs %v", names)
+	}
+
+	if _, err := ResolveCluster(ctx, "fake-user-test",
+		[]string{"fake-user-test-5"}, []string{fake.ProviderName}); err == nil {
+		t.Error("expected an error for a VM which does not exist")
+	}
+}
+
+// TestShrinkCluster checks that ShrinkCluster only removes the last VMs of a
+// cluster, and that the remaining VMs keep their IPs.
+func TestShrinkCluster(t *testing.T) {
+	p, c := newFakeCluster(t, 12*time.Hour)
+	for i := range c.VMs {
+		c.VMs[i].PublicIP = fmt.Sprintf("203.0.113.%d", i+1)
+		c.VMs[i].PrivateIP = fmt.Sprintf("10.0.0.%d", i+1)
+		p.Seed(c.VMs[i])
+	}
+
+	ctx := context.Background()
+	for _, n := range []int{0, 3} {
+		if err := ShrinkCluster(ctx, c, n); err == nil {
+			t.Errorf("expected removing %d of the 3 nodes to fail", n)
+		}
+	}
+	if calls := p.CallsTo("Delete"); len(calls) != 0 {
+		t.Fatalf("expected no VMs to be deleted, got %v", calls)
+	}
+
+	if err := ShrinkCluster(ctx, c, 1); err != nil {
+		t.Fatal(err)
+	}
+	vms, err := p.List(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vms) != 2 {
+		t.Fatalf("expected 2 VMs to remain, got %v", vms.Names())
+	}
+	for i, v := range vms {
+		if v.Name != c.VMs[i].Name || v.PublicIP != c.VMs[i].PublicIP || v.PrivateIP != c.VMs[i].PrivateIP {
+			t.Errorf("%s has IPs %s and %s, expected %s to be unchanged", v.Name, v.PublicIP, v.PrivateIP, c.VMs[i].Name)
+		}
+	}
+}
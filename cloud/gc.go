@@ -1,11 +1,11 @@
 package cloud
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"hash/fnv"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"sort"
@@ -140,7 +140,7 @@ func postStatus(
 	if len(badVMs) == 0 {
 		send, err := shouldSend(channel, s)
 		if err != nil {
-			log.Printf("unable to deduplicate notification: %s", err)
+			vm.Warningf("unable to deduplicate notification: %s", err)
 		}
 		if !send {
 			return
@@ -219,12 +219,12 @@ func postStatus(
 
 	_, _, err := client.PostMessage(channel, "", params)
 	if err != nil {
-		log.Println(err)
+		vm.Logf(vm.LevelError, "%s", err)
 	}
 }
 
 func postError(client *slack.Client, channel string, err error) {
-	log.Println(err)
+	vm.Logf(vm.LevelError, "%s", err)
 	if client == nil || channel == "" {
 		return
 	}
@@ -236,7 +236,7 @@ func postError(client *slack.Client, channel string, err error) {
 	}
 	_, _, err = client.PostMessage(channel, fmt.Sprintf("`%s`", err), params)
 	if err != nil {
-		log.Println(err)
+		vm.Logf(vm.LevelError, "%s", err)
 	}
 }
 
@@ -263,17 +263,26 @@ func shouldSend(channel string, status *status) (bool, error) {
 	return true, ioutil.WriteFile(hashPath, []byte(newHash), 0644)
 }
 
-// GCClusters checks all cluster to see if they should be deleted. It only
-// fails on failure to perform cloud actions. All others actions (load/save
-// file, email) do not abort.
-func GCClusters(cloud *Cloud, dryrun bool) error {
+// GCClusters checks all cluster to see if they should be deleted. Clusters
+// are deleted once they have been expired for longer than the grace period.
+// Clusters and VMs without a known lifetime are never deleted. It only fails
+// on failure to perform cloud actions. All others actions (load/save file,
+// email) do not abort.
+func GCClusters(ctx context.Context, cloud *Cloud, dryrun bool, grace time.Duration) error {
 	now := time.Now()
+	// Clusters are only destroyed once they expired before this time.
+	cutoff := now.Add(-grace)
 
 	var names []string
-	for name := range cloud.Clusters {
-		if name != config.Local {
-			names = append(names, name)
+	for name, c := range cloud.Clusters {
+		if name == config.Local {
+			continue
 		}
+		if c.Lifetime <= 0 {
+			vm.Infof("not collecting cluster %s: %s", name, vm.ErrNoExpiration)
+			continue
+		}
+		names = append(names, name)
 	}
 	sort.Strings(names)
 
@@ -286,16 +295,29 @@ func GCClusters(cloud *Cloud, dryrun bool) error {
 			u = &status{}
 			users[c.User] = u
 		}
-		s.add(c, now)
-		u.add(c, now)
+		s.add(c, cutoff)
+		u.add(c, cutoff)
 	}
 
 	// Compile list of "bad vms" and destroy them.
 	var badVMs vm.List
-	for _, vm := range cloud.BadInstances {
+	for _, v := range cloud.BadInstances {
+		if v.HasError(vm.ErrorCodeNoExpiration) {
+			vm.Infof("not collecting VM %s: %s", v.Name, vm.ErrNoExpiration)
+			continue
+		}
 		// We only delete "bad vms" if they were created more than 1h ago.
-		if now.Sub(vm.CreatedAt) >= time.Hour {
-			badVMs = append(badVMs, vm)
+		if now.Sub(v.CreatedAt) >= time.Hour {
+			badVMs = append(badVMs, v)
+		}
+	}
+
+	if dryrun {
+		for _, c := range s.destroy {
+			fmt.Printf("would destroy cluster %s (expired at %s)\n", c.Name, c.ExpiresAt())
+		}
+		for _, v := range badVMs {
+			fmt.Printf("would destroy VM %s: %v\n", v.Name, v.Errors)
 		}
 	}
 
@@ -318,8 +340,9 @@ func GCClusters(cloud *Cloud, dryrun bool) error {
 	if !dryrun {
 		if len(badVMs) > 0 {
 			// Destroy bad VMs.
-			err := vm.FanOut(badVMs, func(p vm.Provider, vms vm.List) error {
-				return p.Delete(vms)
+			err := vm.FanOut(ctx, badVMs, func(ctx context.Context, p vm.Provider, vms vm.List) error {
+				defer vm.InvalidateListCache(p.Name())
+				return p.Delete(ctx, vms)
 			})
 			if err != nil {
 				postError(client, channel, err)
@@ -328,10 +351,74 @@ func GCClusters(cloud *Cloud, dryrun bool) error {
 
 		// Destroy expired clusters.
 		for _, c := range s.destroy {
-			if err := DestroyCluster(c); err != nil {
+			if err := DestroyCluster(ctx, c); err != nil {
 				postError(client, channel, err)
 			}
 		}
 	}
 	return nil
 }
+
+// KeepLabel marks the VMs of a cluster which OldClusters skips, whatever its
+// value, e.g. with `roachprod create --label keep=true`.
+const KeepLabel = "keep"
+
+// OldClusters returns the clusters of the cloud, sorted by name, which were
+// created more than age before now, whatever their lifetime. The VMs which
+// ListCloud sets aside as bad instances, such as those without a lifetime,
+// are counted with their clusters. The clusters with a VM labeled KeepLabel,
+// or whose creation time is unknown, are returned by name in skipped
+// instead.
+func OldClusters(cloud *Cloud, age time.Duration, now time.Time) (old []*CloudCluster, skipped []string) {
+	byName := make(map[string]*CloudCluster)
+	for name, c := range cloud.Clusters {
+		if name == config.Local {
+			continue
+		}
+		copied := *c
+		copied.VMs = append(vm.List(nil), c.VMs...)
+		byName[name] = &copied
+	}
+	for _, v := range cloud.BadInstances {
+		user, name, err := v.ClusterName()
+		if err != nil || name == config.Local {
+			continue
+		}
+		c, ok := byName[name]
+		if !ok {
+			c = &CloudCluster{Cluster: vm.Cluster{Name: name, User: user, CreatedAt: v.CreatedAt}}
+			byName[name] = c
+		}
+		c.VMs = append(c.VMs, v)
+		if v.CreatedAt.Before(c.CreatedAt) {
+			c.CreatedAt = v.CreatedAt
+		}
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := byName[name]
+		sort.Sort(c.VMs)
+		keep, unknown := false, false
+		for _, v := range c.VMs {
+			_, labeled := v.Labels[KeepLabel]
+			keep = keep || labeled
+			unknown = unknown || v.CreatedAt.IsZero()
+		}
+		switch {
+		case keep:
+			vm.Infof("not collecting cluster %s: labeled %s", name, KeepLabel)
+			skipped = append(skipped, name)
+		case unknown:
+			vm.Infof("not collecting cluster %s: unknown creation time", name)
+			skipped = append(skipped, name)
+		case now.Sub(c.CreatedAt) > age:
+			old = append(old, c)
+		}
+	}
+	return old, skipped
+}
@@ -0,0 +1,71 @@
+package cloud
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cockroachdb/roachprod/vm"
+)
+
+// ProviderHealth summarizes whether a vm.Provider is usable. The error
+// fields are empty if the corresponding check succeeded.
+type ProviderHealth struct {
+	Provider         string `json:"provider"`
+	Account          string `json:"account"`
+	CredentialsError string `json:"credentials_error,omitempty"`
+	APIError         string `json:"api_error,omitempty"`
+	Clusters         int    `json:"clusters"`
+	VMs              int    `json:"vms"`
+}
+
+// Healthy returns true if all of the checks succeeded.
+func (h ProviderHealth) Healthy() bool {
+	return h.CredentialsError == "" && h.APIError == ""
+}
+
+// CheckProviders checks the credentials and active account of every provider,
+// as vm.ListProviders does, and then concurrently the API reachability of
+// those whose credentials are configured, counting the clusters and VMs they
+// host. A failed check does not prevent the remaining providers from being
+// checked. The results are sorted by provider name.
+func CheckProviders(ctx context.Context) []ProviderHealth {
+	infos := vm.ListProviders(ctx)
+	ret := make([]ProviderHealth, len(infos))
+	var wg sync.WaitGroup
+	for i, info := range infos {
+		ret[i] = ProviderHealth{
+			Provider:         info.Name,
+			Account:          info.Account,
+			CredentialsError: info.CredentialsError,
+		}
+		p, ok := vm.LookupProvider(info.Name)
+		if !info.Usable() || !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(p vm.Provider, h *ProviderHealth) {
+			defer wg.Done()
+			checkAPI(ctx, p, h)
+		}(p, &ret[i])
+	}
+	wg.Wait()
+	return ret
+}
+
+// checkAPI lists the VMs of the provider, recording the clusters and VMs it
+// hosts in h, or the error.
+func checkAPI(ctx context.Context, p vm.Provider, h *ProviderHealth) {
+	vms, err := p.List(ctx, nil)
+	if err != nil {
+		h.APIError = err.Error()
+		return
+	}
+	clusters := make(map[string]bool)
+	for _, v := range vms {
+		if _, clusterName, err := v.ClusterName(); err == nil {
+			clusters[clusterName] = true
+		}
+	}
+	h.Clusters = len(clusters)
+	h.VMs = len(vms)
+}
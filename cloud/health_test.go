@@ -0,0 +1,50 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/cockroachdb/roachprod/vm/fake"
+)
+
+// healthOf returns the health of the fake provider among the results.
+func healthOf(t *testing.T, results []ProviderHealth) ProviderHealth {
+	for _, h := range results {
+		if h.Provider == fake.ProviderName {
+			return h
+		}
+	}
+	t.Fatalf("no health reported for %s in %v", fake.ProviderName, results)
+	return ProviderHealth{}
+}
+
+func TestCheckProviders(t *testing.T) {
+	p, _ := newFakeCluster(t, 0)
+	p.Account = "fake-user"
+	p.Seed(vm.VM{Name: "fake-other-1"})
+	listed := len(p.CallsTo("List"))
+
+	h := healthOf(t, CheckProviders(context.Background()))
+	if !h.Healthy() || h.Account != "fake-user" || h.Clusters != 2 || h.VMs != 4 {
+		t.Errorf("unexpected health %+v", h)
+	}
+
+	// The API is not checked without credentials.
+	p.FailOn("CheckCredentials", errors.New("no credentials"))
+	h = healthOf(t, CheckProviders(context.Background()))
+	if h.CredentialsError != "no credentials" || h.APIError != "" || h.VMs != 0 {
+		t.Errorf("unexpected health %+v", h)
+	}
+	if calls := len(p.CallsTo("List")) - listed; calls != 1 {
+		t.Errorf("expected the VMs to be listed by the first check only, got %d listings", calls)
+	}
+
+	p.FailOn("CheckCredentials", nil)
+	p.FailOn("List", errors.New("unreachable"))
+	h = healthOf(t, CheckProviders(context.Background()))
+	if h.CredentialsError != "" || h.APIError != "unreachable" {
+		t.Errorf("unexpected health %+v", h)
+	}
+}
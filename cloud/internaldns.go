@@ -0,0 +1,69 @@
+package cloud
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// internalDNSMetadataKey is the metadata key in which the search suffix of
+// the internal host names of a cluster is kept (see SetInternalDNS), on the
+// VM which holds its lock. The suffix is kept with a trailing dot, so that a
+// cluster without one has the value ".".
+const internalDNSMetadataKey = "internal-dns"
+
+// InternalDNS returns true if the nodes of the cluster resolve each other by
+// their internal host names, n<node>, along with the search suffix of the
+// names, which may be empty.
+func InternalDNS(ctx context.Context, c *CloudCluster) (string, bool, error) {
+	v, ok := lockVM(c)
+	if !ok {
+		return "", false, nil
+	}
+	p, _ := vm.LookupProvider(v.Provider)
+	md, err := p.GetMetadata(ctx, v)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "could not read the internal DNS settings of cluster %s", c.Name)
+	}
+	suffix, ok := md[internalDNSMetadataKey]
+	if !ok || suffix == "" {
+		return "", false, nil
+	}
+	return strings.TrimSuffix(suffix, "."), true, nil
+}
+
+// SetInternalDNS records that the nodes of the cluster resolve each other by
+// their internal host names, under the search suffix, so that the names are
+// kept up to date as the cluster grows or its addresses change. The record
+// is deleted with the cluster.
+func SetInternalDNS(ctx context.Context, c *CloudCluster, suffix string) error {
+	v, ok := lockVM(c)
+	if !ok {
+		return errors.Errorf("the providers of cluster %s do not support internal DNS", c.Name)
+	}
+	value := strings.TrimSuffix(suffix, ".") + "."
+	p, _ := vm.LookupProvider(v.Provider)
+	if err := p.SetMetadata(ctx, v, map[string]string{internalDNSMetadataKey: value}); err != nil {
+		return errors.Wrapf(err, "could not record the internal DNS settings of cluster %s", c.Name)
+	}
+	return nil
+}
+
+// InternalHosts returns the private IPs of the VMs of the cluster, keyed by
+// node.
+func InternalHosts(c *CloudCluster) (map[int]string, error) {
+	ret := make(map[int]string, len(c.VMs))
+	for _, v := range c.VMs {
+		node, err := vm.NodeNumber(v.Name)
+		if err != nil {
+			return nil, err
+		}
+		if v.PrivateIP == "" {
+			return nil, errors.Errorf("VM %s has no private IP address", v.Name)
+		}
+		ret[node] = v.PrivateIP
+	}
+	return ret, nil
+}
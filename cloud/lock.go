@@ -0,0 +1,171 @@
+package cloud
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// lockMetadataKey is the metadata key (see vm.Provider.SetMetadata) in which
+// the lock of a cluster is kept, on the first of its VMs whose provider
+// supports metadata.
+const lockMetadataKey = "lock"
+
+// A ClusterLock is the advisory lock which the commands that mutate a cluster
+// hold while they do so, to keep e.g. a destroy from racing with an extend.
+// It is kept in the metadata of the cluster, so that it is seen by the other
+// users of a shared cluster, and it expires after a while so that it is not
+// held forever by a command which was killed.
+type ClusterLock struct {
+	// Holder is the user and host which hold the lock, as user@host.
+	Holder    string
+	Operation string
+	Expires   time.Time
+	// token identifies the acquisition of the lock, so that it is only
+	// released by its holder.
+	token string
+}
+
+func (l ClusterLock) String() string {
+	return fmt.Sprintf("%s (%s, until %s)", l.Holder, l.Operation, l.Expires.Local().Format(time.Kitchen))
+}
+
+// format returns the metadata value of the lock.
+func (l ClusterLock) format() string {
+	return strings.Join([]string{l.Holder, l.Operation, l.Expires.UTC().Format(time.RFC3339), l.token}, " ")
+}
+
+// parseLock parses the metadata value of a lock, returning false if it is not
+// one.
+func parseLock(s string) (ClusterLock, bool) {
+	fields := strings.Fields(s)
+	if len(fields) != 4 {
+		return ClusterLock{}, false
+	}
+	expires, err := time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		return ClusterLock{}, false
+	}
+	return ClusterLock{Holder: fields[0], Operation: fields[1], Expires: expires, token: fields[3]}, true
+}
+
+// LockOpts configure the acquisition of a ClusterLock.
+type LockOpts struct {
+	// TTL is how long the lock is held for, at most.
+	TTL time.Duration
+	// Wait is how long to wait for the lock if another user holds it.
+	Wait time.Duration
+	// Force overrides the lock of another user.
+	Force bool
+}
+
+// lockPollInterval is how often a held lock is checked while waiting for it.
+const lockPollInterval = 5 * time.Second
+
+// lockVM returns the VM of the cluster which holds its lock, and false if
+// none of the providers of the cluster supports metadata, as is the case for
+// local clusters.
+func lockVM(c *CloudCluster) (vm.VM, bool) {
+	vms := append(vm.List(nil), c.VMs...)
+	sort.Slice(vms, func(i, j int) bool { return vms[i].Name < vms[j].Name })
+	for _, v := range vms {
+		if p, ok := vm.LookupProvider(v.Provider); ok && p.Capabilities().Metadata {
+			return v, true
+		}
+	}
+	return vm.VM{}, false
+}
+
+// LockCluster acquires the lock of the cluster for the operation, waiting up
+// to opts.Wait for another holder to release it, and returns the function
+// which releases it again. The lock is advisory: two commands which acquire
+// it at the same instant may both succeed. The error of a held lock names its
+// holder. Clusters whose providers do not support metadata are not locked,
+// and neither are clusters in a dry run.
+func LockCluster(ctx context.Context, c *CloudCluster, operation string, opts LockOpts) (func(), error) {
+	v, ok := lockVM(c)
+	if !ok || config.DryRun {
+		return func() {}, nil
+	}
+	p, _ := vm.LookupProvider(v.Provider)
+
+	holder := config.OSUser.Username
+	if holder == "" {
+		holder = "unknown"
+	}
+	if host, err := os.Hostname(); err == nil {
+		holder += "@" + host
+	}
+	var token [8]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return nil, err
+	}
+	lock := ClusterLock{Holder: holder, Operation: operation, token: hex.EncodeToString(token[:])}
+
+	deadline := time.Now().Add(opts.Wait)
+	for {
+		md, err := p.GetMetadata(ctx, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read the lock of cluster %s", c.Name)
+		}
+		cur, held := parseLock(md[lockMetadataKey])
+		held = held && time.Now().Before(cur.Expires)
+		if held && opts.Force {
+			vm.Warningf("overriding the lock of cluster %s held by %s", c.Name, cur)
+		} else if held {
+			if !time.Now().Before(deadline) {
+				return nil, errors.Errorf("cluster %s is locked by %s; retry later, wait for it with --lock-wait, "+
+					"or override it with --force-lock", c.Name, cur)
+			}
+			vm.Infof("cluster %s is locked by %s, waiting", c.Name, cur)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(lockPollInterval):
+			}
+			continue
+		}
+
+		lock.Expires = time.Now().Add(opts.TTL)
+		if err := p.SetMetadata(ctx, v, map[string]string{lockMetadataKey: lock.format()}); err != nil {
+			return nil, errors.Wrapf(err, "could not lock cluster %s", c.Name)
+		}
+		// A concurrent acquisition may have overwritten the lock, in which
+		// case it is waited for in turn.
+		md, err = p.GetMetadata(ctx, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read the lock of cluster %s", c.Name)
+		}
+		if cur, _ := parseLock(md[lockMetadataKey]); cur.token == lock.token {
+			break
+		}
+		opts.Force = false
+	}
+
+	return func() {
+		// The lock is released even if the context of the operation has
+		// been cancelled or has timed out.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		md, err := p.GetMetadata(ctx, v)
+		if err != nil {
+			// The VM holding the lock may have been destroyed.
+			return
+		}
+		if cur, _ := parseLock(md[lockMetadataKey]); cur.token != lock.token {
+			return
+		}
+		if err := p.SetMetadata(ctx, v, map[string]string{lockMetadataKey: ""}); err != nil {
+			vm.Warningf("could not release the lock of cluster %s: %s", c.Name, err)
+		}
+	}, nil
+}
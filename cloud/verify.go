@@ -0,0 +1,181 @@
+package cloud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// A VerifyCheck is the result of one of the checks of VerifyCluster. Problems
+// is empty if the check passed, and Remedy suggests the roachprod command which
+// fixes the problems otherwise.
+type VerifyCheck struct {
+	Name     string   `json:"name"`
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems,omitempty"`
+	Remedy   string   `json:"remedy,omitempty"`
+}
+
+// A VerifyReport is the result of VerifyCluster.
+type VerifyReport struct {
+	Cluster string        `json:"cluster"`
+	VMs     int           `json:"vms"`
+	OK      bool          `json:"ok"`
+	Checks  []VerifyCheck `json:"checks"`
+}
+
+// consistentLabels are the labels which roachprod attaches to the VMs of a
+// cluster and which all of them must agree on.
+var consistentLabels = []string{
+	vm.ClusterLabel, vm.UserLabel, vm.PlacementLabel, vm.FirewallLabel, vm.StaticIPLabel,
+}
+
+// VerifyCluster checks that the VMs of the named cluster, as listed, are
+// healthy: that every node from 1 to the highest one exists, that all of the
+// VMs are running, have network addresses and a lifetime, and that they agree
+// on the labels which roachprod attaches to them. The VMs with errors, which
+// ListCloud sets aside as bad instances, are included. Each check is reported,
+// whether it passed or not. An error is only returned if the cluster has no
+// VMs.
+func VerifyCluster(cloud *Cloud, name string) (VerifyReport, error) {
+	var vms vm.List
+	if c, ok := cloud.Clusters[name]; ok {
+		vms = append(vms, c.VMs...)
+	}
+	for _, v := range cloud.BadInstances {
+		if _, cluster, err := v.ClusterName(); err == nil && cluster == name {
+			vms = append(vms, v)
+		}
+	}
+	if len(vms) == 0 {
+		return VerifyReport{}, errors.Errorf("cluster %s does not exist", name)
+	}
+	sort.Sort(vms)
+
+	report := VerifyReport{Cluster: name, VMs: len(vms), OK: true}
+	add := func(check, remedy string, problems []string) {
+		c := VerifyCheck{Name: check, OK: len(problems) == 0, Problems: problems}
+		if !c.OK {
+			c.Remedy = remedy
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, c)
+	}
+
+	add("nodes", fmt.Sprintf("roachprod create %s -n <nodes> creates the missing nodes", name), checkNodes(vms))
+
+	var stopped, preempted, other []string
+	for _, v := range vms {
+		switch v.Status {
+		case vm.StatusRunning:
+		case vm.StatusStopped:
+			stopped = append(stopped, fmt.Sprintf("%s is %s", v.Name, v.Status))
+		case vm.StatusPreempted:
+			preempted = append(preempted, fmt.Sprintf("%s is %s", v.Name, v.Status))
+		default:
+			other = append(other, fmt.Sprintf("%s is %s", v.Name, v.Status))
+		}
+	}
+	var remedies []string
+	if len(stopped) > 0 {
+		remedies = append(remedies, fmt.Sprintf("roachprod resume %s starts the stopped VMs", name))
+	}
+	if len(preempted) > 0 {
+		remedies = append(remedies, fmt.Sprintf("roachprod recreate-preempted %s replaces the preempted VMs", name))
+	}
+	if len(other) > 0 {
+		remedies = append(remedies, "wait for the VMs to settle and verify again")
+	}
+	add("running", strings.Join(remedies, "; "), append(append(stopped, preempted...), other...))
+
+	var network []string
+	for _, v := range vms {
+		switch {
+		case v.HasError(vm.ErrorCodeBadNetwork):
+			network = append(network, fmt.Sprintf("%s: %s", v.Name, vm.ErrBadNetwork))
+		case v.Host() == "":
+			network = append(network, fmt.Sprintf("%s has no IP address", v.Name))
+		}
+	}
+	add("network", fmt.Sprintf("roachprod refresh %s lists the addresses again", name), network)
+
+	var lifetime []string
+	for _, v := range vms {
+		switch {
+		case v.HasError(vm.ErrorCodeNoExpiration):
+			lifetime = append(lifetime, fmt.Sprintf("%s: %s", v.Name, vm.ErrNoExpiration))
+		case v.HasError(vm.ErrorCodeBadLifetime):
+			lifetime = append(lifetime, fmt.Sprintf("%s: %s", v.Name, vm.ErrBadLifetime))
+		case v.Lifetime <= 0:
+			lifetime = append(lifetime, fmt.Sprintf("%s has no lifetime", v.Name))
+		}
+	}
+	add("lifetime", fmt.Sprintf("roachprod extend %s sets the lifetime of the VMs", name), lifetime)
+
+	add("labels", fmt.Sprintf("roachprod describe %s shows where the VMs came from; "+
+		"they were not all created for the same cluster", name), checkLabels(name, vms))
+	return report, nil
+}
+
+// checkNodes returns a problem for each node from 1 to the highest one of the
+// VMs which is missing, and for each node number which several VMs share.
+func checkNodes(vms vm.List) []string {
+	byNode := make(map[int][]string)
+	highest := 0
+	var problems []string
+	for _, v := range vms {
+		node, err := vm.NodeNumber(v.Name)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		byNode[node] = append(byNode[node], v.Name)
+		if node > highest {
+			highest = node
+		}
+	}
+	for node := 1; node <= highest; node++ {
+		switch names := byNode[node]; len(names) {
+		case 0:
+			problems = append(problems, fmt.Sprintf("node %d is missing", node))
+		case 1:
+		default:
+			problems = append(problems, fmt.Sprintf("node %d has %d VMs: %s",
+				node, len(names), strings.Join(names, ", ")))
+		}
+	}
+	return problems
+}
+
+// checkLabels returns a problem for each of the consistentLabels on which the
+// VMs disagree, and for VMs whose ClusterLabel names another cluster.
+func checkLabels(name string, vms vm.List) []string {
+	var problems []string
+	for _, key := range consistentLabels {
+		values := make(map[string][]string)
+		for _, v := range vms {
+			values[v.Labels[key]] = append(values[v.Labels[key]], v.Name)
+		}
+		if len(values) < 2 {
+			continue
+		}
+		var parts []string
+		for value, names := range values {
+			if value == "" {
+				value = "<unset>"
+			}
+			parts = append(parts, fmt.Sprintf("%s on %s", value, strings.Join(names, ", ")))
+		}
+		sort.Strings(parts)
+		problems = append(problems, fmt.Sprintf("label %s differs: %s", key, strings.Join(parts, "; ")))
+	}
+	for _, v := range vms {
+		if cluster, ok := v.Labels[vm.ClusterLabel]; ok && cluster != name {
+			problems = append(problems, fmt.Sprintf("%s is labeled with cluster %s", v.Name, cluster))
+		}
+	}
+	return problems
+}
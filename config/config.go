@@ -1,22 +1,96 @@
 package config
 
 import (
-	"log"
+	"os"
 	"os/user"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 var (
 	Binary     = "cockroach"
 	SlackToken string
 	OSUser     *user.User
+
+	// MaxRetries is the number of times a cloud API request which failed
+	// with a transient error is retried.
+	MaxRetries = 5
+	// MaxRetryBackoff bounds the exponential backoff between retries.
+	MaxRetryBackoff = 30 * time.Second
+	// MaxConcurrency bounds the number of concurrent cloud API requests a
+	// provider issues when operating on many VMs.
+	MaxConcurrency = 10
+	// Parallelism bounds the total number of cloud API requests in flight
+	// across all providers and operations, which MaxConcurrency only bounds
+	// per operation. Zero disables the limit.
+	Parallelism = 32
+	// MaxQPS bounds the rate of the cloud API requests issued by each
+	// provider, unless ProviderMaxQPS overrides it for the provider. Zero
+	// disables the limit.
+	MaxQPS = 10.0
+	// ProviderMaxQPS holds the rates which override MaxQPS, keyed by the
+	// name of the provider.
+	ProviderMaxQPS = map[string]float64{}
+	// SSHKeyPath, if set, is the private key which roachprod uses to ssh
+	// into VMs, in addition to the default keys. The providers register its
+	// public half unless they have been given a key of their own.
+	SSHKeyPath string
+	// UseListCache allows the VMs listed by a provider to be served from
+	// the on-disk cache if they were listed within ListCacheTTL.
+	UseListCache bool
+	ListCacheTTL = time.Minute
+	// DryRun makes the providers print the cloud API calls with which they
+	// would create or delete VMs, rather than making them.
+	DryRun bool
+	// BastionHost, if set, is the jump host (host[:port]) through which ssh
+	// connects to VMs without public IPs. Providers may be given bastions of
+	// their own. BastionUser and BastionKeyPath, if set, are the user and
+	// private key with which to log into the bastion.
+	BastionHost    string
+	BastionUser    string
+	BastionKeyPath string
+	// MaxLifetime, if non-zero, caps the lifetime of the VMs which roachprod
+	// creates or extends. Longer lifetimes are capped when extending, unless
+	// RejectLongLifetimes is set, in which case they are errors.
+	MaxLifetime         time.Duration
+	RejectLongLifetimes bool
+	// Version is the version of the roachprod binary, which is recorded on
+	// the VMs it creates. It is set at build time with -ldflags "-X
+	// github.com/cockroachdb/roachprod/config.Version=<version>"; if it is
+	// not, the VCS revision embedded by the go tool is used, if any.
+	Version string
 )
 
 func init() {
-	var err error
-	OSUser, err = user.Current()
-	if err != nil {
-		log.Panic("Unable to determine OS user", err)
+	// OSUser is never nil. Commands look it up again, so that an error can be
+	// reported if the user cannot be determined at all.
+	OSUser, _ = CurrentUser()
+}
+
+// CurrentUser returns the user running roachprod. If it cannot be looked up,
+// e.g. in a container whose user has no passwd entry, the user is taken from
+// $USER and $HOME instead, and an error is only returned if $USER is unset.
+// The returned user is never nil.
+func CurrentUser() (*user.User, error) {
+	u, err := user.Current()
+	if err == nil {
+		return u, nil
+	}
+	u = &user.User{Username: os.Getenv("USER"), HomeDir: os.Getenv("HOME")}
+	if u.Username == "" {
+		return u, errors.Wrap(err, "and $USER is unset")
+	}
+	return u, nil
+}
+
+// ProviderQPS returns the maximum rate of the cloud API requests of the named
+// provider: its ProviderMaxQPS, if set, or else MaxQPS.
+func ProviderQPS(provider string) float64 {
+	if qps, ok := ProviderMaxQPS[provider]; ok {
+		return qps
 	}
+	return MaxQPS
 }
 
 // A sentinel value used to indicate that an installation should
@@ -24,6 +98,7 @@ func init() {
 // this ought to be replaced by a LocalCloudProvider or somesuch.
 const (
 	DefaultHostDir = "${HOME}/.roachprod/hosts"
+	ListCacheDir   = "${HOME}/.roachprod/cache"
 	EmailDomain    = "@cockroachlabs.com"
 	Local          = "local"
 )
@@ -0,0 +1,55 @@
+package dns
+
+import (
+	"context"
+
+	"github.com/cockroachdb/roachprod/vm"
+)
+
+// cloudDNS implements Provider for a Google Cloud DNS managed zone in the
+// default gcloud project.
+type cloudDNS struct {
+	zone string
+}
+
+// recordTTL is the TTL in seconds of the records which are created. It is
+// short since IP addresses are reused by new clusters.
+const recordTTL = "60"
+
+// CreateRecords is part of the Provider interface. Cloud DNS cannot create a
+// record set which already exists, so any existing records are deleted first.
+func (p *cloudDNS) CreateRecords(ctx context.Context, records []Record) error {
+	names := make([]string, len(records))
+	for i, r := range records {
+		names[i] = r.Name
+	}
+	if err := p.DeleteRecords(ctx, names); err != nil {
+		return err
+	}
+	return vm.ForEach(len(records), func(i int) error {
+		args := []string{"dns", "record-sets", "create", fqdn(records[i].Name),
+			"--zone", p.zone, "--type", "A", "--ttl", recordTTL, "--rrdatas", records[i].IP,
+			"--format", "json"}
+		return runJSONCommand(ctx, "gcloud", args, nil)
+	})
+}
+
+// DeleteRecords is part of the Provider interface.
+func (p *cloudDNS) DeleteRecords(ctx context.Context, names []string) error {
+	return vm.ForEach(len(names), func(i int) error {
+		var existing []struct {
+			Name string
+		}
+		args := []string{"dns", "record-sets", "list", "--zone", p.zone,
+			"--name", fqdn(names[i]), "--type", "A", "--format", "json"}
+		if err := runJSONCommand(ctx, "gcloud", args, &existing); err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			return nil
+		}
+		args = []string{"dns", "record-sets", "delete", fqdn(names[i]),
+			"--zone", p.zone, "--type", "A", "--format", "json"}
+		return runJSONCommand(ctx, "gcloud", args, nil)
+	})
+}
@@ -0,0 +1,116 @@
+// Package dns manages DNS records which give the VMs of a cluster stable
+// host names. It is independent of the vm.Provider hosting the VMs, so that
+// a single DNS zone can be used for clusters spanning several clouds.
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// A Record maps a fully-qualified host name to an IPv4 address.
+type Record struct {
+	Name string
+	IP   string
+}
+
+// A Provider manages the A records in a DNS zone.
+type Provider interface {
+	// CreateRecords creates the records, replacing any existing A records
+	// with the same names.
+	CreateRecords(ctx context.Context, records []Record) error
+	// DeleteRecords deletes the A records with the given names. Names which
+	// have no records are ignored.
+	DeleteRecords(ctx context.Context, names []string) error
+}
+
+// Flag values which configure the DNS integration. It is disabled unless
+// ProviderName is set.
+var (
+	ProviderName = os.Getenv("ROACHPROD_DNS_PROVIDER")
+	Zone         = os.Getenv("ROACHPROD_DNS_ZONE")
+	Domain       = os.Getenv("ROACHPROD_DNS_DOMAIN")
+)
+
+// providers contains the constructors of the known Providers, keyed by the
+// name of the cloud hosting the DNS zone.
+var providers = map[string]func(zone string) Provider{
+	"aws": func(zone string) Provider { return &route53{hostedZoneID: zone} },
+	"gce": func(zone string) Provider { return &cloudDNS{zone: zone} },
+}
+
+// Active returns the configured Provider, or nil if the DNS integration is
+// disabled.
+func Active() (Provider, error) {
+	if ProviderName == "" {
+		return nil, nil
+	}
+	newProvider, ok := providers[ProviderName]
+	if !ok {
+		return nil, errors.Errorf("unknown DNS provider: %s", ProviderName)
+	}
+	if Zone == "" || Domain == "" {
+		return nil, errors.New("a DNS zone and domain must be configured")
+	}
+	return newProvider(Zone), nil
+}
+
+// RecordName returns the host name of a node: n<node>.<cluster>.<domain>.
+func RecordName(cluster string, node int) string {
+	return fmt.Sprintf("n%d.%s.%s", node, cluster, strings.TrimSuffix(Domain, "."))
+}
+
+// isTransientError classifies errors from the gcloud and aws commands as a
+// fallback for vm.Retry.
+func isTransientError(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{"Throttling", "PriorRequestNotComplete", "rateLimitExceeded", "503"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter paces all of the gcloud and aws DNS commands.
+var rateLimiter vm.RateLimiter
+
+// runJSONCommand runs a gcloud or aws command, retrying transient errors,
+// and parses its output into parsed, unless parsed is nil.
+func runJSONCommand(ctx context.Context, name string, args []string, parsed interface{}) error {
+	var stdout []byte
+	err := vm.Retry(ctx, &rateLimiter, isTransientError, func() error {
+		var err error
+		stdout, err = exec.CommandContext(ctx, name, args...).Output()
+		if err != nil {
+			var stderr []byte
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				stderr = exitErr.Stderr
+			}
+			return errors.Wrapf(err, "failed to run: %s %s: %s",
+				name, strings.Join(args, " "), bytes.TrimSpace(stderr))
+		}
+		return nil
+	})
+	if err != nil || parsed == nil {
+		return err
+	}
+	if err := json.Unmarshal(stdout, parsed); err != nil {
+		return errors.Wrapf(err, "failed to parse json %s", stdout)
+	}
+	return nil
+}
+
+// fqdn returns name with a trailing dot, as used by both Cloud DNS and
+// Route53.
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/cockroachdb/roachprod/vm"
+)
+
+// route53 implements Provider for an AWS Route53 hosted zone.
+type route53 struct {
+	hostedZoneID string
+}
+
+// resourceRecordSet mirrors the Route53 API type of the same name.
+type resourceRecordSet struct {
+	Name            string
+	Type            string
+	TTL             int64
+	ResourceRecords []struct {
+		Value string
+	}
+}
+
+type change struct {
+	Action            string
+	ResourceRecordSet resourceRecordSet
+}
+
+// changeRecords applies a batch of changes atomically.
+func (p *route53) changeRecords(ctx context.Context, changes []change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	batch, err := json.Marshal(struct{ Changes []change }{changes})
+	if err != nil {
+		return err
+	}
+	args := []string{"route53", "change-resource-record-sets",
+		"--hosted-zone-id", p.hostedZoneID, "--change-batch", string(batch), "--output", "json"}
+	return runJSONCommand(ctx, "aws", args, nil)
+}
+
+// CreateRecords is part of the Provider interface.
+func (p *route53) CreateRecords(ctx context.Context, records []Record) error {
+	changes := make([]change, len(records))
+	for i, r := range records {
+		changes[i].Action = "UPSERT"
+		changes[i].ResourceRecordSet = resourceRecordSet{Name: fqdn(r.Name), Type: "A", TTL: 60}
+		changes[i].ResourceRecordSet.ResourceRecords = append(
+			changes[i].ResourceRecordSet.ResourceRecords, struct{ Value string }{r.IP})
+	}
+	return p.changeRecords(ctx, changes)
+}
+
+// DeleteRecords is part of the Provider interface. Route53 requires the
+// deleted record sets to be given exactly, so they are looked up first.
+func (p *route53) DeleteRecords(ctx context.Context, names []string) error {
+	found := make([]*resourceRecordSet, len(names))
+	err := vm.ForEach(len(names), func(i int) error {
+		var data struct {
+			ResourceRecordSets []resourceRecordSet
+		}
+		args := []string{"route53", "list-resource-record-sets",
+			"--hosted-zone-id", p.hostedZoneID,
+			"--start-record-name", fqdn(names[i]), "--start-record-type", "A",
+			"--max-items", "1", "--output", "json"}
+		if err := runJSONCommand(ctx, "aws", args, &data); err != nil {
+			return err
+		}
+		// The listing starts at the given name, which need not exist.
+		if len(data.ResourceRecordSets) == 1 {
+			if rrs := data.ResourceRecordSets[0]; rrs.Name == fqdn(names[i]) && rrs.Type == "A" {
+				found[i] = &rrs
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var changes []change
+	for _, rrs := range found {
+		if rrs != nil {
+			changes = append(changes, change{Action: "DELETE", ResourceRecordSet: *rrs})
+		}
+	}
+	return p.changeRecords(ctx, changes)
+}
@@ -45,10 +45,16 @@ func syncHosts(cloud *cloud.Cloud) error {
 
 			// Align columns left and separate with at least two spaces.
 			tw := tabwriter.NewWriter(file, 0, 8, 2, ' ', 0)
-			tw.Write([]byte("# user@host\tlocality\tvpcId\n"))
+			tw.Write([]byte("# user@host\tlocality\tvpcId\tname\n"))
 			for _, vm := range c.VMs {
+				// The columns are separated by whitespace, so an empty VPC is
+				// written as "-" to keep the name in its column.
+				vpc := vm.VPC
+				if vpc == "" {
+					vpc = "-"
+				}
 				tw.Write([]byte(fmt.Sprintf(
-					"%s@%s\t%s\t%s\n", vm.RemoteUser, vm.PublicIP, vm.Locality(), vm.VPC)))
+					"%s@%s\t%s\t%s\t%s\n", vm.RemoteUser, vm.Host(), vm.Locality(), vpc, vm.Name)))
 			}
 			if err := tw.Flush(); err != nil {
 				return errors.Wrapf(err, "problem writing file %s", filename)
@@ -91,7 +97,7 @@ func gcHostsFiles(cloud *cloud.Cloud) error {
 }
 
 func newInvalidHostsLineErr(line string) error {
-	return fmt.Errorf("invalid hosts line, expected <username>@<host> [locality] [vpcId], got %q", line)
+	return fmt.Errorf("invalid hosts line, expected <username>@<host> [locality] [vpcId] [name], got %q", line)
 }
 
 func loadClusters() error {
@@ -128,7 +134,7 @@ func loadClusters() error {
 			} else if len(fields[0]) > 0 && fields[0][0] == '#' {
 				// Comment line.
 				continue
-			} else if len(fields) > 3 {
+			} else if len(fields) > 4 {
 				return newInvalidHostsLineErr(l)
 			}
 
@@ -153,7 +159,15 @@ func loadClusters() error {
 
 			var vpc string
 			if len(fields) > 0 {
-				vpc = fields[0]
+				if fields[0] != "-" {
+					vpc = fields[0]
+				}
+				fields = fields[1:]
+			}
+
+			var vmName string
+			if len(fields) > 0 {
+				vmName = fields[0]
 				fields = fields[1:]
 			}
 
@@ -165,6 +179,7 @@ func loadClusters() error {
 			c.Users = append(c.Users, u)
 			c.Localities = append(c.Localities, locality)
 			c.VPCs = append(c.VPCs, vpc)
+			c.VMNames = append(c.VMNames, vmName)
 		}
 		install.Clusters[file.Name()] = c
 	}
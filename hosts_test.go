@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	cld "github.com/cockroachdb/roachprod/cloud"
+	"github.com/cockroachdb/roachprod/install"
+	"github.com/cockroachdb/roachprod/vm"
+)
+
+// TestSyncedVMNamesGapped checks that the nodes of a synced cluster from which
+// a node was removed are selected by position, by their names as well as by
+// their hosts.
+func TestSyncedVMNamesGapped(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.MkdirAll(filepath.Join(home, ".roachprod", "hosts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldClusters := install.Clusters
+	install.Clusters = map[string]*install.SyncedCluster{}
+	t.Cleanup(func() { install.Clusters = oldClusters })
+
+	c := &cld.CloudCluster{Cluster: vm.Cluster{Name: "user-test"}}
+	for _, v := range []struct{ name, ip, vpc string }{
+		{"user-test-0001", "10.0.0.1", "vpc-1"},
+		{"user-test-0003", "10.0.0.3", ""},
+		{"user-test-0004", "10.0.0.4", "vpc-1"},
+	} {
+		c.VMs = append(c.VMs, vm.VM{Name: v.name, PublicIP: v.ip, VPC: v.vpc,
+			Provider: "gce", Zone: "us-east1-b", RemoteUser: "ubuntu"})
+	}
+	if err := syncHosts(&cld.Cloud{Clusters: map[string]*cld.CloudCluster{c.Name: c}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadClusters(); err != nil {
+		t.Fatal(err)
+	}
+	synced, ok := install.Clusters[c.Name]
+	if !ok {
+		t.Fatalf("cluster %s was not loaded", c.Name)
+	}
+	if !syncedNamesKnown(synced) {
+		t.Fatalf("the names of the VMs are unknown: %v", synced.VMNames)
+	}
+	if synced.VPCs[1] != "" {
+		t.Errorf("the empty VPC was read back as %q", synced.VPCs[1])
+	}
+
+	for _, tc := range []struct {
+		nodes    string
+		expected []string
+	}{
+		{"all", []string{"user-test-0001", "user-test-0003", "user-test-0004"}},
+		{"3", []string{"user-test-0004"}},
+		{"2-3", []string{"user-test-0003", "user-test-0004"}},
+	} {
+		names, err := syncedVMNames(synced, tc.nodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != len(tc.expected) {
+			t.Fatalf("%s: expected %v, got %v", tc.nodes, tc.expected, names)
+		}
+		for i, name := range names {
+			if name != tc.expected[i] {
+				t.Errorf("%s: expected %v, got %v", tc.nodes, tc.expected, names)
+			}
+		}
+	}
+	// Node 3 is the host of user-test-0004 for "roachprod run" and "roachprod
+	// ssh" as well.
+	if host := synced.VMs[2]; host != "10.0.0.4" {
+		t.Errorf("node 3 has host %s, expected 10.0.0.4", host)
+	}
+	if _, err := syncedVMNames(synced, "4"); err == nil {
+		t.Error("expected an error for node 4 of 3")
+	}
+}
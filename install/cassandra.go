@@ -29,7 +29,7 @@ func (Cassandra) Start(c *SyncedCluster, extraArgs []string) {
 		user := c.user(nodes[i])
 
 		if err := func() error {
-			session, err := ssh.NewSSHSession(user, host)
+			session, err := ssh.NewSSHSession(user, host, c.sshAccess(nodes[i]))
 			if err != nil {
 				return err
 			}
@@ -47,7 +47,7 @@ func (Cassandra) Start(c *SyncedCluster, extraArgs []string) {
 
 		for {
 			up, err := func() (bool, error) {
-				session, err := ssh.NewSSHSession(user, host)
+				session, err := ssh.NewSSHSession(user, host, c.sshAccess(nodes[i]))
 				if err != nil {
 					return false, err
 				}
@@ -21,6 +21,7 @@ import (
 	"github.com/cockroachdb/roachprod/config"
 	"github.com/cockroachdb/roachprod/ssh"
 	"github.com/cockroachdb/roachprod/ui"
+	"github.com/cockroachdb/roachprod/vm"
 
 	"github.com/pkg/errors"
 )
@@ -46,6 +47,9 @@ type SyncedCluster struct {
 	Users      []string
 	Localities []string
 	VPCs       []string
+	// VMNames are the names of the VMs, which are unknown (empty) for the
+	// hosts files written before they were recorded.
+	VMNames []string
 	// all other fields are populated in newCluster.
 	Nodes       []int
 	LoadGen     int
@@ -70,6 +74,28 @@ func (c *SyncedCluster) locality(index int) string {
 	return c.Localities[index-1]
 }
 
+// sshAccess returns how ssh reaches the node, as described by the provider
+// named by the cloud= tier of its locality.
+func (c *SyncedCluster) sshAccess(index int) vm.SSHAccess {
+	for _, tier := range strings.Split(c.locality(index), ",") {
+		if strings.HasPrefix(tier, "cloud=") {
+			return vm.SSHAccessOf(strings.TrimPrefix(tier, "cloud="))
+		}
+	}
+	return vm.SSHAccess{}
+}
+
+// listenHost returns the address at which a command run on the node reaches
+// the node's own server: the loopback address of the node on the local
+// cluster, whose nodes may each have one of their own, and localhost on the
+// VMs of a cloud cluster.
+func (c *SyncedCluster) listenHost(index int) string {
+	if c.IsLocal() {
+		return c.host(index)
+	}
+	return "localhost"
+}
+
 // TODO(tschottdorf): roachprod should cleanly encapsulate the home directory
 // which is currently the biggest culprit for awkward one-offs.
 func (c *SyncedCluster) IsLocal() bool {
@@ -117,7 +143,7 @@ func (c *SyncedCluster) newSession(i int) (session, error) {
 	if c.IsLocal() {
 		return newLocalSession(), nil
 	}
-	return newRemoteSession(c.user(i), c.host(i))
+	return newRemoteSession(c.user(i), c.host(i), c.sshAccess(i))
 }
 
 func (c *SyncedCluster) Stop(sig int, wait bool) {
@@ -292,14 +318,14 @@ while :; do
   fi
 
   if [ -n "${lastpid}" ]; then
-    nc localhost %[1]d >/dev/null 2>&1
+    nc %[2]s %[1]d >/dev/null 2>&1
     echo nc exited
   else
     sleep 1
   fi
 done
 `,
-				Cockroach{}.NodePort(c, nodes[i]))
+				Cockroach{}.NodePort(c, nodes[i]), c.listenHost(nodes[i]))
 
 			// Request a PTY so that the script will receive will receive a SIGPIPE
 			// when the session is closed.
@@ -599,7 +625,7 @@ func (c *SyncedCluster) RunLoad(cmd string, stdout, stderr io.Writer) error {
 		return nil, err
 	})
 
-	session, err := ssh.NewSSHSession(c.user(c.LoadGen), c.host(c.LoadGen))
+	session, err := ssh.NewSSHSession(c.user(c.LoadGen), c.host(c.LoadGen), c.sshAccess(c.LoadGen))
 	if err != nil {
 		return err
 	}
@@ -729,7 +755,11 @@ func (c *SyncedCluster) Put(src, dest string) {
 			// the internal IP address? The external address works, but it might be
 			// slower.
 			to := mkpath(i)
-			err := c.scp(from, to)
+			nodes := []int{c.Nodes[i]}
+			if srcIndex != -1 {
+				nodes = append(nodes, c.Nodes[srcIndex])
+			}
+			err := c.scp(from, to, nodes...)
 			results <- result{i, err}
 
 			if err != nil {
@@ -918,7 +948,7 @@ func (c *SyncedCluster) Get(src, dest string) {
 				return
 			}
 
-			err := c.scp(fmt.Sprintf("%s@%s:%s", c.user(c.Nodes[0]), c.host(c.Nodes[i]), src), dest)
+			err := c.scp(fmt.Sprintf("%s@%s:%s", c.user(c.Nodes[0]), c.host(c.Nodes[i]), src), dest, c.Nodes[i])
 			results <- result{i, err}
 		}(i)
 	}
@@ -1046,7 +1076,7 @@ func (c *SyncedCluster) Ssh(sshArgs, args []string) error {
 			"-o", "UserKnownHostsFile=/dev/null",
 			"-o", "StrictHostKeyChecking=no",
 		}
-		allArgs = append(allArgs, sshAuthArgs()...)
+		allArgs = append(allArgs, sshAuthArgs(c.sshAccess(c.Nodes[0]))...)
 		allArgs = append(allArgs, sshArgs...)
 		if len(args) > 0 {
 			allArgs = append(allArgs, fmt.Sprintf("export ROACHPROD=%d%s ;", c.Nodes[0], c.Tag))
@@ -1061,12 +1091,17 @@ func (c *SyncedCluster) Ssh(sshArgs, args []string) error {
 	return syscall.Exec(sshPath, allArgs, os.Environ())
 }
 
-func (c *SyncedCluster) scp(src, dest string) error {
+// scp copies src to dest, either of which is on one of the nodes.
+func (c *SyncedCluster) scp(src, dest string, nodes ...int) error {
 	args := []string{
 		"scp", "-r", "-C",
 		"-o", "StrictHostKeyChecking=no",
 	}
-	args = append(args, sshAuthArgs()...)
+	accesses := make([]vm.SSHAccess, len(nodes))
+	for i, node := range nodes {
+		accesses[i] = c.sshAccess(node)
+	}
+	args = append(args, sshAuthArgs(accesses...)...)
 	args = append(args, src, dest)
 	cmd := exec.Command(args[0], args[1:]...)
 	out, err := cmd.CombinedOutput()
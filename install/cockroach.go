@@ -159,8 +159,16 @@ func (r Cockroach) Start(c *SyncedCluster, extraArgs []string) {
 
 				var nodeNames []string
 				if c.IsLocal() {
-					// For local clusters, we only need to add one of the VM IP addresses.
-					nodeNames = append(nodeNames, "$(hostname)", c.VMs[0])
+					// For local clusters, the nodes share the loopback address unless
+					// they were given addresses of their own.
+					nodeNames = append(nodeNames, "$(hostname)")
+					seen := make(map[string]bool)
+					for _, host := range c.VMs {
+						if !seen[host] {
+							seen[host] = true
+							nodeNames = append(nodeNames, host)
+						}
+					}
 				} else {
 					// Add both the local and external IP addresses, as well as the
 					// hostnames to the node certificate.
@@ -208,7 +216,7 @@ tar cvf certs.tar certs
 				defer os.Remove(tmpfile.Name()) // clean up
 
 				if err := func() error {
-					return c.scp(fmt.Sprintf("%s@%s:certs.tar", c.user(1), c.host(1)), tmpfile.Name())
+					return c.scp(fmt.Sprintf("%s@%s:certs.tar", c.user(1), c.host(1)), tmpfile.Name(), 1)
 				}(); err != nil {
 					fmt.Fprintln(os.Stderr, err)
 					os.Exit(1)
@@ -310,11 +318,12 @@ tar cvf certs.tar certs
 			args = append(args, fmt.Sprintf("--max-sql-memory=%d%%", cache))
 		}
 		if c.IsLocal() {
-			// This avoids annoying firewall prompts on Mac OS X.
+			// Listening on the loopback address of the node avoids annoying
+			// firewall prompts on Mac OS X.
 			if VersionSatifies(vers, ">=2.1") {
-				args = append(args, "--listen-addr=127.0.0.1")
+				args = append(args, "--listen-addr="+c.host(nodes[i]))
 			} else {
-				args = append(args, "--host=127.0.0.1")
+				args = append(args, "--host="+c.host(nodes[i]))
 			}
 		}
 		args = append(args, fmt.Sprintf("--port=%d", port))
@@ -405,7 +414,7 @@ tar cvf certs.tar certs
 			cmd += `
 if ! test -e ` + dir + `/settings-initialized ; then
   COCKROACH_CONNECT_TIMEOUT=0 ` + cockroachNodeBinary(c, 1) + " sql --url " +
-				r.NodeURL(c, "localhost", r.NodePort(c, 1)) + " -e " +
+				r.NodeURL(c, c.listenHost(1), r.NodePort(c, 1)) + " -e " +
 				fmt.Sprintf(`"
 SET CLUSTER SETTING server.remote_debugging.mode = 'any';
 SET CLUSTER SETTING cluster.organization = 'Cockroach Labs - Production Testing';
@@ -474,7 +483,7 @@ func (r Cockroach) SQL(c *SyncedCluster, args []string) error {
 		if len(args) == 0 && len(c.Nodes) != 1 {
 			return fmt.Errorf("invalid number of nodes for interactive sql: %d", len(c.Nodes))
 		}
-		url := r.NodeURL(c, "localhost", r.NodePort(c, c.Nodes[0]))
+		url := r.NodeURL(c, c.listenHost(c.Nodes[0]), r.NodePort(c, c.Nodes[0]))
 		binary := cockroachNodeBinary(c, c.Nodes[0])
 		allArgs := []string{binary, "sql", "--url", url}
 		allArgs = append(allArgs, ssh.Escape(args))
@@ -503,7 +512,7 @@ func (r Cockroach) SQL(c *SyncedCluster, args []string) error {
 			cmd = fmt.Sprintf(`cd ${HOME}/local/%d ; `, c.Nodes[i])
 		}
 		cmd += cockroachNodeBinary(c, c.Nodes[i]) + " sql --url " +
-			r.NodeURL(c, "localhost", r.NodePort(c, c.Nodes[i])) + " " +
+			r.NodeURL(c, c.listenHost(c.Nodes[i]), r.NodePort(c, c.Nodes[i])) + " " +
 			ssh.Escape(args)
 
 		out, err := session.CombinedOutput(cmd)
@@ -0,0 +1,88 @@
+package install
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The lines which delimit the entries of /etc/hosts that SetupHosts manages,
+// so that they can be replaced without touching the others.
+const (
+	hostsBeginMarker = "# BEGIN roachprod internal hosts"
+	hostsEndMarker   = "# END roachprod internal hosts"
+)
+
+// resolvedDropIn is the systemd-resolved configuration in which SetupHosts
+// sets the search domain of the nodes.
+const resolvedDropIn = "/etc/systemd/resolved.conf.d/roachprod.conf"
+
+// HostsEntries returns the /etc/hosts lines which give each node of ips,
+// keyed by node, the name n<node>, as well as n<node>.<suffix> if there is a
+// suffix.
+func HostsEntries(ips map[int]string, suffix string) []string {
+	nodes := make([]int, 0, len(ips))
+	for node := range ips {
+		nodes = append(nodes, node)
+	}
+	sort.Ints(nodes)
+	ret := make([]string, len(nodes))
+	for i, node := range nodes {
+		name := fmt.Sprintf("n%d", node)
+		if suffix != "" {
+			name = fmt.Sprintf("%s.%s %s", name, suffix, name)
+		}
+		ret[i] = fmt.Sprintf("%s\t%s", ips[node], name)
+	}
+	return ret
+}
+
+// SetupHosts writes the HostsEntries of the nodes with the given private IPs
+// to /etc/hosts on each node of the cluster, replacing those of an earlier
+// call, so that the nodes resolve each other as n<node>. With a suffix, it is
+// also made the DNS search domain of the nodes, so that the other names under
+// it resolve as well.
+func (c *SyncedCluster) SetupHosts(ips map[int]string, suffix string) error {
+	if c.IsLocal() {
+		return errors.New("the local cluster has no internal host names")
+	}
+	cmd := fmt.Sprintf(`
+sudo sed -i '/^%[1]s$/,/^%[2]s$/d' /etc/hosts
+sudo tee -a /etc/hosts > /dev/null <<'EOF'
+%[1]s
+%[3]s
+%[2]s
+EOF
+`, hostsBeginMarker, hostsEndMarker, strings.Join(HostsEntries(ips, suffix), "\n"))
+	if suffix != "" {
+		cmd += fmt.Sprintf(`
+sudo mkdir -p %[1]s
+printf '[Resolve]\nDomains=%[2]s\n' | sudo tee %[3]s > /dev/null
+sudo systemctl try-restart systemd-resolved
+`, path.Dir(resolvedDropIn), suffix, resolvedDropIn)
+	} else {
+		cmd += fmt.Sprintf(`
+if [ -e %[1]s ]; then
+  sudo rm %[1]s
+  sudo systemctl try-restart systemd-resolved
+fi
+`, resolvedDropIn)
+	}
+
+	c.Parallel("writing internal hosts", len(c.Nodes), 0, func(i int) ([]byte, error) {
+		session, err := c.newSession(c.Nodes[i])
+		if err != nil {
+			return nil, err
+		}
+		defer session.Close()
+
+		if out, err := session.CombinedOutput(cmd); err != nil {
+			return nil, errors.Wrapf(err, "~ %s\n%s", cmd, out)
+		}
+		return nil, nil
+	})
+	return nil
+}
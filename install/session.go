@@ -6,9 +6,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sync"
 
 	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/vm"
 )
 
 type session interface {
@@ -29,14 +29,14 @@ type remoteSession struct {
 	cancel func()
 }
 
-func newRemoteSession(user, host string) (*remoteSession, error) {
+func newRemoteSession(user, host string, access vm.SSHAccess) (*remoteSession, error) {
 	args := []string{
 		user + "@" + host,
 		"-q",
 		"-o", "UserKnownHostsFile=/dev/null",
 		"-o", "StrictHostKeyChecking=no",
 	}
-	args = append(args, sshAuthArgs()...)
+	args = append(args, sshAuthArgs(access)...)
 	ctx, cancel := context.WithCancel(context.Background())
 	cmd := exec.CommandContext(ctx, "ssh", args...)
 	return &remoteSession{cmd, cancel}, nil
@@ -144,20 +144,33 @@ func (s *localSession) Close() error {
 	return nil
 }
 
-var sshAuthArgsVal []string
-var sshAuthArgsOnce sync.Once
-
-func sshAuthArgs() []string {
-	sshAuthArgsOnce.Do(func() {
-		paths := []string{
-			filepath.Join(config.OSUser.HomeDir, ".ssh", "id_rsa"),
-			filepath.Join(config.OSUser.HomeDir, ".ssh", "google_compute_engine"),
+// sshAuthArgs returns the -i arguments of an ssh or scp command which logs
+// into VMs reached as described by the accesses: the keys of their providers,
+// followed by config.SSHKeyPath and the default keys, those which exist.
+func sshAuthArgs(accesses ...vm.SSHAccess) []string {
+	var paths []string
+	for _, a := range accesses {
+		if a.KeyPath != "" {
+			paths = append(paths, a.KeyPath)
 		}
-		for _, p := range paths {
-			if _, err := os.Stat(p); err == nil {
-				sshAuthArgsVal = append(sshAuthArgsVal, "-i", p)
-			}
+	}
+	if config.SSHKeyPath != "" {
+		paths = append(paths, os.ExpandEnv(config.SSHKeyPath))
+	}
+	paths = append(paths,
+		filepath.Join(config.OSUser.HomeDir, ".ssh", "id_rsa"),
+		filepath.Join(config.OSUser.HomeDir, ".ssh", "google_compute_engine"),
+	)
+	var args []string
+	seen := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		if seen[p] {
+			continue
 		}
-	})
-	return sshAuthArgsVal
+		seen[p] = true
+		if _, err := os.Stat(p); err == nil {
+			args = append(args, "-i", p)
+		}
+	}
+	return args
 }
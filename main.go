@@ -1,31 +1,39 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"os/user"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
 	cld "github.com/cockroachdb/roachprod/cloud"
 	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/dns"
 	"github.com/cockroachdb/roachprod/install"
 	"github.com/cockroachdb/roachprod/ssh"
 	"github.com/cockroachdb/roachprod/ui"
 	"github.com/cockroachdb/roachprod/vm"
 	_ "github.com/cockroachdb/roachprod/vm/aws"
+	_ "github.com/cockroachdb/roachprod/vm/azure"
 	"github.com/cockroachdb/roachprod/vm/gce"
 	"github.com/cockroachdb/roachprod/vm/local"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/crypto/ssh/terminal"
 	"golang.org/x/sys/unix"
 )
@@ -52,15 +60,122 @@ destroy the cluster.
 `,
 }
 
+// accountProviders restricts the providers consulted for the active account.
+// By default, all providers that have an account are used.
+var accountProviders []string
+
+// operationTimeout bounds the duration of the commands which interact with
+// the cloud providers. Zero disables the timeout. See wrapLongCtx for the
+// commands to which it only applies if given.
+var operationTimeout time.Duration
+
+// lockWait and forceLock configure the acquisition of the cluster locks of
+// the commands which mutate clusters. See lockCluster.
+var (
+	lockWait  time.Duration
+	forceLock bool
+)
+
+// lockCluster acquires the lock of the cloud cluster for the operation (see
+// cld.LockCluster), which is held at most until --timeout elapses, or for an
+// hour without a timeout.
+func lockCluster(ctx context.Context, c *cld.CloudCluster, operation string) (func(), error) {
+	ttl := operationTimeout
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	return cld.LockCluster(ctx, c, operation, cld.LockOpts{TTL: ttl, Wait: lockWait, Force: forceLock})
+}
+
+// lockWholeCluster is like lockCluster for a cluster of which only some of
+// the nodes were selected.
+func lockWholeCluster(ctx context.Context, c *cld.CloudCluster, operation string) (func(), error) {
+	cloud, err := cld.ListCloud(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if whole, ok := cloud.Clusters[c.Name]; ok {
+		c = whole
+	}
+	return lockCluster(ctx, c, operation)
+}
+
+// logLevel is the most verbose level of the messages logged by the providers.
+var logLevel string
+
+// providerQPS is the value of the --<provider>-max-qps flag of the named
+// provider, which sets its config.ProviderMaxQPS.
+type providerQPS string
+
+var _ pflag.Value = providerQPS("")
+
+func (p providerQPS) String() string {
+	if qps, ok := config.ProviderMaxQPS[string(p)]; ok {
+		return strconv.FormatFloat(qps, 'g', -1, 64)
+	}
+	return ""
+}
+
+func (p providerQPS) Set(s string) error {
+	qps, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	config.ProviderMaxQPS[string(p)] = qps
+	return nil
+}
+
+func (p providerQPS) Type() string {
+	return "float"
+}
+
+// defaultLogLevel returns ROACHPROD_LOG_LEVEL, if set, or else info.
+func defaultLogLevel() string {
+	if level := os.Getenv("ROACHPROD_LOG_LEVEL"); level != "" {
+		return level
+	}
+	return vm.LevelInfo.String()
+}
+
+// describeDisks prints the disks of the VMs rather than their description.
+var describeDisks bool
+
+// describeNICs prints the network interfaces of the VMs rather than their
+// description.
+var describeNICs bool
+
+// describeScheduling prints the scheduling of the VMs rather than their
+// description.
+var describeScheduling bool
+
 var (
 	numNodes       int
 	numRacks       int
 	username       string
+	allUsers       bool
 	dryrun         bool
 	extendLifetime time.Duration
+	extendMine     bool
 	listDetails    bool
 	listJSON       bool
 	listMine       bool
+	listUser       string
+	listFilter     string
+	listSortBy     = "name"
+	listExpired    bool
+	listExpiring   time.Duration
+	healthJSON     bool
+	verifyJSON     bool
+	providersJSON  bool
+	createLabels   []string
+	geoWeights     []string
+	resizeMachine  string
+	sshTimeout     time.Duration
+	gcGracePeriod  time.Duration
+	gcOlderThan    time.Duration
+	gcYes          bool
+	otherUserYes   bool
+	collectPaths   = []string{"logs", "/var/crash"}
 	clusterType    = "cockroach"
 	secure         = false
 	nodeEnv        = "COCKROACH_ENABLE_RPC_COMPRESSION=false"
@@ -159,7 +274,7 @@ Hint: use "roachprod sync" to update the list of available clusters.
 // our naming pattern of "<username>-<clustername>". The
 // username must match one of the vm.Provider account names
 // or the --username override.
-func verifyClusterName(clusterName string) (string, error) {
+func verifyClusterName(ctx context.Context, clusterName string) (string, error) {
 	if len(clusterName) == 0 {
 		return "", fmt.Errorf("cluster name cannot be blank")
 	}
@@ -167,22 +282,19 @@ func verifyClusterName(clusterName string) (string, error) {
 		return clusterName, nil
 	}
 
-	// Use the vm.Provider account names, or --username.
+	// Use the vm.Provider account name, or --username.
 	var accounts []string
 	if len(username) > 0 {
 		accounts = []string{username}
 	} else {
-		seenAccounts := map[string]bool{}
-		active, err := vm.FindActiveAccounts()
+		account, err := vm.FindActiveAccount(ctx, accountProviders)
+		if mismatch, ok := err.(*vm.AccountMismatchError); ok {
+			account, err = resolveAccountMismatch(mismatch, createVMOpts.VMProviders)
+		}
 		if err != nil {
 			return "", err
 		}
-		for _, account := range active {
-			if !seenAccounts[account] {
-				seenAccounts[account] = true
-				accounts = append(accounts, account)
-			}
-		}
+		accounts = []string{account}
 	}
 
 	// If we see <account>-<something>, accept it.
@@ -191,6 +303,10 @@ func verifyClusterName(clusterName string) (string, error) {
 			return clusterName, nil
 		}
 	}
+	// With --all-users, the clusters of other users are accepted as well.
+	if i := strings.Index(clusterName, "-"); allUsers && i > 0 && i < len(clusterName)-1 {
+		return clusterName, nil
+	}
 
 	// Try to pick out a reasonable cluster name from the input.
 	i := strings.Index(clusterName, "-")
@@ -216,6 +332,142 @@ func verifyClusterName(clusterName string) (string, error) {
 		clusterName, suggestions)
 }
 
+// resolveAccountMismatch picks the account to use when the providers disagree
+// on the active account. Only a disagreement between the providers of
+// --clouds is an error; otherwise the account of those providers is used, or
+// that of the first provider which has one if none of them does.
+func resolveAccountMismatch(mismatch *vm.AccountMismatchError, clouds []string) (string, error) {
+	var account string
+	for _, name := range clouds {
+		a, ok := mismatch.Accounts[name]
+		if !ok {
+			continue
+		}
+		if account != "" && a != account {
+			return "", errors.Wrap(mismatch,
+				"use --username or --account-provider to choose the account to use")
+		}
+		account = a
+	}
+	if account == "" {
+		names := make([]string, 0, len(mismatch.Accounts))
+		for name := range mismatch.Accounts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		account = mismatch.Accounts[names[0]]
+	}
+	vm.Warningf("%s; using %s", mismatch, account)
+	return account, nil
+}
+
+// confirmOtherUser asks for confirmation before a destructive action is
+// taken on a cluster which does not belong to any of the active accounts,
+// as is possible with --username or --all-users. The confirmation is skipped
+// with --yes, and is an error when stdin is not a terminal.
+func confirmOtherUser(ctx context.Context, c *cld.CloudCluster, action string) error {
+	accounts, err := vm.FindActiveAccounts(ctx, accountProviders)
+	if err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		if account == c.User {
+			return nil
+		}
+	}
+	if otherUserYes {
+		return nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return errors.Errorf("--yes is required to %s cluster %s of %s when stdin is not a terminal",
+			action, c.Name, c.User)
+	}
+	fmt.Printf("Cluster %s belongs to %s. Are you sure you want to %s it? [y/N] ", c.Name, c.User, action)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	default:
+		return errors.Errorf("not confirmed, cluster %s was not modified", c.Name)
+	}
+}
+
+// isClusterGlob returns true if the cluster argument is a glob (see
+// path.Match), e.g. marc-test-*, rather than the name of a cluster.
+func isClusterGlob(arg string) bool {
+	return strings.ContainsAny(arg, "*?[")
+}
+
+// resolveClusters returns the cloud clusters named by the arguments, each of
+// which is the name of a cluster or a glob matching several of them. A glob
+// only matches the clusters which belong to the active accounts (or the
+// --username), whatever their names, unless --all-users is given. Each
+// cluster is returned once, in the order of the arguments, and the clusters
+// matched by a glob in the order of their names.
+func resolveClusters(ctx context.Context, cloud *cld.Cloud, args []string) ([]*cld.CloudCluster, error) {
+	var users map[string]bool
+	if !allUsers && username != "" {
+		users = map[string]bool{username: true}
+	} else if !allUsers {
+		accounts, err := vm.FindActiveAccounts(ctx, accountProviders)
+		if err != nil {
+			return nil, err
+		}
+		users = make(map[string]bool, len(accounts))
+		for _, account := range accounts {
+			users[account] = true
+		}
+	}
+
+	var ret []*cld.CloudCluster
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		var names []string
+		if isClusterGlob(arg) {
+			if _, err := path.Match(arg, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid cluster glob %s", arg)
+			}
+			for name, c := range cloud.Clusters {
+				if matched, _ := path.Match(arg, name); matched && !c.IsLocal() && (users == nil || users[c.User]) {
+					names = append(names, name)
+				}
+			}
+			if len(names) == 0 && users != nil {
+				return nil, errors.Errorf("no clusters of yours match %s; "+
+					"use --all-users to match the clusters of other users", arg)
+			} else if len(names) == 0 {
+				return nil, errors.Errorf("no clusters match %s", arg)
+			}
+			sort.Strings(names)
+		} else {
+			name, err := verifyClusterName(ctx, arg)
+			if err != nil {
+				return nil, err
+			}
+			if name == config.Local {
+				return nil, errors.New("the local cluster cannot be combined with other clusters")
+			}
+			if _, ok := cloud.Clusters[name]; !ok {
+				return nil, fmt.Errorf("cluster %s does not exist", name)
+			}
+			names = []string{name}
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				ret = append(ret, cloud.Clusters[name])
+			}
+		}
+	}
+	return ret, nil
+}
+
+// singleCluster returns true if the arguments name a single cluster, rather
+// than several clusters or a glob.
+func singleCluster(args []string) bool {
+	return len(args) == 1 && !isClusterGlob(args[0])
+}
+
 func wrap(f func(cmd *cobra.Command, args []string) error) func(cmd *cobra.Command, args []string) {
 	return func(cmd *cobra.Command, args []string) {
 		err := f(cmd, args)
@@ -226,10 +478,173 @@ func wrap(f func(cmd *cobra.Command, args []string) error) func(cmd *cobra.Comma
 	}
 }
 
+// wrapCtx is like wrap, but supplies a context which is cancelled if the
+// process is interrupted or --timeout elapses. This is used by the commands
+// which interact with the cloud providers so that in-flight requests are
+// aborted on Ctrl-C.
+func wrapCtx(
+	f func(ctx context.Context, cmd *cobra.Command, args []string) error,
+) func(cmd *cobra.Command, args []string) {
+	return wrap(func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := interruptContext()
+		defer cancel()
+		if operationTimeout <= 0 {
+			return f(ctx, cmd, args)
+		}
+		ctx, cancelTimeout := context.WithTimeout(ctx, operationTimeout)
+		inFlight := make(chan []string, 1)
+		go func() {
+			<-ctx.Done()
+			if ctx.Err() == context.DeadlineExceeded {
+				inFlight <- vm.InFlight()
+			}
+			close(inFlight)
+		}()
+		err := f(ctx, cmd, args)
+		cancelTimeout()
+		if ops, timedOut := <-inFlight; timedOut {
+			reportTimeout(ops)
+		}
+		return err
+	})
+}
+
+// wrapLongCtx is like wrapCtx for the commands whose duration grows with the
+// work they do, such as creating and setting up VMs or capturing images,
+// which only time out if --timeout is given explicitly.
+func wrapLongCtx(
+	f func(ctx context.Context, cmd *cobra.Command, args []string) error,
+) func(cmd *cobra.Command, args []string) {
+	run := wrapCtx(f)
+	return func(cmd *cobra.Command, args []string) {
+		if !cmd.Flags().Changed("timeout") {
+			operationTimeout = 0
+		}
+		run(cmd, args)
+	}
+}
+
+// reportTimeout reports that --timeout elapsed, along with the provider
+// operations which were in flight at the time.
+func reportTimeout(inFlight []string) {
+	fmt.Fprintf(os.Stderr, "timed out after %s, aborting\n", operationTimeout)
+	for _, op := range inFlight {
+		fmt.Fprintf(os.Stderr, "  still in flight: %s\n", op)
+	}
+}
+
+// interruptContext returns a context which is cancelled when the process
+// receives SIGINT or SIGTERM. After the first signal, the default signal
+// handling is restored so that a second interrupt terminates the process
+// immediately.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-ch:
+			fmt.Fprintf(os.Stderr, "received %s, aborting (interrupt again to exit immediately)\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(ch)
+	}()
+	return ctx, cancel
+}
+
 var createVMOpts vm.CreateOpts
+var createStartupScript string
+var createNodeSpecs string
+
+// createAutoRestart is only passed as vm.CreateOpts.AutoRestart if
+// --auto-restart is given.
+var createAutoRestart bool
+
+// createSpecFile is the cluster spec file of create -f.
+var createSpecFile string
+
+// createInternalDNS and createInternalDNSSuffix give the nodes of a new
+// cluster internal host names (see cld.SetInternalDNS).
+var (
+	createInternalDNS       bool
+	createInternalDNSSuffix string
+)
+
+// internalDNSSuffixRE matches the domain names which can be used as the
+// search suffix of --internal-dns-suffix.
+var internalDNSSuffixRE = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// createExistingDisks are the --existing-disk flags of create, each of which
+// is a <node>=<disk> pair.
+var createExistingDisks []string
+
+// parseExistingDiskFlags sets the ExistingDisks of createVMOpts from
+// --existing-disk. Like data disks, existing disks replace the local SSDs,
+// unless --local-ssd was given explicitly.
+func parseExistingDiskFlags(cmd *cobra.Command, nodes int) error {
+	createVMOpts.ExistingDisks = nil
+	if len(createExistingDisks) == 0 {
+		if createVMOpts.KeepExistingDisks {
+			return fmt.Errorf("--keep-existing-disks requires --existing-disk")
+		}
+		return nil
+	}
+	createVMOpts.ExistingDisks = make(map[int]string, len(createExistingDisks))
+	nodeOf := make(map[string]int, len(createExistingDisks))
+	for _, s := range createExistingDisks {
+		parts := strings.SplitN(s, "=", 2)
+		node, err := strconv.Atoi(parts[0])
+		if len(parts) != 2 || err != nil || parts[1] == "" {
+			return fmt.Errorf("invalid --existing-disk %q, expected <node>=<disk>", s)
+		}
+		if node < 1 || node > nodes {
+			return fmt.Errorf("--existing-disk %q: node %d is not in [1..%d]", s, node, nodes)
+		}
+		if _, ok := createVMOpts.ExistingDisks[node]; ok {
+			return fmt.Errorf("--existing-disk: node %d has several disks", node)
+		}
+		if other, ok := nodeOf[parts[1]]; ok {
+			return fmt.Errorf("--existing-disk: disk %s is given for nodes %d and %d", parts[1], other, node)
+		}
+		createVMOpts.ExistingDisks[node] = parts[1]
+		nodeOf[parts[1]] = node
+	}
+	if !cmd.Flags().Changed("local-ssd") {
+		createVMOpts.UseLocalSSD = false
+	}
+	return vm.ValidateDataDisks(createVMOpts)
+}
+
+// The --ingress and --ingress-cidr flags of create and clone.
+var createIngress, createIngressCIDRs []string
+
+// parseIngressFlags sets the Firewall and Ingress options of createVMOpts from
+// --ingress or --ingress-cidr, which cannot be combined.
+func parseIngressFlags() error {
+	if len(createIngress) > 0 && len(createIngressCIDRs) > 0 {
+		return fmt.Errorf("--ingress cannot be combined with --ingress-cidr")
+	}
+	createVMOpts.Ingress = nil
+	for _, s := range createIngress {
+		r, err := vm.ParseIngressRule(s)
+		if err != nil {
+			return err
+		}
+		createVMOpts.Ingress = append(createVMOpts.Ingress, r)
+	}
+	if len(createIngressCIDRs) > 0 {
+		var err error
+		if createVMOpts.Ingress, err = vm.DefaultIngressRules(createIngressCIDRs); err != nil {
+			return err
+		}
+	}
+	createVMOpts.Firewall = len(createVMOpts.Ingress) > 0
+	return nil
+}
 
 var createCmd = &cobra.Command{
-	Use:   "create <cluster>",
+	Use:   "create <cluster> | -f <spec> [<cluster>]",
 	Short: "create a cluster",
 	Long: `Create a local or cloud-based cluster.
 
@@ -253,6 +668,12 @@ Cloud Clusters
   detected and can be override by the ROACHPROD_USER environment variable or
   the --username flag.
 
+  Creating a cluster which already exists creates only its missing nodes, so
+  that a create which was interrupted or failed part-way can be rerun. The
+  existing nodes must have the machine type and preemptibility which the
+  command would give them, and the cluster must not have more nodes than
+  requested. If the rerun fails, only the nodes it created are cleaned up.
+
   The machine type and the use of local SSD storage can be specified during
   cluster creation via the --{cloud}-machine-type and --local-ssd flags. The
   machine-type is cloud specified. For example, --gce-machine-type=n1-highcpu-8
@@ -261,33 +682,159 @@ Cloud Clusters
   the cloud provider's documentation for details on the machine types
   available.
 
+  A cluster can also be described by a JSON spec file, given by -f, which can
+  be kept in version control, and single nodes can be given other machine
+  types or disks with --node-spec. See "roachprod help create-spec".
+
+  The other options of the VMs are described along with their flags in the
+  following topics:
+
+    roachprod help create-vms      machine types, zones, images and scheduling
+    roachprod help create-disks    boot disks, local SSDs, data disks and
+                                   startup scripts
+    roachprod help create-network  public IPs, bastions, firewalls, DNS and
+                                   placement
+
+  With --dry-run, the VMs which would be created are printed along with their
+  estimated hourly cost and the commands which would create them, and nothing
+  is created.
+
 Local Clusters
 
   A local cluster stores the per-node data in ${HOME}/local on the machine
   roachprod is being run on. Local clusters requires local ssh access. Unlike
   cloud clusters there can be only a single local cluster, the local cluster is
-  always named "local", and has no expiration (unlimited lifetime).
+  always named "local", and has no expiration (unlimited lifetime). Each node
+  of a local cluster listens on 127.0.0.1 using its own ports and keeps its data
+  in ${HOME}/local/<node>. With --local-addresses, node n listens on
+  127.1.1.n instead, the same address whenever the cluster is created, e.g. to
+  test tools which tell nodes apart by address. On macOS the addresses must
+  first be aliased on lo0.
 `,
-	Args: cobra.ExactArgs(1),
-	Run: wrap(func(cmd *cobra.Command, args []string) error {
+	Args: cobra.RangeArgs(0, 1),
+	Run: wrapLongCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		var spec *vm.ClusterSpec
+		if createSpecFile != "" {
+			s, err := readClusterSpec(createSpecFile, args)
+			if err != nil {
+				return err
+			}
+			spec = &s
+			args = []string{s.Name}
+			numNodes = s.Nodes
+		} else if len(args) != 1 {
+			return fmt.Errorf("a cluster name is required, unless it is given by the spec of -f")
+		}
+
 		if numNodes <= 0 || numNodes >= 1000 {
 			// Upper limit is just for safety.
 			return fmt.Errorf("number of nodes must be in [1..999]")
 		}
 
-		clusterName, err := verifyClusterName(args[0])
+		clusterName, err := verifyClusterName(ctx, args[0])
 		if err != nil {
 			return err
 		}
 
-		if clusterName != config.Local {
-			cloud, err := cld.ListCloud()
+		createVMOpts.Labels, err = vm.ParseLabels(createLabels)
+		if err != nil {
+			return err
+		}
+		if err := vm.CheckLabels(createVMOpts.Labels); err != nil {
+			return err
+		}
+		if len(geoWeights) > 0 {
+			createVMOpts.GeoWeights, err = vm.ParseGeoWeights(geoWeights)
 			if err != nil {
 				return err
 			}
-			if _, ok := cloud.Clusters[clusterName]; ok {
-				return fmt.Errorf("cluster %s already exists", clusterName)
+			createVMOpts.GeoDistributed = true
+		}
+		createVMOpts.StartupScript, err = readStartupScript(createStartupScript)
+		if err != nil {
+			return err
+		}
+		if err := checkDataDiskFlags(cmd); err != nil {
+			return err
+		}
+		if err := parseExistingDiskFlags(cmd, numNodes); err != nil {
+			return err
+		}
+		if createVMOpts.StaticIP && createVMOpts.NoPublicIP {
+			return fmt.Errorf("--static-ip cannot be combined with --no-public-ip")
+		}
+		if createVMOpts.KeepStaticIP && !createVMOpts.StaticIP {
+			return fmt.Errorf("--keep-static-ip requires --static-ip")
+		}
+		if createVMOpts.NetworkInterfaces < 1 {
+			return fmt.Errorf("--nics must be at least 1, not %d", createVMOpts.NetworkInterfaces)
+		}
+		if createVMOpts.MTU < 0 {
+			return fmt.Errorf("--mtu must not be negative")
+		}
+		if createVMOpts.NetworkTier != "" {
+			createVMOpts.NetworkTier = strings.ToUpper(createVMOpts.NetworkTier)
+			if createVMOpts.NetworkTier != vm.NetworkTierPremium && createVMOpts.NetworkTier != vm.NetworkTierStandard {
+				return fmt.Errorf("--network-tier must be one of %s, not %q",
+					strings.Join(vm.NetworkTiers, ", "), createVMOpts.NetworkTier)
+			}
+			if createVMOpts.NoPublicIP {
+				return fmt.Errorf("--network-tier cannot be combined with --no-public-ip")
+			}
+		}
+		if createVMOpts.SSHUser != "" {
+			if err := vm.ValidateSSHUser(createVMOpts.SSHUser); err != nil {
+				return err
+			}
+		}
+		if createInternalDNSSuffix != "" {
+			createInternalDNSSuffix = strings.TrimSuffix(createInternalDNSSuffix, ".")
+			if !internalDNSSuffixRE.MatchString(createInternalDNSSuffix) {
+				return fmt.Errorf("--internal-dns-suffix %q is not a domain name", createInternalDNSSuffix)
+			}
+			createInternalDNS = true
+		}
+		if createInternalDNS && clusterName == config.Local {
+			return fmt.Errorf("--internal-dns is not supported for the local cluster")
+		}
+		if err := parseIngressFlags(); err != nil {
+			return err
+		}
+		if err := vm.ValidatePlacement(createVMOpts.Placement); err != nil {
+			return err
+		}
+		if err := checkMachineSizeFlags(cmd); err != nil {
+			return err
+		}
+		if err := readNodeSpecs(createNodeSpecs); err != nil {
+			return err
+		}
+		if spec != nil {
+			createVMOpts = spec.Apply(createVMOpts)
+			if err := vm.ValidateDataDisks(createVMOpts); err != nil {
+				return errors.Wrapf(err, "cluster spec %s", createSpecFile)
+			}
+		}
+		if len(createVMOpts.GeoWeights) > 0 && len(createVMOpts.VMProviders) > 1 {
+			return fmt.Errorf("--geo-weights requires a single cloud")
+		}
+		createVMOpts.MaintenancePolicy = strings.ToUpper(createVMOpts.MaintenancePolicy)
+		if cmd.Flags().Changed("auto-restart") {
+			createVMOpts.AutoRestart = &createAutoRestart
+		}
+		if err := vm.ValidateScheduling(createVMOpts); err != nil {
+			return err
+		}
+
+		// The VMs of a cloud cluster which already exist, e.g. because a
+		// previous attempt to create it was interrupted, are kept.
+		var existing *cld.CloudCluster
+		if clusterName != config.Local {
+			cloud, err := cld.ListCloud(ctx, nil)
+			if err != nil {
+				return err
 			}
+			existing = cloud.Clusters[clusterName]
 		} else {
 			if _, ok := install.Clusters[clusterName]; ok {
 				return fmt.Errorf("cluster %s already exists", clusterName)
@@ -297,64 +844,40 @@ Local Clusters
 			createVMOpts.VMProviders = []string{local.ProviderName}
 		}
 
+		if config.DryRun {
+			fmt.Printf("Planning cluster %s with %d nodes\n", clusterName, numNodes)
+			_, err := cld.CreateCluster(ctx, clusterName, numNodes, existing, createVMOpts)
+			return err
+		}
+
 		fmt.Printf("Creating cluster %s with %d nodes\n", clusterName, numNodes)
-		if createErr := cld.CreateCluster(clusterName, numNodes, createVMOpts); createErr == nil {
+		if created, createErr := cld.CreateCluster(
+			ctx, clusterName, numNodes, existing, createVMOpts,
+		); createErr == nil {
 			fmt.Println("OK")
 		} else if clusterName == config.Local {
 			return createErr
 		} else {
 			fmt.Fprintf(os.Stderr, "Unable to create cluster:\n%s\nCleaning up...\n", createErr)
-			if err := cleanupFailedCreate(clusterName); err != nil {
+			// The create context may have been cancelled by an interrupt, but we
+			// still want to clean up. A second interrupt will abort the cleanup.
+			// The VMs which existed beforehand are kept.
+			cleanup := func(ctx context.Context) error {
+				if existing == nil {
+					return cleanupFailedCreate(ctx, clusterName)
+				}
+				return cleanupFailedGrow(ctx, clusterName, created)
+			}
+			if err := cleanup(context.Background()); err != nil {
 				fmt.Fprintf(os.Stderr, "Error while cleaning up partially-created cluster: %s\n", err)
+				fmt.Fprintf(os.Stderr, "Use \"roachprod destroy %s\" to remove any remaining VMs\n", clusterName)
 			}
 			os.Exit(1)
 		}
 
 		if clusterName != config.Local {
-			{
-				cloud, err := cld.ListCloud()
-				if err != nil {
-					return err
-				}
-
-				c, ok := cloud.Clusters[clusterName]
-				if !ok {
-					return fmt.Errorf("could not find %s in list of cluster", clusterName)
-				}
-				c.PrintDetails()
-
-				// Run ssh-keygen -R serially on each new VM in case an IP address has been recycled
-				for _, v := range c.VMs {
-					cmd := exec.Command("ssh-keygen", "-R", v.PublicIP)
-					out, err := cmd.CombinedOutput()
-					if err != nil {
-						log.Printf("could not clear ssh key for hostname %s:\n%s", v.PublicIP, string(out))
-					}
-				}
-
-				if err := syncAll(cloud, false /* quiet */); err != nil {
-					return err
-				}
-			}
-
-			{
-				// Wait for the nodes in the cluster to start.
-				install.Clusters = map[string]*install.SyncedCluster{}
-				if err := loadClusters(); err != nil {
-					return err
-				}
-
-				c, err := newCluster(clusterName, false)
-				if err != nil {
-					return err
-				}
-
-				if err := c.Wait(); err != nil {
-					return err
-				}
-				if err := c.SetupSSH(); err != nil {
-					return err
-				}
+			if err := setupCloudCluster(ctx, clusterName); err != nil {
+				return err
 			}
 		} else {
 			for i := 0; i < numNodes; i++ {
@@ -369,8 +892,315 @@ Local Clusters
 	}),
 }
 
-func cleanupFailedCreate(clusterName string) error {
-	cloud, err := cld.ListCloud()
+// The help topics of "roachprod create", which hold the details of its
+// options.
+var createSpecHelp = &cobra.Command{
+	Use:   "create-spec",
+	Short: "the cluster spec files of create -f and --node-spec",
+	Long: `A cluster can be described by a JSON spec file, given to "roachprod create -f",
+which can be kept in version control:
+
+  {"name": "marc-test", "nodes": 6, "clouds": ["gce"],
+   "zones": ["us-east1-b:3", "us-west1-b:3"], "geo": true,
+   "lifetime": "24h", "machine_type": "n2-standard-8",
+   "data_disk_count": 2, "labels": {"team": "kv"},
+   "node_specs": {"1": {"cpus": 16}}}
+
+Besides name and nodes, a spec may set clouds, zones (optionally with a node
+count each), geo, geo_weights, lifetime, labels, preemptible, the fields of
+--node-spec for all of the nodes, and node_specs for single nodes. Zones,
+geo_weights and a machine_type require a single cloud. All of the problems
+of an invalid spec are reported at once. The fields which it sets take
+precedence over the flags, which still supply the rest (e.g. --gce-project),
+and a cluster name given as an argument overrides that of the spec.
+
+Individual nodes can be given a different machine type or disks than the
+rest of the cluster with --node-spec, e.g. a bigger first node with
+--node-spec '{"1": {"cpus": 16, "disk_size": 500}}'. The spec is a JSON
+object (or the name of a file holding one) keyed by node number, whose
+values may set machine_type, cpus, mem_gb, disk_size, disk_type, local_ssd,
+local_ssd_count, data_disk_count, data_disk_size and data_disk_type; the
+other nodes, and the fields which a spec leaves out, follow the flags. A
+machine_type is used as is on every cloud, so cpus and mem_gb are better
+suited to clusters spanning clouds.
+`,
+}
+
+var createVMsHelp = &cobra.Command{
+	Use:   "create-vms",
+	Short: "the machine types, zones and images of created VMs",
+	Long: `Rather than a machine type, the --cpus and --mem-gb flags request a size, which
+each cloud maps to the closest of its machine types with that many vCPUs,
+e.g. --cpus 8 --mem-gb 32 selects n2-standard-8 on GCE, m5.2xlarge (m5d with
+--local-ssd) on AWS and Standard_D8s_v3 on Azure. Machine types whose
+memory differs from --mem-gb by more than 25% are not considered, and the
+general purpose families are preferred if --mem-gb is not given. The flags
+cannot be combined with the --{cloud}-machine-type flags.
+
+Not every machine type is offered in every zone, so the machine type is
+checked in all of the zones of the cluster before any VMs are created, and
+the regions where it is unavailable are reported. Alternatives can be given
+with --{cloud}-machine-type-fallbacks, in which case the first one offered
+is used in such zones instead.
+
+The quotas of each cloud, such as the vCPUs, in-use IP addresses and SSD
+storage of a region, are also checked against their current usage before
+any VMs are created, so that a cluster which would exceed one is not left
+half-created. The error names the quota, its region and the shortfall. The
+check can be skipped with --skip-quota-check, e.g. if the credentials lack
+access to the quotas.
+
+The default zone and machine type of each cloud can be configured with the
+ROACHPROD_GCE_ZONE, ROACHPROD_GCE_MACHINE_TYPE, ROACHPROD_AWS_ZONE,
+ROACHPROD_AWS_MACHINE_TYPE and ROACHPROD_AWS_MACHINE_TYPE_SSD environment
+variables. Flags take precedence over the environment, which takes
+precedence over the built-in defaults. The default zone is used by clusters
+which are not geo-distributed, and comes first for --geo clusters.
+
+By default, the nodes of a --geo cluster are spread evenly over the zones
+given by the --{cloud}-zones flag. An uneven distribution can be requested
+by appending a node count to each zone, e.g.
+--gce-zones=us-east1-b:3,us-west1-b:2, in which case the counts must add up
+to the number of nodes created on that cloud and --geo is implied. The zones
+are checked against the zones offered by each cloud, which are cached in
+~/.roachprod/cache for a day, before any VMs are created.
+
+The nodes can instead be distributed over regions by weight, e.g. with
+--geo-weights=us-east1=3,us-west1=1,europe-west1=1 six of ten nodes go to
+us-east1 and two to each of the others. A region is a GCE region, an AWS
+region or an Azure location, and its nodes are spread over its zones of
+--{cloud}-zones, or on AWS without --aws-zones over all of the zones of the
+region. The shares are rounded by largest remainder, ties going to the
+heavier region and then to the region named first alphabetically, and each
+cloud reports the resulting count of each region. The weights require a
+single cloud, imply --geo and cannot be combined with node counts of the
+zones.
+
+The letters of AWS zone names are assigned per account, so us-east-1a of one
+account may be us-east-1c of another. --aws-zones therefore also accepts the
+IDs of availability zones, e.g. --aws-zones=use1-az1:3,usw2-az2:3, which
+name the same zone in every account and are mapped to the zone names of the
+account before the VMs are created, so that geo-distributed tests are
+placed alike across accounts. The IDs must be in the configured regions.
+
+The project, account or subscription in which the VMs are created, listed
+and deleted is selected by --gce-project (or its alias --gcp-project),
+--aws-account-profile (a named profile of the AWS CLI) and
+--azure-subscription, without changing the configuration of the clouds'
+CLIs. Each is checked to be accessible before it is used.
+
+The VMs boot from Ubuntu 16.04 by default. Another OS image can be chosen
+with --gce-os-image (an image name, or family/<name> for the latest image of
+a family, in --gce-os-image-project) and with --aws-os-image (an AMI name
+pattern, matched against the AMIs of --aws-os-image-owner). The image is
+checked to be available before any VMs are created, and the resolved image
+is shown as "os_image" by "roachprod list --json".
+
+With --gce-template or --aws-template, the VMs are created from a GCE
+instance template or an EC2 launch template (which must exist in each
+region), and roachprod only sets their names, zones and labels. The template
+determines everything else, so it has to prepare /mnt/data1 itself. Flags
+with defaults, such as the machine type and --local-ssd, are overridden by
+the template, while --disk-size, --disk-type, --data-disk-count, --gpu-count,
+--image, --no-public-ip, --preemptible and --startup-script are errors.
+
+Azure clusters (--clouds=azure) require the az tool to be logged in via "az
+login". The VMs of a cluster in each location are kept in a resource group
+named <cluster>-<location>, which is deleted with the last of them. Azure
+zones are a location optionally followed by an availability zone, e.g.
+eastus2 or eastus2-1, and default to ROACHPROD_AZURE_ZONE if set, as does
+the machine type to ROACHPROD_AZURE_MACHINE_TYPE.
+
+The --gce-service-account and --aws-iam-profile flags attach a service
+account or IAM instance profile to the VMs, so that cockroach can access
+cloud storage (e.g. for backups) without credentials on the VMs. They
+default to the GCE_SERVICE_ACCOUNT and ROACHPROD_AWS_IAM_PROFILE environment
+variables, and are checked to exist before any VMs are created.
+
+The --preemptible flag requests preemptible (GCE) or spot (AWS) instances,
+which are considerably cheaper but may be reclaimed by the cloud provider at
+any time, regardless of the cluster's --lifetime. GCE additionally stops
+preemptible instances after 24 hours, so longer lifetimes are rejected. The
+maximum spot price on AWS may be set via --aws-spot-max-price.
+
+GPUs can be attached to the VMs with the --gpu-count and --gpu-type flags.
+GPU types use the GCE accelerator names (e.g. nvidia-tesla-v100). On AWS,
+GPUs are only available via dedicated instance families, so the instance type
+providing the requested GPUs is used instead of --aws-machine-type.
+
+What happens to the VMs when their host is under maintenance or fails can
+be set with --maintenance-policy and --auto-restart, e.g. for long-lived
+clusters. On GCE, MIGRATE live-migrates the VMs to another host and
+TERMINATE stops them, after which they are restarted unless
+--auto-restart=false; preemptible VMs and VMs with GPUs are always
+terminated and preemptible VMs never restarted, so other combinations are
+rejected. On AWS, --auto-restart sets the automatic recovery of the VMs to
+another host, if their instance type supports it. The VMs added by
+"roachprod grow" are scheduled like the existing ones. "roachprod describe
+--scheduling" shows the current scheduling of the VMs.
+
+Security-hardened VMs can be requested with --gce-shielded, which creates
+Shielded VMs with secure boot, a virtual TPM and integrity monitoring from a
+UEFI-compatible image, and with --aws-enclave, which enables Nitro Enclaves
+on instance types that support them. The images and instance types are
+checked before any VMs are created, and the option is recorded in the
+"security" metadata of the VMs (see "roachprod metadata").
+
+Arbitrary key=value labels (GCE) or tags (AWS) can be attached to the VMs
+with the repeatable --label flag. GCE label keys and values are lower-cased
+and must otherwise conform to the character set allowed by each cloud.
+roachprod itself labels every VM with the user and time which created it,
+the version of roachprod (roachprod-version) and the host it ran on
+(roachprod-host), whose keys cannot be given via --label.
+
+The --ssh-user flag picks the user as which roachprod logs into the VMs,
+e.g. for OS images without the usual user. It must exist on the image on
+AWS, while GCE and Azure create it. By default AWS uses the user of the
+distribution of --aws-os-image, e.g. ec2-user for Amazon Linux, and the
+others use ubuntu on Azure and the local user on GCE. The user is recorded
+on the VMs, which "roachprod list", "ssh" and the other commands use, as do
+the VMs added by "roachprod grow". --aws-user and --azure-user take
+precedence.
+`,
+}
+
+var createDisksHelp = &cobra.Command{
+	Use:   "create-disks",
+	Short: "the disks of created VMs",
+	Long: `The boot disk holds the OS, logs and core dumps and can be enlarged with the
+--disk-size and --disk-type flags. With --local-ssd, the cockroach data
+directory is on the local SSDs. Otherwise it is on a separate EBS volume on
+AWS, and on the boot disk on GCE. Several local SSDs can be requested with
+--local-ssd-count, in which case they are striped into a single RAID 0
+volume. GCE supports 1-8, 16 or 24 local SSDs, while on AWS the count is
+fixed by the --aws-machine-type-ssd instance type. The boot disk of VMs
+created from an --image cannot be changed on GCE.
+
+Unlike local SSDs, persistent data disks keep their data across reboots.
+--data-disk-count attaches that many disks of --data-disk-size and
+--data-disk-type (by default 500GB of pd-ssd on GCE and of gp2 on AWS),
+which hold the cockroach data directory in place of the local SSDs and are
+striped like them. --local-ssd is therefore turned off, and passing both
+flags is an error. The data disks are deleted along with the VMs.
+
+The repeatable --existing-disk flag attaches a disk which already exists,
+e.g. one kept from an earlier cluster, to a node: --existing-disk 2=my-disk
+for a GCE disk, or --existing-disk 2=vol-0123456789abcdef0 for an EBS
+volume. The disk must be in the zone of its node and must not be attached
+to another VM. It is mounted as the data directory of its node at
+/mnt/data1, keeping its data, and is only formatted if it has no filesystem.
+As with --data-disk-count, --local-ssd is turned off unless it is given
+explicitly, and the two kinds of disks cannot be combined. Existing disks
+are deleted along with the VMs, unless --keep-existing-disks keeps them for
+the next cluster.
+
+The --startup-script flag runs a script as root when each VM first boots,
+after its disks have been set up. The flag is either @<file>, the file
+containing the script, or inline:<script>, the script itself. Without a
+prefix, the flag names a file if one exists, and is otherwise the script
+itself if it has more than one word. It may refer to the cluster
+name and node index as {{.Cluster}} and {{.Node}}. The output of the script
+is written to /var/log/roachprod-startup-script.log on each VM, e.g.
+"roachprod run <cluster> cat /var/log/roachprod-startup-script.log".
+Together with roachprod's own setup, the script may be at most 256 KiB on
+GCE and 16 KiB on AWS, where it is passed as the instance's user-data.
+`,
+}
+
+var createNetworkHelp = &cobra.Command{
+	Use:   "create-network",
+	Short: "the networking of created VMs",
+	Long: `With --no-public-ip, the VMs are created without external addresses and
+roachprod connects to them at their private IPs instead. roachprod must then
+either be run from a host within the VMs' network or reach them through a
+bastion host given by --bastion (or per provider by --gce-bastion,
+--aws-bastion and --azure-bastion), and the network needs a NAT gateway (or
+equivalent) for the VMs to install packages when they boot. Nodes added by
+"roachprod grow" or "roachprod clone" have public IPs only if the existing
+nodes do.
+
+The bastion is a host[:port] reached as --bastion-user with --bastion-key.
+"roachprod sync", which also runs after create, adds a ProxyCommand for the
+private IPs of the VMs to ~/.ssh/config, so that a plain ssh reaches them
+through the bastion. The section is removed once no private VMs remain.
+
+The --static-ip flag reserves a static external IP for each VM (a GCE
+address or an AWS Elastic IP) named <cluster>-<node>-ip. The addresses are
+released when the cluster is destroyed, unless --keep-static-ip is given, in
+which case a cluster created later with the same name and --static-ip reuses
+them, so that its DNS records do not change. Kept addresses are billed while
+they are unused. Static IPs are subject to a per-region quota, and none are
+kept if the cluster cannot be created because it is exhausted.
+
+The --ingress-cidr flag puts the cluster behind a firewall of its own (GCE
+firewall rules for the instances tagged <cluster>-fw, or an AWS security
+group of that name in place of --aws-sg), which admits connections between
+the VMs of the cluster and, from each of the given CIDRs, to ports 22, 26257
+and 8080. The repeatable --ingress flag instead takes the complete set of
+rules as <port>[-<port>]@<cidr>, e.g. --ingress 26257@203.0.113.0/24. All
+other ingress is denied. VMs added by "roachprod grow" join the firewall,
+which is deleted along with the last VM of the cluster.
+
+The --mtu flag sets the MTU of the network interfaces of the VMs, at boot,
+up to that of their network: 9001 on AWS, and the MTU of the default VPC
+network on GCE (1460 unless it was changed). The --nics flag gives each VM
+additional network interfaces, as many as its machine type allows in its
+zone. On GCE each additional interface needs a subnet in another VPC
+network, given in order by --gce-nic-subnets. On AWS the interfaces share
+the subnet of the VM, and EC2 only assigns public IPs to VMs with a single
+interface, so several require --no-public-ip. "roachprod describe --nics"
+shows the interfaces.
+
+The --network-tier flag picks the network tier of the public IPs on GCE:
+STANDARD costs less for egress, while PREMIUM, the default of most
+projects, has lower latency. VMs added by "roachprod grow" get the tier of
+the existing VMs. The other providers have no tiers and reject the flag
+(see "roachprod providers").
+
+The --internal-dns flag lets the nodes resolve each other by stable host
+names, e.g. for cockroach's --advertise-addr: each node's /etc/hosts maps
+n1, n2, ... to the private IPs of the nodes. --internal-dns-suffix also
+names them n1.<suffix>, ... and makes the suffix the DNS search domain of
+the nodes. The setting is kept in the "internal-dns" metadata of the first
+VM, and the names are written again when "roachprod grow" adds nodes and
+when "roachprod start" or "roachprod refresh" find that addresses changed.
+They disappear along with the VMs.
+
+The --placement=spread flag launches the VMs into a placement group of the
+cluster named <cluster>-pg, which puts them on distinct hardware so that a
+single host or rack failure takes out at most one of them: an AWS spread
+placement group, a GCE spread placement policy, or an Azure availability
+set. AWS spread placement groups hold at most 7 instances per zone, and
+Azure availability sets cannot be combined with availability zones. The
+policy is recorded in the roachprod-placement label of the VMs; those added
+by "roachprod grow" join the placement group, which is deleted along with
+the last VM of the cluster.
+`,
+}
+
+// checkMachineSizeFlags verifies that --cpus and --mem-gb, which request a
+// machine size, were not combined with flags which select a machine type.
+func checkMachineSizeFlags(cmd *cobra.Command) error {
+	size := createVMOpts.Size
+	switch {
+	case size.CPUs < 0 || size.MemoryGB < 0:
+		return fmt.Errorf("--cpus and --mem-gb must not be negative")
+	case size.MemoryGB > 0 && size.CPUs == 0:
+		return fmt.Errorf("--mem-gb requires --cpus")
+	case size.IsZero():
+		return nil
+	}
+	var err error
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if strings.HasSuffix(f.Name, "machine-type") && err == nil {
+			err = fmt.Errorf("--cpus cannot be combined with --%s", f.Name)
+		}
+	})
+	return err
+}
+
+func cleanupFailedCreate(ctx context.Context, clusterName string) error {
+	cloud, err := cld.ListCloud(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -380,28 +1210,397 @@ func cleanupFailedCreate(clusterName string) error {
 		// before failing. Not an error.
 		return nil
 	}
-	return cld.DestroyCluster(c)
+	return cld.DestroyCluster(ctx, c)
 }
 
-var destroyCmd = &cobra.Command{
-	Use:   "destroy <cluster>",
-	Short: "destroy a cluster",
-	Long: `Destroy a local or cloud-based cluster.
+// cleanupFailedGrow destroys the VMs with the given names, which were being
+// added to the cluster when growing it failed.
+func cleanupFailedGrow(ctx context.Context, clusterName string, names []string) error {
+	cloud, err := cld.ListCloud(ctx, nil)
+	if err != nil {
+		return err
+	}
+	c, ok := cloud.Clusters[clusterName]
+	if !ok {
+		return nil
+	}
+	added := make(map[string]bool, len(names))
+	for _, name := range names {
+		added[name] = true
+	}
+	var vms vm.List
+	for _, v := range c.VMs {
+		if added[v.Name] {
+			vms = append(vms, v)
+		}
+	}
+	return cld.DestroyCluster(ctx, &cld.CloudCluster{
+		Cluster: vm.Cluster{Name: c.Name, User: c.User, VMs: vms},
+	})
+}
 
-Destroying a cluster releases the resources for a cluster. For a cloud-based
-cluster the machine and associated disk resources are freed. For a local
-cluster, any processes started by roachprod are stopped, and the ${HOME}/local
+// setupCloudCluster prepares newly-created VMs in the cluster for use: the
+// hosts files are synced, and we wait for the nodes to start before
+// distributing ssh keys.
+func setupCloudCluster(ctx context.Context, clusterName string) error {
+	{
+		cloud, err := cld.ListCloud(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		c, ok := cloud.Clusters[clusterName]
+		if !ok {
+			return fmt.Errorf("could not find %s in list of cluster", clusterName)
+		}
+		if err := cld.RegisterClusterDNS(ctx, c); err != nil {
+			return errors.Wrap(err, "unable to register DNS records")
+		}
+		if createInternalDNS {
+			if err := cld.SetInternalDNS(ctx, c, createInternalDNSSuffix); err != nil {
+				return err
+			}
+		}
+		c.PrintDetails()
+
+		// Run ssh-keygen -R serially on each new VM in case an IP address has been recycled
+		for _, v := range c.VMs {
+			cmd := exec.Command("ssh-keygen", "-R", v.Host())
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				log.Printf("could not clear ssh key for hostname %s:\n%s", v.Host(), string(out))
+			}
+		}
+
+		if err := syncAll(ctx, cloud, false /* quiet */); err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: waiting for ssh\n", clusterName)
+		if err := vm.WaitForSSH(ctx, c.VMs, sshTimeout); err != nil {
+			return err
+		}
+	}
+
+	// Wait for the nodes in the cluster to start.
+	install.Clusters = map[string]*install.SyncedCluster{}
+	if err := loadClusters(); err != nil {
+		return err
+	}
+
+	c, err := newCluster(clusterName, false)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Wait(); err != nil {
+		return err
+	}
+	if err := c.SetupSSH(); err != nil {
+		return err
+	}
+	return setupInternalDNS(ctx, clusterName)
+}
+
+// setupInternalDNS writes the internal host names of the nodes of the cluster
+// to each of them, if the cluster was created with --internal-dns. The synced
+// clusters must be loaded.
+func setupInternalDNS(ctx context.Context, clusterName string) error {
+	cloud, err := cld.ListCloud(ctx, nil)
+	if err != nil {
+		return err
+	}
+	cc, ok := cloud.Clusters[clusterName]
+	if !ok {
+		return fmt.Errorf("could not find %s in list of cluster", clusterName)
+	}
+	suffix, enabled, err := cld.InternalDNS(ctx, cc)
+	if err != nil || !enabled {
+		return err
+	}
+	ips, err := cld.InternalHosts(cc)
+	if err != nil {
+		return err
+	}
+	if err := vm.WaitForSSH(ctx, cc.VMs, sshTimeout); err != nil {
+		return err
+	}
+	c, err := newCluster(clusterName, false)
+	if err != nil {
+		return err
+	}
+	return c.SetupHosts(ips, suffix)
+}
+
+// explainNotRunning annotates an error from running a command on the cluster
+// with the VMs which are not running, which is the most likely cause.
+func explainNotRunning(clusterName string, err error) error {
+	if err == nil || clusterName == config.Local {
+		return err
+	}
+	cloud, listErr := cld.ListCloud(context.Background(), nil)
+	if listErr != nil {
+		return err
+	}
+	c, ok := cloud.Clusters[clusterName]
+	if !ok {
+		return err
+	}
+	var notRunning []string
+	for _, v := range c.VMs {
+		if v.Status != vm.StatusRunning {
+			notRunning = append(notRunning, fmt.Sprintf("%s (%s)", v.Name, v.Status))
+		}
+	}
+	if len(notRunning) == 0 {
+		return err
+	}
+	return errors.Wrapf(err, "not all VMs are running: %s", strings.Join(notRunning, ", "))
+}
+
+// cloudClusterWithNodes looks up the cloud cluster named by arg, which may
+// include a :<nodes> suffix, and returns a copy of the cluster that only
+// contains the specified VMs.
+func cloudClusterWithNodes(ctx context.Context, arg string) (*cld.CloudCluster, error) {
+	name, nodeNames := arg, "all"
+	if i := strings.Index(arg, ":"); i != -1 {
+		name, nodeNames = arg[:i], arg[i+1:]
+	}
+
+	clusterName, err := verifyClusterName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if clusterName == config.Local {
+		return nil, fmt.Errorf("operation is not supported on the local cluster")
+	}
+
+	// The names of the VMs of a synced cluster are known, so only they are
+	// looked up on the providers which the cluster spans.
+	if synced, ok := install.Clusters[clusterName]; ok && syncedNamesKnown(synced) {
+		vmNames, err := syncedVMNames(synced, nodeNames)
+		if err != nil {
+			return nil, err
+		}
+		c, err := cld.ResolveCluster(ctx, clusterName, vmNames, syncedProviders(synced))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to find the VMs of cluster %s, which may need a roachprod sync", clusterName)
+		}
+		return c, nil
+	}
+
+	cloud, err := cld.ListCloud(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := cloud.Clusters[clusterName]
+	if !ok {
+		return nil, fmt.Errorf("cluster %s does not exist", clusterName)
+	}
+
+	nodes, err := install.ListNodes(nodeNames, len(c.VMs))
+	if err != nil {
+		return nil, err
+	}
+	subset := *c
+	subset.VMs = make(vm.List, 0, len(nodes))
+	for _, n := range nodes {
+		if n < 1 || n > len(c.VMs) {
+			return nil, fmt.Errorf("invalid node %d for cluster %s with %d nodes", n, clusterName, len(c.VMs))
+		}
+		subset.VMs = append(subset.VMs, c.VMs[n-1])
+	}
+	return &subset, nil
+}
+
+// syncedNamesKnown returns true if the hosts file of the synced cluster
+// records the names of all of its VMs.
+func syncedNamesKnown(c *install.SyncedCluster) bool {
+	for _, name := range c.VMNames {
+		if name == "" {
+			return false
+		}
+	}
+	return len(c.VMNames) > 0
+}
+
+// syncedVMNames returns the names of the VMs of the synced cluster which the
+// node list selects. The nodes are numbered by the position of their VMs in
+// the cluster, as for "roachprod run", rather than by their names, which
+// differ once a node has been removed.
+func syncedVMNames(c *install.SyncedCluster, nodeNames string) ([]string, error) {
+	nodes, err := install.ListNodes(nodeNames, len(c.VMNames))
+	if err != nil {
+		return nil, err
+	}
+	vmNames := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		if n < 1 || n > len(c.VMNames) {
+			return nil, fmt.Errorf("invalid node %d for cluster %s with %d nodes", n, c.Name, len(c.VMNames))
+		}
+		vmNames = append(vmNames, c.VMNames[n-1])
+	}
+	return vmNames, nil
+}
+
+// syncedProviders returns the providers named by the cloud= tier of the
+// localities of the synced cluster, or all of the providers if none are.
+func syncedProviders(c *install.SyncedCluster) []string {
+	seen := make(map[string]bool)
+	var providers []string
+	for _, locality := range c.Localities {
+		for _, tier := range strings.Split(locality, ",") {
+			if p := strings.TrimPrefix(tier, "cloud="); p != tier && !seen[p] {
+				seen[p] = true
+				providers = append(providers, p)
+			}
+		}
+	}
+	if len(providers) == 0 {
+		return vm.AllProviderNames()
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// readStartupScript returns the startup script of the flag, which is either
+// @<file>, inline:<script>, or, without a prefix, the name of an existing file
+// or a script of more than one word. A single word which names no file is
+// rejected, since it is more likely a mistyped file name than a script.
+func readStartupScript(flag string) (string, error) {
+	switch {
+	case flag == "":
+		return "", nil
+	case strings.HasPrefix(flag, "inline:"):
+		return strings.TrimPrefix(flag, "inline:"), nil
+	case strings.HasPrefix(flag, "@"):
+		script, err := ioutil.ReadFile(strings.TrimPrefix(flag, "@"))
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to read startup script")
+		}
+		return string(script), nil
+	}
+	script, err := ioutil.ReadFile(flag)
+	if os.IsNotExist(err) {
+		if len(strings.Fields(flag)) <= 1 {
+			return "", errors.Errorf("startup script file %s does not exist; "+
+				"use inline:%s if it is the script itself", flag, flag)
+		}
+		return flag, nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "unable to read startup script")
+	}
+	return string(script), nil
+}
+
+// readClusterSpec reads the cluster spec of create -f from the named file, or
+// from stdin if it is "-". The name of the cluster, if given as an argument,
+// overrides that of the spec, so that one spec can describe several clusters.
+func readClusterSpec(filename string, args []string) (vm.ClusterSpec, error) {
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return vm.ClusterSpec{}, errors.Wrapf(err, "unable to read cluster spec")
+	}
+	spec, err := vm.ParseClusterSpec(data)
+	if err != nil {
+		return vm.ClusterSpec{}, errors.Wrapf(err, "%s", filename)
+	}
+	if len(args) > 0 {
+		spec.Name = args[0]
+	}
+	if spec.Name == "" {
+		return vm.ClusterSpec{}, fmt.Errorf("%s: the cluster spec has no name, and none was given", filename)
+	}
+	return spec, nil
+}
+
+// readNodeSpecs sets the NodeSpecs of createVMOpts from --node-spec, which is
+// either the name of a JSON file or the JSON itself, and validates the disks
+// of each node.
+func readNodeSpecs(flag string) error {
+	if flag == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(flag)
+	if os.IsNotExist(err) {
+		data = []byte(flag)
+	} else if err != nil {
+		return errors.Wrapf(err, "unable to read node specs")
+	}
+	if createVMOpts.NodeSpecs, err = vm.ParseNodeSpecs(data); err != nil {
+		return err
+	}
+	for node, spec := range createVMOpts.NodeSpecs {
+		if err := vm.ValidateDataDisks(spec.Apply(createVMOpts)); err != nil {
+			return errors.Wrapf(err, "node spec of node %d", node)
+		}
+	}
+	return nil
+}
+
+// checkDataDiskFlags reconciles --data-disk-count with --local-ssd, which is
+// on by default: data disks replace the local SSDs, unless both were
+// requested explicitly.
+func checkDataDiskFlags(cmd *cobra.Command) error {
+	if createVMOpts.DataDiskCount > 0 {
+		if cmd.Flags().Changed("local-ssd") && createVMOpts.UseLocalSSD {
+			return errors.New("--data-disk-count cannot be combined with --local-ssd")
+		}
+		createVMOpts.UseLocalSSD = false
+	}
+	return vm.ValidateDataDisks(createVMOpts)
+}
+
+var destroyCmd = &cobra.Command{
+	Use:   "destroy <cluster>...",
+	Short: "destroy clusters",
+	Long: `Destroy a local or cloud-based cluster.
+
+Destroying a cluster releases the resources for a cluster. For a cloud-based
+cluster the machine and associated disk resources are freed. For a local
+cluster, any processes started by roachprod are stopped, and the ${HOME}/local
 directory is removed.
+
+Clusters are named after the user who owns them. The clusters of other users,
+e.g. a teammate's, can be operated on by passing their name via --username, or
+with --all-users. Destroying, shrinking, rebooting or resizing another user's
+cluster asks for confirmation first, unless --yes is given.
+
+Several cloud-based clusters can be destroyed together by naming each of them,
+or with a glob, which are destroyed in parallel:
+
+  roachprod destroy marc-test-*
+
+A glob only matches your own clusters, even if it would match the names of
+other users' clusters, unless --all-users is given. The result is reported for
+each cluster.
+
+While a cloud-based cluster is destroyed, extended, grown, shrunk, resized or
+has its preempted nodes recreated, roachprod holds a lock on it, so that two
+users cannot mutate a shared cluster at once. The lock is kept in the "lock"
+metadata of the first node (see "roachprod metadata") and expires with
+--timeout, or after an hour without one. A command which finds the cluster
+locked reports who holds the lock and fails, unless --lock-wait gives it time
+to wait for the lock to be released. --force-lock overrides the lock.
 `,
-	Args: cobra.ExactArgs(1),
-	Run: wrap(func(cmd *cobra.Command, args []string) error {
-		clusterName, err := verifyClusterName(args[0])
+	Args: cobra.MinimumNArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		if !singleCluster(args) {
+			return destroyClusters(ctx, args)
+		}
+		clusterName, err := verifyClusterName(ctx, args[0])
 		if err != nil {
 			return err
 		}
 
 		if clusterName != config.Local {
-			cloud, err := cld.ListCloud()
+			cloud, err := cld.ListCloud(ctx, nil)
 			if err != nil {
 				return err
 			}
@@ -410,11 +1609,26 @@ directory is removed.
 			if !ok {
 				return fmt.Errorf("cluster %s does not exist", clusterName)
 			}
+			if err := confirmOtherUser(ctx, c, "destroy"); err != nil {
+				return err
+			}
+			unlock, err := lockCluster(ctx, c, "destroy")
+			if err != nil {
+				return err
+			}
+			defer unlock()
+
+			if config.DryRun {
+				fmt.Printf("Planning the destruction of cluster %s with %d nodes\n", clusterName, len(c.VMs))
+				return cld.DestroyCluster(ctx, c)
+			}
 
 			fmt.Printf("Destroying cluster %s with %d nodes\n", clusterName, len(c.VMs))
-			if err := cld.DestroyCluster(c); err != nil {
+			if err := cld.DestroyCluster(ctx, c); err != nil {
 				return err
 			}
+		} else if config.DryRun {
+			return errors.New("--dry-run is not supported when destroying the local cluster")
 		} else {
 			if _, ok := install.Clusters[clusterName]; !ok {
 				return fmt.Errorf("cluster %s does not exist", clusterName)
@@ -434,296 +1648,1743 @@ directory is removed.
 				return err
 			}
 		}
-
+
+		fmt.Println("OK")
+		return nil
+	}),
+}
+
+// destroyClusters destroys the cloud clusters named by the arguments (see
+// resolveClusters), reporting the result for each of them.
+func destroyClusters(ctx context.Context, args []string) error {
+	cloud, err := cld.ListCloud(ctx, nil)
+	if err != nil {
+		return err
+	}
+	clusters, err := resolveClusters(ctx, cloud, args)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(clusters))
+	nodes := 0
+	for i, c := range clusters {
+		if err := confirmOtherUser(ctx, c, "destroy"); err != nil {
+			return err
+		}
+		names[i] = c.Name
+		nodes += len(c.VMs)
+	}
+	// The clusters which are locked by other users are left alone.
+	lockErrs := make(map[string]error)
+	var locked []*cld.CloudCluster
+	for _, c := range clusters {
+		unlock, err := lockCluster(ctx, c, "destroy")
+		if err != nil {
+			lockErrs[c.Name] = err
+			continue
+		}
+		defer unlock()
+		locked = append(locked, c)
+	}
+
+	verb := "Destroying"
+	if config.DryRun {
+		verb = "Planning the destruction of"
+	}
+	fmt.Printf("%s %d clusters with %d nodes: %s\n", verb, len(clusters), nodes, strings.Join(names, ", "))
+	errs := cld.DestroyClusters(ctx, locked)
+	if config.DryRun {
+		return nil
+	}
+	for name, err := range lockErrs {
+		errs[name] = err
+	}
+	for _, name := range names {
+		if err, ok := errs[name]; ok {
+			fmt.Printf("%s: failed: %v\n", name, err)
+		} else {
+			fmt.Printf("%s: destroyed\n", name)
+		}
+	}
+	fmt.Printf("destroyed %d of %d clusters\n", len(names)-len(errs), len(names))
+	if len(errs) > 0 {
+		return errors.Errorf("failed to destroy %d clusters", len(errs))
+	}
+	return nil
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list [--details] [--filter <labels>] [--expired | --expiring-within <duration>] [ --mine | --user <user> | <cluster name regex>... ]",
+	Short: "list all clusters",
+	Long: `List all clusters.
+
+The list command accepts optional positional arguments, which are regular
+expressions that will be matched against the cluster name pattern. A cluster
+is listed if its name matches any of them.  Alternatively,
+the --mine flag can be provided to list the clusters that are owned by the current
+user, or the --user flag to list the clusters of another user.
+
+The default output shows one line per cluster, including the local cluster if
+it exists:
+
+  ~ roachprod list
+  local:     [local]    1  (-)
+  marc-test: [aws gce]  4  (5h34m35s remaining)
+  Syncing...
+
+The second column lists the cloud providers that host VMs for the cluster.
+
+The third and fourth columns are the number of nodes in the cluster and the
+time remaining before the cluster will be automatically destroyed. Clusters
+which have expired or will expire within the hour are marked EXPIRED or
+EXPIRING SOON. Note that local clusters do not have an expiration, and neither
+do clusters whose VMs have no lifetime (see the "could not determine
+expiration" errors in the --details output).
+
+The --sort-by flag orders the clusters by "name" (the default) or by "expiry",
+in which case the clusters expiring first are listed first.
+
+The --expired flag lists only the clusters whose lifetime has elapsed, and
+--expiring-within=<duration> additionally those whose lifetime elapses within
+the duration, e.g. --expiring-within=2h. Clusters are considered to expire at
+their creation time plus their lifetime, while the GC may take up to an hour
+longer to destroy them. The clusters whose expiration is unknown are named on
+stderr instead, or as "no_expiration" with --json:
+
+  ~ roachprod list --expiring-within=2h --json | jq -r '.clusters | keys[]'
+
+The --details flag adjusts the output format to include per-node details:
+
+  ~ roachprod list --details
+  local [local]: (no expiration)
+    local-0001		127.0.0.1	127.0.0.1	running
+  marc-test: [aws gce] 5h33m57s remaining
+    marc-test-0001	marc-test-0001.us-east1-b.cockroach-ephemeral	10.142.0.18	35.229.60.91	running
+    marc-test-0002	marc-test-0002.us-east1-b.cockroach-ephemeral	10.142.0.17	35.231.0.44	running
+    marc-test-0003	marc-test-0003.us-east1-b.cockroach-ephemeral	10.142.0.19	35.229.111.100	running
+    marc-test-0004	marc-test-0004.us-east1-b.cockroach-ephemeral	10.142.0.20	35.231.102.125	running
+  Syncing...
+
+The first and second column are the node hostname and fully qualified name
+respectively. The third and fourth column are the private and public IP
+addresses. The fifth column is the status of the node: pending, running,
+stopped, terminating or unknown. The sixth column lists the labels attached to
+the node, if any, among which roachprod-version and roachprod-host record the
+version of roachprod that created the node and the host it ran on.
+
+The --json flag sets the format of the command output to json. The output
+contains the matching clusters, keyed by name, along with any instances that
+could not be associated with a cluster. Clusters and VMs include the time at
+which they expire as "expires_at", which is null if they have no expiration:
+
+  ~ roachprod list --json | jq '.clusters[].vms[].public_ip'
+
+Durations (e.g. "lifetime") are rendered as integral nanoseconds and instance
+errors are rendered as a list of objects with a "message" and a stable "code",
+such as no_expiration, bad_lifetime, bad_network, invalid_name,
+no_machine_type or unknown_price (or unknown). No other output is written to
+stdout when --json is specified.
+
+The --filter flag restricts the output to the VMs whose labels (GCE) or tags
+(AWS) match all of the given comma-separated clauses. Each clause is of the form
+key=value, and may be negated with a leading "!":
+
+  ~ roachprod list --filter 'team=kv,!purpose=perf'
+
+Every VM is labeled with the user that created it (roachprod-user), its cluster
+(roachprod-cluster) and its creation time in UTC (roachprod-created), so that
+stray VMs can be attributed:
+
+  ~ roachprod list --details --filter roachprod-user=marc
+
+Listing clusters has the side-effect of syncing ssh keys/configs and the local
+hosts file, unless --filter is specified.
+
+The VMs listed by each cloud are cached in ~/.roachprod/cache. With --cached,
+a cloud is not queried again if it was listed within --cache-ttl, which makes
+repeated listings considerably faster. The cache of a cloud is dropped by
+roachprod commands which change its VMs, but not by changes made by others.
+`,
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		if listMine && listUser != "" {
+			return errors.New("--mine cannot be combined with --user")
+		}
+		listPatterns := []*regexp.Regexp{regexp.MustCompile(".*")}
+		switch len(args) {
+		case 0:
+			if listUser != "" {
+				listPatterns[0] = regexp.MustCompile(fmt.Sprintf("^%s-", regexp.QuoteMeta(listUser)))
+			} else if listMine {
+				// In general, we expect that users will have the same
+				// account name across the services they're using,
+				// but we still want to function even if this is not
+				// the case.
+				seenAccounts := map[string]bool{}
+				accounts, err := vm.FindActiveAccounts(ctx, accountProviders)
+				if err != nil {
+					return err
+				}
+				pattern := ""
+				for _, account := range accounts {
+					if !seenAccounts[account] {
+						seenAccounts[account] = true
+						if len(pattern) > 0 {
+							pattern += "|"
+						}
+						pattern += fmt.Sprintf("(^%s-)", regexp.QuoteMeta(account))
+					}
+				}
+				listPatterns[0], err = regexp.Compile(pattern)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			if listMine || listUser != "" {
+				return errors.New("--mine and --user cannot be combined with a pattern")
+			}
+			listPatterns = make([]*regexp.Regexp, len(args))
+			for i, arg := range args {
+				var err error
+				listPatterns[i], err = regexp.Compile(arg)
+				if err != nil {
+					return errors.Wrapf(err, "could not compile regex pattern: %s", arg)
+				}
+			}
+		}
+		matchesPattern := func(name string) bool {
+			for _, pattern := range listPatterns {
+				if pattern.MatchString(name) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if listSortBy != "name" && listSortBy != "expiry" {
+			return errors.Errorf("unknown --sort-by value %q, expected name or expiry", listSortBy)
+		}
+		if listExpired && listExpiring > 0 {
+			return errors.New("--expired cannot be combined with --expiring-within")
+		}
+		filterExpiry := listExpired || listExpiring > 0
+
+		filter, err := vm.ParseLabelFilter(listFilter)
+		if err != nil {
+			return err
+		}
+
+		cloud, err := cld.ListCloud(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		// Filter and sort by cluster names for stable output. With --expired
+		// or --expiring-within, the clusters without an expiration are
+		// reported separately.
+		var names, noExpiration []string
+		filteredCloud := cloud.Clone()
+		for name, c := range cloud.Clusters {
+			switch {
+			case !matchesPattern(name):
+				delete(filteredCloud.Clusters, name)
+			case filterExpiry && !c.HasExpiration():
+				if !c.IsLocal() {
+					noExpiration = append(noExpiration, name)
+				}
+				delete(filteredCloud.Clusters, name)
+			case filterExpiry && !c.ExpiresWithin(listExpiring):
+				delete(filteredCloud.Clusters, name)
+			default:
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		sort.Strings(noExpiration)
+		if listSortBy == "expiry" {
+			// Clusters without an expiration sort last.
+			sort.SliceStable(names, func(i, j int) bool {
+				a, b := filteredCloud.Clusters[names[i]], filteredCloud.Clusters[names[j]]
+				if a.HasExpiration() != b.HasExpiration() {
+					return a.HasExpiration()
+				}
+				return a.GCAt().Before(b.GCAt())
+			})
+		}
+
+		if listJSON {
+			if listDetails {
+				return errors.New("--json cannot be combined with --detail")
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(struct {
+				*cld.Cloud
+				NoExpiration []string `json:"no_expiration,omitempty"`
+			}{filteredCloud, noExpiration}); err != nil {
+				return err
+			}
+		} else {
+			// Align columns left and separate with at least two spaces.
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			for _, name := range names {
+				c := filteredCloud.Clusters[name]
+				if listDetails {
+					c.PrintDetails()
+				} else {
+					fmt.Fprintf(tw, "%s:\t%s\t%d", c.Name, c.Clouds(), len(c.VMs))
+					if !c.IsLocal() {
+						fmt.Fprintf(tw, "\t(%s)", c.LifetimeStatus())
+					} else {
+						fmt.Fprintf(tw, "\t(-)")
+					}
+					fmt.Fprintf(tw, "\n")
+				}
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			if len(noExpiration) > 0 {
+				fmt.Fprintf(os.Stderr, "Clusters with no expiration, which were not listed: %s\n",
+					strings.Join(noExpiration, ", "))
+			}
+
+			// Optionally print any dangling instances with errors
+			if listDetails {
+				collated := filteredCloud.BadInstanceErrors()
+
+				// Sort by Error() value for stable output
+				var errors ui.ErrorsByError
+				for err := range collated {
+					errors = append(errors, err)
+				}
+				sort.Sort(errors)
+
+				for _, e := range errors {
+					fmt.Printf("%s: %s\n", e, collated[e].Names())
+				}
+			}
+		}
+
+		if len(filter) > 0 {
+			// The filtered listing is incomplete, so it cannot be used to
+			// sync the hosts files.
+			return nil
+		}
+		return syncAll(ctx, cloud, listJSON /* quiet */)
+	}),
+}
+
+// TODO(peter): Do we need this command given that the "list" command syncs as
+// a side-effect. If you don't care about the list output, just "roachprod list
+// &>/dev/null".
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "sync ssh keys/config and hosts files",
+	Long:  ``,
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		cloud, err := cld.ListCloud(ctx, nil)
+		if err != nil {
+			return err
+		}
+		return syncAll(ctx, cloud, false /* quiet */)
+	}),
+}
+
+var lockFile = os.ExpandEnv("$HOME/.roachprod/LOCK")
+
+var bashCompletion = os.ExpandEnv("$HOME/.roachprod/bash-completion.sh")
+
+// clusterArgCmds are the commands whose arguments syncAll completes with the
+// names of the clusters and their nodes. They are set by main, since some of
+// the commands sync themselves.
+var clusterArgCmds []*cobra.Command
+
+func syncAll(ctx context.Context, cloud *cld.Cloud, quiet bool) error {
+	if !quiet {
+		fmt.Println("Syncing...")
+	}
+
+	// Acquire a filesystem lock so that two concurrent `roachprod sync`
+	// operations don't clobber each other.
+	f, err := os.Create(lockFile)
+	if err != nil {
+		return errors.Wrapf(err, "creating lock file %q", lockFile)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return errors.Wrap(err, "acquiring lock on %q")
+	}
+	defer f.Close()
+
+	if err := syncHosts(cloud); err != nil {
+		return err
+	}
+
+	{
+		names := make([]string, 0, len(cloud.Clusters)*3)
+		for name, c := range cloud.Clusters {
+			names = append(names, name)
+			for i := range c.VMs {
+				names = append(names, fmt.Sprintf("%s:%d", name, i))
+			}
+		}
+		for _, cmd := range clusterArgCmds {
+			cmd.ValidArgs = names
+		}
+		rootCmd.GenBashCompletionFile(bashCompletion)
+	}
+	return vm.ConfigSSH(ctx, vm.AllProviderNames())
+}
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "GC expired clusters\n",
+	Long: `Garbage collect expired clusters.
+
+Destroys expired clusters, sending email if properly configured. Usually run
+hourly by a cronjob so it is not necessary to run manually.
+
+A cluster expires once the lifetime of any of its VMs has elapsed, and is
+destroyed once it has been expired for longer than --grace-period. Clusters and
+VMs whose lifetime cannot be determined are reported but never destroyed. With
+--dry-run, the clusters and VMs which would be destroyed are printed instead.
+
+With --older-than, the clusters created longer ago than the given duration are
+destroyed instead, whatever their lifetime, which catches the clusters created
+without one:
+
+  roachprod gc --older-than=72h
+
+The clusters with a VM labeled "keep" (e.g. created with --label keep=true) are
+skipped. The clusters to destroy are listed and must be confirmed, or --yes
+given, which is required when stdin is not a terminal. They are destroyed in
+parallel and the totals are reported at the end.
+`,
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		if cmd.Flags().Changed("older-than") && gcOlderThan <= 0 {
+			return errors.New("--older-than must be positive")
+		}
+		cloud, err := cld.ListCloud(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if gcOlderThan > 0 {
+			return gcOldClusters(ctx, cloud)
+		}
+		return cld.GCClusters(ctx, cloud, dryrun, gcGracePeriod)
+	}),
+}
+
+// gcOldClusters destroys the clusters of the cloud which are older than
+// --older-than (see cld.OldClusters), after listing them and asking for
+// confirmation unless --yes is given.
+func gcOldClusters(ctx context.Context, cloud *cld.Cloud) error {
+	now := time.Now()
+	clusters, skipped := cld.OldClusters(cloud, gcOlderThan, now)
+	if len(clusters) == 0 {
+		fmt.Printf("No clusters older than %s (%d skipped)\n", gcOlderThan, len(skipped))
+		return nil
+	}
+	nodes := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "CLUSTER\tUSER\tVMS\tAGE\tLIFETIME\n")
+	for _, c := range clusters {
+		nodes += len(c.VMs)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", c.Name, c.User, len(c.VMs),
+			now.Sub(c.CreatedAt).Round(time.Hour), c.LifetimeStatus())
+	}
+	fmt.Printf("%d clusters with %d VMs are older than %s:\n", len(clusters), nodes, gcOlderThan)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if dryrun {
+		return nil
+	}
+	if !gcYes {
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return errors.New("--yes is required to destroy the clusters when stdin is not a terminal")
+		}
+		fmt.Printf("Destroy these %d clusters? [y/N] ", len(clusters))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+		default:
+			return errors.New("not confirmed, no clusters were destroyed")
+		}
+	}
+
+	errs := cld.DestroyClusters(ctx, clusters)
+	destroyedVMs := 0
+	for _, c := range clusters {
+		if err, ok := errs[c.Name]; ok {
+			fmt.Printf("%s: failed: %v\n", c.Name, err)
+		} else {
+			fmt.Printf("%s: destroyed\n", c.Name)
+			destroyedVMs += len(c.VMs)
+		}
+	}
+	fmt.Printf("destroyed %d of %d clusters with %d VMs, skipped %d clusters\n",
+		len(clusters)-len(errs), len(clusters), destroyedVMs, len(skipped))
+	if len(errs) > 0 {
+		return errors.Errorf("failed to destroy %d clusters", len(errs))
+	}
+	return nil
+}
+
+var healthCmd = &cobra.Command{
+	Use:   "health [--json]",
+	Short: "check the credentials and API access of the cloud providers",
+	Long: `Check the credentials and API access of the cloud providers.
+
+Each provider is checked concurrently for valid credentials, the active account
+and whether its API can be used to list VMs. This helps to diagnose why other
+commands, such as create, fail:
+
+  ~ roachprod health
+  PROVIDER  ACCOUNT  CREDENTIALS  API  CLUSTERS  VMS
+  aws       marc     ok           ok   1         3
+  gce       marc     ok           ok   4         17
+  local              ok           ok   1         1
+
+The full error of any failed check is shown below the table. The --json flag
+prints the results as json instead. The command fails if any check fails.
+`,
+	Args: cobra.NoArgs,
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		results := cld.CheckProviders(ctx)
+
+		if healthJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(results); err != nil {
+				return err
+			}
+		} else {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintf(tw, "PROVIDER\tACCOUNT\tCREDENTIALS\tAPI\tCLUSTERS\tVMS\n")
+			check := func(failure string) string {
+				if failure != "" {
+					return "FAILED"
+				}
+				return "ok"
+			}
+			for _, h := range results {
+				api, clusters, vms := check(h.APIError), fmt.Sprint(h.Clusters), fmt.Sprint(h.VMs)
+				if h.CredentialsError != "" {
+					// The API is not checked without valid credentials.
+					api, clusters, vms = "-", "-", "-"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+					h.Provider, h.Account, check(h.CredentialsError), api, clusters, vms)
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			for _, h := range results {
+				for _, failure := range []string{h.CredentialsError, h.APIError} {
+					if failure != "" {
+						fmt.Printf("\n%s: %s\n", h.Provider, failure)
+					}
+				}
+			}
+		}
+
+		for _, h := range results {
+			if !h.Healthy() {
+				return errors.New("some providers are not usable")
+			}
+		}
+		return nil
+	}),
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <cluster> [--json]",
+	Short: "check that the VMs of a cluster are healthy",
+	Long: `Check that the VMs of a cloud-based cluster are healthy.
+
+The cluster is listed and each of the following is checked, without changing
+anything:
+
+  nodes     every node from 1 to the highest one has exactly one VM
+  running   all of the VMs are running
+  network   all of the VMs have network addresses
+  lifetime  all of the VMs have a lifetime, so that "roachprod gc" tracks them
+  labels    the VMs agree on the labels which roachprod attaches to them
+
+Each failed check is reported with its problems and the command which is
+likely to fix them, e.g. "roachprod resume" for stopped VMs or "roachprod
+refresh" for missing addresses:
+
+  ~ roachprod verify marc-test
+  CHECK     RESULT
+  nodes     ok
+  running   FAILED
+  network   ok
+  lifetime  ok
+  labels    ok
+
+  running: marc-test-0002 is stopped
+    remedy: roachprod resume marc-test starts the stopped VMs
+
+The --json flag prints the report as json instead, for gating CI jobs on the
+health of their clusters. The command fails if any check fails.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		cloud, err := cld.ListCloud(ctx, nil)
+		if err != nil {
+			return err
+		}
+		report, err := cld.VerifyCluster(cloud, args[0])
+		if err != nil {
+			return err
+		}
+
+		if verifyJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(report); err != nil {
+				return err
+			}
+		} else {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintf(tw, "CHECK\tRESULT\n")
+			for _, c := range report.Checks {
+				result := "ok"
+				if !c.OK {
+					result = "FAILED"
+				}
+				fmt.Fprintf(tw, "%s\t%s\n", c.Name, result)
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			for _, c := range report.Checks {
+				if c.OK {
+					continue
+				}
+				fmt.Printf("\n%s: %s\n", c.Name, strings.Join(c.Problems, "\n  "))
+				fmt.Printf("  remedy: %s\n", c.Remedy)
+			}
+		}
+
+		if !report.OK {
+			return fmt.Errorf("cluster %s failed verification", report.Cluster)
+		}
+		return nil
+	}),
+}
+
+var metadataCmd = &cobra.Command{
+	Use:   "metadata <cluster>[:<nodes>] [<key>=<value>...]",
+	Short: "show or set the metadata of VMs",
+	Long: `Show or set small pieces of metadata on the VMs of a cluster.
+
+Unlike labels, metadata can be changed on existing VMs, e.g. to record the
+version of the binary under test. It is stored in the instance metadata on
+GCE and in tags on AWS. Without key=value pairs, the metadata of the VMs is
+shown. Otherwise, the pairs are added to the metadata of the VMs, replacing
+existing values. A pair with an empty value removes the key:
+
+  ~ roachprod metadata marc-test sha=3c0744f
+  ~ roachprod metadata marc-test:1
+  VM              KEY  VALUE
+  marc-test-0001  sha  3c0744f
+  ~ roachprod metadata marc-test sha=
+
+Keys consist of up to 64 letters, digits, hyphens and underscores. Values may
+be at most 256 KiB on GCE, and 256 characters on AWS, where an instance can
+have at most 50 tags, including those set by roachprod.
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		c, err := cloudClusterWithNodes(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		kv, err := vm.ParseLabels(args[1:])
+		if err != nil {
+			return err
+		}
+
+		metadata := make([]map[string]string, len(c.VMs))
+		err = vm.ForEach(len(c.VMs), func(i int) error {
+			v := c.VMs[i]
+			return vm.ForProvider(ctx, v.Provider, func(ctx context.Context, p vm.Provider) error {
+				var err error
+				if len(kv) > 0 {
+					// Metadata is stored in tags on AWS, which are listed.
+					defer vm.InvalidateListCache(p.Name())
+					err = p.SetMetadata(ctx, v, kv)
+				} else {
+					metadata[i], err = p.GetMetadata(ctx, v)
+				}
+				return errors.Wrapf(err, "%s", v.Name)
+			})
+		})
+		if err != nil || len(kv) > 0 {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "VM\tKEY\tVALUE\n")
+		for i, v := range c.VMs {
+			for _, k := range vm.MetadataKeys(metadata[i]) {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", v.Name, k, metadata[i][k])
+			}
+		}
+		return tw.Flush()
+	}),
+}
+
+var providersCmd = &cobra.Command{
+	Use:   "providers [--verbose] [--json]",
+	Short: "list the cloud providers and whether they are usable",
+	Long: `List the cloud providers known to roachprod.
+
+For each provider, the active account shows whether its credentials are
+configured, in which case the provider is usable. The optional features which
+the provider supports are listed as well:
+
+  ~ roachprod providers
+  PROVIDER  USABLE  ACCOUNT  FEATURES
+  aws       yes     marc     local-ssd,preemptible,gpus,images,...
+  gce       no               local-ssd,preemptible,gpus,images,...
+  local     yes
+
+The --verbose flag lists every optional feature of each provider as well,
+along with the limits of those which have one, such as the number of local
+SSDs per VM or the lifetime of preemptible VMs. Options of "roachprod create" which a provider does not support
+are rejected before any VMs are created.
+
+The --json flag prints the providers as json instead, which allows scripts to
+discover the usable providers. See "roachprod health" for a more thorough
+check of the providers.
+`,
+	Args: cobra.NoArgs,
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		infos := vm.ListProviders(ctx)
+		if providersJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(infos)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "PROVIDER\tUSABLE\tACCOUNT\tFEATURES\n")
+		for _, info := range infos {
+			usable := "yes"
+			if !info.Usable() {
+				usable = "no"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", info.Name, usable, info.Account,
+				strings.Join(info.Capabilities.Features(), ","))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if !info.Usable() {
+				fmt.Printf("\n%s: %s\n", info.Name, info.CredentialsError)
+			}
+		}
+		if providersVerbose {
+			for _, info := range infos {
+				fmt.Printf("\n%s:\n", info.Name)
+				for _, c := range info.Capabilities.All() {
+					supported := "no"
+					if c.Supported {
+						supported = "yes"
+					}
+					if c.Supported && c.Limit > 0 {
+						supported += fmt.Sprintf(" (at most %d per VM)", c.Limit)
+					}
+					if c.Supported && c.MaxLifetime > 0 {
+						supported += fmt.Sprintf(" (for at most %s)", c.MaxLifetime)
+					}
+					fmt.Fprintf(tw, "  %s\t%s\n", c.Name, supported)
+				}
+				if err := tw.Flush(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}),
+}
+
+// providersVerbose makes "roachprod providers" list all of the capabilities
+// of each provider.
+var providersVerbose bool
+
+var describeCmd = &cobra.Command{
+	Use:   "describe <cluster>[:<nodes>] | <vm name>",
+	Short: "show the cloud provider's metadata of VMs",
+	Long: `Show the cloud provider's own description of the VMs of a cluster.
+
+The output is the raw metadata reported by the provider, such as the
+instance's status, scheduling, disks and network interfaces, keyed by VM
+name. It is intended for debugging VMs which roachprod cannot interpret, for
+example those listed as bad instances by "roachprod list". Such a VM can be
+described by its name. Stopped instances can be described as well:
+
+  ~ roachprod describe marc-test:2
+  ~ roachprod describe marc-test-0002
+
+With --disks, the disks attached to each VM are printed instead, as a table
+of their name, device, size and type. Fields which the provider does not
+report when listing VMs, such as the size of AWS volumes, are left empty.
+Similarly, --nics prints the network interfaces of each VM, with their subnet
+and private IP. VMs with a single interface show it as their VPC and private
+IP. --scheduling prints the maintenance policy of each VM and whether it is
+restarted after a failure of its host, which are "-" if the provider does not
+report them.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		cloud, err := cld.ListCloud(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		var vms vm.List
+		for _, v := range cloud.BadInstances {
+			if v.Name == args[0] {
+				vms = append(vms, v)
+			}
+		}
+		for _, c := range cloud.Clusters {
+			for _, v := range c.VMs {
+				if v.Name == args[0] {
+					vms = append(vms, v)
+				}
+			}
+		}
+		if len(vms) == 0 {
+			c, err := cloudClusterWithNodes(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			vms = c.VMs
+		}
+
+		if describeDisks {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintf(tw, "VM\tDISK\tDEVICE\tSIZE\tTYPE\t\n")
+			for _, v := range vms {
+				for _, d := range v.Disks {
+					var attrs []string
+					if d.Boot {
+						attrs = append(attrs, "boot")
+					}
+					if d.Local {
+						attrs = append(attrs, "local")
+					}
+					size := "-"
+					if d.SizeGB > 0 {
+						size = fmt.Sprintf("%dGB", d.SizeGB)
+					}
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+						v.Name, d.Name, d.Device, size, d.Type, strings.Join(attrs, ","))
+				}
+			}
+			return tw.Flush()
+		}
+		if describeNICs {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintf(tw, "VM\tNIC\tSUBNET\tPRIVATE IP\t\n")
+			for _, v := range vms {
+				nics := v.NetworkInterfaces
+				if len(nics) == 0 {
+					nics = []vm.NetworkInterface{{Name: "-", Subnet: v.VPC, PrivateIP: v.PrivateIP}}
+				}
+				for _, nic := range nics {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t\n", v.Name, nic.Name, nic.Subnet, nic.PrivateIP)
+				}
+			}
+			return tw.Flush()
+		}
+
+		if describeScheduling {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintf(tw, "VM\tMAINTENANCE\tAUTO-RESTART\tPREEMPTIBLE\t\n")
+			for _, v := range vms {
+				policy, autoRestart := "-", "-"
+				if s := v.Scheduling; s != nil {
+					if s.MaintenancePolicy != "" {
+						policy = s.MaintenancePolicy
+					}
+					autoRestart = strconv.FormatBool(s.AutoRestart)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t\n", v.Name, policy, autoRestart, v.Preemptible)
+			}
+			return tw.Flush()
+		}
+
+		descriptions := make(map[string]interface{}, len(vms))
+		for _, v := range vms {
+			v := v
+			err := vm.ForProvider(ctx, v.Provider, func(ctx context.Context, p vm.Provider) error {
+				d, err := p.Describe(ctx, v)
+				if err != nil {
+					return err
+				}
+				descriptions[v.Name] = d
+				return nil
+			})
+			if err != nil {
+				return errors.Wrapf(err, "unable to describe %s", v.Name)
+			}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(descriptions)
+	}),
+}
+
+var extendCmd = &cobra.Command{
+	Use:   "extend [--mine | <cluster>...]",
+	Short: "extend the lifetime of clusters",
+	Long: `Extend the lifetime of the specified cluster to prevent it from being
+destroyed:
+
+  roachprod extend marc-test --lifetime=6h
+
+The --mine flag extends all of the clusters created by the current user, as
+identified by the roachprod-user label of their VMs. The result for each
+cluster is reported, including any lifetimes which were capped by the provider
+(e.g. GCE preemptible VMs live for at most 24h):
+
+  roachprod extend --mine --lifetime=72h
+
+The --max-lifetime flag caps the lifetime of every VM, in addition to the
+limits of the providers. A capped lifetime is reported for each VM, unless
+--reject-max-lifetime is given, in which case a cluster whose lifetime would
+be capped is not extended at all. "roachprod create" rejects lifetimes beyond
+--max-lifetime.
+
+Several clusters can be extended together by naming each of them, or with a
+glob, which only matches your own clusters unless --all-users is given. The
+result is then reported for each cluster, as with --mine:
+
+  roachprod extend 'marc-test-*' --lifetime=6h
+
+A cluster which is locked by another roachprod command, e.g. while it is being
+destroyed, is not extended; see "roachprod destroy --help".
+`,
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		if extendMine {
+			if len(args) > 0 {
+				return errors.New("--mine cannot be combined with a cluster name")
+			}
+			return extendMyClusters(ctx)
+		}
+		if len(args) == 0 {
+			return errors.New("a cluster name or --mine is required")
+		}
+		if !singleCluster(args) {
+			cloud, err := cld.ListCloud(ctx, nil)
+			if err != nil {
+				return err
+			}
+			clusters, err := resolveClusters(ctx, cloud, args)
+			if err != nil {
+				return err
+			}
+			names := make([]string, len(clusters))
+			for i, c := range clusters {
+				names[i] = c.Name
+			}
+			return extendClusters(ctx, cloud, names)
+		}
+
+		clusterName, err := verifyClusterName(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		cloud, err := cld.ListCloud(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		c, ok := cloud.Clusters[clusterName]
+		if !ok {
+			return fmt.Errorf("cluster %s does not exist", clusterName)
+		}
+		unlock, err := lockCluster(ctx, c, "extend")
+		if err != nil {
+			return err
+		}
+		clamps, err := cld.ExtendCluster(ctx, c, extendLifetime)
+		unlock()
+		if err != nil {
+			return err
+		}
+		for _, clamp := range clamps {
+			fmt.Println(clamp)
+		}
+
+		// Reload the clusters and print details.
+		cloud, err = cld.ListCloud(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		c, ok = cloud.Clusters[clusterName]
+		if !ok {
+			return fmt.Errorf("cluster %s does not exist", clusterName)
+		}
+
+		c.PrintDetails()
+		return nil
+	}),
+}
+
+// extendMyClusters extends the lifetime of every cluster whose VMs are labeled
+// with one of the current user's accounts.
+func extendMyClusters(ctx context.Context) error {
+	accounts, err := vm.FindActiveAccounts(ctx, accountProviders)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]bool)
+	for _, account := range accounts {
+		users[vm.UserLabelValue(account)] = true
+	}
+
+	cloud, err := cld.ListCloud(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name, c := range cloud.Clusters {
+		for _, v := range c.VMs {
+			if users[v.Labels[vm.UserLabel]] {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		fmt.Println("no clusters found")
+		return nil
+	}
+	return extendClusters(ctx, cloud, names)
+}
+
+// extendClusters extends the lifetime of the named clusters of the cloud,
+// reporting the result for each of them.
+func extendClusters(ctx context.Context, cloud *cld.Cloud, names []string) error {
+	requested := make(map[string]time.Duration, len(names))
+	var extended []string
+	for _, name := range names {
+		c := cloud.Clusters[name]
+		requested[name] = c.Lifetime + extendLifetime
+		unlock, err := lockCluster(ctx, c, "extend")
+		if err != nil {
+			fmt.Printf("%s: failed: %v\n", name, err)
+			continue
+		}
+		clamps, err := cld.ExtendCluster(ctx, c, extendLifetime)
+		unlock()
+		if err != nil {
+			fmt.Printf("%s: failed: %v\n", name, err)
+			continue
+		}
+		for _, clamp := range clamps {
+			fmt.Printf("%s: %s\n", name, clamp)
+		}
+		extended = append(extended, name)
+	}
+
+	// Reload the clusters to report the lifetimes which were applied.
+	cloud, err := cld.ListCloud(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, name := range extended {
+		c, ok := cloud.Clusters[name]
+		switch {
+		case !ok:
+			fmt.Printf("%s: no longer exists\n", name)
+		case c.Lifetime < requested[name]:
+			fmt.Printf("%s: lifetime %s (capped; %s requested)\n",
+				name, c.Lifetime, requested[name])
+		default:
+			fmt.Printf("%s: lifetime %s\n", name, c.Lifetime)
+		}
+	}
+
+	fmt.Printf("extended %d of %d clusters\n", len(extended), len(names))
+	if len(extended) < len(names) {
+		return errors.Errorf("failed to extend %d clusters", len(names)-len(extended))
+	}
+	return nil
+}
+
+var growCmd = &cobra.Command{
+	Use:   "grow <cluster> <nodes>",
+	Short: "add nodes to a cluster",
+	Long: `Add nodes to a cloud-based cluster:
+
+  roachprod grow marc-test 3
+
+The new nodes are numbered after the existing nodes and are created with the
+same machine type, labels and lifetime as the existing nodes. They are placed
+in the zones which currently have the fewest nodes, so a cluster which is
+evenly spread over its zones stays that way.
+
+If any of the new nodes cannot be created, the new nodes which were created are
+destroyed again so that the command can safely be rerun.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: wrapLongCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid number of nodes: %s", args[1])
+		}
+
+		clusterName, err := verifyClusterName(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if clusterName == config.Local {
+			return fmt.Errorf("operation is not supported on the local cluster")
+		}
+
+		cloud, err := cld.ListCloud(ctx, nil)
+		if err != nil {
+			return err
+		}
+		c, ok := cloud.Clusters[clusterName]
+		if !ok {
+			return fmt.Errorf("cluster %s does not exist", clusterName)
+		}
+
+		createVMOpts.StartupScript, err = readStartupScript(createStartupScript)
+		if err != nil {
+			return err
+		}
+		if err := checkDataDiskFlags(cmd); err != nil {
+			return err
+		}
+
+		unlock, err := lockCluster(ctx, c, "grow")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Adding %d nodes to cluster %s\n", n, clusterName)
+		names, growErr := cld.GrowCluster(ctx, c, n, createVMOpts)
+		unlock()
+		if growErr != nil {
+			fmt.Fprintf(os.Stderr, "Unable to grow cluster:\n%s\nCleaning up...\n", growErr)
+			if err := cleanupFailedGrow(context.Background(), clusterName, names); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while cleaning up new nodes: %s\n", err)
+				fmt.Fprintf(os.Stderr, "Use \"roachprod destroy\" to remove any of %v\n", names)
+			}
+			os.Exit(1)
+		}
+		fmt.Println("OK")
+
+		return setupCloudCluster(ctx, clusterName)
+	}),
+}
+
+var recreateWatch time.Duration
+
+var recreateCmd = &cobra.Command{
+	Use:   "recreate-preempted <cluster>",
+	Short: "recreate the preempted nodes of a cluster",
+	Long: `Recreate the nodes of a cloud-based cluster which their cloud reclaimed:
+
+  roachprod recreate-preempted marc-test
+
+The preemptible (GCE) or spot (AWS) nodes which were reclaimed are deleted and
+created again under the same names, so that they keep their node numbers. Each
+one gets the zone, machine type, OS image, labels and expiration of the node it
+replaces, and keeps its static IP if it has one, while the disks are configured
+by the same flags as for "roachprod create". The cluster is then set up as
+after "roachprod create", since the new nodes have new network addresses.
+
+AWS only reports a reclaimed spot instance for about an hour, and Azure deletes
+its evicted spot VMs outright. The nodes which are no longer reported can be
+created again with "roachprod create" and the number of nodes of the cluster,
+which only creates the missing nodes.
+
+With --watch, the cluster is checked for preempted nodes at the given interval
+until the command is interrupted, which keeps a long-running preemptible
+cluster healthy. The errors of a check are then reported without ending the
+command. --timeout bounds all of the checks together, so it has to be disabled
+with --timeout 0 to watch the cluster indefinitely.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: wrapLongCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		clusterName, err := verifyClusterName(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if clusterName == config.Local {
+			return fmt.Errorf("operation is not supported on the local cluster")
+		}
+		createVMOpts.StartupScript, err = readStartupScript(createStartupScript)
+		if err != nil {
+			return err
+		}
+		if err := checkDataDiskFlags(cmd); err != nil {
+			return err
+		}
+
+		for {
+			err := recreatePreempted(ctx, clusterName)
+			if recreateWatch == 0 {
+				return err
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(recreateWatch):
+			}
+			// The statuses are listed afresh for every check.
+			for _, name := range vm.AllProviderNames() {
+				vm.InvalidateListCache(name)
+			}
+		}
+	}),
+}
+
+// recreatePreempted recreates the preempted VMs of the named cluster, and
+// sets up the cluster again if there were any.
+func recreatePreempted(ctx context.Context, clusterName string) error {
+	cloud, err := cld.ListCloud(ctx, nil)
+	if err != nil {
+		return err
+	}
+	c, ok := cloud.Clusters[clusterName]
+	if !ok {
+		return fmt.Errorf("cluster %s does not exist", clusterName)
+	}
+
+	unlock, err := lockCluster(ctx, c, "recreate")
+	if err != nil {
+		return err
+	}
+	names, err := cld.RecreatePreempted(ctx, c, createVMOpts)
+	unlock()
+	if err != nil && len(names) > 0 {
+		return errors.Wrapf(err, "unable to recreate %v; use \"roachprod create %s -n %d\" "+
+			"to create the missing nodes", names, clusterName, len(c.VMs))
+	} else if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		fmt.Printf("%s: no preempted nodes\n", clusterName)
+		return nil
+	}
+	fmt.Printf("%s: recreated %s\n", clusterName, strings.Join(names, ", "))
+	return setupCloudCluster(ctx, clusterName)
+}
+
+var cloneCmd = &cobra.Command{
+	Use:   "clone <cluster> <new cluster>",
+	Short: "create a copy of a cluster",
+	Long: `Create a cloud-based cluster with the same shape as an existing cluster:
+
+  roachprod clone marc-test marc-test2
+
+Each node of the new cluster is created in the zone, and with the machine type,
+OS image, preemptibility and disks, of the node of the existing cluster with
+the same number. AWS and Azure do not report the number of local SSDs, so the
+clones of nodes with local SSDs use a single one. The labels and lifetime of
+the existing cluster are copied. The names of the new nodes are printed next
+to the nodes which they clone. If the existing cluster has a firewall, the new
+cluster gets one of its own, whose rules must be given with --ingress or
+--ingress-cidr.
+
+If any of the new nodes cannot be created, the new cluster is destroyed again
+so that the command can safely be rerun.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: wrapLongCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		srcName, err := verifyClusterName(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		clusterName, err := verifyClusterName(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		if srcName == config.Local || clusterName == config.Local {
+			return fmt.Errorf("operation is not supported on the local cluster")
+		}
+
+		cloud, err := cld.ListCloud(ctx, nil)
+		if err != nil {
+			return err
+		}
+		c, ok := cloud.Clusters[srcName]
+		if !ok {
+			return fmt.Errorf("cluster %s does not exist", srcName)
+		}
+		if _, ok := cloud.Clusters[clusterName]; ok {
+			return fmt.Errorf("cluster %s already exists", clusterName)
+		}
+
+		createVMOpts.StartupScript, err = readStartupScript(createStartupScript)
+		if err != nil {
+			return err
+		}
+		if err := parseIngressFlags(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Cloning cluster %s into %s with %d nodes\n", srcName, clusterName, len(c.VMs))
+		clones, cloneErr := cld.CloneCluster(ctx, c, clusterName, createVMOpts)
+		if cloneErr != nil {
+			fmt.Fprintf(os.Stderr, "Unable to clone cluster:\n%s\nCleaning up...\n", cloneErr)
+			if err := cleanupFailedCreate(context.Background(), clusterName); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while cleaning up partially-created cluster: %s\n", err)
+				fmt.Fprintf(os.Stderr, "Use \"roachprod destroy %s\" to remove any remaining VMs\n", clusterName)
+			}
+			os.Exit(1)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, v := range c.VMs {
+			fmt.Fprintf(tw, "%s\t-> %s\n", v.Name, clones[v.Name])
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+
+		return setupCloudCluster(ctx, clusterName)
+	}),
+}
+
+var shrinkCmd = &cobra.Command{
+	Use:   "shrink <cluster>:<nodes>",
+	Short: "remove nodes from a cluster",
+	Long: `Destroy the last nodes of a cloud-based cluster:
+
+  roachprod shrink marc-test:4-6
+
+The syntax of <nodes> is the same as for the other commands which accept a node
+specification, e.g. "roachprod help run", but only the last nodes of the
+cluster can be removed, so that the remaining nodes keep their node numbers.
+The remaining nodes, including their IP addresses, are unaffected. Node 1
+cannot be removed since roachprod uses it to initialize and connect to the
+cluster. Use "roachprod destroy" to remove all of the nodes.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		i := strings.Index(args[0], ":")
+		if i == -1 {
+			return fmt.Errorf("the nodes to remove must be specified, e.g. %s:4", args[0])
+		}
+		c, err := cloudClusterWithNodes(ctx, args[0][:i])
+		if err != nil {
+			return err
+		}
+		nodes, err := install.ListNodes(args[0][i+1:], len(c.VMs))
+		if err != nil {
+			return err
+		}
+		if len(nodes) == 0 {
+			return fmt.Errorf("no nodes of cluster %s are specified", c.Name)
+		}
+		if first := len(c.VMs) - len(nodes) + 1; nodes[0] != first || nodes[len(nodes)-1] != len(c.VMs) {
+			return fmt.Errorf("only the last nodes of cluster %s can be removed, e.g. %s:%d-%d",
+				c.Name, c.Name, first, len(c.VMs))
+		}
+		if err := confirmOtherUser(ctx, c, "shrink"); err != nil {
+			return err
+		}
+		unlock, err := lockWholeCluster(ctx, c, "shrink")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		fmt.Printf("Removing %d nodes from cluster %s\n", len(nodes), c.Name)
+		if err := cld.ShrinkCluster(ctx, c, len(nodes)); err != nil {
+			return err
+		}
+
+		cloud, err := cld.ListCloud(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := syncAll(ctx, cloud, false /* quiet */); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+		return nil
+	}),
+}
+
+var rebootCmd = &cobra.Command{
+	Use:   "reboot <cluster>",
+	Short: "reboot the VMs in a cluster",
+	Long: `Reboot the VMs in a cloud-based cluster.
+
+Rebooting resets the VM instances in place, which preserves the contents of
+local SSDs. The command waits until the VMs are running again before
+returning. Note that any processes started by roachprod will have to be
+restarted (e.g. via "roachprod start").
+`,
+	Args: cobra.ExactArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		c, err := cloudClusterWithNodes(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		if err := confirmOtherUser(ctx, c, "reboot"); err != nil {
+			return err
+		}
+
+		fmt.Printf("Rebooting %d nodes in cluster %s\n", len(c.VMs), c.Name)
+		if err := cld.RebootCluster(ctx, c); err != nil {
+			return err
+		}
+		if err := refreshCluster(ctx, c); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+		return nil
+	}),
+}
+
+var resizeCmd = &cobra.Command{
+	Use:   "resize <cluster> --machine-type=<type>",
+	Short: "change the machine type of the VMs in a cluster",
+	Long: `Change the machine type of the VMs in a cloud-based cluster:
+
+  roachprod resize marc-test --machine-type=n1-standard-16
+
+Resizing requires each VM to be stopped, modified, and started again. Any
+processes started by roachprod will have to be restarted afterwards, and the
+contents of local SSDs may be lost. The machine type is cloud specific, so
+clusters spanning multiple clouds must be resized one cloud at a time by
+specifying the relevant nodes.
+
+If the machine type is not available in the zone of one of the VMs, no VMs are
+modified. If resizing fails part-way through, the VMs that were successfully
+resized are reported.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		if resizeMachine == "" {
+			return errors.New("--machine-type must be specified")
+		}
+		c, err := cloudClusterWithNodes(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		if err := confirmOtherUser(ctx, c, "resize"); err != nil {
+			return err
+		}
+		unlock, err := lockWholeCluster(ctx, c, "resize")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		fmt.Printf("Resizing %d nodes in cluster %s to %s\n", len(c.VMs), c.Name, resizeMachine)
+		if err := cld.ResizeCluster(ctx, c, resizeMachine); err != nil {
+			return err
+		}
+		if err := refreshCluster(ctx, c); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+		return nil
+	}),
+}
+
+var suspendCmd = &cobra.Command{
+	Use:   "suspend <cluster>",
+	Short: "stop the VMs in a cluster",
+	Long: `Stop the VMs in a cloud-based cluster, e.g. overnight to save cost.
+
+The VMs are stopped (deallocated on Azure) with their persistent disks, which
+keep their data, and are started again by "roachprod resume". The contents of
+local SSDs are preserved on GCE, unless --gce-discard-local-ssd is given, and
+lost elsewhere. AWS spot instances cannot be stopped. Unlike
+"roachprod stop", which stops the processes on the VMs, this stops the VMs
+themselves, so any processes started by roachprod have to be restarted after
+resuming (e.g. via "roachprod start").
+`,
+	Args: cobra.ExactArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		c, err := cloudClusterWithNodes(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		if err := confirmOtherUser(ctx, c, "suspend"); err != nil {
+			return err
+		}
+
+		fmt.Printf("Suspending %d nodes in cluster %s\n", len(c.VMs), c.Name)
+		if err := cld.StopCluster(ctx, c); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+		return nil
+	}),
+}
+
+var resumeCmd = &cobra.Command{
+	Use:   "resume <cluster>",
+	Short: "start the VMs of a suspended cluster",
+	Long: `Start the VMs of a cloud-based cluster stopped by "roachprod suspend".
+
+The VMs often come back with new public IPs, so the cluster is refreshed as by
+"roachprod refresh" once they are running.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		c, err := cloudClusterWithNodes(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		if err := confirmOtherUser(ctx, c, "resume"); err != nil {
+			return err
+		}
+
+		fmt.Printf("Resuming %d nodes in cluster %s\n", len(c.VMs), c.Name)
+		changed, err := cld.StartCluster(ctx, c)
+		if err != nil {
+			return err
+		}
+		if err := syncRefreshed(ctx, c, changed); err != nil {
+			return err
+		}
 		fmt.Println("OK")
 		return nil
 	}),
 }
 
-var listCmd = &cobra.Command{
-	Use:   "list [--details] [ --mine | <cluster name regex> ]",
-	Short: "list all clusters",
-	Long: `List all clusters.
-
-The list command accepts an optional positional argument, which is a regular
-expression that will be matched against the cluster name pattern.  Alternatively,
-the --mine flag can be provided to list the clusters that are owned by the current
-user.
-
-The default output shows one line per cluster, including the local cluster if
-it exists:
-
-  ~ roachprod list
-  local:     [local]    1  (-)
-  marc-test: [aws gce]  4  (5h34m35s)
-  Syncing...
-
-The second column lists the cloud providers that host VMs for the cluster.
+var refreshCmd = &cobra.Command{
+	Use:   "refresh <cluster>",
+	Short: "refresh the network addresses of the VMs in a cluster",
+	Long: `Refresh the network addresses of the VMs in a cloud-based cluster.
 
-The third and fourth columns are the number of nodes in the cluster and the
-time remaining before the cluster will be automatically destroyed. Note that
-local clusters do not have an expiration.
+The public and private IPs and the DNS names of the VMs are listed again, since
+they may change when a VM is stopped and started, and the hosts files, ssh
+configuration and DNS records of the cluster are updated to match. "roachprod
+reboot" and "roachprod resize" refresh the cluster on their own.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		c, err := cloudClusterWithNodes(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		return refreshCluster(ctx, c)
+	}),
+}
 
-The --details flag adjusts the output format to include per-node details:
+var sshConfigFormat string
 
-  ~ roachprod list --details
-  local [local]: (no expiration)
-    localhost		127.0.0.1	127.0.0.1
-  marc-test: [aws gce] 5h33m57s remaining
-    marc-test-0001	marc-test-0001.us-east1-b.cockroach-ephemeral	10.142.0.18	35.229.60.91
-    marc-test-0002	marc-test-0002.us-east1-b.cockroach-ephemeral	10.142.0.17	35.231.0.44
-    marc-test-0003	marc-test-0003.us-east1-b.cockroach-ephemeral	10.142.0.19	35.229.111.100
-    marc-test-0004	marc-test-0004.us-east1-b.cockroach-ephemeral	10.142.0.20	35.231.102.125
-  Syncing...
+var sshConfigCmd = &cobra.Command{
+	Use:   "ssh-config <cluster>",
+	Short: "print the ssh configuration of the nodes of a cluster",
+	Long: `Print how to ssh to the nodes of a cloud-based cluster:
 
-The first and second column are the node hostname and fully qualified name
-respectively. The third and fourth column are the private and public IP
-addresses.
+  roachprod ssh-config marc-test >> ~/.ssh/config
+  ssh marc-test-0001
 
-The --json flag sets the format of the command output to json.
+By default, an ssh_config snippet is printed with a Host entry for each node,
+named after the node, which sets its address, the user to log in as and the
+ssh key registered with the cloud by "roachprod sync". The nodes without
+public IPs are reached at their private IPs via the bastion of their cloud
+(see --bastion), which is set as their ProxyJump. A bastion with a key of its
+own (see --bastion-key) gets a Host entry which sets the key.
 
-Listing clusters has the side-effect of syncing ssh keys/configs and the local
-hosts file.
+With --format=commands, a ready-to-use ssh command is printed for each node
+instead, and with --format=json, the configuration of the nodes is printed as a
+JSON array which includes the commands.
 `,
-	Run: wrap(func(cmd *cobra.Command, args []string) error {
-		listPattern := regexp.MustCompile(".*")
-		switch len(args) {
-		case 0:
-			if listMine {
-				// In general, we expect that users will have the same
-				// account name across the services they're using,
-				// but we still want to function even if this is not
-				// the case.
-				seenAccounts := map[string]bool{}
-				accounts, err := vm.FindActiveAccounts()
-				if err != nil {
-					return err
-				}
-				pattern := ""
-				for _, account := range accounts {
-					if !seenAccounts[account] {
-						seenAccounts[account] = true
-						if len(pattern) > 0 {
-							pattern += "|"
-						}
-						pattern += fmt.Sprintf("(^%s-)", regexp.QuoteMeta(account))
-					}
-				}
-				listPattern, err = regexp.Compile(pattern)
-				if err != nil {
-					return err
-				}
-			}
-		case 1:
-			if listMine {
-				return errors.New("--mine cannot be combined with a pattern")
-			}
-			var err error
-			listPattern, err = regexp.Compile(args[0])
-			if err != nil {
-				return errors.Wrapf(err, "could not compile regex pattern: %s", args[0])
-			}
+	Args: cobra.ExactArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		switch sshConfigFormat {
+		case "config", "commands", "json":
 		default:
-			return errors.New("only a single pattern may be listed")
+			return fmt.Errorf("unknown format %q: expected config, commands or json", sshConfigFormat)
 		}
-
-		cloud, err := cld.ListCloud()
+		c, err := cloudClusterWithNodes(ctx, args[0])
 		if err != nil {
 			return err
 		}
-
-		// Filter and sort by cluster names for stable output.
-		var names []string
-		filteredCloud := cloud.Clone()
-		for name := range cloud.Clusters {
-			if listPattern.MatchString(name) {
-				names = append(names, name)
-			} else {
-				delete(filteredCloud.Clusters, name)
+		targets := make([]vm.SSHTarget, 0, len(c.VMs))
+		for _, v := range c.VMs {
+			p, ok := vm.LookupProvider(v.Provider)
+			if !ok {
+				return fmt.Errorf("%s: unknown provider %s", v.Name, v.Provider)
+			}
+			t, err := vm.NewSSHTarget(v, p.SSHAccess())
+			if err != nil {
+				return err
 			}
+			targets = append(targets, t)
 		}
-		sort.Strings(names)
 
-		if listJSON {
-			if listDetails {
-				return errors.New("--json cannot be combined with --detail")
+		switch sshConfigFormat {
+		case "commands":
+			for _, t := range targets {
+				fmt.Println(t.Command)
 			}
-
+			return nil
+		case "json":
 			enc := json.NewEncoder(os.Stdout)
 			enc.SetIndent("", "  ")
-			if err := enc.Encode(filteredCloud); err != nil {
-				return err
-			}
-		} else {
-			// Align columns left and separate with at least two spaces.
-			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
-			for _, name := range names {
-				c := filteredCloud.Clusters[name]
-				if listDetails {
-					c.PrintDetails()
-				} else {
-					fmt.Fprintf(tw, "%s:\t%s\t%d", c.Name, c.Clouds(), len(c.VMs))
-					if !c.IsLocal() {
-						fmt.Fprintf(tw, "\t(%s)", c.LifetimeRemaining().Round(time.Second))
-					} else {
-						fmt.Fprintf(tw, "\t(-)")
-					}
-					fmt.Fprintf(tw, "\n")
-				}
-			}
-			if err := tw.Flush(); err != nil {
-				return err
-			}
-
-			// Optionally print any dangling instances with errors
-			if listDetails {
-				collated := filteredCloud.BadInstanceErrors()
-
-				// Sort by Error() value for stable output
-				var errors ui.ErrorsByError
-				for err := range collated {
-					errors = append(errors, err)
-				}
-				sort.Sort(errors)
-
-				for _, e := range errors {
-					fmt.Printf("%s: %s\n", e, collated[e].Names())
-				}
-			}
+			return enc.Encode(targets)
+		default:
+			return vm.WriteSSHConfig(os.Stdout, targets)
 		}
-
-		return syncAll(cloud, listJSON /* quiet */)
 	}),
 }
 
-// TODO(peter): Do we need this command given that the "list" command syncs as
-// a side-effect. If you don't care about the list output, just "roachprod list
-// &>/dev/null".
-var syncCmd = &cobra.Command{
-	Use:   "sync",
-	Short: "sync ssh keys/config and hosts files",
-	Long:  ``,
-	Run: wrap(func(cmd *cobra.Command, args []string) error {
-		cloud, err := cld.ListCloud()
-		if err != nil {
-			return err
-		}
-		return syncAll(cloud, false /* quiet */)
-	}),
+// refreshCluster updates the network addresses of the VMs of the cluster
+// after they may have changed (see syncRefreshed).
+func refreshCluster(ctx context.Context, c *cld.CloudCluster) error {
+	changed, err := cld.RefreshCluster(ctx, c)
+	if err != nil {
+		return errors.Wrap(err, "unable to refresh the network addresses")
+	}
+	return syncRefreshed(ctx, c, changed)
 }
 
-var lockFile = os.ExpandEnv("$HOME/.roachprod/LOCK")
-
-var bashCompletion = os.ExpandEnv("$HOME/.roachprod/bash-completion.sh")
-
-func syncAll(cloud *cld.Cloud, quiet bool) error {
-	if !quiet {
-		fmt.Println("Syncing...")
+// syncRefreshed reports the VMs of the cluster whose network addresses
+// changed when it was refreshed, and persists the addresses by syncing. The
+// internal host names of --internal-dns are written again.
+func syncRefreshed(ctx context.Context, c *cld.CloudCluster, changed []string) error {
+	if len(changed) == 0 {
+		return nil
 	}
-
-	// Acquire a filesystem lock so that two concurrent `roachprod sync`
-	// operations don't clobber each other.
-	f, err := os.Create(lockFile)
-	if err != nil {
-		return errors.Wrapf(err, "creating lock file %q", lockFile)
+	isChanged := make(map[string]bool, len(changed))
+	for _, name := range changed {
+		isChanged[name] = true
 	}
-	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
-		return errors.Wrap(err, "acquiring lock on %q")
+	for _, v := range c.VMs {
+		if isChanged[v.Name] {
+			fmt.Printf("%s: public IP %s, private IP %s, DNS %s\n", v.Name, v.PublicIP, v.PrivateIP, v.DNS)
+		}
 	}
-	defer f.Close()
-
-	if err := syncHosts(cloud); err != nil {
+	cloud, err := cld.ListCloud(ctx, nil)
+	if err != nil {
 		return err
 	}
-	err = vm.ProvidersSequential(vm.AllProviderNames(), func(p vm.Provider) error {
-		return p.CleanSSH()
-	})
-	if err != nil {
+	if err := syncAll(ctx, cloud, false /* quiet */); err != nil {
 		return err
 	}
-
-	{
-		names := make([]string, 0, len(cloud.Clusters)*3)
-		for name, c := range cloud.Clusters {
-			names = append(names, name)
-			for i := range c.VMs {
-				names = append(names, fmt.Sprintf("%s:%d", name, i))
-			}
-		}
-		for _, cmd := range []*cobra.Command{
-			startCmd, stopCmd, wipeCmd,
-			extendCmd, destroyCmd,
-			statusCmd, monitorCmd,
-			runCmd, sqlCmd,
-			adminurlCmd, pgurlCmd,
-		} {
-			cmd.ValidArgs = names
-		}
-		rootCmd.GenBashCompletionFile(bashCompletion)
+	install.Clusters = map[string]*install.SyncedCluster{}
+	if err := loadClusters(); err != nil {
+		return err
 	}
-	return vm.ProvidersSequential(vm.AllProviderNames(), func(p vm.Provider) error {
-		return p.ConfigSSH()
-	})
+	return setupInternalDNS(ctx, c.Name)
 }
 
-var gcCmd = &cobra.Command{
-	Use:   "gc",
-	Short: "GC expired clusters\n",
-	Long: `Garbage collect expired clusters.
-
-Destroys expired clusters, sending email if properly configured. Usually run
-hourly by a cronjob so it is not necessary to run manually.
+var imageCmd = &cobra.Command{
+	Use:   "image <cluster> <image name>",
+	Short: "capture images of the VMs in a cluster",
+	Long: `Capture images of the VMs in a cloud-based cluster.
+
+The images can later be used to boot new clusters via "roachprod create
+--image". GCE machine images are created, which include all of the disks of
+the instance. On AWS, an AMI is created, which is only usable within the region
+of the source VM.
+
+Image names follow the same naming scheme as clusters and must be prefixed by
+the authenticated user (e.g. "marc-golden"). When images of more than one VM
+are captured, each image name is suffixed with the VM's node number. For
+example, "roachprod image marc-test marc-golden" on a 3 node cluster creates
+marc-golden-0001, marc-golden-0002 and marc-golden-0003. A single node can be
+captured by specifying it explicitly (e.g. marc-test:1). Images are not
+associated with a cluster and are never garbage collected.
 `,
-	Run: wrap(func(cmd *cobra.Command, args []string) error {
-		cloud, err := cld.ListCloud()
+	Args: cobra.ExactArgs(2),
+	Run: wrapLongCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		c, err := cloudClusterWithNodes(ctx, args[0])
 		if err != nil {
 			return err
 		}
-		return cld.GCClusters(cloud, dryrun)
-	}),
-}
-
-var extendCmd = &cobra.Command{
-	Use:   "extend <cluster>",
-	Short: "extend the lifetime of a cluster",
-	Long: `Extend the lifetime of the specified cluster to prevent it from being
-destroyed:
-
-  roachprod extend marc-test --lifetime=6h
-`,
-	Args: cobra.ExactArgs(1),
-	Run: wrap(func(cmd *cobra.Command, args []string) error {
-		clusterName, err := verifyClusterName(args[0])
+		imageName, err := verifyClusterName(ctx, args[1])
 		if err != nil {
 			return err
 		}
 
-		cloud, err := cld.ListCloud()
+		fmt.Printf("Capturing images of %d nodes in cluster %s\n", len(c.VMs), c.Name)
+		ids, err := cld.CreateClusterImages(ctx, c, imageName)
 		if err != nil {
 			return err
 		}
 
-		c, ok := cloud.Clusters[clusterName]
-		if !ok {
-			return fmt.Errorf("cluster %s does not exist", clusterName)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, v := range c.VMs {
+			fmt.Fprintf(tw, "%s:\t%s\n", v.Name, ids[v.Name])
 		}
+		return tw.Flush()
+	}),
+}
+
+var costCmd = &cobra.Command{
+	Use:   "cost <cluster>",
+	Short: "estimate the cost of a cluster",
+	Long: `Estimate the cost of a cloud-based cluster.
+
+The hourly cost is estimated from the on-demand prices of the machine types
+used by the cluster and multiplied by the cluster's remaining lifetime:
 
-		if err := cld.ExtendCluster(c, extendLifetime); err != nil {
+  ~ roachprod cost marc-test
+  marc-test: [gce] 4 nodes
+    hourly:     $0.76
+    remaining:  5h33m57s
+    total:      $4.23
+
+The estimate is based on a table of approximate prices embedded in roachprod,
+so it should not be relied upon for billing purposes. Nodes with machine types
+missing from the table are listed but excluded from the estimate.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: wrapCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		c, err := cloudClusterWithNodes(ctx, args[0])
+		if err != nil {
 			return err
 		}
 
-		// Reload the clusters and print details.
-		cloud, err = cld.ListCloud()
+		hourly, unpriced, err := cld.EstimateClusterCost(ctx, c)
 		if err != nil {
 			return err
 		}
-
-		c, ok = cloud.Clusters[clusterName]
-		if !ok {
-			return fmt.Errorf("cluster %s does not exist", clusterName)
+		remaining := c.LifetimeRemaining()
+		if remaining < 0 {
+			remaining = 0
 		}
 
-		c.PrintDetails()
+		fmt.Printf("%s: %s %d nodes\n", c.Name, c.Clouds(), len(c.VMs))
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "  hourly:\t$%.2f\n", hourly)
+		fmt.Fprintf(tw, "  remaining:\t%s\n", remaining.Round(time.Second))
+		fmt.Fprintf(tw, "  total:\t$%.2f\n", hourly*remaining.Hours())
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		for _, v := range unpriced {
+			fmt.Printf("  %s: %s %q\n", vm.ErrUnknownPrice, v.Name, v.MachineType)
+		}
 		return nil
 	}),
 }
@@ -960,7 +3621,7 @@ var runCmd = &cobra.Command{
 		// Use "ssh" if an interactive session was requested (i.e. there is no
 		// remote command to run).
 		if len(args) == 1 {
-			return c.Ssh(nil, args[1:])
+			return explainNotRunning(c.Name, c.Ssh(nil, args[1:]))
 		}
 
 		cmd := strings.TrimSpace(strings.Join(args[1:], " "))
@@ -968,7 +3629,7 @@ var runCmd = &cobra.Command{
 		if len(title) > 30 {
 			title = title[:27] + "..."
 		}
-		return c.Run(os.Stdout, os.Stderr, c.Nodes, title, cmd)
+		return explainNotRunning(c.Name, c.Run(os.Stdout, os.Stderr, c.Nodes, title, cmd))
 	}),
 }
 
@@ -1108,6 +3769,57 @@ multiple nodes the destination file name will be prefixed with the node number.
 	}),
 }
 
+var collectCmd = &cobra.Command{
+	Use:   "collect <cluster> [<dir>]",
+	Short: "collect the logs and core dumps of the nodes into a local directory",
+	Long: `Collect the logs and core dumps of the nodes into a local directory.
+
+The paths of --path, which default to the logs directory of roachprod and
+/var/crash, where Ubuntu saves core dumps, are copied from each node in
+parallel into <dir>/<VM name>/, under home/ for the paths relative to the home
+directory of the remote user and root/ for absolute ones. <dir> defaults to
+<cluster>-collect-<time>. The paths may be directories or globs:
+
+  roachprod collect marc-test --path logs --path '/mnt/data1/cores/*' ./post-mortem
+
+The nodes are reached with the ssh key of their provider, and through the
+bastion if they have no public IP. Nodes which are down, and paths which cannot
+be copied, are reported without stopping the collection; paths which do not
+exist on a node are skipped. What was collected from where is recorded in
+<dir>/manifest.json. The command fails only if nothing could be collected.
+`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: wrapLongCtx(func(ctx context.Context, cmd *cobra.Command, args []string) error {
+		c, err := cloudClusterWithNodes(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		dir := fmt.Sprintf("%s-collect-%s", c.Name, time.Now().UTC().Format("20060102-150405"))
+		if len(args) == 2 {
+			dir = args[1]
+		}
+		fmt.Printf("Collecting %s from %d nodes into %s\n", strings.Join(collectPaths, ", "), len(c.VMs), dir)
+		manifest, err := vm.Collect(ctx, c.VMs, collectPaths, dir)
+		collected, missing := 0, 0
+		for _, e := range manifest.Entries {
+			switch {
+			case e.Error != "":
+				fmt.Printf("%s: %s: failed: %s\n", e.VM, e.RemotePath, e.Error)
+			case e.Missing:
+				missing++
+			default:
+				collected++
+			}
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("collected %d paths, %d missing, %d failed; see %s\n", collected, missing,
+			len(manifest.Failed()), filepath.Join(dir, vm.CollectManifestFile))
+		return nil
+	}),
+}
+
 var sqlCmd = &cobra.Command{
 	Use:   "sql <cluster> -- [args]",
 	Short: "run `cockroach sql` on a remote cluster",
@@ -1231,13 +3943,45 @@ func main() {
 	// that gcCmd and adminurlCmd contain a trailing \n in their Short help in
 	// order to separate the commands into logical groups.
 	cobra.EnableCommandSorting = false
+	clusterArgCmds = []*cobra.Command{
+		startCmd, stopCmd, wipeCmd,
+		extendCmd, destroyCmd, rebootCmd, resizeCmd, suspendCmd, resumeCmd, refreshCmd,
+		imageCmd, costCmd, verifyCmd, statusCmd, monitorCmd,
+		runCmd, collectCmd, sqlCmd,
+		adminurlCmd, pgurlCmd,
+	}
+	rootCmd.PersistentPreRunE = func(_ *cobra.Command, _ []string) error {
+		level, err := vm.ParseLevel(logLevel)
+		if err != nil {
+			return err
+		}
+		vm.SetVerbosity(level)
+		return nil
+	}
 	rootCmd.AddCommand(
 		createCmd,
 		destroyCmd,
 		extendCmd,
+		growCmd,
+		cloneCmd,
+		shrinkCmd,
+		rebootCmd,
+		resizeCmd,
+		suspendCmd,
+		resumeCmd,
+		refreshCmd,
+		recreateCmd,
+		sshConfigCmd,
+		imageCmd,
+		costCmd,
 		listCmd,
 		syncCmd,
 		gcCmd,
+		healthCmd,
+		verifyCmd,
+		providersCmd,
+		describeCmd,
+		metadataCmd,
 
 		statusCmd,
 		monitorCmd,
@@ -1250,6 +3994,7 @@ func main() {
 		installCmd,
 		putCmd,
 		getCmd,
+		collectCmd,
 		stageCmd,
 		sqlCmd,
 		pgurlCmd,
@@ -1257,14 +4002,70 @@ func main() {
 
 		webCmd,
 		dumpCmd,
+
+		createSpecHelp,
+		createVMsHelp,
+		createDisksHelp,
+		createNetworkHelp,
 	)
 
 	rootCmd.PersistentFlags().BoolVarP(
 		&quiet, "quiet", "q", false, "disable fancy progress output")
+	rootCmd.PersistentFlags().StringVar(&logLevel,
+		"log-level", defaultLogLevel(), "most verbose messages to log: error, warning, info or debug")
+	rootCmd.PersistentFlags().DurationVar(&operationTimeout,
+		"timeout", 15*time.Minute, "abort cloud operations which take longer than this; 0 disables the timeout. "+
+			"The commands which create and set up VMs, capture images or collect artifacts have no timeout unless it is given")
+	rootCmd.PersistentFlags().IntVar(&config.MaxRetries,
+		"max-retries", config.MaxRetries, "maximum number of retries of transient cloud API errors")
+	rootCmd.PersistentFlags().DurationVar(&config.MaxRetryBackoff,
+		"max-retry-backoff", config.MaxRetryBackoff, "maximum backoff between retries of cloud API errors")
+	rootCmd.PersistentFlags().IntVar(&config.MaxConcurrency,
+		"max-concurrency", config.MaxConcurrency, "maximum number of concurrent cloud API requests per provider")
+	rootCmd.PersistentFlags().IntVar(&config.Parallelism,
+		"parallelism", config.Parallelism, "maximum number of cloud API requests in flight across all providers (0 for no limit)")
+	rootCmd.PersistentFlags().Float64Var(&config.MaxQPS,
+		"max-qps", config.MaxQPS, "maximum rate of cloud API requests per second per provider (0 for no limit)")
+	for _, name := range vm.AllProviderNames() {
+		if name == config.Local {
+			continue
+		}
+		rootCmd.PersistentFlags().Var(providerQPS(name),
+			name+"-max-qps", "maximum rate of "+name+" API requests per second (defaults to --max-qps)")
+	}
+	rootCmd.PersistentFlags().BoolVar(&config.UseListCache,
+		"cached", config.UseListCache, "use the VMs listed by each cloud within --cache-ttl instead of listing them again")
+	rootCmd.PersistentFlags().DurationVar(&config.ListCacheTTL,
+		"cache-ttl", config.ListCacheTTL, "how long the VMs listed by a cloud are used with --cached")
+	rootCmd.PersistentFlags().StringSliceVar(&accountProviders,
+		"account-provider", nil, "only use the active accounts of these providers to determine the username")
+	rootCmd.PersistentFlags().StringVar(&config.SSHKeyPath,
+		"ssh-key", os.Getenv("ROACHPROD_SSH_KEY"),
+		"private ssh key used to connect to VMs and registered with the clouds (generated if missing)")
+	rootCmd.PersistentFlags().StringVar(&dns.ProviderName,
+		"dns-provider", dns.ProviderName, "provider (aws or gce) of the DNS zone in which to register cluster nodes")
+	rootCmd.PersistentFlags().StringVar(&dns.Zone,
+		"dns-zone", dns.Zone, "DNS zone (hosted zone ID for aws) in which to register cluster nodes")
+	rootCmd.PersistentFlags().StringVar(&dns.Domain,
+		"dns-domain", dns.Domain, "domain of the DNS zone; nodes are registered as n<node>.<cluster>.<domain>")
+	rootCmd.PersistentFlags().StringVar(&config.BastionHost,
+		"bastion", os.Getenv("ROACHPROD_BASTION"),
+		"jump host (host[:port]) through which to reach the VMs without public IPs")
+	rootCmd.PersistentFlags().StringVar(&config.BastionUser,
+		"bastion-user", os.Getenv("ROACHPROD_BASTION_USER"), "user to log into the bastion as (defaults to the ssh default)")
+	rootCmd.PersistentFlags().StringVar(&config.BastionKeyPath,
+		"bastion-key", os.Getenv("ROACHPROD_BASTION_KEY"), "private ssh key used to connect to the bastion")
 
-	for _, cmd := range []*cobra.Command{createCmd, destroyCmd, extendCmd} {
+	for _, cmd := range []*cobra.Command{
+		createCmd, destroyCmd, extendCmd, growCmd, shrinkCmd, rebootCmd, resizeCmd, suspendCmd,
+		resumeCmd, imageCmd, costCmd, describeCmd, metadataCmd,
+	} {
 		cmd.Flags().StringVarP(&username, "username", "u", os.Getenv("ROACHPROD_USER"),
 			"Username to run under, detect if blank")
+		if cmd != createCmd {
+			cmd.Flags().BoolVar(&allUsers,
+				"all-users", false, "Allow operating on clusters which belong to other users")
+		}
 	}
 
 	for _, cmd := range []*cobra.Command{statusCmd, monitorCmd, startCmd,
@@ -1277,8 +4078,65 @@ func main() {
 
 	createCmd.Flags().DurationVarP(&createVMOpts.Lifetime,
 		"lifetime", "l", 12*time.Hour, "Lifetime of the cluster")
+	extendCmd.Flags().BoolVarP(&extendMine,
+		"mine", "m", false, "Extend all clusters belonging to the current user")
 	createCmd.Flags().BoolVar(&createVMOpts.UseLocalSSD,
 		"local-ssd", true, "Use local SSD")
+	createCmd.Flags().IntVar(&createVMOpts.BootDiskSizeGB,
+		"disk-size", 0, "Boot disk size in GB (0 selects the cloud's default)")
+	createCmd.Flags().StringVar(&createVMOpts.BootDiskType,
+		"disk-type", "", "Boot disk type, e.g. pd-ssd (GCE) or gp3 (AWS)")
+	createCmd.Flags().BoolVar(&createVMOpts.NoPublicIP,
+		"no-public-ip", false, "Create VMs without public IPs, which are then reached at their private IPs")
+	createCmd.Flags().BoolVar(&createVMOpts.StaticIP,
+		"static-ip", false, "Reserve a static IP for each VM, reusing those kept by a previous cluster of the same name")
+	createCmd.Flags().BoolVar(&createVMOpts.KeepStaticIP,
+		"keep-static-ip", false, "Keep the static IPs of --static-ip when the cluster is destroyed")
+	createCmd.Flags().IntVar(&createVMOpts.MTU,
+		"mtu", 0, "MTU of the network interfaces of the VMs (0 keeps that of the network)")
+	createCmd.Flags().IntVar(&createVMOpts.NetworkInterfaces,
+		"nics", 1, "Number of network interfaces of each VM")
+	createCmd.Flags().StringVar(&createVMOpts.NetworkTier,
+		"network-tier", "", "Network tier of the public IPs, PREMIUM or STANDARD (defaults to that of the project; GCE only)")
+	createCmd.Flags().StringVar(&createVMOpts.SSHUser,
+		"ssh-user", "", "User to log into the VMs as (defaults to the user of the OS image)")
+	createCmd.Flags().StringArrayVar(&createExistingDisks,
+		"existing-disk", nil, "Existing disk (<node>=<GCE disk or EBS volume ID>) holding the data of a node; may be repeated")
+	createCmd.Flags().BoolVar(&createVMOpts.KeepExistingDisks,
+		"keep-existing-disks", false, "Keep the disks of --existing-disk when the cluster is destroyed")
+	createCmd.Flags().BoolVar(&createInternalDNS,
+		"internal-dns", false, "Let the nodes resolve each other's private IPs as n1, n2, ...")
+	createCmd.Flags().StringVar(&createInternalDNSSuffix,
+		"internal-dns-suffix", "", "Search domain of the nodes, under which they are also named n1.<suffix>, ... (implies --internal-dns)")
+	createCmd.Flags().IntVar(&createVMOpts.Size.CPUs,
+		"cpus", 0, "Number of vCPUs of the VMs, which selects the closest machine type of each cloud")
+	createCmd.Flags().Float64Var(&createVMOpts.Size.MemoryGB,
+		"mem-gb", 0, "Memory of the VMs in GB, combined with --cpus")
+	createCmd.Flags().StringVarP(&createSpecFile,
+		"file", "f", "", "Cluster spec (a JSON file, or - for stdin) with the name, nodes, zones, machine type and disks; "+
+			`see "roachprod help create-spec"`)
+	createCmd.Flags().StringVar(&createNodeSpecs,
+		"node-spec", "", "Per-node machine types and disks (a JSON file name or the JSON itself), keyed by node number; "+
+			`see "roachprod help create-spec"`)
+	createCmd.Flags().BoolVar(&createVMOpts.SkipQuotaCheck,
+		"skip-quota-check", false, "Create the VMs without checking the quotas of the clouds first")
+	createCmd.Flags().StringVar(&createVMOpts.Placement,
+		"placement", "", "Placement policy of the VMs: spread to place them on distinct hardware")
+	createCmd.Flags().BoolVar(&createVMOpts.Preemptible,
+		"preemptible", false, "Use preemptible (GCE) or spot (AWS) instances")
+	createCmd.Flags().StringVar(&createVMOpts.MaintenancePolicy,
+		"maintenance-policy", "", "What to do with the VMs during host maintenance, MIGRATE or TERMINATE "+
+			"(defaults to TERMINATE for preemptible VMs and VMs with GPUs, and MIGRATE otherwise; GCE only)")
+	createCmd.Flags().BoolVar(&createAutoRestart,
+		"auto-restart", true, "Restart or recover the VMs after a failure of their host (the cloud's default applies unless given)")
+	createCmd.Flags().IntVar(&createVMOpts.GPUCount,
+		"gpu-count", 0, "Number of GPUs to attach to each VM")
+	createCmd.Flags().StringVar(&createVMOpts.GPUType,
+		"gpu-type", "nvidia-tesla-k80", "Type of the GPUs attached via --gpu-count")
+	createCmd.Flags().StringVar(&createVMOpts.Image,
+		"image", "", "Boot the VMs from an image captured via \"roachprod image\"")
+	createCmd.Flags().StringArrayVar(&createLabels,
+		"label", nil, "Label (key=value) to attach to the VMs; may be repeated")
 	createCmd.Flags().IntVarP(&numNodes,
 		"nodes", "n", 4, "Total number of nodes, distributed across all clouds")
 	createCmd.Flags().StringSliceVarP(&createVMOpts.VMProviders,
@@ -1286,30 +4144,131 @@ func main() {
 		fmt.Sprintf("The cloud provider(s) to use when creating new vm instances: %s", vm.AllProviderNames()))
 	createCmd.Flags().BoolVar(&createVMOpts.GeoDistributed,
 		"geo", false, "Create geo-distributed cluster")
+	createCmd.Flags().StringSliceVar(&geoWeights,
+		"geo-weights", nil, "Weights (region=weight) by which the nodes are distributed over regions; implies --geo")
 	// Allow each Provider to inject additional configuration flags
-	for _, p := range vm.Providers {
+	for _, p := range vm.AllProviders() {
 		p.Flags().ConfigureCreateFlags(createCmd.Flags())
 
 		for _, cmd := range []*cobra.Command{
-			createCmd, destroyCmd, extendCmd, listCmd, syncCmd, gcCmd,
+			createCmd, destroyCmd, extendCmd, growCmd, cloneCmd, shrinkCmd, rebootCmd, resizeCmd,
+			suspendCmd, resumeCmd, refreshCmd, recreateCmd, sshConfigCmd, imageCmd, costCmd, listCmd, syncCmd, gcCmd,
+			healthCmd, verifyCmd, providersCmd, describeCmd, metadataCmd, collectCmd,
 		} {
 			p.Flags().ConfigureClusterFlags(cmd.Flags())
 		}
 	}
 
+	for _, cmd := range []*cobra.Command{createCmd, extendCmd} {
+		cmd.Flags().DurationVar(&config.MaxLifetime,
+			"max-lifetime", config.MaxLifetime, "longest lifetime of the VMs (0 for no limit)")
+	}
+	sshConfigCmd.Flags().StringVar(&sshConfigFormat,
+		"format", "config", "Output format: config (an ssh_config snippet), commands or json")
+	recreateCmd.Flags().DurationVar(&recreateWatch,
+		"watch", 0, "Check for preempted nodes at this interval until interrupted (0 to check once)")
+	extendCmd.Flags().BoolVar(&config.RejectLongLifetimes,
+		"reject-max-lifetime", false, "fail rather than cap lifetimes beyond their maximum")
 	extendCmd.Flags().DurationVarP(&extendLifetime,
 		"lifetime", "l", 12*time.Hour, "Lifetime of the cluster")
 
+	for _, cmd := range []*cobra.Command{growCmd, recreateCmd} {
+		cmd.Flags().BoolVar(&createVMOpts.UseLocalSSD,
+			"local-ssd", true, "Use local SSD")
+	}
+
+	for _, cmd := range []*cobra.Command{createCmd, growCmd, recreateCmd} {
+		cmd.Flags().IntVar(&createVMOpts.LocalSSDCount,
+			"local-ssd-count", 1, "Number of local SSDs to attach with --local-ssd")
+		cmd.Flags().IntVar(&createVMOpts.DataDiskCount,
+			"data-disk-count", 0, "Number of persistent data disks to attach in place of local SSDs")
+		cmd.Flags().IntVar(&createVMOpts.DataDiskSizeGB,
+			"data-disk-size", 0, "Data disk size in GB (0 selects the cloud's default)")
+		cmd.Flags().StringVar(&createVMOpts.DataDiskType,
+			"data-disk-type", "", "Data disk type, e.g. pd-standard (GCE), gp3 (AWS) or Premium_LRS (Azure)")
+	}
+
+	for _, cmd := range []*cobra.Command{createCmd, growCmd, cloneCmd, recreateCmd} {
+		cmd.Flags().StringVar(&createStartupScript,
+			"startup-script", "", "Script (@<file> or inline:<script>) to run when each VM first boots")
+		cmd.Flags().DurationVar(&sshTimeout,
+			"ssh-timeout", 2*time.Minute, "How long to wait for ssh to become available on new VMs")
+	}
+
+	for _, cmd := range []*cobra.Command{createCmd, cloneCmd} {
+		cmd.Flags().StringArrayVar(&createIngress,
+			"ingress", nil, "Firewall rule (<port>[-<port>]@<cidr>) admitting connections to the VMs; may be repeated")
+		cmd.Flags().StringSliceVar(&createIngressCIDRs,
+			"ingress-cidr", nil, "CIDRs from which the firewall admits connections to ports 22, 26257 and 8080")
+	}
+
+	for _, cmd := range []*cobra.Command{destroyCmd, extendCmd, growCmd, shrinkCmd, resizeCmd, recreateCmd} {
+		cmd.Flags().DurationVar(&lockWait,
+			"lock-wait", 0, "How long to wait for the lock of a cluster which another user holds")
+		cmd.Flags().BoolVar(&forceLock,
+			"force-lock", false, "Override the lock of a cluster which another user holds")
+	}
+
+	for _, cmd := range []*cobra.Command{destroyCmd, shrinkCmd, rebootCmd, resizeCmd, suspendCmd, resumeCmd} {
+		cmd.Flags().BoolVar(&otherUserYes,
+			"yes", false, "Operate on the clusters of other users without asking for confirmation")
+	}
+
+	for _, cmd := range []*cobra.Command{createCmd, destroyCmd} {
+		cmd.Flags().BoolVar(&config.DryRun,
+			"dry-run", false, "Print the cloud API calls which would be made, without making them")
+	}
+
+	resizeCmd.Flags().StringVar(&resizeMachine,
+		"machine-type", "", "The new machine type for the VMs")
+
+	describeCmd.Flags().BoolVar(&describeDisks,
+		"disks", false, "Show the disks attached to the VMs")
+	describeCmd.Flags().BoolVar(&describeNICs,
+		"nics", false, "Show the network interfaces of the VMs")
+	describeCmd.Flags().BoolVar(&describeScheduling,
+		"scheduling", false, "Show the maintenance policy and automatic restart of the VMs")
+
 	listCmd.Flags().BoolVarP(&listDetails,
 		"details", "d", false, "Show cluster details")
 	listCmd.Flags().BoolVar(&listJSON,
 		"json", false, "Show cluster specs in a json format")
 	listCmd.Flags().BoolVarP(&listMine,
 		"mine", "m", false, "Show only clusters belonging to the current user")
+	listCmd.Flags().StringVar(&listUser,
+		"user", "", "Show only clusters belonging to the given user")
+	listCmd.Flags().StringVar(&listSortBy,
+		"sort-by", listSortBy, "Order clusters by name or expiry")
+	listCmd.Flags().BoolVar(&listExpired,
+		"expired", false, "Show only the clusters whose lifetime has elapsed")
+	listCmd.Flags().DurationVar(&listExpiring,
+		"expiring-within", 0, "Show only the clusters whose lifetime elapses within the duration")
+	listCmd.Flags().StringVar(&listFilter,
+		"filter", "", "Show only VMs whose labels match the filter, e.g. team=kv,!purpose=perf")
+
+	healthCmd.Flags().BoolVar(&healthJSON,
+		"json", false, "Show the results in json format")
+
+	verifyCmd.Flags().BoolVar(&verifyJSON,
+		"json", false, "Show the report in json format")
+
+	providersCmd.Flags().BoolVar(&providersJSON,
+		"json", false, "Show the providers in json format")
+	providersCmd.Flags().BoolVar(&providersVerbose,
+		"verbose", false, "Show every optional feature of each provider, with its limits")
+
+	collectCmd.Flags().StringArrayVar(&collectPaths,
+		"path", collectPaths, "Remote path to collect from each node, relative to the home directory unless absolute; may be repeated")
 
 	gcCmd.Flags().BoolVarP(
 		&dryrun, "dry-run", "n", dryrun, "dry run (don't perform any actions)")
 	gcCmd.Flags().StringVar(&config.SlackToken, "slack-token", "", "Slack bot token")
+	gcCmd.Flags().DurationVar(&gcGracePeriod,
+		"grace-period", 0, "How long after expiring a cluster is destroyed")
+	gcCmd.Flags().DurationVar(&gcOlderThan,
+		"older-than", 0, "Destroy the clusters created longer ago than this, whatever their lifetime")
+	gcCmd.Flags().BoolVar(&gcYes,
+		"yes", false, "Destroy the clusters of --older-than without asking for confirmation")
 
 	pgurlCmd.Flags().BoolVar(
 		&external, "external", false, "return pgurls for external connections")
@@ -1347,6 +4306,7 @@ func main() {
 	for _, cmd := range []*cobra.Command{
 		getCmd, putCmd, runCmd, startCmd, statusCmd, stopCmd, testCmd,
 		wipeCmd, pgurlCmd, adminurlCmd, sqlCmd, installCmd,
+		rebootCmd, resizeCmd, suspendCmd, resumeCmd, refreshCmd, imageCmd, costCmd,
 	} {
 		switch cmd {
 		case startCmd, testCmd:
@@ -1396,7 +4356,7 @@ Node specification
 	}
 
 	var err error
-	config.OSUser, err = user.Current()
+	config.OSUser, err = config.CurrentUser()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "unable to lookup current user: %s\n", err)
 		os.Exit(1)
@@ -1409,7 +4369,7 @@ Node specification
 
 	if err := loadClusters(); err != nil {
 		// We don't want to exit as we may be looking at the help message.
-		fmt.Printf("problem loading clusters: %s\n", err)
+		fmt.Fprintf(os.Stderr, "problem loading clusters: %s\n", err)
 	}
 
 	if err := rootCmd.Execute(); err != nil {
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadStartupScript(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "setup.sh")
+	if err := ioutil.WriteFile(file, []byte("apt-get install -y fio\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		flag     string
+		expected string
+		err      bool
+	}{
+		{flag: ""},
+		{flag: "@" + file, expected: "apt-get install -y fio\n"},
+		{flag: file, expected: "apt-get install -y fio\n"},
+		{flag: "inline:reboot", expected: "reboot"},
+		{flag: "touch /tmp/ready", expected: "touch /tmp/ready"},
+		// A mistyped file name is not taken for a script.
+		{flag: file + ".missing", err: true},
+		{flag: "@" + file + ".missing", err: true},
+	} {
+		script, err := readStartupScript(tc.flag)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tc.flag, script)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.flag, err)
+		} else if script != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.flag, tc.expected, script)
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/vm"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
@@ -85,27 +86,77 @@ func getSSHKeySigner(path string, haveAgent bool) ssh.Signer {
 	return signer
 }
 
-func getDefaultSSHKeySigners(haveAgent bool) []ssh.Signer {
-	var signers []ssh.Signer
+// getDefaultSSHKeySigners returns the signers of the key of the provider, if
+// any, followed by those of config.SSHKeyPath and the default keys.
+func getDefaultSSHKeySigners(keyPath string, haveAgent bool) []ssh.Signer {
+	var paths []string
+	if keyPath != "" {
+		paths = append(paths, keyPath)
+	}
+	if config.SSHKeyPath != "" {
+		paths = append(paths, os.ExpandEnv(config.SSHKeyPath))
+	}
 	for _, name := range []string{"id_rsa", "google_compute_engine"} {
-		s := getSSHKeySigner(filepath.Join(config.OSUser.HomeDir, ".ssh", name), haveAgent)
-		if s != nil {
+		paths = append(paths, filepath.Join(config.OSUser.HomeDir, ".ssh", name))
+	}
+	var signers []ssh.Signer
+	seen := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if s := getSSHKeySigner(path, haveAgent); s != nil {
 			signers = append(signers, s)
 		}
 	}
 	return signers
 }
 
-func newSSHClient(user, host string) (*ssh.Client, net.Conn, error) {
+// getSigners returns the signers with which to log into the VMs of a
+// provider whose key is keyPath: those of the ssh agent, followed by
+// getDefaultSSHKeySigners.
+func getSigners(keyPath string) []ssh.Signer {
+	sshState.agentInit.Do(func() {
+		sshState.agentSigners = getSSHAgentSigners()
+	})
+	sshState.signersMu.Lock()
+	defer sshState.signersMu.Unlock()
+	signers, ok := sshState.signers[keyPath]
+	if !ok {
+		haveAgentSigner := len(sshState.agentSigners) > 0
+		signers = append(append([]ssh.Signer(nil), sshState.agentSigners...),
+			getDefaultSSHKeySigners(keyPath, haveAgentSigner)...)
+		sshState.signers[keyPath] = signers
+	}
+	return signers
+}
+
+// newSSHClient connects to host, a VM reached as described by access, through
+// its bastion if it has one. The port of host defaults to 22.
+func newSSHClient(user, host string, access vm.SSHAccess) (*ssh.Client, net.Conn, error) {
 	config := &ssh.ClientConfig{
 		User:            user,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(sshState.signers...)},
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(getSigners(access.KeyPath)...)},
 		HostKeyCallback: getKnownHosts(),
 	}
 	config.SetDefaults()
 
-	addr := fmt.Sprintf("%s:22", host)
-	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, "22")
+	}
+	var conn net.Conn
+	var err error
+	if b, ok := access.BastionTo(host); ok {
+		var bastion *ssh.Client
+		if bastion, err = getBastionClient(b); err != nil {
+			return nil, nil, errors.Wrapf(err, "unable to connect to bastion %s", b.Host)
+		}
+		conn, err = bastion.Dial("tcp", addr)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -116,22 +167,57 @@ func newSSHClient(user, host string) (*ssh.Client, net.Conn, error) {
 	return ssh.NewClient(c, chans, reqs), conn, nil
 }
 
+// getBastionClient returns the client connected to the bastion, which is
+// shared by the connections through it.
+func getBastionClient(b vm.Bastion) (*ssh.Client, error) {
+	user := b.User
+	if user == "" {
+		user = config.OSUser.Username
+	}
+	sshState.clientMu.Lock()
+	target := fmt.Sprintf("bastion %s@%s", user, b.Addr())
+	client := sshState.clients[target]
+	if client == nil {
+		client = &sshClient{}
+		sshState.clients[target] = client
+	}
+	sshState.clientMu.Unlock()
+
+	client.Lock()
+	defer client.Unlock()
+	if client.Client == nil {
+		var err error
+		client.Client, _, err = newSSHClient(user, b.Addr(), vm.SSHAccess{KeyPath: b.KeyPath})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return client.Client, nil
+}
+
 type sshClient struct {
 	sync.Mutex
 	*ssh.Client
 }
 
 var sshState = struct {
-	signers     []ssh.Signer
-	signersInit sync.Once
+	// agentSigners are those of the ssh agent, and signers those of
+	// getSigners, keyed by the key of the provider.
+	agentSigners []ssh.Signer
+	agentInit    sync.Once
+	signers      map[string][]ssh.Signer
+	signersMu    sync.Mutex
 
 	clients  map[string]*sshClient
 	clientMu sync.Mutex
 }{
+	signers: map[string][]ssh.Signer{},
 	clients: map[string]*sshClient{},
 }
 
-func NewSSHSession(user, host string) (*ssh.Session, error) {
+// NewSSHSession returns a session on host, a VM reached as described by
+// access, logged in as user.
+func NewSSHSession(user, host string, access vm.SSHAccess) (*ssh.Session, error) {
 	if host == "127.0.0.1" || host == "localhost" {
 		return nil, errors.New("unable to ssh to localhost; file a bug")
 	}
@@ -145,17 +231,11 @@ func NewSSHSession(user, host string) (*ssh.Session, error) {
 	}
 	sshState.clientMu.Unlock()
 
-	sshState.signersInit.Do(func() {
-		sshState.signers = append(sshState.signers, getSSHAgentSigners()...)
-		haveAgentSigner := len(sshState.signers) > 0
-		sshState.signers = append(sshState.signers, getDefaultSSHKeySigners(haveAgentSigner)...)
-	})
-
 	client.Lock()
 	defer client.Unlock()
 	if client.Client == nil {
 		var err error
-		client.Client, _, err = newSSHClient(user, host)
+		client.Client, _, err = newSSHClient(user, host, access)
 		if err != nil {
 			return nil, err
 		}
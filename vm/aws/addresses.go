@@ -0,0 +1,215 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// jsonAddress is an Elastic IP, as reported by describe-addresses.
+type jsonAddress struct {
+	AllocationId string
+	PublicIp     string
+	// AssociationId and InstanceId are set while the address is associated
+	// with an instance.
+	AssociationId string
+	InstanceId    string
+	Tags          []struct {
+		Key   string
+		Value string
+	}
+}
+
+// name returns the Name tag of the address.
+func (a jsonAddress) name() string {
+	for _, tag := range a.Tags {
+		if tag.Key == "Name" {
+			return tag.Value
+		}
+	}
+	return ""
+}
+
+// listAddresses returns the Elastic IPs of the named VMs in a region which
+// exist, keyed by the name of the VM. The addresses are identified by their
+// Name tag, since they have no name of their own.
+func listAddresses(ctx context.Context, region string, names []string) (map[string]jsonAddress, error) {
+	byAddress := make(map[string]string, len(names))
+	values := make([]string, len(names))
+	for i, name := range names {
+		byAddress[vm.StaticIPName(name)] = name
+		values[i] = vm.StaticIPName(name)
+	}
+	args := []string{"ec2", "describe-addresses", "--region", region,
+		"--filters", "Name=tag:Name,Values=" + strings.Join(values, ",")}
+	var data struct {
+		Addresses []jsonAddress
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]jsonAddress, len(data.Addresses))
+	for _, a := range data.Addresses {
+		if name, ok := byAddress[a.name()]; ok {
+			ret[name] = a
+		}
+	}
+	return ret, nil
+}
+
+// allocateAddressArgs returns the arguments of the allocate-address command
+// which reserves the Elastic IP of the named VM.
+func allocateAddressArgs(region, name string) []string {
+	return []string{"ec2", "allocate-address", "--domain", "vpc", "--region", region,
+		"--tag-specifications", fmt.Sprintf(
+			"ResourceType=elastic-ip,Tags=[{Key=Name,Value=%s},{Key=Roachprod,Value=true}]",
+			vm.StaticIPName(name))}
+}
+
+// reserveAddresses ensures that an Elastic IP exists for each VM in regions,
+// which maps the names of the VMs to their regions. The addresses left by
+// previous VMs of the same names are reused, provided that they are not
+// associated with another instance. The allocation ids of the addresses are
+// returned, keyed by the name of the VM, along with the names of the VMs whose
+// addresses were allocated here, keyed by region. If any of the addresses
+// cannot be allocated, e.g. because the Elastic IP quota of a region is
+// exhausted, those allocated here are released.
+func reserveAddresses(
+	ctx context.Context, regions map[string]string,
+) (allocations map[string]string, reserved map[string][]string, _ error) {
+	byRegion := make(map[string][]string)
+	for name, region := range regions {
+		byRegion[region] = append(byRegion[region], name)
+	}
+	regionList := make([]string, 0, len(byRegion))
+	for region := range byRegion {
+		regionList = append(regionList, region)
+		sort.Strings(byRegion[region])
+	}
+	sort.Strings(regionList)
+
+	var mu sync.Mutex
+	allocations = make(map[string]string, len(regions))
+	reserved = make(map[string][]string)
+	missing := make(map[string][]string)
+	err := vm.ForEach(len(regionList), func(i int) error {
+		region := regionList[i]
+		existing, err := listAddresses(ctx, region, byRegion[region])
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, name := range byRegion[region] {
+			a, ok := existing[name]
+			switch {
+			case !ok:
+				missing[region] = append(missing[region], name)
+			case a.AssociationId != "":
+				return errors.Errorf("static IP %s (%s) is in use by %s",
+					vm.StaticIPName(name), a.PublicIp, a.InstanceId)
+			default:
+				allocations[name] = a.AllocationId
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.DryRun {
+		for _, region := range regionList {
+			for _, name := range missing[region] {
+				vm.PrintDryRun("aws", allocateAddressArgs(region, name))
+			}
+		}
+		return allocations, missing, nil
+	}
+
+	err = vm.ForEach(len(regionList), func(i int) error {
+		region := regionList[i]
+		for _, name := range missing[region] {
+			var data struct {
+				AllocationId string
+			}
+			if err := runJSONCommand(ctx, allocateAddressArgs(region, name), &data); err != nil {
+				if strings.Contains(err.Error(), "AddressLimitExceeded") {
+					return errors.Errorf("the Elastic IP quota of region %s does not allow %d more addresses; "+
+						"release unused addresses or create the cluster without --static-ip: %s",
+						region, len(missing[region]), err)
+				}
+				return errors.Wrapf(err, "could not allocate a static IP for %s", name)
+			}
+			mu.Lock()
+			allocations[name] = data.AllocationId
+			reserved[region] = append(reserved[region], name)
+			mu.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		if releaseErr := releaseAddresses(ctx, reserved); releaseErr != nil {
+			vm.Warningf("unable to release the static IPs allocated for %v: %s", reserved, releaseErr)
+		}
+		return nil, nil, err
+	}
+	return allocations, reserved, nil
+}
+
+// associateAddress associates the Elastic IP with the instance once it is
+// running.
+func associateAddress(ctx context.Context, region, instanceID, allocationID string) error {
+	for _, args := range [][]string{
+		{"ec2", "wait", "instance-running", "--instance-ids", instanceID},
+		{"ec2", "associate-address", "--instance-id", instanceID, "--allocation-id", allocationID},
+	} {
+		if err := runCommand(ctx, append(args, "--region", region)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseAddresses releases the Elastic IPs of the VMs whose names are keyed
+// by region, which must no longer be associated with instances. Addresses
+// which do not exist are ignored.
+func releaseAddresses(ctx context.Context, byRegion map[string][]string) error {
+	regions := make([]string, 0, len(byRegion))
+	for region := range byRegion {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	if config.DryRun {
+		for _, region := range regions {
+			for _, name := range byRegion[region] {
+				vm.PrintDryRun("aws", []string{"ec2", "release-address", "--region", region,
+					"--allocation-id", fmt.Sprintf("<%s>", vm.StaticIPName(name))})
+			}
+		}
+		return nil
+	}
+	return vm.ForEach(len(regions), func(i int) error {
+		region := regions[i]
+		existing, err := listAddresses(ctx, region, byRegion[region])
+		if err != nil {
+			return err
+		}
+		for _, name := range byRegion[region] {
+			a, ok := existing[name]
+			if !ok {
+				continue
+			}
+			if err := runCommand(ctx, []string{"ec2", "release-address", "--region", region,
+				"--allocation-id", a.AllocationId}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
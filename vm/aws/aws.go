@@ -1,14 +1,20 @@
 package aws
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cockroachdb/roachprod/config"
 	"github.com/cockroachdb/roachprod/vm"
 	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
@@ -17,7 +23,16 @@ import (
 
 const ProviderName = "aws"
 
-// init will inject the AWS provider into vm.Providers, but only
+// lifetimeTag is the tag holding the lifetime of an instance, which EC2 does
+// not track itself. It is set at creation, updated by Extend and read back by
+// List.
+const lifetimeTag = "Lifetime"
+
+// defaultRemoteUser is the user of the Ubuntu AMIs, as which the instances
+// are logged into unless another is chosen (see remoteUser).
+const defaultRemoteUser = "ubuntu"
+
+// init will register the AWS provider with vm.MustRegister, but only
 // if the aws tool is available on the local path.
 func init() {
 	if _, err := exec.LookPath("aws"); err == nil {
@@ -35,7 +50,7 @@ func init() {
 		}
 
 		if haveCredentials() {
-			vm.Providers[ProviderName] = &Provider{}
+			vm.MustRegister(ProviderName, &Provider{})
 		}
 	} else {
 		// TODO(bob): This breaks the use of `roachprod pgurl --external` to
@@ -47,12 +62,29 @@ func init() {
 
 // providerOpts implements the vm.ProviderFlags interface for aws.Provider.
 type providerOpts struct {
-	AMI            []string
-	MachineType    string
-	SecurityGroups []string
-	SSDMachineType string
-	Subnets        []string
-	RemoteUserName string
+	AMI         []string
+	DefaultZone string
+	// Enclave launches the instances with Nitro Enclaves enabled.
+	Enclave     bool
+	IAMProfile  string
+	MachineType string
+	// MachineTypeFallbacks are used, in order, in zones which do not offer
+	// MachineType or SSDMachineType.
+	MachineTypeFallbacks []string
+	OSImage              string
+	OSImageOwner         string
+	SecurityGroups       []string
+	SSDMachineType       string
+	Subnets              []string
+	RemoteUserName       string
+	SpotMaxPrice         string
+	SSHKey               string
+	Bastion              string
+	// Template is a launch template which determines all of the properties
+	// of the instances but their names, zones, tags and key pair.
+	Template string
+	VPCs     []string
+	Zones    []string
 }
 
 // ConfigureCreateFlags is part of the vm.ProviderFlags interface.
@@ -69,16 +101,27 @@ func (o *providerOpts) ConfigureCreateFlags(flags *pflag.FlagSet) {
 			"us-west-2:ami-79873901",
 		},
 		"AMI images for each region")
+	flags.StringVar(&o.OSImage, ProviderName+"-os-image", "",
+		"Name pattern (e.g. ubuntu/images/hvm-ssd/ubuntu-focal-20.04-amd64-server-*) of the AMI "+
+			"to use in every region instead of --"+ProviderName+"-ami; the newest match is used")
+	flags.StringVar(&o.OSImageOwner, ProviderName+"-os-image-owner", "099720109477",
+		"Owner of the AMIs matched by --"+ProviderName+"-os-image (defaults to Canonical)")
 
 	// m5.xlarge is a 4core, 16Gb instance, approximately equal to a GCE n1-standard-4
-	flags.StringVar(&o.MachineType, ProviderName+"-machine-type", "m5.xlarge",
+	flags.StringVar(&o.MachineType, ProviderName+"-machine-type",
+		vm.EnvDefault("ROACHPROD_AWS_MACHINE_TYPE", "m5.xlarge"),
 		"Machine type (see https://aws.amazon.com/ec2/instance-types/)")
 
 	// The m5 devices only support EBS volumes, so we need a different instance type
 	// for directly-attached SSD support. This is 4 core, 16GB ram, 150GB ssd.
-	flags.StringVar(&o.SSDMachineType, ProviderName+"-machine-type-ssd", "m5d.xlarge",
+	flags.StringVar(&o.SSDMachineType, ProviderName+"-machine-type-ssd",
+		vm.EnvDefault("ROACHPROD_AWS_MACHINE_TYPE_SSD", "m5d.xlarge"),
 		"Machine type for --local-ssd (see https://aws.amazon.com/ec2/instance-types/)")
 
+	flags.StringSliceVar(&o.MachineTypeFallbacks, ProviderName+"-machine-type-fallbacks", nil,
+		"Machine types to use, in order, in zones which do not offer the machine type chosen by "+
+			"--"+ProviderName+"-machine-type or --"+ProviderName+"-machine-type-ssd")
+
 	// The subnet actually controls placement into a particular AZ
 	flags.StringSliceVar(&o.Subnets, ProviderName+"-subnet",
 		[]string{
@@ -90,7 +133,11 @@ func (o *providerOpts) ConfigureCreateFlags(flags *pflag.FlagSet) {
 			"us-west-2b:subnet-2910174c",
 			"us-west-2c:subnet-da2a5783",
 		},
-		"Subnet id for zones in each region")
+		"Subnet id for each zone (e.g. us-east-2b:subnet-49170331); geo-distributed clusters use the subnet of each zone")
+
+	// By default, the VPC is whichever one contains the subnet.
+	flags.StringSliceVar(&o.VPCs, ProviderName+"-vpc", nil,
+		"VPC id in each region (e.g. us-east-2:vpc-0a1b2c3d); the subnets must belong to it")
 
 	// Set up a roachprod security group in each region
 	flags.StringSliceVar(&o.SecurityGroups, ProviderName+"-sg",
@@ -99,12 +146,43 @@ func (o *providerOpts) ConfigureCreateFlags(flags *pflag.FlagSet) {
 			"us-west-2:sg-00dfe24958e988576"},
 		"Security group id in each region")
 
+	// By default, the zones are derived from the subnets, starting with the
+	// default zone.
+	flags.StringVar(&o.DefaultZone, ProviderName+"-default-zone", os.Getenv("ROACHPROD_AWS_ZONE"),
+		"Zone used first when --aws-zones is not given; its region is the primary region of --geo clusters")
+	flags.StringSliceVar(&o.Zones, ProviderName+"-zones", nil,
+		"Zones for cluster, by name or ID, optionally with a node count per zone "+
+			"(e.g. us-east-2b:3,usw2-az1:2); each zone must have a subnet")
+
+	flags.StringVar(&o.IAMProfile, ProviderName+"-iam-profile", os.Getenv("ROACHPROD_AWS_IAM_PROFILE"),
+		"IAM instance profile to attach to the VMs, giving them access to the AWS APIs allowed by its role "+
+			"(defaults to $ROACHPROD_AWS_IAM_PROFILE)")
+
 	// AWS images generally use "ubuntu" or "ec2-user"
-	flags.StringVar(&o.RemoteUserName, ProviderName+"-user",
-		"ubuntu", "Name of the remote user to SSH as")
+	flags.StringVar(&o.RemoteUserName, ProviderName+"-user", "",
+		"Name of the remote user to SSH as (defaults to --ssh-user, or the user of the distribution of "+
+			"--"+ProviderName+"-os-image, or "+defaultRemoteUser+")")
+
+	// If no max price is given, AWS caps the spot price at the on-demand price.
+	flags.StringVar(&o.SpotMaxPrice, ProviderName+"-spot-max-price", "",
+		"Maximum hourly price in USD for --preemptible spot instances (defaults to the on-demand price)")
+
+	flags.StringVar(&o.Template, ProviderName+"-template", "",
+		"Launch template to create the VMs from, in each region; only their names, zones and tags are set by roachprod")
+	flags.BoolVar(&o.Enclave, ProviderName+"-enclave", false,
+		"Launch the instances with Nitro Enclaves enabled; requires an instance type which supports them")
 }
 
 func (o *providerOpts) ConfigureClusterFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&profile, ProviderName+"-account-profile", os.Getenv("ROACHPROD_AWS_PROFILE"),
+		"Named profile of the AWS CLI whose account and credentials to use (defaults to the CLI's default profile)")
+	flags.StringVar(&endpointURL, ProviderName+"-endpoint-url", os.Getenv("ROACHPROD_AWS_ENDPOINT_URL"),
+		"URL of the EC2 API endpoint to use in place of the public one of each region, e.g. of a VPC endpoint")
+	flags.StringVar(&o.SSHKey, ProviderName+"-ssh-key", "",
+		"Private ssh key whose public half is imported as the EC2 key pair "+
+			"(defaults to --ssh-key or ~/.ssh/id_rsa; generated if missing)")
+	flags.StringVar(&o.Bastion, ProviderName+"-bastion", os.Getenv("ROACHPROD_AWS_BASTION"),
+		"Jump host (host[:port]) for the instances without public IPs (defaults to --bastion)")
 }
 
 // Provider implements the vm.Provider interface for AWS.
@@ -112,20 +190,83 @@ type Provider struct {
 	opts providerOpts
 }
 
-// CleanSSH is part of vm.Provider.  This implementation is a no-op,
-// since we depend on the user's local identity file.
-func (p *Provider) CleanSSH() error {
-	return nil
+// Capabilities is part of the vm.Provider interface.
+func (p *Provider) Capabilities() vm.ProviderCapabilities {
+	return vm.ProviderCapabilities{
+		LocalSSD:        true,
+		MaxLocalSSDs:    8,
+		Preemptible:     true,
+		GPUs:            true,
+		MaxGPUs:         16,
+		Images:          true,
+		OSImages:        true,
+		Metadata:        true,
+		StartupScripts:  true,
+		BootDisks:       true,
+		DataDisks:       true,
+		MaxDataDisks:    maxDataVolumes,
+		PrivateIPs:      true,
+		Extend:          true,
+		Reboot:          true,
+		Resize:          true,
+		Suspend:         true,
+		StaticIPs:       true,
+		Firewalls:       true,
+		SpreadPlacement: true,
+		MachineSizes:    true,
+		MTU:             true,
+
+		NetworkInterfaces: true,
+		ExistingDisks:     true,
+		GeoWeights:        true,
+		AutoRestart:       true,
+	}
 }
 
-// ConfigSSH ensures that for each region we're operating in, we have
+// CheckCredentials is part of vm.Provider. The caller identity is available
+// to any valid credentials, regardless of their permissions. The endpoint of
+// --aws-endpoint-url, if any, must also be reachable.
+func (p *Provider) CheckCredentials(ctx context.Context) error {
+	if endpointURL != "" {
+		if err := vm.CheckEndpoint(ctx, endpointURL); err != nil {
+			return err
+		}
+	}
+	return runCommand(ctx, []string{"sts", "get-caller-identity"})
+}
+
+// CleanSSH is part of vm.Provider. It only removes the bastion
+// configuration, since we depend on the user's local identity file. The key
+// pairs imported by ConfigSSH are named after the key's hash and are reused.
+func (p *Provider) CleanSSH(ctx context.Context) error {
+	return vm.CleanBastionSSH(ProviderName)
+}
+
+// ConfigSSH is part of the vm.Provider interface. It imports the key pairs
+// and configures the bastion, if any, through which the instances without
+// public IPs are reached.
+func (p *Provider) ConfigSSH(ctx context.Context) error {
+	if err := p.importKeyPairs(ctx); err != nil {
+		return err
+	}
+	return vm.ConfigBastionSSH(ctx, p, vm.BastionFor(p.opts.Bastion))
+}
+
+// importKeyPairs ensures that for each region we're operating in, we have
 // a <user>-<hash> keypair where <hash> is a hash of the public key.
 // We use a hash since a user probably has multiple machines they're
 // running roachprod on and these machines (ought to) have separate
 // ssh keypairs.  If the remote keypair doesn't exist, we'll upload
-// the user's ~/.ssh/id_rsa.pub file or ask them to generate one.
-func (p *Provider) ConfigSSH() error {
-	keyName, err := p.sshKeyName()
+// the user's ~/.ssh/id_rsa.pub file (or the --ssh-key or --aws-ssh-key
+// key), generating the key pair if necessary. The key pair is only imported
+// into the regions which lack it, and a failure in some of the regions is
+// reported along with those in which the key pair is present.
+func (p *Provider) importKeyPairs(ctx context.Context) error {
+	keyName, err := p.sshKeyName(ctx)
+	if err != nil {
+		return err
+	}
+	publicKey, err := vm.SSHPublicKey(p.sshKeyPath())
 	if err != nil {
 		return err
 	}
@@ -135,130 +276,739 @@ func (p *Provider) ConfigSSH() error {
 		return err
 	}
 
-	var g errgroup.Group
-	for _, r := range regions {
-		// capture loop variable
-		region := r
-		g.Go(func() error {
-			exists, err := sshKeyExists(keyName, region)
+	errs := make([]error, len(regions))
+	_ = vm.ForEach(len(regions), func(i int) error {
+		exists, err := sshKeyExists(ctx, keyName, regions[i])
+		if err != nil {
+			errs[i] = err
+			return nil
+		}
+		if !exists {
+			if errs[i] = sshKeyImport(ctx, keyName, regions[i], publicKey); errs[i] == nil {
+				vm.Infof("imported %s.pub as %s in region %s",
+					p.sshKeyPath(), keyName, regions[i])
+			}
+		}
+		return nil
+	})
+	return keyPairRegionsError(keyName, regions, errs)
+}
+
+// placements returns the zone of each of count instances created with opts.
+// Unless explicit per-zone node counts or region weights were given, the
+// instances are placed round-robin over the zones.
+func (p *Provider) placements(opts vm.CreateOpts, count int) ([]string, error) {
+	zones := p.opts.Zones
+	if len(opts.Zones) > 0 {
+		zones = opts.Zones
+	}
+	zones, zoneCounts, err := vm.ParseZoneCounts(zones, count)
+	if err != nil {
+		return nil, err
+	}
+	geo := opts.GeoDistributed || len(opts.GeoWeights) > 0
+	if zoneCounts != nil && len(opts.GeoWeights) > 0 {
+		return nil, errors.New("zone node counts cannot be combined with --geo-weights")
+	}
+	if zoneCounts != nil {
+		var placements []string
+		for i, zone := range zones {
+			for j := 0; j < zoneCounts[i]; j++ {
+				placements = append(placements, zone)
+			}
+		}
+		return placements, nil
+	}
+
+	if len(zones) > 0 {
+		if !geo {
+			zones = zones[:1]
+		}
+	} else {
+		regions, err := p.allRegions()
+		if err != nil {
+			return nil, err
+		}
+		for _, region := range regions {
+			regionZones, err := p.allZones(region)
 			if err != nil {
+				return nil, err
+			}
+			zones = append(zones, regionZones...)
+
+			// Only use one region if we're not creating a distributed cluster
+			if !geo {
+				break
+			}
+		}
+	}
+	if len(opts.GeoWeights) > 0 {
+		zoneCounts, err := vm.WeightedZoneCounts(ProviderName, zones, zoneToRegion, opts.GeoWeights, count)
+		if err != nil {
+			return nil, err
+		}
+		var placements []string
+		for i, zone := range zones {
+			for j := 0; j < zoneCounts[i]; j++ {
+				placements = append(placements, zone)
+			}
+		}
+		return placements, nil
+	}
+	placements := make([]string, count)
+	for i := range placements {
+		placements[i] = zones[i%len(zones)]
+	}
+	return placements, nil
+}
+
+// Create is part of the vm.Provider interface.
+func (p *Provider) Create(ctx context.Context, names []string, opts vm.CreateOpts) error {
+	for _, name := range names {
+		if err := vm.ValidateName(name); err != nil {
+			return err
+		}
+		if _, err := startupScript(name, opts); err != nil {
+			return err
+		}
+	}
+	if err := vm.ValidateDataDisks(opts); err != nil {
+		return err
+	}
+	if err := vm.ValidateScheduling(opts); err != nil {
+		return err
+	}
+	if opts.MTU > 0 && (opts.MTU < vm.MinMTU || opts.MTU > maxMTU) {
+		return errors.Errorf("the MTU must be between %d and %d, not %d", vm.MinMTU, maxMTU, opts.MTU)
+	}
+	// EC2 only assigns public IPs to instances launched with a single
+	// network interface.
+	if opts.NetworkInterfaces > 1 && !opts.NoPublicIP {
+		return errors.Errorf("instances with several network interfaces require --no-public-ip on %s",
+			ProviderName)
+	}
+	if err := checkProfileAccess(ctx); err != nil {
+		return err
+	}
+
+	// We need to make sure that the SSH keys have been distributed to all
+	// regions, unless this is a dry run, in which case the --dry-run checks
+	// below will report any missing key pairs.
+	if !config.DryRun {
+		if err := p.importKeyPairs(ctx); err != nil {
+			return err
+		}
+	}
+
+	opts, err := p.resolveZoneIDs(ctx, opts)
+	if err != nil {
+		return err
+	}
+	placements, err := p.placements(opts, len(names))
+	if err != nil {
+		return err
+	}
+
+	usedZones := vm.UniqueZones(placements)
+	regionCounts := make(map[string]int)
+	for _, zone := range placements {
+		region, _ := zoneToRegion(zone)
+		regionCounts[region]++
+	}
+	if len(opts.GeoWeights) > 0 {
+		vm.LogRegionCounts(ProviderName, regionCounts, opts.GeoWeights)
+	}
+	if p.opts.Template != "" {
+		if p.opts.Enclave {
+			return errors.Errorf("--%s-enclave cannot be combined with --%s-template, "+
+				"which determines the enclave options", ProviderName, ProviderName)
+		}
+		return p.createFromTemplate(ctx, names, placements, opts)
+	}
+	machineType, err := p.machineType(opts)
+	if err != nil {
+		return err
+	}
+	machineTypes, err := vm.MachineTypes(ctx, p, usedZones, machineType, p.opts.MachineTypeFallbacks)
+	if err != nil {
+		return err
+	}
+	// The instances of each zone are launched with the machine type chosen
+	// for it.
+	zoneOpts := func(zone string) vm.CreateOpts {
+		ret := opts
+		ret.MachineType = machineTypes[zone]
+		return ret
+	}
+
+	if p.opts.IAMProfile != "" {
+		if err := checkIAMProfile(ctx, p.opts.IAMProfile); err != nil {
+			return err
+		}
+	}
+
+	user, err := p.FindActiveAccount(ctx)
+	if err != nil {
+		return err
+	}
+	opts.Labels = vm.StandardLabels(opts.Labels, user, names[0], time.Now())
+	opts.Labels[vm.SSHUserLabel] = p.remoteUser(opts)
+	// The enclave options are recorded in the metadata of the instances,
+	// where they are shown by `roachprod metadata`, rather than being
+	// copied from the existing instances of the cluster.
+	delete(opts.Labels, vm.MetadataPrefix+vm.SecurityMetadataKey)
+	if p.opts.Enclave {
+		opts.Labels[vm.MetadataPrefix+vm.SecurityMetadataKey] = "nitro-enclave"
+	}
+	if opts.StaticIP {
+		opts.Labels[vm.StaticIPLabel] = vm.StaticIPPolicy(opts)
+	}
+	if opts.Firewall {
+		opts.Labels[vm.FirewallLabel] = "true"
+	}
+	if opts.Placement != "" {
+		opts.Labels[vm.PlacementLabel] = opts.Placement
+		zones := make([]string, len(names))
+		for i := range names {
+			zones[i] = placements[i%len(placements)]
+		}
+		if err := checkSpreadPlacement(zones); err != nil {
+			return err
+		}
+	}
+
+	// Validate the subnet, security group and AMI of each zone up front,
+	// rather than having some of the instances fail to launch.
+	networks := make(map[string]network)
+	amis := make(map[string]string)
+	for _, zone := range placements {
+		if _, ok := networks[zone]; ok {
+			continue
+		}
+		n, err := p.zoneNetwork(ctx, zone)
+		if err != nil {
+			return err
+		}
+		networks[zone] = n
+
+		region, err := zoneToRegion(zone)
+		if err != nil {
+			return err
+		}
+		if _, ok := amis[region]; !ok {
+			if amis[region], err = p.osImage(ctx, region, opts); err != nil {
 				return err
 			}
-			if !exists {
-				err = sshKeyImport(keyName, region)
-				if err != nil {
-					return err
+		}
+	}
+
+	if opts.Firewall {
+		if err := ensureSecurityGroups(ctx, opts.Labels[vm.ClusterLabel], networks, opts.Ingress); err != nil {
+			return err
+		}
+	}
+
+	nameRegions := make(map[string]string, len(names))
+	var regions []string
+	seenRegions := make(map[string]bool)
+	for i, name := range names {
+		if nameRegions[name], err = zoneToRegion(placements[i%len(placements)]); err != nil {
+			return err
+		}
+		if !seenRegions[nameRegions[name]] {
+			seenRegions[nameRegions[name]] = true
+			regions = append(regions, nameRegions[name])
+		}
+	}
+	if opts.Placement != "" {
+		if err := ensurePlacementGroups(ctx, opts.Labels[vm.ClusterLabel], regions); err != nil {
+			return err
+		}
+	}
+	if err := checkExistingDisks(ctx, names, placements, opts); err != nil {
+		return err
+	}
+
+	if config.DryRun {
+		if err := p.dryRunCreate(ctx, names, placements, networks, amis, zoneOpts); err != nil {
+			return err
+		}
+		if opts.StaticIP {
+			_, _, err := reserveAddresses(ctx, nameRegions)
+			return err
+		}
+		return nil
+	}
+
+	// The Elastic IPs are allocated up front, so that an exhausted quota
+	// is reported before any instances are launched.
+	var allocations map[string]string
+	var reserved map[string][]string
+	if opts.StaticIP {
+		if allocations, reserved, err = reserveAddresses(ctx, nameRegions); err != nil {
+			return err
+		}
+	}
+
+	var mu sync.Mutex
+	var created []string
+	failedZones := make(map[string]bool)
+	launched := make(map[string]bool)
+	err = vm.ForEach(len(names), func(i int) error {
+		zone := placements[i%len(placements)]
+		region, err := zoneToRegion(zone)
+		if err != nil {
+			return err
+		}
+		id, err := p.runInstance(ctx, names[i], zone, networks[zone], amis[region], zoneOpts(zone))
+		if err == nil {
+			mu.Lock()
+			launched[names[i]] = true
+			mu.Unlock()
+			if opts.StaticIP {
+				err = associateAddress(ctx, region, id, allocations[names[i]])
+			}
+			if volumeID := opts.ExistingDisk(names[i]); err == nil && volumeID != "" {
+				err = attachExistingDisk(ctx, region, id, volumeID, opts.KeepExistingDisks)
+			}
+		}
+		if err != nil {
+			mu.Lock()
+			failedZones[zone] = true
+			mu.Unlock()
+			return errors.Wrapf(err, "%s in zone %s", names[i], zone)
+		}
+		mu.Lock()
+		created = append(created, names[i])
+		mu.Unlock()
+		return nil
+	})
+
+	if err != nil {
+		// The Elastic IPs allocated above for instances which could not be
+		// launched are released.
+		unused := make(map[string][]string)
+		for region, regionNames := range reserved {
+			for _, name := range regionNames {
+				if !launched[name] {
+					unused[region] = append(unused[region], name)
 				}
-				log.Printf("imported %s as %s in region %s",
-					sshPublicKeyFile, keyName, region)
 			}
-			return nil
+		}
+		if releaseErr := releaseAddresses(ctx, unused); releaseErr != nil {
+			vm.Warningf("unable to release unused static IPs: %s", releaseErr)
+		}
+		// Report what we know to exist so that the user can clean up.
+		sort.Strings(created)
+		return errors.Wrapf(err, "created %d/%d instances %v, failed in %s",
+			len(created), len(names), created, vm.JoinZones(failedZones))
+	}
+	return nil
+}
+
+// dryRunCreate prints the instances which Create would launch and the
+// run-instances commands which would launch them. The first command of each
+// zone is checked with --dry-run, which verifies the request and our
+// permissions without launching anything.
+func (p *Provider) dryRunCreate(
+	ctx context.Context,
+	names, placements []string,
+	networks map[string]network,
+	amis map[string]string,
+	zoneOpts func(zone string) vm.CreateOpts,
+) error {
+	var planned vm.List
+	var commands, checks [][]string
+	checked := make(map[string]bool)
+	for i, name := range names {
+		zone := placements[i%len(placements)]
+		region, err := zoneToRegion(zone)
+		if err != nil {
+			return err
+		}
+		opts := zoneOpts(zone)
+		args, machineType, err := p.runInstanceArgs(ctx, name, zone, networks[zone], amis[region], opts)
+		if err != nil {
+			return err
+		}
+		planned = append(planned, vm.VM{
+			Name:        name,
+			Provider:    ProviderName,
+			Zone:        zone,
+			MachineType: machineType,
+			Preemptible: opts.Preemptible,
 		})
+		commands = append(commands, args)
+		if !checked[zone] {
+			checked[zone] = true
+			checks = append(checks, withoutPlacement(args))
+		}
 	}
 
-	return g.Wait()
+	vm.PrintPlan(p, planned)
+	for _, args := range commands {
+		// The user-data is the whole startup script, which would drown out
+		// the rest of the command.
+		printed := append([]string(nil), args...)
+		for i := range printed {
+			if printed[i] == "--user-data" && i+1 < len(printed) {
+				printed[i+1] = fmt.Sprintf("<%d bytes>", len(printed[i+1]))
+			}
+		}
+		vm.PrintDryRun("aws", printed)
+	}
+	return vm.ForEach(len(checks), func(i int) error {
+		return checkDryRun(ctx, checks[i])
+	})
 }
 
-// Create is part of the vm.Provider interface.
-func (p *Provider) Create(names []string, opts vm.CreateOpts) error {
-	// We need to make sure that the SSH keys have been distributed to all regions
-	if err := p.ConfigSSH(); err != nil {
-		return err
+// withoutPlacement returns the run-instances arguments without the placement
+// group, which may not exist yet in a dry run.
+func withoutPlacement(args []string) []string {
+	ret := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--placement" {
+			i++
+			continue
+		}
+		ret = append(ret, args[i])
 	}
+	return ret
+}
 
-	var placements []string
-	regions, err := p.allRegions()
+// createFromTemplate launches the instances from --aws-template, the i-th in
+// placements[i]. Only the name, the subnet of the zone, the tags and the key
+// pair are given, so the launch template determines everything else,
+// including the startup script, which must prepare /mnt/data1 like
+// roachprod's own. The template must therefore not define network
+// interfaces, which cannot be combined with a subnet.
+func (p *Provider) createFromTemplate(
+	ctx context.Context, names, placements []string, opts vm.CreateOpts,
+) error {
+	if err := vm.ValidateTemplateOpts(opts, "--"+ProviderName+"-template"); err != nil {
+		return err
+	}
+	keyName, err := p.sshKeyName(ctx)
+	if err != nil {
+		return err
+	}
+	user, err := p.FindActiveAccount(ctx)
 	if err != nil {
 		return err
 	}
+	opts.Labels = vm.StandardLabels(opts.Labels, user, names[0], time.Now())
+	opts.Labels[vm.SSHUserLabel] = p.remoteUser(opts)
+	delete(opts.Labels, vm.MetadataPrefix+vm.SecurityMetadataKey)
 
-	for _, region := range regions {
-		zones, err := p.allZones(region)
+	// Launch templates are regional, so the template must exist in each of
+	// the regions.
+	networks := make(map[string]network)
+	machineTypes := make(map[string]string)
+	for _, zone := range placements {
+		if _, ok := networks[zone]; ok {
+			continue
+		}
+		n, err := p.zoneNetwork(ctx, zone)
 		if err != nil {
 			return err
 		}
-		placements = append(placements, zones...)
+		networks[zone] = n
 
-		// Only use one region if we're not creating a distributed cluster
-		if !opts.GeoDistributed {
-			break
+		region, err := zoneToRegion(zone)
+		if err != nil {
+			return err
+		}
+		if _, ok := machineTypes[region]; !ok {
+			if machineTypes[region], err = launchTemplateInstanceType(ctx, region, p.opts.Template); err != nil {
+				return err
+			}
 		}
 	}
 
-	var g errgroup.Group
+	var planned vm.List
+	var commands, checks [][]string
+	checked := make(map[string]bool)
+	for i, name := range names {
+		zone := placements[i%len(placements)]
+		region, err := zoneToRegion(zone)
+		if err != nil {
+			return err
+		}
+		tagSpecs, err := tagSpecifications(name, opts)
+		if err != nil {
+			return err
+		}
+		args := []string{
+			"ec2", "run-instances",
+			"--count", "1",
+			"--launch-template", "LaunchTemplateName=" + p.opts.Template,
+			"--key-name", keyName,
+			"--region", region,
+			"--subnet-id", networks[zone].subnetID,
+			"--tag-specifications", tagSpecs,
+		}
+		planned = append(planned, vm.VM{
+			Name:        name,
+			Provider:    ProviderName,
+			Zone:        zone,
+			MachineType: machineTypes[region],
+		})
+		commands = append(commands, args)
+		if !checked[zone] {
+			checked[zone] = true
+			checks = append(checks, args)
+		}
+	}
 
-	var pIdx int
-	for _, name := range names {
-		// capture loop variable
-		capName := name
-		placement := placements[pIdx]
+	if config.DryRun {
+		vm.PrintPlan(p, planned)
+		for _, args := range commands {
+			vm.PrintDryRun("aws", args)
+		}
+		return vm.ForEach(len(checks), func(i int) error {
+			return checkDryRun(ctx, checks[i])
+		})
+	}
+
+	var mu sync.Mutex
+	var created []string
+	failedZones := make(map[string]bool)
+	err = vm.ForEach(len(commands), func(i int) error {
+		if err := runCommand(ctx, commands[i]); err != nil {
+			mu.Lock()
+			failedZones[planned[i].Zone] = true
+			mu.Unlock()
+			return errors.Wrapf(err, "%s in zone %s", names[i], planned[i].Zone)
+		}
+		mu.Lock()
+		created = append(created, names[i])
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		sort.Strings(created)
+		return errors.Wrapf(err, "created %d/%d instances %v, failed in %s",
+			len(created), len(names), created, vm.JoinZones(failedZones))
+	}
+	return nil
+}
+
+// CreateImage is part of the vm.Provider interface.
+// This creates an AMI from each instance and waits for it to become
+// available. AMIs are regional, so instances created from the image
+// must be placed in the same region as the source instance.
+func (p *Provider) CreateImage(ctx context.Context, vms vm.List, imageName string) ([]string, error) {
+	names := vm.ImageNames(vms, imageName)
+	ids := make([]string, len(vms))
+	g := errgroup.Group{}
+	for i := range vms {
+		// Capture loop vars here
+		i := i
+		v := vms[i]
 		g.Go(func() error {
-			return p.runInstance(capName, placement, opts)
+			region, err := zoneToRegion(v.Zone)
+			if err != nil {
+				return err
+			}
+			var data struct {
+				ImageId string
+			}
+			args := []string{
+				"ec2", "create-image",
+				"--region", region,
+				"--instance-id", v.ProviderID,
+				"--name", names[i],
+			}
+			if err := runJSONCommand(ctx, args, &data); err != nil {
+				return err
+			}
+			ids[i] = data.ImageId
+			return runCommand(ctx, []string{
+				"ec2", "wait", "image-available",
+				"--region", region,
+				"--image-ids", data.ImageId,
+			})
 		})
-		pIdx = (pIdx + 1) % len(placements)
 	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
 
-	return g.Wait()
+// CreatedMachineTypes is part of the vm.Provider interface. The instance type
+// of the instances launched from --aws-template is that of the template, which
+// is not known.
+func (p *Provider) CreatedMachineTypes(opts vm.CreateOpts) ([]string, error) {
+	if p.opts.Template != "" {
+		return nil, nil
+	}
+	machineType, err := p.machineType(opts)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{machineType}, p.opts.MachineTypeFallbacks...), nil
+}
+
+// CreatedZones is part of the vm.Provider interface.
+func (p *Provider) CreatedZones(ctx context.Context, opts vm.CreateOpts, count int) ([]string, error) {
+	opts, err := p.resolveZoneIDs(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	placements, err := p.placements(opts, count)
+	if err != nil {
+		return nil, err
+	}
+	return vm.UniqueZones(placements), nil
 }
 
 // Delete is part of vm.Provider.
 // This will delete all instances in a single AWS command.
-func (p *Provider) Delete(vms vm.List) error {
+func (p *Provider) Delete(ctx context.Context, vms vm.List) error {
+	if err := checkProfileAccess(ctx); err != nil {
+		return err
+	}
 	byRegion, err := regionMap(vms)
 	if err != nil {
 		return err
 	}
-	g := errgroup.Group{}
-	for region, list := range byRegion {
+	regions := regionNames(byRegion)
+	terminateArgs := func(region string) []string {
 		args := []string{
 			"ec2", "terminate-instances",
 			"--region", region,
 			"--instance-ids",
 		}
-		args = append(args, list.ProviderIDs()...)
-		g.Go(func() error {
-			var data struct {
-				TerminatingInstances []struct {
-					InstanceId string
-				}
-			}
-			return runJSONCommand(args, &data)
-		})
+		return append(args, byRegion[region].ProviderIDs()...)
+	}
+	// The VMs whose Elastic IPs are to be released, and the clusters whose
+	// security and placement groups are to be deleted, keyed by region.
+	released := make(map[string][]string)
+	firewalled := make(map[string][]string)
+	placed := make(map[string][]string)
+	for _, region := range regions {
+		seen := make(map[string]bool)
+		seenPlaced := make(map[string]bool)
+		for _, v := range byRegion[region] {
+			if v.Labels[vm.StaticIPLabel] == vm.StaticIPRelease {
+				released[region] = append(released[region], v.Name)
+			}
+			if cluster := v.Labels[vm.ClusterLabel]; v.Labels[vm.FirewallLabel] != "" && !seen[cluster] {
+				seen[cluster] = true
+				firewalled[region] = append(firewalled[region], cluster)
+			}
+			if cluster := v.Labels[vm.ClusterLabel]; v.Labels[vm.PlacementLabel] != "" && !seenPlaced[cluster] {
+				seenPlaced[cluster] = true
+				placed[region] = append(placed[region], cluster)
+			}
+		}
+	}
+	if config.DryRun {
+		for _, region := range regions {
+			vm.PrintDryRun("aws", terminateArgs(region))
+		}
+		if err := vm.ForEach(len(regions), func(i int) error {
+			return checkDryRun(ctx, terminateArgs(regions[i]))
+		}); err != nil {
+			return err
+		}
+		for _, region := range regions {
+			if err := deleteSecurityGroups(ctx, region, firewalled[region]); err != nil {
+				return err
+			}
+			if err := deletePlacementGroups(ctx, region, placed[region]); err != nil {
+				return err
+			}
+		}
+		return releaseAddresses(ctx, released)
+	}
+	err = vm.ForEach(len(regions), func(i int) error {
+		args := terminateArgs(regions[i])
+		var data struct {
+			TerminatingInstances []struct {
+				InstanceId string
+			}
+		}
+		if err := runJSONCommand(ctx, args, &data); err != nil {
+			return err
+		}
+		if len(released[regions[i]]) == 0 && len(firewalled[regions[i]]) == 0 && len(placed[regions[i]]) == 0 {
+			return nil
+		}
+		// An Elastic IP can only be released, and a security or placement
+		// group deleted, once its instances have been terminated.
+		waitArgs := []string{"ec2", "wait", "instance-terminated", "--region", regions[i], "--instance-ids"}
+		if err := runCommand(ctx, append(waitArgs, byRegion[regions[i]].ProviderIDs()...)); err != nil {
+			return err
+		}
+		if err := deleteSecurityGroups(ctx, regions[i], firewalled[regions[i]]); err != nil {
+			return err
+		}
+		return deletePlacementGroups(ctx, regions[i], placed[regions[i]])
+	})
+	if err != nil {
+		return err
+	}
+	return releaseAddresses(ctx, released)
+}
+
+// Describe is part of the vm.Provider interface.
+// It returns the instance as reported by describe-instances, which includes
+// stopped instances and their state transition reasons.
+func (p *Provider) Describe(ctx context.Context, v vm.VM) (map[string]interface{}, error) {
+	if v.Zone == "" {
+		return nil, errors.Errorf("zone of %s is unknown", v.Name)
+	}
+	region, err := zoneToRegion(v.Zone)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"ec2", "describe-instances",
+		"--region", region,
+		"--instance-ids", v.ProviderID,
+	}
+	var data struct {
+		Reservations []struct {
+			Instances []map[string]interface{}
+		}
 	}
-	return g.Wait()
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return nil, err
+	}
+	if len(data.Reservations) == 0 || len(data.Reservations[0].Instances) == 0 {
+		return nil, errors.Errorf("instance %s not found in %s", v.ProviderID, region)
+	}
+	return data.Reservations[0].Instances[0], nil
 }
 
 // Extend is part of the vm.Provider interface.
 // This will update the Lifetime tag on the instances.
-func (p *Provider) Extend(vms vm.List, lifetime time.Duration) error {
+func (p *Provider) Extend(ctx context.Context, vms vm.List, lifetime time.Duration) error {
 	byRegion, err := regionMap(vms)
 	if err != nil {
 		return err
 	}
-	g := errgroup.Group{}
-	for region, list := range byRegion {
-		// Capture loop vars here
+	regions := regionNames(byRegion)
+	return vm.ForEach(len(regions), func(i int) error {
 		args := []string{
 			"ec2", "create-tags",
-			"--region", region,
-			"--tags", "Key=Lifetime,Value=" + lifetime.String(),
+			"--region", regions[i],
+			"--tags", fmt.Sprintf("Key=%s,Value=%s", lifetimeTag, lifetime),
 			"--resources",
 		}
-		args = append(args, list.ProviderIDs()...)
-
-		g.Go(func() error {
-			return runCommand(args)
-		})
-	}
-	return g.Wait()
+		args = append(args, byRegion[regions[i]].ProviderIDs()...)
+		return runCommand(ctx, args)
+	})
 }
 
 // cachedActiveAccount memoizes the return value from FindActiveAccount
 var cachedActiveAccount string
 
 // FindActiveAccount is part of the vm.Provider interface.
-// This queries the AWS command for the current IAM user.
-func (p *Provider) FindActiveAccount() (string, error) {
+// This queries the AWS command for the IAM user of --aws-account-profile.
+func (p *Provider) FindActiveAccount(ctx context.Context) (string, error) {
 	if len(cachedActiveAccount) > 0 {
 		return cachedActiveAccount, nil
 	}
@@ -268,7 +1018,7 @@ func (p *Provider) FindActiveAccount() (string, error) {
 		}
 	}
 	args := []string{"iam", "get-user"}
-	err := runJSONCommand(args, &userInfo)
+	err := runJSONCommand(ctx, args, &userInfo)
 	if err != nil {
 		return "", err
 	}
@@ -281,8 +1031,26 @@ func (p *Provider) Flags() vm.ProviderFlags {
 	return &p.opts
 }
 
+// GetMetadata is part of the vm.Provider interface.
+func (p *Provider) GetMetadata(ctx context.Context, v vm.VM) (map[string]string, error) {
+	tags, err := instanceTags(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string)
+	for k, value := range tags {
+		if strings.HasPrefix(k, vm.MetadataPrefix) {
+			ret[strings.TrimPrefix(k, vm.MetadataPrefix)] = value
+		}
+	}
+	return ret, nil
+}
+
 // List is part of the vm.Provider interface.
-func (p *Provider) List() (vm.List, error) {
+func (p *Provider) List(ctx context.Context, filter vm.LabelFilter) (vm.List, error) {
+	if err := checkProfileAccess(ctx); err != nil {
+		return nil, err
+	}
 	regions, err := p.allRegions()
 	if err != nil {
 		return nil, err
@@ -296,7 +1064,7 @@ func (p *Provider) List() (vm.List, error) {
 		// capture loop variable
 		region := r
 		g.Go(func() error {
-			vms, err := p.listRegion(region)
+			vms, err := p.listRegion(ctx, region, filter)
 			if err != nil {
 				return err
 			}
@@ -314,13 +1082,281 @@ func (p *Provider) List() (vm.List, error) {
 	return ret, nil
 }
 
+// ListScope is part of the vm.Provider interface. The instances are those of
+// the profile of --aws-account-profile, as seen through --aws-endpoint-url.
+func (p *Provider) ListScope() string {
+	scope := "profile=" + profile
+	if endpointURL != "" {
+		scope += ",endpoint=" + endpointURL
+	}
+	return scope
+}
+
+// MachineTypeAvailable is part of the vm.Provider interface.
+func (p *Provider) MachineTypeAvailable(ctx context.Context, zone, machineType string) (bool, error) {
+	return instanceTypeOffered(ctx, machineType, zone)
+}
+
 // Name is part of the vm.Provider interface. This returns "aws".
 func (p *Provider) Name() string {
 	return ProviderName
 }
 
+// Reboot is part of the vm.Provider interface.
+// The reboot request is asynchronous, so we wait for the instances
+// to pass their status checks before returning.
+func (p *Provider) Reboot(ctx context.Context, vms vm.List) error {
+	byRegion, err := regionMap(vms)
+	if err != nil {
+		return err
+	}
+	g := errgroup.Group{}
+	for region, list := range byRegion {
+		// Capture loop vars here
+		ids := list.ProviderIDs()
+		args := []string{
+			"ec2", "reboot-instances",
+			"--region", region,
+			"--instance-ids",
+		}
+		args = append(args, ids...)
+		waitArgs := []string{
+			"ec2", "wait", "instance-status-ok",
+			"--region", region,
+			"--instance-ids",
+		}
+		waitArgs = append(waitArgs, ids...)
+
+		g.Go(func() error {
+			if err := runCommand(ctx, args); err != nil {
+				return err
+			}
+			return runCommand(ctx, waitArgs)
+		})
+	}
+	return g.Wait()
+}
+
+// Resize is part of the vm.Provider interface.
+// Each instance is stopped, has its instance type modified and is then
+// started again. Note that the contents of instance-store volumes are
+// lost when an instance is stopped.
+func (p *Provider) Resize(ctx context.Context, vms vm.List, machineType string) error {
+	zones := make(map[string]bool)
+	for _, v := range vms {
+		zones[v.Zone] = true
+	}
+
+	// Make sure the instance type is offered in every zone before we stop
+	// any of the instances.
+	for zone := range zones {
+		if err := checkInstanceTypeOffered(ctx, machineType, zone); err != nil {
+			return err
+		}
+	}
+
+	var mu sync.Mutex
+	var resized []string
+	var g errgroup.Group
+
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			region, err := zoneToRegion(v.Zone)
+			if err != nil {
+				return err
+			}
+			for _, args := range [][]string{
+				{"ec2", "stop-instances", "--instance-ids", v.ProviderID},
+				{"ec2", "wait", "instance-stopped", "--instance-ids", v.ProviderID},
+				{"ec2", "modify-instance-attribute", "--instance-id", v.ProviderID,
+					"--instance-type", "Value=" + machineType},
+				{"ec2", "start-instances", "--instance-ids", v.ProviderID},
+				{"ec2", "wait", "instance-running", "--instance-ids", v.ProviderID},
+			} {
+				if err := runCommand(ctx, append(args, "--region", region)); err != nil {
+					return err
+				}
+			}
+			mu.Lock()
+			resized = append(resized, v.Name)
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		sort.Strings(resized)
+		return errors.Wrapf(err, "resized %d of %d instances %v", len(resized), len(vms), resized)
+	}
+	return nil
+}
+
+// SSHAccess is part of the vm.Provider interface.
+func (p *Provider) SSHAccess() vm.SSHAccess {
+	return vm.SSHAccess{KeyPath: p.sshKeyPath(), Bastion: vm.BastionFor(p.opts.Bastion)}
+}
+
+// SetMetadata is part of the vm.Provider interface. The metadata is stored
+// in tags, which are limited in number and size.
+func (p *Provider) SetMetadata(ctx context.Context, v vm.VM, kv map[string]string) error {
+	if err := vm.CheckMetadata(kv, maxTagValueSize); err != nil {
+		return err
+	}
+	region, err := zoneToRegion(v.Zone)
+	if err != nil {
+		return err
+	}
+
+	tags, err := instanceTags(ctx, v)
+	if err != nil {
+		return err
+	}
+	for k, value := range kv {
+		if value == "" {
+			delete(tags, vm.MetadataPrefix+k)
+		} else {
+			tags[vm.MetadataPrefix+k] = value
+		}
+	}
+	if len(tags) > maxTags {
+		return errors.Errorf("%s would have %d tags, but AWS allows at most %d", v.Name, len(tags), maxTags)
+	}
+
+	type tag struct {
+		Key   string
+		Value string `json:",omitempty"`
+	}
+	var added, removed []tag
+	for _, k := range vm.MetadataKeys(kv) {
+		if kv[k] == "" {
+			removed = append(removed, tag{Key: vm.MetadataPrefix + k})
+		} else {
+			added = append(added, tag{Key: vm.MetadataPrefix + k, Value: kv[k]})
+		}
+	}
+	// The tags are passed as json, so that the values may contain the
+	// characters which are special to the shorthand syntax.
+	for _, op := range []struct {
+		command string
+		tags    []tag
+	}{
+		{"create-tags", added},
+		{"delete-tags", removed},
+	} {
+		if len(op.tags) == 0 {
+			continue
+		}
+		tagsJSON, err := json.Marshal(op.tags)
+		if err != nil {
+			return err
+		}
+		args := []string{
+			"ec2", op.command,
+			"--region", region,
+			"--resources", v.ProviderID,
+			"--tags", string(tagsJSON),
+		}
+		if err := runCommand(ctx, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start is part of the vm.Provider interface.
+func (p *Provider) Start(ctx context.Context, vms vm.List) error {
+	return p.runInstanceCommands(ctx, vms, "start-instances", "instance-running")
+}
+
+// Stop is part of the vm.Provider interface. Spot instances are launched as
+// one-time requests, which cannot be stopped.
+func (p *Provider) Stop(ctx context.Context, vms vm.List) error {
+	for _, v := range vms {
+		if v.Preemptible {
+			return errors.Errorf("spot instance %s cannot be stopped", v.Name)
+		}
+	}
+	return p.runInstanceCommands(ctx, vms, "stop-instances", "instance-stopped")
+}
+
+// runInstanceCommands runs the ec2 command on the instances of each region in
+// parallel, and then waits for the instances to reach the given state.
+func (p *Provider) runInstanceCommands(ctx context.Context, vms vm.List, command, state string) error {
+	byRegion, err := regionMap(vms)
+	if err != nil {
+		return err
+	}
+	regions := regionNames(byRegion)
+	return vm.ForEach(len(regions), func(i int) error {
+		ids := byRegion[regions[i]].ProviderIDs()
+		for _, args := range [][]string{
+			{"ec2", command},
+			{"ec2", "wait", state},
+		} {
+			args = append(args, "--region", regions[i], "--instance-ids")
+			if err := runCommand(ctx, append(args, ids...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ZoneCatalog is part of the vm.Provider interface. It includes the zones of
+// every region enabled for the account, not just the configured ones, by both
+// their names and their IDs.
+func (p *Provider) ZoneCatalog(ctx context.Context) (vm.ZoneCatalog, error) {
+	configured, err := p.allRegions()
+	if err != nil {
+		return nil, err
+	}
+	if len(configured) == 0 {
+		return nil, errors.New("no regions configured")
+	}
+	var regions struct {
+		Regions []struct {
+			RegionName string
+		}
+	}
+	args := []string{"ec2", "describe-regions", "--region", configured[0]}
+	if err := runJSONCommand(ctx, args, &regions); err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	ret := make(vm.ZoneCatalog)
+	err = vm.ForEach(len(regions.Regions), func(i int) error {
+		var data struct {
+			AvailabilityZones []struct {
+				ZoneName   string
+				ZoneId     string
+				RegionName string
+			}
+		}
+		args := []string{"ec2", "describe-availability-zones", "--region", regions.Regions[i].RegionName}
+		if err := runJSONCommand(ctx, args, &data); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// The IDs of the zones are included, so that the regions of zones
+		// requested by ID are known too.
+		for _, z := range data.AvailabilityZones {
+			ret[z.ZoneName] = z.RegionName
+			ret[z.ZoneId] = z.RegionName
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 // allRegions returns the regions that have been configured with
-// AMI and SecurityGroup instances.
+// AMI and SecurityGroup instances. The region of the default zone, if
+// one is configured, comes first.
 func (p *Provider) allRegions() ([]string, error) {
 	amiMap, err := splitMap(p.opts.AMI)
 	if err != nil {
@@ -337,14 +1373,18 @@ func (p *Provider) allRegions() ([]string, error) {
 		if _, ok := securityMap[region]; ok {
 			keys = append(keys, region)
 		} else {
-			log.Printf("ignoring region %s because it has no associated SecurityGroup", region)
+			vm.Warningf("ignoring region %s because it has no associated SecurityGroup", region)
 		}
 	}
-	return keys, nil
+	defaultRegion, err := zoneToRegion(p.opts.DefaultZone)
+	if err != nil {
+		return nil, err
+	}
+	return preferFirst(keys, defaultRegion), nil
 }
 
 // allZones returns all AWS availability zones which have been correctly
-// configured within the given region.
+// configured within the given region, with the default zone first.
 func (p *Provider) allZones(region string) ([]string, error) {
 	subnetMap, err := splitMap(p.opts.Subnets)
 	if err != nil {
@@ -358,13 +1398,19 @@ func (p *Provider) allZones(region string) ([]string, error) {
 		}
 	}
 
-	return ret, nil
+	return preferFirst(ret, p.opts.DefaultZone), nil
 }
 
+// listPageSize is the number of instances requested per page by listRegion.
+const listPageSize = 500
+
 // listRegion extracts the roachprod-managed instances in the
-// given region.
-func (p *Provider) listRegion(region string) (vm.List, error) {
-	var data struct {
+// given region, page by page.
+func (p *Provider) listRegion(
+	ctx context.Context, region string, filter vm.LabelFilter,
+) (vm.List, error) {
+	// describeInstancesPage is one page of the output of describe-instances.
+	type describeInstancesPage struct {
 		Reservations []struct {
 			Instances []struct {
 				InstanceId string
@@ -380,31 +1426,117 @@ func (p *Provider) listRegion(region string) (vm.List, error) {
 					Code int
 					Name string
 				}
+				// StateReason explains the last change of State, e.g.
+				// Server.SpotInstanceTermination for the reclaimed spot
+				// instances.
+				StateReason struct {
+					Code string
+				}
 				Tags []struct {
 					Key   string
 					Value string
 				}
 				VpcId        string
 				InstanceType string
+				// InstanceLifecycle is "spot" for spot instances and unset
+				// otherwise.
+				InstanceLifecycle string
+				// AutoRecovery is "default" or "disabled".
+				MaintenanceOptions struct {
+					AutoRecovery string
+				}
+				// Ipv6Address is the primary IPv6 address, if the subnet
+				// assigns them. EC2 IPv6 addresses are globally unique and
+				// are reachable from the internet if the subnet routes them.
+				Ipv6Address string
+				ImageId     string
+				// Only the EBS volumes are mapped, without their size or
+				// type, which are reported by describe-volumes.
+				BlockDeviceMappings []struct {
+					DeviceName string
+					Ebs        struct {
+						VolumeId string
+					}
+				}
+				RootDeviceName    string
+				NetworkInterfaces []struct {
+					NetworkInterfaceId string
+					SubnetId           string
+					PrivateIpAddress   string
+					Attachment         struct {
+						DeviceIndex int
+					}
+				}
 			}
 		}
+		NextToken string
 	}
 	args := []string{
 		"ec2", "describe-instances",
 		"--region", region,
 	}
-	err := runJSONCommand(args, &data)
-	if err != nil {
-		return nil, err
+	// EC2 filters cannot be negated, so only the positive clauses are
+	// applied server-side.
+	var tagFilters []string
+	for _, c := range filter {
+		if !c.Negate {
+			tagFilters = append(tagFilters, fmt.Sprintf("Name=tag:%s,Values=%s", c.Key, c.Value))
+		}
+	}
+	if len(tagFilters) > 0 {
+		args = append(args, "--filters")
+		args = append(args, tagFilters...)
+	}
+
+	// The aws CLI would page through the instances itself, but a throttled
+	// page would then fail the whole listing. Paging explicitly retries each
+	// page on its own. The last page has no NextToken.
+	args = append(args, "--max-items", strconv.Itoa(listPageSize))
+	// Each page is decoded afresh, since decoding into the same struct
+	// would reuse, and overwrite, the reservations of the earlier pages.
+	var data describeInstancesPage
+	for token := ""; ; {
+		pageArgs := args
+		if token != "" {
+			pageArgs = append(args[:len(args):len(args)], "--starting-token", token)
+		}
+		var page describeInstancesPage
+		if err := runJSONCommand(ctx, pageArgs, &page); err != nil {
+			return nil, err
+		}
+		data.Reservations = append(data.Reservations, page.Reservations...)
+		if token = page.NextToken; token == "" {
+			break
+		}
 	}
 
 	var ret vm.List
+	// The terminated spot instances which EC2 reclaimed are reported as
+	// preempted, as long as EC2 still lists them (for about an hour) and
+	// they have not been replaced by an instance of the same name.
+	preempted := make(map[string]int)
+	live := make(map[string]bool)
 	for _, res := range data.Reservations {
 	in:
 		for _, in := range res.Instances {
-			// Ignore any instances that are not pending or running
-			if in.State.Name != "pending" && in.State.Name != "running" {
-				continue in
+			// Ignore any instances that no longer exist
+			var status vm.Status
+			switch in.State.Name {
+			case "pending":
+				status = vm.StatusPending
+			case "running":
+				status = vm.StatusRunning
+			case "stopping", "stopped":
+				status = vm.StatusStopped
+			case "shutting-down":
+				status = vm.StatusTerminating
+			case "terminated":
+				if in.StateReason.Code != "Server.SpotInstanceTermination" {
+					continue in
+				}
+				status = vm.StatusPreempted
+			default:
+				status = vm.StatusUnknown
 			}
 
 			// Convert the tag map into a more useful representation
@@ -420,19 +1552,61 @@ func (p *Provider) listRegion(region string) (vm.List, error) {
 			var errs []error
 			createdAt, err := time.Parse(time.RFC3339, in.LaunchTime)
 			if err != nil {
-				errs = append(errs, vm.ErrNoExpiration)
+				errs = append(errs, vm.ErrNoExpiration.Wrap(err))
 			}
 
 			var lifetime time.Duration
-			if lifeText, ok := tagMap["Lifetime"]; ok {
+			if lifeText, ok := tagMap[lifetimeTag]; ok {
 				lifetime, err = time.ParseDuration(lifeText)
 				if err != nil {
-					errs = append(errs, err)
+					errs = append(errs, vm.ErrBadLifetime.Wrap(err))
 				}
 			} else {
 				errs = append(errs, vm.ErrNoExpiration)
 			}
 
+			if in.InstanceType == "" {
+				errs = append(errs, vm.ErrNoMachineType)
+			}
+
+			var disks []vm.Disk
+			for _, d := range in.BlockDeviceMappings {
+				disks = append(disks, vm.Disk{
+					Name:   d.Ebs.VolumeId,
+					Device: d.DeviceName,
+					Boot:   d.DeviceName == in.RootDeviceName,
+				})
+			}
+
+			var staticIP string
+			if tagMap[vm.StaticIPLabel] != "" {
+				staticIP = in.PublicIpAddress
+			}
+			var scheduling *vm.Scheduling
+			if recovery := in.MaintenanceOptions.AutoRecovery; recovery != "" {
+				scheduling = &vm.Scheduling{AutoRestart: recovery != "disabled"}
+			}
+			// The instances created before the user was recorded use the
+			// default one.
+			remoteUser := tagMap[vm.SSHUserLabel]
+			if remoteUser == "" {
+				remoteUser = defaultRemoteUser
+			}
+
+			var nics []vm.NetworkInterface
+			if len(in.NetworkInterfaces) > 1 {
+				sort.Slice(in.NetworkInterfaces, func(i, j int) bool {
+					return in.NetworkInterfaces[i].Attachment.DeviceIndex < in.NetworkInterfaces[j].Attachment.DeviceIndex
+				})
+				for _, nic := range in.NetworkInterfaces {
+					nics = append(nics, vm.NetworkInterface{
+						Name:      nic.NetworkInterfaceId,
+						Subnet:    nic.SubnetId,
+						PrivateIP: nic.PrivateIpAddress,
+					})
+				}
+			}
+
 			m := vm.VM{
 				CreatedAt:   createdAt,
 				DNS:         in.PrivateDnsName,
@@ -443,104 +1617,242 @@ func (p *Provider) listRegion(region string) (vm.List, error) {
 				Provider:    ProviderName,
 				ProviderID:  in.InstanceId,
 				PublicIP:    in.PublicIpAddress,
-				RemoteUser:  p.opts.RemoteUserName,
+				StaticIP:    staticIP,
+				RemoteUser:  remoteUser,
 				VPC:         in.VpcId,
 				MachineType: in.InstanceType,
 				Zone:        in.Placement.AvailabilityZone,
+				Status:      status,
+				Preemptible: in.InstanceLifecycle == "spot",
+				Scheduling:  scheduling,
+				Labels:      tagMap,
+				PrivateIPv6: in.Ipv6Address,
+				PublicIPv6:  in.Ipv6Address,
+				OSImage:     in.ImageId,
+				Disks:       disks,
+
+				NetworkInterfaces: nics,
+			}
+			if status != vm.StatusPreempted {
+				live[m.Name] = true
+			} else if i, ok := preempted[m.Name]; ok {
+				// Only the latest of the instances of a name is kept.
+				if m.CreatedAt.After(ret[i].CreatedAt) {
+					ret[i] = m
+				}
+				continue
+			} else {
+				preempted[m.Name] = len(ret)
 			}
 			ret = append(ret, m)
 		}
 	}
 
-	return ret, nil
+	if len(preempted) == 0 {
+		return ret, nil
+	}
+	filtered := ret[:0]
+	for _, v := range ret {
+		if v.Status != vm.StatusPreempted || !live[v.Name] {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered, nil
+}
+
+// machineType returns the instance type requested by opts: the type given
+// explicitly, or otherwise one providing the requested GPUs, the closest to
+// the requested size, or the configured type with or without local SSDs.
+func (p *Provider) machineType(opts vm.CreateOpts) (string, error) {
+	switch {
+	case opts.MachineType != "":
+		return opts.MachineType, nil
+	case opts.GPUCount > 0 && !opts.Size.IsZero():
+		return "", errors.New("GPUs are only available via dedicated instance families, " +
+			"so --gpu-count cannot be combined with --cpus")
+	case opts.GPUCount > 0:
+		return gpuInstanceType(opts.GPUType, opts.GPUCount)
+	case !opts.Size.IsZero():
+		return vm.ClosestMachineType(instanceTypeSizes(opts.UseLocalSSD), opts.Size, "--"+ProviderName+"-machine-type")
+	case opts.UseLocalSSD:
+		return p.opts.SSDMachineType, nil
+	default:
+		return p.opts.MachineType, nil
+	}
 }
 
 // runInstance is responsible for allocating a single ec2 vm.
 // Given that every AWS region may as well be a parallel dimension,
 // we need to do a bit of work to look up all of the various ids that
-// we need in order to actually allocate an instance.
-func (p *Provider) runInstance(name string, zone string, opts vm.CreateOpts) error {
-	region, err := zoneToRegion(zone)
+// we need in order to actually allocate an instance. The id of the
+// instance is returned.
+func (p *Provider) runInstance(
+	ctx context.Context, name string, zone string, n network, amiId string, opts vm.CreateOpts,
+) (string, error) {
+	args, _, err := p.runInstanceArgs(ctx, name, zone, n, amiId, opts)
 	if err != nil {
-		return err
+		return "", err
 	}
-
-	amiMap, err := splitMap(p.opts.AMI)
-	if err != nil {
-		return err
+	// The client token makes the request idempotent, so that a retry of a
+	// request which was carried out returns the instance it launched rather
+	// than launching another.
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return "", err
+	}
+	args = append(args, "--client-token", hex.EncodeToString(token[:]))
+	var data struct {
+		Instances []struct {
+			InstanceId string
+		}
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return "", err
 	}
-	amiId, ok := amiMap[region]
-	if !ok {
-		return errors.Errorf("could not find an AMI image id for region %s", region)
+	if len(data.Instances) == 0 {
+		return "", errors.Errorf("run-instances launched no instance for %s", name)
 	}
+	return data.Instances[0].InstanceId, nil
+}
 
-	keyName, err := p.sshKeyName()
+// runInstanceArgs returns the arguments of the run-instances command which
+// allocates the named vm, along with its instance type.
+func (p *Provider) runInstanceArgs(
+	ctx context.Context, name string, zone string, n network, amiId string, opts vm.CreateOpts,
+) ([]string, string, error) {
+	region, err := zoneToRegion(zone)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	var machineType string
-	if opts.UseLocalSSD {
-		machineType = p.opts.SSDMachineType
-	} else {
-		machineType = p.opts.MachineType
+	keyName, err := p.sshKeyName(ctx)
+	if err != nil {
+		return nil, "", err
 	}
 
-	sgMap, err := splitMap(p.opts.SecurityGroups)
+	userData, err := startupScript(name, opts)
 	if err != nil {
-		return err
-	}
-	sgId, ok := sgMap[region]
-	if !ok {
-		return errors.Errorf("could not find a security group id for region %s", region)
+		return nil, "", err
 	}
 
-	subnetMap, err := splitMap(p.opts.Subnets)
+	machineType, err := p.machineType(opts)
 	if err != nil {
-		return err
-	}
-	subnetId, ok := subnetMap[zone]
-	if !ok {
-		return errors.Errorf("could not find a subnet id for zone %s", zone)
+		return nil, "", err
 	}
 
-	// We avoid the need to make a second call to set the tags by jamming
-	// all of our metadata into the TagSpec.
-	tagSpecs := fmt.Sprintf(
-		"ResourceType=instance,Tags=["+
-			"{Key=Lifetime,Value=%s},"+
-			"{Key=Name,Value=%s},"+
-			"{Key=Roachprod,Value=true},"+
-			"]", opts.Lifetime, name)
+	// The instance store volumes are determined by the instance type, so
+	// check that it provides as many as were requested.
+	if opts.UseLocalSSD && opts.LocalSSDCount > 1 {
+		disks, err := instanceStoreDisks(ctx, region, machineType)
+		if err != nil {
+			return nil, "", err
+		}
+		if disks < opts.LocalSSDCount {
+			return nil, "", errors.Errorf("instance type %s has %d local SSDs, but %d were requested",
+				machineType, disks, opts.LocalSSDCount)
+		}
+	}
 
-	var data struct {
-		Instances []struct {
-			InstanceId string
+	if p.opts.Enclave {
+		if err := checkEnclaveSupport(ctx, region, machineType); err != nil {
+			return nil, "", err
+		}
+	}
+	if opts.NetworkInterfaces > 1 {
+		if err := checkNetworkInterfaceLimit(ctx, region, machineType, opts.NetworkInterfaces); err != nil {
+			return nil, "", err
 		}
 	}
 
+	tagSpecs, err := tagSpecifications(name, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
 	args := []string{
 		"ec2", "run-instances",
-		"--associate-public-ip-address",
 		"--count", "1",
 		"--image-id", amiId,
 		"--instance-type", machineType,
 		"--key-name", keyName,
 		"--region", region,
-		"--security-group-ids", sgId,
-		"--subnet-id", subnetId,
 		"--tag-specifications", tagSpecs,
-		"--user-data", awsStartupScript,
+		"--user-data", userData,
+	}
+	if opts.NetworkInterfaces > 1 {
+		// The interfaces share the subnet, and thus the availability zone,
+		// of the instance.
+		nics, err := networkInterfaces(n, opts.NetworkInterfaces)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, "--network-interfaces", nics)
+	} else {
+		publicIP := "--associate-public-ip-address"
+		if opts.NoPublicIP {
+			publicIP = "--no-associate-public-ip-address"
+		}
+		args = append(args, publicIP,
+			"--security-group-ids", n.securityGroupID,
+			"--subnet-id", n.subnetID)
+	}
+
+	if opts.Placement != "" {
+		args = append(args, "--placement", "GroupName="+vm.PlacementGroupName(opts.Labels[vm.ClusterLabel]))
+	}
+	if p.opts.IAMProfile != "" {
+		args = append(args, "--iam-instance-profile", "Name="+p.opts.IAMProfile)
+	}
+	if p.opts.Enclave {
+		args = append(args, "--enclave-options", "Enabled=true")
+	}
+	// With the default, EC2 recovers the instance on another host if its
+	// host fails and its instance type supports it.
+	if opts.AutoRestart != nil {
+		recovery := "disabled"
+		if *opts.AutoRestart {
+			recovery = "default"
+		}
+		args = append(args, "--maintenance-options", "AutoRecovery="+recovery)
+	}
+
+	if opts.BootDiskSizeGB > 0 || opts.BootDiskType != "" {
+		mapping, err := bootDiskMapping(ctx, region, amiId, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, "--block-device-mapping", mapping)
+	}
+
+	// The local NVMe devices are automatically mapped.  Otherwise, we need to map EBS data volumes.
+	// The startup script stripes all of the NVMe devices, so data volumes
+	// cannot be added to the instance store.
+	if opts.DataDiskCount > 0 && hasInstanceStore(machineType) {
+		return nil, "", errors.Errorf("instance type %s has local SSDs, which cannot be combined with data disks",
+			machineType)
+	}
+	// The existing volume of the instance, which is attached once it is
+	// running, takes the place of its data volumes.
+	if (!opts.UseLocalSSD || !hasInstanceStore(machineType)) && opts.ExistingDisk(name) == "" {
+		mappings, err := dataDiskMappings(opts)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, m := range mappings {
+			args = append(args, "--block-device-mapping", m)
+		}
 	}
 
-	// The local NVMe devices are automatically mapped.  Otherwise, we need to map an EBS data volume.
-	if !opts.UseLocalSSD {
+	if opts.Preemptible {
+		spotOpts := "SpotInstanceType=one-time,InstanceInterruptionBehavior=terminate"
+		if p.opts.SpotMaxPrice != "" {
+			spotOpts += ",MaxPrice=" + p.opts.SpotMaxPrice
+		}
 		args = append(args,
-			"--block-device-mapping",
-			// Size is measured in GB.  gp2 type derives guaranteed iops from size.
-			"DeviceName=/dev/sdd,Ebs={VolumeSize=500,VolumeType=gp2,DeleteOnTermination=true}",
+			"--instance-market-options",
+			fmt.Sprintf("MarketType=spot,SpotOptions={%s}", spotOpts),
 		)
 	}
 
-	return runJSONCommand(args, &data)
+	return args, machineType, nil
 }
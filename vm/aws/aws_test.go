@@ -0,0 +1,265 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/roachprod/vm"
+)
+
+// stubAWS replaces the aws CLI with fn for the duration of the test.
+func stubAWS(t *testing.T, fn func(args []string) ([]byte, error)) {
+	old := awsCommand
+	awsCommand = func(_ context.Context, args []string) ([]byte, error) {
+		return fn(args)
+	}
+	t.Cleanup(func() { awsCommand = old })
+}
+
+// argValue returns the value of the flag in args, or "" if it is absent.
+func argValue(args []string, flag string) string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// TestListRegionPages checks that listRegion returns each of the instances of
+// a region which is listed over several pages exactly once.
+func TestListRegionPages(t *testing.T) {
+	const instances = 2*listPageSize + 200
+	const perReservation = 2
+
+	type instance struct {
+		InstanceId string
+		LaunchTime string
+		State      struct{ Name string }
+		Tags       []struct{ Key, Value string }
+	}
+	type reservation struct {
+		Instances []instance
+	}
+	var pages [][]byte
+	for start := 0; start < instances; start += listPageSize {
+		var page struct {
+			Reservations []reservation
+			NextToken    string `json:",omitempty"`
+		}
+		for i := start; i < start+listPageSize && i < instances; i += perReservation {
+			var res reservation
+			for j := i; j < i+perReservation; j++ {
+				in := instance{
+					InstanceId: fmt.Sprintf("i-%d", j),
+					LaunchTime: "2020-01-02T03:04:05Z",
+				}
+				in.State.Name = "running"
+				in.Tags = []struct{ Key, Value string }{
+					{"Roachprod", "true"},
+					{"Name", fmt.Sprintf("user-test-%04d", j+1)},
+					{lifetimeTag, "12h0m0s"},
+				}
+				res.Instances = append(res.Instances, in)
+			}
+			page.Reservations = append(page.Reservations, res)
+		}
+		if start+listPageSize < instances {
+			page.NextToken = strconv.Itoa(len(pages) + 1)
+		}
+		b, err := json.Marshal(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, b)
+	}
+
+	var calls int
+	stubAWS(t, func(args []string) ([]byte, error) {
+		calls++
+		if got := argValue(args, "--max-items"); got != strconv.Itoa(listPageSize) {
+			t.Errorf("--max-items is %q, expected %d", got, listPageSize)
+		}
+		page := 0
+		if token := argValue(args, "--starting-token"); token != "" {
+			var err error
+			if page, err = strconv.Atoi(token); err != nil || page >= len(pages) {
+				return nil, fmt.Errorf("unexpected token %q", token)
+			}
+		}
+		return pages[page], nil
+	})
+
+	vms, err := (&Provider{}).listRegion(context.Background(), "us-east-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != len(pages) {
+		t.Errorf("listed %d pages, expected %d", calls, len(pages))
+	}
+	if len(vms) != instances {
+		t.Fatalf("listed %d instances, expected %d", len(vms), instances)
+	}
+	seen := make(map[string]bool, len(vms))
+	for _, v := range vms {
+		if seen[v.ProviderID] {
+			t.Errorf("%s is listed more than once", v.ProviderID)
+		}
+		seen[v.ProviderID] = true
+	}
+	for i := 0; i < instances; i++ {
+		if id := fmt.Sprintf("i-%d", i); !seen[id] {
+			t.Errorf("%s is missing", id)
+		}
+	}
+}
+
+// TestExtendRoundTrip checks that the lifetime which Extend tags the
+// instances with is read back by listRegion.
+func TestExtendRoundTrip(t *testing.T) {
+	var tagged string
+	stubAWS(t, func(args []string) ([]byte, error) {
+		switch args[1] {
+		case "create-tags":
+			tagged = argValue(args, "--tags")
+			return nil, nil
+		case "describe-instances":
+			value := strings.TrimPrefix(tagged, "Key="+lifetimeTag+",Value=")
+			return []byte(fmt.Sprintf(`{"Reservations": [{"Instances": [{
+				"InstanceId": "i-1",
+				"InstanceType": "m5.xlarge",
+				"LaunchTime": "2020-01-02T03:04:05Z",
+				"State": {"Name": "running"},
+				"Tags": [
+					{"Key": "Roachprod", "Value": "true"},
+					{"Key": "Name", "Value": "user-test-0001"},
+					{"Key": %q, "Value": %q}
+				]
+			}]}]}`, lifetimeTag, value)), nil
+		default:
+			return nil, fmt.Errorf("unexpected command %v", args)
+		}
+	})
+
+	p := &Provider{}
+	extended := vm.List{{Name: "user-test-0001", ProviderID: "i-1", Zone: "us-east-1a"}}
+	if err := p.Extend(context.Background(), extended, 36*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	vms, err := p.listRegion(context.Background(), "us-east-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vms) != 1 {
+		t.Fatalf("listed %d instances, expected 1", len(vms))
+	}
+	if vms[0].Lifetime != 36*time.Hour {
+		t.Errorf("the lifetime is %s, expected %s", vms[0].Lifetime, 36*time.Hour)
+	}
+	if len(vms[0].Errors) > 0 {
+		t.Errorf("unexpected errors %v", vms[0].Errors)
+	}
+}
+
+// TestMetadataRoundTrip checks that the metadata which SetMetadata tags an
+// instance with is read back by GetMetadata, and that it leaves the other
+// tags alone.
+func TestMetadataRoundTrip(t *testing.T) {
+	type tag struct{ Key, Value string }
+	tags := map[string]string{"Roachprod": "true", "Name": "user-test-0001"}
+	stubAWS(t, func(args []string) ([]byte, error) {
+		switch args[1] {
+		case "describe-tags":
+			var data struct{ Tags []tag }
+			for k, v := range tags {
+				data.Tags = append(data.Tags, tag{k, v})
+			}
+			return json.Marshal(data)
+		case "create-tags", "delete-tags":
+			var changed []tag
+			if err := json.Unmarshal([]byte(argValue(args, "--tags")), &changed); err != nil {
+				return nil, err
+			}
+			for _, c := range changed {
+				if args[1] == "create-tags" {
+					tags[c.Key] = c.Value
+				} else {
+					delete(tags, c.Key)
+				}
+			}
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("unexpected command %v", args)
+		}
+	})
+
+	p := &Provider{}
+	v := vm.VM{Name: "user-test-0001", ProviderID: "i-1", Zone: "us-east-1a"}
+	ctx := context.Background()
+	if err := p.SetMetadata(ctx, v, map[string]string{
+		"lock":  "user, 2020-01-02",
+		"notes": `a=b,"c" d`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetMetadata(ctx, v, map[string]string{"notes": ""}); err != nil {
+		t.Fatal(err)
+	}
+	md, err := p.GetMetadata(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md) != 1 || md["lock"] != "user, 2020-01-02" {
+		t.Errorf("unexpected metadata %v", md)
+	}
+	if tags["Name"] != "user-test-0001" || tags["Roachprod"] != "true" {
+		t.Errorf("the other tags were changed: %v", tags)
+	}
+}
+
+// TestDescribeUnknownZone checks that Describe fails without running the aws CLI
+// when the zone of the VM is unknown.
+func TestDescribeUnknownZone(t *testing.T) {
+	stubAWS(t, func(args []string) ([]byte, error) {
+		t.Errorf("unexpected command %v", args)
+		return nil, nil
+	})
+	_, err := (&Provider{}).Describe(context.Background(), vm.VM{Name: "user-test-0001", ProviderID: "i-1"})
+	if err == nil || err.Error() != "zone of user-test-0001 is unknown" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// TestRetryClassifier checks that throttled requests are retried, and that
+// requests which failed because EC2 was unavailable are only retried by the
+// commands which read resources.
+func TestRetryClassifier(t *testing.T) {
+	throttled := errors.New("An error occurred (RequestLimitExceeded) when calling the RunInstances operation")
+	unavailable := errors.New("An error occurred (Unavailable) when calling the DescribeInstances operation")
+	internal := errors.New("An error occurred (InternalError) when calling the TerminateInstances operation")
+	invalid := errors.New("An error occurred (InvalidParameterValue) when calling the RunInstances operation")
+	for _, tc := range []struct {
+		args     []string
+		err      error
+		expected bool
+	}{
+		{[]string{"ec2", "run-instances"}, throttled, true},
+		{[]string{"ec2", "run-instances"}, invalid, false},
+		{[]string{"ec2", "run-instances"}, unavailable, false},
+		{[]string{"ec2", "terminate-instances"}, internal, false},
+		{[]string{"ec2", "describe-instances"}, unavailable, true},
+		{[]string{"ec2", "describe-instances"}, internal, true},
+		{[]string{"ec2", "describe-instances"}, invalid, false},
+		{[]string{"iam", "get-instance-profile"}, unavailable, true},
+	} {
+		if actual := retryClassifier(tc.args)(tc.err); actual != tc.expected {
+			t.Errorf("%v: expected %q to be retried: %t", tc.args, tc.err, tc.expected)
+		}
+	}
+}
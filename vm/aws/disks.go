@@ -0,0 +1,99 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// existingDiskDevice is the device name under which the existing volume of
+// vm.CreateOpts.ExistingDisks is attached. Since the existing volume takes
+// the place of the data volumes, it uses the device of the first of those.
+var existingDiskDevice = fmt.Sprintf("/dev/sd%c", firstDataDevice)
+
+// existingDiskPath returns the path of the NVMe device of the EBS volume
+// within the instance, which unlike the device name does not depend on the
+// order in which volumes are attached.
+func existingDiskPath(volumeID string) string {
+	return "/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_" + strings.Replace(volumeID, "-", "", 1)
+}
+
+// checkExistingDisks returns an error if any of the existing volumes of the
+// named instances, which are launched in the zones of placements, is not in
+// the zone of its instance or is not available, e.g. because it is attached
+// to another instance.
+func checkExistingDisks(ctx context.Context, names, placements []string, opts vm.CreateOpts) error {
+	var indexes []int
+	for i, name := range names {
+		if opts.ExistingDisk(name) != "" {
+			indexes = append(indexes, i)
+		}
+	}
+	return vm.ForEach(len(indexes), func(j int) error {
+		name, zone := names[indexes[j]], placements[indexes[j]%len(placements)]
+		volumeID := opts.ExistingDisk(name)
+		region, err := zoneToRegion(zone)
+		if err != nil {
+			return err
+		}
+		var data struct {
+			Volumes []struct {
+				AvailabilityZone string
+				State            string
+				Attachments      []struct {
+					InstanceId string
+				}
+			}
+		}
+		args := []string{"ec2", "describe-volumes", "--region", region, "--volume-ids", volumeID}
+		if err := runJSONCommand(ctx, args, &data); err != nil {
+			return errors.Wrapf(err, "volume %s of %s is not in region %s", volumeID, name, region)
+		}
+		if len(data.Volumes) == 0 {
+			return errors.Errorf("volume %s of %s is not in region %s", volumeID, name, region)
+		}
+		v := data.Volumes[0]
+		if v.AvailabilityZone != zone {
+			return errors.Errorf("volume %s of %s is in zone %s, not %s", volumeID, name, v.AvailabilityZone, zone)
+		}
+		if len(v.Attachments) > 0 {
+			var instances []string
+			for _, a := range v.Attachments {
+				instances = append(instances, a.InstanceId)
+			}
+			sort.Strings(instances)
+			return errors.Errorf("volume %s of %s is attached to %s", volumeID, name, strings.Join(instances, ", "))
+		}
+		if v.State != "available" {
+			return errors.Errorf("volume %s of %s is %s, not available", volumeID, name, v.State)
+		}
+		return nil
+	})
+}
+
+// attachExistingDisk attaches the existing volume to the instance once it is
+// running, where the startup script waits for it. Unless keep is set, the
+// volume is deleted along with the instance, as its data volumes are.
+func attachExistingDisk(ctx context.Context, region, instanceID, volumeID string, keep bool) error {
+	cmds := [][]string{
+		{"ec2", "wait", "instance-running", "--instance-ids", instanceID},
+		{"ec2", "attach-volume", "--volume-id", volumeID, "--instance-id", instanceID,
+			"--device", existingDiskDevice},
+		{"ec2", "wait", "volume-in-use", "--volume-ids", volumeID},
+	}
+	if !keep {
+		cmds = append(cmds, []string{"ec2", "modify-instance-attribute", "--instance-id", instanceID,
+			"--block-device-mappings",
+			fmt.Sprintf(`[{"DeviceName":"%s","Ebs":{"DeleteOnTermination":true}}]`, existingDiskDevice)})
+	}
+	for _, args := range cmds {
+		if err := runCommand(ctx, append(args, "--region", region)); err != nil {
+			return errors.Wrapf(err, "could not attach volume %s", volumeID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// findSecurityGroup returns the id of the security group of a cluster in the
+// VPC, or an empty string if it has none.
+func findSecurityGroup(ctx context.Context, region, vpcID, cluster string) (string, error) {
+	args := []string{"ec2", "describe-security-groups", "--region", region,
+		"--filters",
+		"Name=vpc-id,Values=" + vpcID,
+		"Name=group-name,Values=" + vm.FirewallName(cluster),
+	}
+	var data struct {
+		SecurityGroups []struct {
+			GroupId string
+		}
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return "", err
+	}
+	if len(data.SecurityGroups) == 0 {
+		return "", nil
+	}
+	return data.SecurityGroups[0].GroupId, nil
+}
+
+// ingressPermissions returns the --ip-permissions of the security group with
+// the id: the instances in the group may connect to each other, and otherwise
+// only the ingress rules are allowed.
+func ingressPermissions(groupID string, ingress []vm.IngressRule) []string {
+	ret := []string{fmt.Sprintf("IpProtocol=-1,UserIdGroupPairs=[{GroupId=%s}]", groupID)}
+	for _, r := range ingress {
+		ret = append(ret, fmt.Sprintf("IpProtocol=tcp,FromPort=%d,ToPort=%d,IpRanges=[{CidrIp=%s}]",
+			r.FromPort, r.ToPort, r.CIDR))
+	}
+	return ret
+}
+
+// createSecurityGroup creates the security group of a cluster in the VPC with
+// the ingress rules, and returns its id.
+func createSecurityGroup(
+	ctx context.Context, region, vpcID, cluster string, ingress []vm.IngressRule,
+) (string, error) {
+	name := vm.FirewallName(cluster)
+	createArgs := []string{"ec2", "create-security-group", "--region", region,
+		"--group-name", name, "--vpc-id", vpcID,
+		"--description", "roachprod firewall of cluster " + cluster,
+		"--tag-specifications", fmt.Sprintf(
+			"ResourceType=security-group,Tags=[{Key=Name,Value=%s},{Key=Roachprod,Value=true}]", name),
+	}
+	if config.DryRun {
+		vm.PrintDryRun("aws", createArgs)
+		vm.PrintDryRun("aws", append([]string{"ec2", "authorize-security-group-ingress", "--region", region,
+			"--group-id", fmt.Sprintf("<%s>", name), "--ip-permissions"},
+			ingressPermissions(fmt.Sprintf("<%s>", name), ingress)...))
+		return "", nil
+	}
+	var data struct {
+		GroupId string
+	}
+	if err := runJSONCommand(ctx, createArgs, &data); err != nil {
+		return "", errors.Wrapf(err, "could not create security group %s in VPC %s", name, vpcID)
+	}
+	authorizeArgs := append([]string{"ec2", "authorize-security-group-ingress", "--region", region,
+		"--group-id", data.GroupId, "--ip-permissions"}, ingressPermissions(data.GroupId, ingress)...)
+	if err := runCommand(ctx, authorizeArgs); err != nil {
+		// A group without its rules would admit nothing but the instances
+		// themselves, so it is not kept.
+		if deleteErr := runCommand(ctx, []string{"ec2", "delete-security-group", "--region", region,
+			"--group-id", data.GroupId}); deleteErr != nil {
+			vm.Warningf("unable to delete security group %s: %s", data.GroupId, deleteErr)
+		}
+		return "", errors.Wrapf(err, "could not add the ingress rules of security group %s", name)
+	}
+	return data.GroupId, nil
+}
+
+// ensureSecurityGroups launches the instances of each zone in networks into
+// the security group of the cluster in the zone's VPC instead of the
+// configured one. The groups which do not exist yet are created with the
+// ingress rules, and the existing ones are left as they are. In a dry run, the
+// configured groups are kept for the --dry-run checks of the launches, since
+// the groups to be created have no ids.
+func ensureSecurityGroups(
+	ctx context.Context, cluster string, networks map[string]network, ingress []vm.IngressRule,
+) error {
+	type vpc struct {
+		region, id string
+	}
+	var vpcs []vpc
+	seen := make(map[vpc]bool)
+	for zone, n := range networks {
+		region, err := zoneToRegion(zone)
+		if err != nil {
+			return err
+		}
+		if v := (vpc{region, n.vpcID}); !seen[v] {
+			seen[v] = true
+			vpcs = append(vpcs, v)
+		}
+	}
+	sort.Slice(vpcs, func(i, j int) bool {
+		if vpcs[i].region != vpcs[j].region {
+			return vpcs[i].region < vpcs[j].region
+		}
+		return vpcs[i].id < vpcs[j].id
+	})
+
+	groups := make([]string, len(vpcs))
+	if err := vm.ForEach(len(vpcs), func(i int) error {
+		var err error
+		groups[i], err = findSecurityGroup(ctx, vpcs[i].region, vpcs[i].id, cluster)
+		return err
+	}); err != nil {
+		return err
+	}
+	var missing []int
+	for i := range vpcs {
+		if groups[i] == "" {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 && len(ingress) == 0 {
+		return errors.Errorf("cluster %s has no security group in VPC %s, and no ingress rules were given to create one",
+			cluster, vpcs[missing[0]].id)
+	}
+
+	if config.DryRun {
+		for _, i := range missing {
+			if _, err := createSecurityGroup(ctx, vpcs[i].region, vpcs[i].id, cluster, ingress); err != nil {
+				return err
+			}
+		}
+	} else {
+		var mu sync.Mutex
+		var created []int
+		err := vm.ForEach(len(missing), func(j int) error {
+			i := missing[j]
+			id, err := createSecurityGroup(ctx, vpcs[i].region, vpcs[i].id, cluster, ingress)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			groups[i] = id
+			created = append(created, i)
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			for _, i := range created {
+				if deleteErr := runCommand(ctx, []string{"ec2", "delete-security-group",
+					"--region", vpcs[i].region, "--group-id", groups[i]}); deleteErr != nil {
+					vm.Warningf("unable to delete security group %s: %s", groups[i], deleteErr)
+				}
+			}
+			return err
+		}
+	}
+
+	for zone, n := range networks {
+		region, _ := zoneToRegion(zone)
+		for i, v := range vpcs {
+			if v == (vpc{region, n.vpcID}) && groups[i] != "" {
+				n.securityGroupID = groups[i]
+			}
+		}
+		networks[zone] = n
+	}
+	return nil
+}
+
+// deleteSecurityGroups deletes the security groups of the clusters in the
+// region, whose instances must have been terminated. A group which is still
+// in use by other instances of its cluster is left for the last of them.
+func deleteSecurityGroups(ctx context.Context, region string, clusters []string) error {
+	for _, cluster := range clusters {
+		name := vm.FirewallName(cluster)
+		if config.DryRun {
+			vm.PrintDryRun("aws", []string{"ec2", "delete-security-group", "--region", region,
+				"--group-id", fmt.Sprintf("<%s>", name)})
+			continue
+		}
+		args := []string{"ec2", "describe-security-groups", "--region", region,
+			"--filters", "Name=group-name,Values=" + name}
+		var data struct {
+			SecurityGroups []struct {
+				GroupId string
+			}
+		}
+		if err := runJSONCommand(ctx, args, &data); err != nil {
+			return err
+		}
+		for _, g := range data.SecurityGroups {
+			err := runCommand(ctx, []string{"ec2", "delete-security-group", "--region", region,
+				"--group-id", g.GroupId})
+			if err != nil && !strings.Contains(err.Error(), "DependencyViolation") {
+				return errors.Wrapf(err, "could not delete security group %s", name)
+			}
+		}
+	}
+	return nil
+}
@@ -1,19 +1,22 @@
 package aws
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
-	"io/ioutil"
-	"os"
+	"strings"
 
+	"github.com/cockroachdb/roachprod/vm"
 	"github.com/pkg/errors"
 )
 
-const sshPublicKeyFile = "${HOME}/.ssh/id_rsa.pub"
+// defaultSSHKeyPath is the private key whose public half is imported into
+// each region, unless overridden by --ssh-key or --aws-ssh-key.
+const defaultSSHKeyPath = "${HOME}/.ssh/id_rsa"
 
 // sshKeyExists checks to see if there is a an SSH key with the given name in the given region.
-func sshKeyExists(keyName string, region string) (bool, error) {
+func sshKeyExists(ctx context.Context, keyName string, region string) (bool, error) {
 	var data struct {
 		KeyPairs []struct {
 			KeyName string
@@ -23,7 +26,7 @@ func sshKeyExists(keyName string, region string) (bool, error) {
 		"ec2", "describe-key-pairs",
 		"--region", region,
 	}
-	err := runJSONCommand(args, &data)
+	err := runJSONCommand(ctx, args, &data)
 	if err != nil {
 		return false, err
 	}
@@ -36,16 +39,10 @@ func sshKeyExists(keyName string, region string) (bool, error) {
 }
 
 // sshKeyImport takes the user's local, public SSH key and imports it into the ec2 region so that
-// we can create new hosts with it.
-func sshKeyImport(keyName string, region string) error {
-	keyBytes, err := ioutil.ReadFile(os.ExpandEnv(sshPublicKeyFile))
-	if err != nil {
-		if os.IsNotExist(err) {
-			return errors.Wrapf(err, "please run ssh-keygen externally to create your %s file", sshPublicKeyFile)
-		}
-		return err
-	}
-
+// we can create new hosts with it. A key pair of the same name which was
+// imported concurrently, e.g. by another roachprod sync, is not an error: the
+// name is derived from the key, so the key pair is the same.
+func sshKeyImport(ctx context.Context, keyName string, region string, publicKey []byte) error {
 	var data struct {
 		KeyName string
 	}
@@ -53,23 +50,51 @@ func sshKeyImport(keyName string, region string) error {
 		"ec2", "import-key-pair",
 		"--region", region,
 		"--key-name", keyName,
-		"--public-key-material", string(keyBytes),
+		"--public-key-material", string(publicKey),
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil && !strings.Contains(err.Error(), "InvalidKeyPair.Duplicate") {
+		return err
+	}
+	return nil
+}
+
+// keyPairRegionsError returns nil if the key pair is present in all of the
+// regions, i.e. if none of errs, which are those of the regions, is set.
+// Otherwise it names the regions which lack the key pair along with their
+// errors, and those which have it.
+func keyPairRegionsError(keyName string, regions []string, errs []error) error {
+	var ok, failed []string
+	for i, region := range regions {
+		if errs[i] == nil {
+			ok = append(ok, region)
+		} else {
+			failed = append(failed, fmt.Sprintf("%s: %s", region, errs[i]))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("key pair %s is missing in %d of %d regions", keyName, len(failed), len(regions))
+	if len(ok) > 0 {
+		msg += fmt.Sprintf(" (present in %s)", strings.Join(ok, ", "))
 	}
-	return runJSONCommand(args, &data)
+	return errors.Errorf("%s:\n  %s", msg, strings.Join(failed, "\n  "))
+}
+
+// sshKeyPath returns the private key whose public half is imported.
+func (p *Provider) sshKeyPath() string {
+	return vm.SSHKeyPath(p.opts.SSHKey, defaultSSHKeyPath)
 }
 
 // sshKeyName computes the name of the ec2 ssh key that we'll store the local user's public key in
-func (p *Provider) sshKeyName() (string, error) {
-	user, err := p.FindActiveAccount()
+func (p *Provider) sshKeyName(ctx context.Context) (string, error) {
+	user, err := p.FindActiveAccount(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	keyBytes, err := ioutil.ReadFile(os.ExpandEnv(sshPublicKeyFile))
+	keyBytes, err := vm.SSHPublicKey(p.sshKeyPath())
 	if err != nil {
-		if os.IsNotExist(err) {
-			return "", errors.Wrapf(err, "please run ssh-keygen externally to create your %s file", sshPublicKeyFile)
-		}
 		return "", err
 	}
 
@@ -82,3 +107,21 @@ func (p *Provider) sshKeyName() (string, error) {
 
 	return fmt.Sprintf("%s-%s", user, hashText), nil
 }
+
+// remoteUser returns the user as which the instances created with opts are
+// logged into: that of --aws-user, or else CreateOpts.SSHUser, or else the
+// user of the distribution named by --aws-os-image, or else
+// defaultRemoteUser. The user of the AMIs of --aws-ami cannot be told from
+// their IDs.
+func (p *Provider) remoteUser(opts vm.CreateOpts) string {
+	switch {
+	case p.opts.RemoteUserName != "":
+		return p.opts.RemoteUserName
+	case opts.SSHUser != "":
+		return opts.SSHUser
+	}
+	if user := vm.DefaultSSHUser(p.opts.OSImage); user != "" && opts.OSImage == "" {
+		return user
+	}
+	return defaultRemoteUser
+}
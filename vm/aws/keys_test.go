@@ -0,0 +1,98 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestKeyPairRegionsError(t *testing.T) {
+	regions := []string{"us-east-1", "us-west-2", "eu-west-1"}
+	if err := keyPairRegionsError("key", regions, make([]error, len(regions))); err != nil {
+		t.Errorf("expected no error when all regions have the key pair, got %s", err)
+	}
+
+	err := keyPairRegionsError("key", regions, []error{nil, errors.New("denied"), nil})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	expected := "key pair key is missing in 1 of 3 regions (present in us-east-1, eu-west-1):\n  us-west-2: denied"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err)
+	}
+
+	err = keyPairRegionsError("key", regions[:1], []error{errors.New("denied")})
+	if err == nil || strings.Contains(err.Error(), "present in") {
+		t.Errorf("expected an error without any regions with the key pair, got %v", err)
+	}
+}
+
+// TestImportKeyPairs checks that the key pair is only imported into the
+// regions which lack it, and that the regions which could not be checked are
+// reported without keeping the others from being imported into.
+func TestImportKeyPairs(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "id_rsa")
+	if err := ioutil.WriteFile(key, []byte("private"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(key+".pub", []byte("ssh-rsa AAAA user@host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldAccount := cachedActiveAccount
+	cachedActiveAccount = "user"
+	t.Cleanup(func() { cachedActiveAccount = oldAccount })
+
+	p := &Provider{}
+	p.opts.SSHKey = key
+	p.opts.DefaultZone = "us-east-1a"
+	p.opts.AMI = []string{"us-east-1:ami-1", "us-west-2:ami-2", "eu-west-1:ami-3"}
+	p.opts.SecurityGroups = []string{"us-east-1:sg-1", "us-west-2:sg-2", "eu-west-1:sg-3"}
+	keyName, err := p.sshKeyName(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var imported []string
+	stubAWS(t, func(args []string) ([]byte, error) {
+		region := argValue(args, "--region")
+		switch args[1] {
+		case "describe-key-pairs":
+			switch region {
+			case "us-east-1":
+				return []byte(fmt.Sprintf(`{"KeyPairs": [{"KeyName": %q}]}`, keyName)), nil
+			case "eu-west-1":
+				return nil, errors.New("UnauthorizedOperation")
+			default:
+				return []byte(`{"KeyPairs": []}`), nil
+			}
+		case "import-key-pair":
+			if got := argValue(args, "--key-name"); got != keyName {
+				t.Errorf("imported key pair %s, expected %s", got, keyName)
+			}
+			mu.Lock()
+			imported = append(imported, region)
+			mu.Unlock()
+			return []byte(`{}`), nil
+		default:
+			return nil, fmt.Errorf("unexpected command %v", args)
+		}
+	})
+
+	err = p.importKeyPairs(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "eu-west-1: ") ||
+		!strings.Contains(err.Error(), "present in us-east-1, us-west-2") {
+		t.Errorf("expected eu-west-1 to be reported, got %v", err)
+	}
+	sort.Strings(imported)
+	if !reflect.DeepEqual(imported, []string{"us-west-2"}) {
+		t.Errorf("imported into %v, expected only us-west-2", imported)
+	}
+}
@@ -0,0 +1,104 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// maxSpreadInstancesPerZone is the number of running instances which a spread
+// placement group may hold in each availability zone.
+const maxSpreadInstancesPerZone = 7
+
+// checkSpreadPlacement returns an error if a spread placement group cannot
+// hold the instances to be launched in placements, the zone of each instance.
+func checkSpreadPlacement(placements []string) error {
+	counts := make(map[string]int)
+	for _, zone := range placements {
+		counts[zone]++
+	}
+	zones := make([]string, 0, len(counts))
+	for zone := range counts {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	for _, zone := range zones {
+		if counts[zone] > maxSpreadInstancesPerZone {
+			return errors.Errorf("a spread placement group holds at most %d instances per zone, not %d in %s; "+
+				"spread the cluster over more zones", maxSpreadInstancesPerZone, counts[zone], zone)
+		}
+	}
+	return nil
+}
+
+// ensurePlacementGroups creates the spread placement group of a cluster in
+// each of the regions which does not have it yet.
+func ensurePlacementGroups(ctx context.Context, cluster string, regions []string) error {
+	name := vm.PlacementGroupName(cluster)
+	missing := make([]bool, len(regions))
+	if err := vm.ForEach(len(regions), func(i int) error {
+		args := []string{"ec2", "describe-placement-groups", "--region", regions[i],
+			"--filters", "Name=group-name,Values=" + name}
+		var data struct {
+			PlacementGroups []struct {
+				GroupName string
+			}
+		}
+		if err := runJSONCommand(ctx, args, &data); err != nil {
+			return err
+		}
+		missing[i] = len(data.PlacementGroups) == 0
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	createArgs := func(region string) []string {
+		return []string{"ec2", "create-placement-group", "--region", region,
+			"--group-name", name, "--strategy", "spread",
+			"--tag-specifications", fmt.Sprintf(
+				"ResourceType=placement-group,Tags=[{Key=Name,Value=%s},{Key=Roachprod,Value=true}]", name)}
+	}
+	if config.DryRun {
+		for i, region := range regions {
+			if missing[i] {
+				vm.PrintDryRun("aws", createArgs(region))
+			}
+		}
+		return nil
+	}
+	return vm.ForEach(len(regions), func(i int) error {
+		if !missing[i] {
+			return nil
+		}
+		if err := runCommand(ctx, createArgs(regions[i])); err != nil {
+			return errors.Wrapf(err, "could not create placement group %s in region %s", name, regions[i])
+		}
+		return nil
+	})
+}
+
+// deletePlacementGroups deletes the placement groups of the clusters in the
+// region, whose instances must have been terminated. A group which is still
+// in use by other instances of its cluster is left for the last of them.
+func deletePlacementGroups(ctx context.Context, region string, clusters []string) error {
+	for _, cluster := range clusters {
+		args := []string{"ec2", "delete-placement-group", "--region", region,
+			"--group-name", vm.PlacementGroupName(cluster)}
+		if config.DryRun {
+			vm.PrintDryRun("aws", args)
+			continue
+		}
+		err := runCommand(ctx, args)
+		if err != nil && !strings.Contains(err.Error(), "InvalidPlacementGroup.InUse") &&
+			!strings.Contains(err.Error(), "InvalidPlacementGroup.Unknown") {
+			return errors.Wrapf(err, "could not delete placement group %s", vm.PlacementGroupName(cluster))
+		}
+	}
+	return nil
+}
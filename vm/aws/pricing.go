@@ -0,0 +1,51 @@
+package aws
+
+import (
+	"github.com/cockroachdb/roachprod/vm"
+)
+
+// On-demand Linux prices in USD for the us-east-2 region. These are only
+// intended to provide a rough estimate and will drift from the published
+// prices. See https://aws.amazon.com/ec2/pricing/on-demand/
+var hourlyPrices = map[string]float64{
+	"m5.large":    0.096,
+	"m5.xlarge":   0.192,
+	"m5.2xlarge":  0.384,
+	"m5.4xlarge":  0.768,
+	"m5.12xlarge": 2.304,
+	"m5d.large":   0.113,
+	"m5d.xlarge":  0.226,
+	"m5d.2xlarge": 0.452,
+	"m5d.4xlarge": 0.904,
+	"c5.xlarge":   0.17,
+	"c5.2xlarge":  0.34,
+	"c5.4xlarge":  0.68,
+	"c5d.xlarge":  0.192,
+	"c5d.2xlarge": 0.384,
+	"c5d.4xlarge": 0.768,
+	"i3.large":    0.156,
+	"i3.xlarge":   0.312,
+	"i3.2xlarge":  0.624,
+	"i3.4xlarge":  1.248,
+}
+
+// Instances without local storage have a 500GB gp2 EBS data volume mapped
+// to them (see runInstance), at $0.10 per GB-month.
+const ebsVolumePrice = 500 * 0.10 / 730
+
+// CostEstimate is part of the vm.Provider interface.
+func (p *Provider) CostEstimate(vms vm.List) (float64, error) {
+	var total float64
+	for i := range vms {
+		price, ok := hourlyPrices[vms[i].MachineType]
+		if !ok {
+			vms[i].Errors = append(vms[i].Errors, vm.ErrUnknownPrice)
+			continue
+		}
+		if !hasInstanceStore(vms[i].MachineType) {
+			price += ebsVolumePrice
+		}
+		total += price
+	}
+	return total, nil
+}
@@ -0,0 +1,274 @@
+package aws
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// The service quota codes of the vCPUs of running on-demand and spot
+// instances, keyed by the class of their family, and of the storage of the EBS
+// volume types.
+var (
+	onDemandVCPUQuotas = map[string]string{"standard": "L-1216C47A", "g": "L-DB2E81BA", "p": "L-417A185B"}
+	spotVCPUQuotas     = map[string]string{"standard": "L-34B43A08", "g": "L-3819A6DF", "p": "L-7212CCBC"}
+	volumeQuotas       = map[string]string{"gp2": "L-D18FCD1D", "gp3": "L-7A658B76"}
+)
+
+// elasticIPQuota is the service quota code of the Elastic IPs of a region.
+const elasticIPQuota = "L-0263D0A3"
+
+// vcpuQuota returns the service quota code of the vCPUs of the instance type,
+// or "" for the families whose quotas are not checked.
+func vcpuQuota(machineType string, spot bool) string {
+	class := "standard"
+	switch {
+	case strings.HasPrefix(machineType, "inf"), strings.HasPrefix(machineType, "dl"),
+		strings.HasPrefix(machineType, "trn"), strings.HasPrefix(machineType, "f"),
+		strings.HasPrefix(machineType, "x"), strings.HasPrefix(machineType, "u"):
+		return ""
+	case strings.HasPrefix(machineType, "g"), strings.HasPrefix(machineType, "vt"):
+		class = "g"
+	case strings.HasPrefix(machineType, "p"):
+		class = "p"
+	}
+	if spot {
+		return spotVCPUQuotas[class]
+	}
+	return onDemandVCPUQuotas[class]
+}
+
+// instanceVCPUs returns the number of vCPUs of each of the instance types.
+func instanceVCPUs(ctx context.Context, region string, types []string) (map[string]int, error) {
+	ret := make(map[string]int, len(types))
+	// describe-instance-types takes at most 100 instance types.
+	for len(types) > 0 {
+		n := len(types)
+		if n > 100 {
+			n = 100
+		}
+		args := append([]string{"ec2", "describe-instance-types", "--region", region,
+			"--instance-types"}, types[:n]...)
+		var data struct {
+			InstanceTypes []struct {
+				InstanceType string
+				VCpuInfo     struct {
+					DefaultVCpus int
+				}
+			}
+		}
+		if err := runJSONCommand(ctx, args, &data); err != nil {
+			return nil, errors.Wrapf(err, "could not describe the instance types in region %s", region)
+		}
+		for _, t := range data.InstanceTypes {
+			ret[t.InstanceType] = t.VCpuInfo.DefaultVCpus
+		}
+		types = types[n:]
+	}
+	return ret, nil
+}
+
+// serviceQuota returns the value of a service quota in the region.
+func serviceQuota(ctx context.Context, region, service, code string) (float64, error) {
+	args := []string{"service-quotas", "get-service-quota", "--region", region,
+		"--service-code", service, "--quota-code", code}
+	var data struct {
+		Quota struct {
+			Value float64
+		}
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return 0, errors.Wrapf(err, "could not get service quota %s in region %s", code, region)
+	}
+	return data.Quota.Value, nil
+}
+
+// quotaUsage returns the current usage of the quotas of the region which
+// CheckQuota checks, keyed by their codes: the vCPUs of the pending and
+// running instances, the storage of the EBS volumes in TiB, and the number of
+// Elastic IPs.
+func quotaUsage(ctx context.Context, region string) (map[string]float64, error) {
+	var instances struct {
+		Reservations []struct {
+			Instances []struct {
+				InstanceType      string
+				InstanceLifecycle string
+			}
+		}
+	}
+	if err := runJSONCommand(ctx, []string{"ec2", "describe-instances", "--region", region,
+		"--filters", "Name=instance-state-name,Values=pending,running"}, &instances); err != nil {
+		return nil, err
+	}
+	var types []string
+	seen := make(map[string]bool)
+	for _, r := range instances.Reservations {
+		for _, in := range r.Instances {
+			if !seen[in.InstanceType] {
+				seen[in.InstanceType] = true
+				types = append(types, in.InstanceType)
+			}
+		}
+	}
+	cpus, err := instanceVCPUs(ctx, region, types)
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]float64)
+	for _, r := range instances.Reservations {
+		for _, in := range r.Instances {
+			usage[vcpuQuota(in.InstanceType, in.InstanceLifecycle == "spot")] += float64(cpus[in.InstanceType])
+		}
+	}
+
+	var volumes struct {
+		Volumes []struct {
+			Size       int
+			VolumeType string
+		}
+	}
+	if err := runJSONCommand(ctx, []string{"ec2", "describe-volumes", "--region", region}, &volumes); err != nil {
+		return nil, err
+	}
+	for _, v := range volumes.Volumes {
+		usage[volumeQuotas[v.VolumeType]] += float64(v.Size) / 1024
+	}
+
+	var addresses struct {
+		Addresses []jsonAddress
+	}
+	if err := runJSONCommand(ctx, []string{"ec2", "describe-addresses", "--region", region}, &addresses); err != nil {
+		return nil, err
+	}
+	usage[elasticIPQuota] = float64(len(addresses.Addresses))
+	delete(usage, "")
+	return usage, nil
+}
+
+// CheckQuota is part of the vm.Provider interface. The vCPUs of the instances
+// are checked against the on-demand or spot quota of their family, the EBS
+// volumes against the storage quota of their type, and the Elastic IPs of
+// static IPs against the quota on them. The root volume, whose size and type
+// default to those of the AMI, is only counted if both are given. Instances
+// launched from a template are not checked.
+func (p *Provider) CheckQuota(ctx context.Context, opts vm.CreateOpts, count int) error {
+	if p.opts.Template != "" || count == 0 {
+		return nil
+	}
+	opts, err := p.resolveZoneIDs(ctx, opts)
+	if err != nil {
+		return err
+	}
+	placements, err := p.placements(opts, count)
+	if err != nil {
+		return err
+	}
+	var usedZones []string
+	zoneRegions := make(map[string]string)
+	regionTypes := make(map[string][]string)
+	for _, zone := range placements {
+		if _, ok := zoneRegions[zone]; ok {
+			continue
+		}
+		if zoneRegions[zone], err = zoneToRegion(zone); err != nil {
+			return err
+		}
+		usedZones = append(usedZones, zone)
+	}
+	machineType, err := p.machineType(opts)
+	if err != nil {
+		return err
+	}
+	machineTypes, err := vm.MachineTypes(ctx, p, usedZones, machineType, p.opts.MachineTypeFallbacks)
+	if err != nil {
+		return err
+	}
+	seenTypes := make(map[string]bool)
+	for _, zone := range usedZones {
+		region := zoneRegions[zone]
+		if key := region + "/" + machineTypes[zone]; !seenTypes[key] {
+			seenTypes[key] = true
+			regionTypes[region] = append(regionTypes[region], machineTypes[zone])
+		}
+	}
+	regions := make([]string, 0, len(regionTypes))
+	for region := range regionTypes {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	cpus := make([]map[string]int, len(regions))
+	if err := vm.ForEach(len(regions), func(i int) error {
+		var err error
+		cpus[i], err = instanceVCPUs(ctx, regions[i], regionTypes[regions[i]])
+		return err
+	}); err != nil {
+		return err
+	}
+	regionCPUs := make(map[string]map[string]int, len(regions))
+	for i, region := range regions {
+		regionCPUs[region] = cpus[i]
+	}
+
+	dataVolumes, dataVolumeSize, dataVolumeType := 1, defaultDataVolumeSizeGB, defaultDataVolumeType
+	if opts.DataDiskCount > 0 {
+		dataVolumes = opts.DataDiskCount
+	}
+	if opts.DataDiskSizeGB > 0 {
+		dataVolumeSize = opts.DataDiskSizeGB
+	}
+	if opts.DataDiskType != "" {
+		dataVolumeType = opts.DataDiskType
+	}
+
+	demands := make(map[string]*vm.QuotaDemand)
+	for _, zone := range placements {
+		region, mt := zoneRegions[zone], machineTypes[zone]
+		if q := vcpuQuota(mt, opts.Preemptible); q != "" {
+			vm.AddQuotaDemand(demands, region, q, "vCPUs", float64(regionCPUs[region][mt]))
+		}
+		if q := volumeQuotas[opts.BootDiskType]; q != "" && opts.BootDiskSizeGB > 0 {
+			vm.AddQuotaDemand(demands, region, q, "TiB", float64(opts.BootDiskSizeGB)/1024)
+		}
+		// As in runInstanceArgs, the instance store replaces the data volumes.
+		if q := volumeQuotas[dataVolumeType]; q != "" && (!opts.UseLocalSSD || !hasInstanceStore(mt)) {
+			vm.AddQuotaDemand(demands, region, q, "TiB", float64(dataVolumes*dataVolumeSize)/1024)
+		}
+		if opts.StaticIP {
+			vm.AddQuotaDemand(demands, region, elasticIPQuota, "addresses", 1)
+		}
+	}
+
+	usage := make([]map[string]float64, len(regions))
+	if err := vm.ForEach(len(regions), func(i int) error {
+		var err error
+		usage[i], err = quotaUsage(ctx, regions[i])
+		return err
+	}); err != nil {
+		return err
+	}
+	regionUsage := make(map[string]map[string]float64, len(regions))
+	for i, region := range regions {
+		regionUsage[region] = usage[i]
+	}
+	keys := make([]string, 0, len(demands))
+	for key := range demands {
+		keys = append(keys, key)
+	}
+	if err := vm.ForEach(len(keys), func(i int) error {
+		d := demands[keys[i]]
+		service := "ec2"
+		if d.Unit == "TiB" {
+			service = "ebs"
+		}
+		var err error
+		d.Limit, err = serviceQuota(ctx, d.Region, service, d.Quota)
+		d.Usage = regionUsage[d.Region][d.Quota]
+		return err
+	}); err != nil {
+		return err
+	}
+	return vm.CheckQuotaDemands(ProviderName, demands)
+}
@@ -1,10 +1,15 @@
 package aws
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"fmt"
 	"os/exec"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/cockroachdb/roachprod/vm"
 	"github.com/pkg/errors"
@@ -29,7 +34,10 @@ for d in $(ls /dev/nvme?n1); do
     echo "Disk ${d} already mounted, skipping..."
   fi
 done
-if [ "${#disks[@]}" -eq "0" ]; then
+if grep -e " ${mountpoint} " /etc/fstab > /dev/null; then
+  echo "${mountpoint} already configured, skipping..."
+  chmod 777 ${mountpoint}
+elif [ "${#disks[@]}" -eq "0" ]; then
   echo "No disks mounted, creating ${mountpoint}"
   mkdir -p ${mountpoint}
   chmod 777 ${mountpoint}
@@ -65,32 +73,159 @@ sudo sh -c 'echo "root - nofile 65536\n* - nofile 65536" > /etc/security/limits.
 sudo touch /mnt/data1/.roachprod-initialized
 `
 
-// runCommand is used to invoke an AWS command for which no output is expected.
-func runCommand(args []string) error {
-	cmd := exec.Command("aws", args...)
+// maxUserDataSize is the limit on the size of the user-data of an instance.
+// See https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instancedata-add-user-data.html
+const maxUserDataSize = 16 << 10
 
-	_, err := cmd.Output()
+// startupScript returns the user-data of the named instance, which includes
+// the user-supplied startup script, if any.
+func startupScript(name string, opts vm.CreateOpts) (string, error) {
+	userScript, err := vm.RenderStartupScript(opts.StartupScript, name)
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			log.Println(string(exitErr.Stderr))
+		return "", err
+	}
+	var existingDisk string
+	if volumeID := opts.ExistingDisk(name); volumeID != "" {
+		existingDisk = existingDiskPath(volumeID)
+	}
+	builtin := vm.InsertStartupScript(awsStartupScript, vm.ExistingDiskStartupScript(existingDisk))
+	script := vm.AppendStartupScript(builtin+vm.MTUStartupScript(opts.MTU), userScript)
+	if len(script) > maxUserDataSize {
+		return "", errors.Errorf("the user-data of %s is %d bytes, but AWS allows at most %d",
+			name, len(script), maxUserDataSize)
+	}
+	return script, nil
+}
+
+// transientErrorRE matches the EC2 error codes for requests which were
+// throttled, and so were rejected without effect and are expected to succeed
+// if retried. Errors such as InternalError or Unavailable are not retried,
+// since the request may have been carried out regardless.
+// See https://docs.aws.amazon.com/AWSEC2/latest/APIReference/errors-overview.html
+var transientErrorRE = regexp.MustCompile(
+	`RequestLimitExceeded|ThrottlingException|\(Throttling\)|status code: 429`)
+
+// isTransientError is used with vm.Retry to classify aws errors.
+func isTransientError(err error) bool {
+	return transientErrorRE.MatchString(err.Error())
+}
+
+// unavailableErrorRE matches the EC2 error codes for requests which failed
+// because the service was temporarily unavailable (HTTP 503) or had an
+// internal error. They are only retried by the commands which read
+// resources, which are safe to repeat.
+var unavailableErrorRE = regexp.MustCompile(
+	`ServiceUnavailable|\(Unavailable\)|InternalError|status code: 503`)
+
+// retryClassifier returns the classifier of the errors of the aws command for
+// vm.Retry. The describe-, get- and list- commands, which only read
+// resources, also retry the errors of unavailableErrorRE.
+func retryClassifier(args []string) func(error) bool {
+	if len(args) > 1 {
+		for _, prefix := range []string{"describe-", "get-", "list-"} {
+			if strings.HasPrefix(args[1], prefix) {
+				return func(err error) bool {
+					return isTransientError(err) || unavailableErrorRE.MatchString(err.Error())
+				}
+			}
 		}
-		return errors.Wrapf(err, "failed to run: aws %s", strings.Join(args, " "))
 	}
-	return nil
+	return isTransientError
+}
+
+// rateLimiter paces all of the aws commands issued by the provider.
+var rateLimiter = vm.RateLimiter{Provider: ProviderName}
+
+// profile is the named profile of the AWS CLI, selected by
+// --aws-account-profile, with which every aws command is run. The CLI's
+// default profile is used if it is empty.
+var profile string
+
+// endpointURL, set by --aws-endpoint-url, overrides the public EC2 endpoint
+// of the regions, e.g. with a VPC endpoint or an emulator. The endpoints of
+// the other services are left alone. GovCloud regions need no override,
+// since the CLI resolves their endpoints from the region.
+var endpointURL string
+
+// profileAccess memoizes the result of checkProfileAccess, which is needed
+// only once per invocation.
+var profileAccess struct {
+	sync.Once
+	err error
+}
+
+// checkProfileAccess returns an error if the profile selected by
+// --aws-account-profile does not exist or its credentials are not valid.
+func checkProfileAccess(ctx context.Context) error {
+	if profile == "" {
+		return nil
+	}
+	profileAccess.Do(func() {
+		if err := runCommand(ctx, []string{"sts", "get-caller-identity"}); err != nil {
+			profileAccess.err = errors.Wrapf(err, "AWS profile %s is not accessible", profile)
+		}
+	})
+	return profileAccess.err
+}
+
+// awsCommand runs the aws CLI with the arguments and returns its standard
+// output. Tests replace it to stub out the CLI.
+var awsCommand = func(ctx context.Context, args []string) ([]byte, error) {
+	return exec.CommandContext(ctx, "aws", args...).Output()
+}
+
+// runAWSCommand invokes an aws command, retrying transient errors, and
+// returns its standard output. The error includes the command's stderr so
+// that it can be classified.
+func runAWSCommand(ctx context.Context, args []string) ([]byte, error) {
+	if profile != "" {
+		args = append(args[:len(args):len(args)], "--profile", profile)
+	}
+	if endpointURL != "" && len(args) > 0 && args[0] == "ec2" {
+		args = append(args[:len(args):len(args)], "--endpoint-url", endpointURL)
+	}
+	var stdout []byte
+	err := vm.Retry(ctx, &rateLimiter, retryClassifier(args), func() error {
+		var err error
+		stdout, err = awsCommand(ctx, args)
+		if err != nil {
+			var stderr []byte
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				stderr = exitErr.Stderr
+			}
+			return errors.Wrapf(err, "failed to run: aws %s: %s",
+				strings.Join(args, " "), bytes.TrimSpace(stderr))
+		}
+		return nil
+	})
+	return stdout, err
+}
+
+// runCommand is used to invoke an AWS command for which no output is expected.
+func runCommand(ctx context.Context, args []string) error {
+	_, err := runAWSCommand(ctx, args)
+	return err
+}
+
+// checkDryRun invokes an aws command with --dry-run, which checks whether
+// the request would succeed without making it. EC2 reports a request which
+// would have succeeded as a DryRunOperation error.
+func checkDryRun(ctx context.Context, args []string) error {
+	_, err := runAWSCommand(ctx, append(args[:len(args):len(args)], "--dry-run"))
+	if err != nil && strings.Contains(err.Error(), "DryRunOperation") {
+		return nil
+	}
+	return err
 }
 
 // runJSONCommand invokes an aws command and parses the json output.
-func runJSONCommand(args []string, parsed interface{}) error {
+func runJSONCommand(ctx context.Context, args []string, parsed interface{}) error {
 	// force json output in case the user has overridden the default behavior
 	args = append(args[:len(args):len(args)], "--output", "json")
-	cmd := exec.Command("aws", args...)
 
-	rawJSON, err := cmd.Output()
+	rawJSON, err := runAWSCommand(ctx, args)
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			log.Println(string(exitErr.Stderr))
-		}
-		return errors.Wrapf(err, "failed to run: aws %s", strings.Join(args, " "))
+		return err
 	}
 
 	if err := json.Unmarshal(rawJSON, &parsed); err != nil {
@@ -113,6 +248,40 @@ func splitMap(data []string) (map[string]string, error) {
 	return ret, nil
 }
 
+// Limits on the tags of an instance.
+// See https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/Using_Tags.html#tag-restrictions
+const (
+	maxTags         = 50
+	maxTagValueSize = 256
+)
+
+// instanceTags returns all of the tags of an instance.
+func instanceTags(ctx context.Context, v vm.VM) (map[string]string, error) {
+	region, err := zoneToRegion(v.Zone)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"ec2", "describe-tags",
+		"--region", region,
+		"--filters", "Name=resource-id,Values=" + v.ProviderID,
+	}
+	var data struct {
+		Tags []struct {
+			Key   string
+			Value string
+		}
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string, len(data.Tags))
+	for _, t := range data.Tags {
+		ret[t.Key] = t.Value
+	}
+	return ret, nil
+}
+
 // regionMap collates VM instances by their region.
 func regionMap(vms vm.List) (map[string]vm.List, error) {
 	// Fan out the work by region
@@ -127,7 +296,614 @@ func regionMap(vms vm.List) (map[string]vm.List, error) {
 	return byRegion, nil
 }
 
-// zoneToRegion converts an availability zone like us-east-2a to the zone name us-east-2
+// regionNames returns the sorted keys of a map returned by regionMap.
+func regionNames(byRegion map[string]vm.List) []string {
+	ret := make([]string, 0, len(byRegion))
+	for region := range byRegion {
+		ret = append(ret, region)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// zoneToRegion converts an availability zone like us-east-2a to the zone name us-east-2.
+// Local Zones (e.g. us-west-2-lax-1a) and Wavelength Zones are in the region
+// which their name starts with.
 func zoneToRegion(zone string) (string, error) {
+	if zone == "" {
+		return "", nil
+	}
+	if match := vm.AWSZoneRE.FindStringSubmatch(zone); match != nil {
+		return match[1], nil
+	}
 	return zone[0 : len(zone)-1], nil
 }
+
+// preferFirst sorts the values, moving preferred to the front if present.
+func preferFirst(values []string, preferred string) []string {
+	sort.Slice(values, func(i, j int) bool {
+		if (values[i] == preferred) != (values[j] == preferred) {
+			return values[i] == preferred
+		}
+		return values[i] < values[j]
+	})
+	return values
+}
+
+// See https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/Using_Tags.html#tag-restrictions
+var (
+	tagKeyRE   = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]{1,128}$`)
+	tagValueRE = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]{0,256}$`)
+)
+
+// formatTags validates the user-supplied labels against the EC2 tag
+// restrictions and formats them as a sequence of `{Key=k,Value=v},`
+// entries for inclusion in a --tag-specifications argument.
+func formatTags(labels map[string]string) (string, error) {
+	var keys []string
+	for k, v := range labels {
+		switch {
+		case k == lifetimeTag || k == "Name" || k == "Roachprod":
+			return "", errors.Errorf("tag %q is reserved", k)
+		case strings.HasPrefix(strings.ToLower(k), "aws:"):
+			return "", errors.Errorf("tag %q uses the reserved aws: prefix", k)
+		case !tagKeyRE.MatchString(k):
+			return "", errors.Errorf("invalid AWS tag key %q", k)
+		case !tagValueRE.MatchString(v):
+			return "", errors.Errorf("invalid AWS tag value %q for key %q", v, k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "{Key=%s,Value=%s},", k, labels[k])
+	}
+	return buf.String(), nil
+}
+
+// hasInstanceStore returns true if the instance type comes with local NVMe
+// storage. Such instance families are suffixed with a "d" (e.g. m5d) or are
+// storage-optimized (i3).
+func hasInstanceStore(machineType string) bool {
+	family := strings.Split(machineType, ".")[0]
+	return strings.HasSuffix(family, "d") || strings.HasPrefix(family, "i3")
+}
+
+// instanceStoreDisks returns the number of instance store volumes which come
+// with the instance type.
+func instanceStoreDisks(ctx context.Context, region, machineType string) (int, error) {
+	var data struct {
+		InstanceTypes []struct {
+			InstanceStorageInfo struct {
+				Disks []struct {
+					Count int
+				}
+			}
+		}
+	}
+	args := []string{
+		"ec2", "describe-instance-types",
+		"--region", region,
+		"--instance-types", machineType,
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return 0, err
+	}
+	if len(data.InstanceTypes) == 0 {
+		return 0, errors.Errorf("unknown instance type %s", machineType)
+	}
+	var count int
+	for _, d := range data.InstanceTypes[0].InstanceStorageInfo.Disks {
+		count += d.Count
+	}
+	return count, nil
+}
+
+// checkEnclaveSupport returns an error if instances of the type cannot be
+// launched with Nitro Enclaves enabled.
+func checkEnclaveSupport(ctx context.Context, region, machineType string) error {
+	var data struct {
+		InstanceTypes []struct {
+			NitroEnclavesSupport string
+		}
+	}
+	args := []string{
+		"ec2", "describe-instance-types",
+		"--region", region,
+		"--instance-types", machineType,
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return err
+	}
+	if len(data.InstanceTypes) == 0 {
+		return errors.Errorf("unknown instance type %s", machineType)
+	}
+	if data.InstanceTypes[0].NitroEnclavesSupport != "supported" {
+		return errors.Errorf("instance type %s does not support Nitro Enclaves (--%s-enclave)",
+			machineType, ProviderName)
+	}
+	return nil
+}
+
+// maxMTU is the MTU of jumbo frames, the largest that instances can use
+// within a VPC.
+const maxMTU = 9001
+
+// checkNetworkInterfaceLimit returns an error if instances of the type cannot
+// have count network interfaces.
+func checkNetworkInterfaceLimit(ctx context.Context, region, machineType string, count int) error {
+	var data struct {
+		InstanceTypes []struct {
+			NetworkInfo struct {
+				MaximumNetworkInterfaces int
+			}
+		}
+	}
+	args := []string{
+		"ec2", "describe-instance-types",
+		"--region", region,
+		"--instance-types", machineType,
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return err
+	}
+	if len(data.InstanceTypes) == 0 {
+		return errors.Errorf("unknown instance type %s", machineType)
+	}
+	if limit := data.InstanceTypes[0].NetworkInfo.MaximumNetworkInterfaces; count > limit {
+		return errors.Errorf("instance type %s supports at most %d network interfaces, not %d",
+			machineType, limit, count)
+	}
+	return nil
+}
+
+// networkInterfaces returns the --network-interfaces of run-instances for
+// count interfaces in the subnet and security group of the network, which
+// are deleted along with the instance.
+func networkInterfaces(n network, count int) (string, error) {
+	type spec struct {
+		DeviceIndex         int
+		SubnetId            string
+		Groups              []string
+		DeleteOnTermination bool
+	}
+	specs := make([]spec, count)
+	for i := range specs {
+		specs[i] = spec{
+			DeviceIndex:         i,
+			SubnetId:            n.subnetID,
+			Groups:              []string{n.securityGroupID},
+			DeleteOnTermination: true,
+		}
+	}
+	bytes, err := json.Marshal(specs)
+	return string(bytes), err
+}
+
+// checkInstanceTypeOffered returns an error if the instance type is not
+// available in the given availability zone.
+func checkInstanceTypeOffered(ctx context.Context, machineType, zone string) error {
+	ok, err := instanceTypeOffered(ctx, machineType, zone)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("instance type %s is not available in zone %s", machineType, zone)
+	}
+	return nil
+}
+
+// instanceTypeOffered returns true if the instance type is available in the
+// given availability zone.
+func instanceTypeOffered(ctx context.Context, machineType, zone string) (bool, error) {
+	region, err := zoneToRegion(zone)
+	if err != nil {
+		return false, err
+	}
+	var data struct {
+		InstanceTypeOfferings []struct {
+			InstanceType string
+		}
+	}
+	args := []string{
+		"ec2", "describe-instance-type-offerings",
+		"--region", region,
+		"--location-type", "availability-zone",
+		"--filters",
+		"Name=instance-type,Values=" + machineType,
+		"Name=location,Values=" + zone,
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return false, err
+	}
+	return len(data.InstanceTypeOfferings) > 0, nil
+}
+
+// gpuInstanceTypes maps GPU types, using the GCE accelerator names, to the EC2
+// instance types providing a given number of those GPUs.
+var gpuInstanceTypes = map[string]map[int]string{
+	"nvidia-tesla-k80":  {1: "p2.xlarge", 8: "p2.8xlarge", 16: "p2.16xlarge"},
+	"nvidia-tesla-m60":  {1: "g3s.xlarge", 2: "g3.8xlarge", 4: "g3.16xlarge"},
+	"nvidia-tesla-t4":   {1: "g4dn.xlarge", 4: "g4dn.12xlarge", 8: "g4dn.metal"},
+	"nvidia-tesla-v100": {1: "p3.2xlarge", 4: "p3.8xlarge", 8: "p3.16xlarge"},
+}
+
+// gpuInstanceType returns the EC2 instance type which provides count GPUs of
+// the given type. GPUs are only available via dedicated instance families.
+func gpuInstanceType(gpuType string, count int) (string, error) {
+	byCount, ok := gpuInstanceTypes[gpuType]
+	if !ok {
+		return "", errors.Errorf("unsupported GPU type %s", gpuType)
+	}
+	machineType, ok := byCount[count]
+	if !ok {
+		return "", errors.Errorf("no instance type provides %d GPUs of type %s", count, gpuType)
+	}
+	return machineType, nil
+}
+
+// instanceSizes maps the sizes of the m5 and r5 instance families, and of
+// their variants with local NVMe storage, to their number of vCPUs.
+// c5InstanceSizes are those of the c5 family, which differ in the larger
+// sizes.
+var (
+	instanceSizes = []struct {
+		size string
+		cpus int
+	}{
+		{"large", 2}, {"xlarge", 4}, {"2xlarge", 8}, {"4xlarge", 16},
+		{"8xlarge", 32}, {"12xlarge", 48}, {"16xlarge", 64}, {"24xlarge", 96},
+	}
+	c5InstanceSizes = []struct {
+		size string
+		cpus int
+	}{
+		{"large", 2}, {"xlarge", 4}, {"2xlarge", 8}, {"4xlarge", 16},
+		{"9xlarge", 36}, {"12xlarge", 48}, {"18xlarge", 72}, {"24xlarge", 96},
+	}
+)
+
+// instanceTypeSizes returns the instance types to which a vm.MachineSize is
+// mapped: those of the general purpose m5 family first, followed by the
+// compute optimized c5 and memory optimized r5 families, or their variants
+// with local NVMe storage if localSSD is set.
+func instanceTypeSizes(localSSD bool) []vm.MachineTypeSize {
+	suffix := ""
+	if localSSD {
+		suffix = "d"
+	}
+	var ret []vm.MachineTypeSize
+	for _, f := range []struct {
+		family       string
+		memoryPerCPU float64
+	}{{"m5", 4}, {"c5", 2}, {"r5", 8}} {
+		sizes := instanceSizes
+		if f.family == "c5" {
+			sizes = c5InstanceSizes
+		}
+		for _, s := range sizes {
+			ret = append(ret, vm.MachineTypeSize{
+				Name:     fmt.Sprintf("%s%s.%s", f.family, suffix, s.size),
+				CPUs:     s.cpus,
+				MemoryGB: f.memoryPerCPU * float64(s.cpus),
+			})
+		}
+	}
+	return ret
+}
+
+// volumeTypes are the EBS volume types which may be used for a boot or data
+// volume. All of them are available in every availability zone.
+var volumeTypes = map[string]bool{
+	"gp2":      true,
+	"gp3":      true,
+	"io1":      true,
+	"io2":      true,
+	"standard": true,
+}
+
+// bootDiskMapping returns a --block-device-mapping entry which overrides the
+// size and/or type of the AMI's root volume.
+func bootDiskMapping(ctx context.Context, region, amiId string, opts vm.CreateOpts) (string, error) {
+	if opts.BootDiskType != "" && !volumeTypes[opts.BootDiskType] {
+		return "", errors.Errorf("invalid boot volume type %s", opts.BootDiskType)
+	}
+
+	// The mapping must be keyed by the root device name of the AMI, which
+	// varies between images.
+	var data struct {
+		Images []struct {
+			RootDeviceName string
+		}
+	}
+	args := []string{
+		"ec2", "describe-images",
+		"--region", region,
+		"--image-ids", amiId,
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return "", err
+	}
+	if len(data.Images) == 0 {
+		return "", errors.Errorf("could not find image %s in region %s", amiId, region)
+	}
+
+	ebs := []string{"DeleteOnTermination=true"}
+	if opts.BootDiskSizeGB > 0 {
+		ebs = append(ebs, fmt.Sprintf("VolumeSize=%d", opts.BootDiskSizeGB))
+	}
+	if opts.BootDiskType != "" {
+		ebs = append(ebs, "VolumeType="+opts.BootDiskType)
+	}
+	return fmt.Sprintf("DeviceName=%s,Ebs={%s}",
+		data.Images[0].RootDeviceName, strings.Join(ebs, ",")), nil
+}
+
+const (
+	defaultDataVolumeSizeGB = 500
+	// gp2 derives its guaranteed iops from the volume size.
+	defaultDataVolumeType = "gp2"
+	// The data volumes are mapped to /dev/sdd onwards. See
+	// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/device_naming.html
+	firstDataDevice = 'd'
+	maxDataVolumes  = 'z' - firstDataDevice + 1
+)
+
+// dataDiskMappings returns the --block-device-mapping entries of the EBS data
+// volumes, which are deleted along with the instance. Without data disks in
+// opts, a single volume of the default size and type is mapped.
+func dataDiskMappings(opts vm.CreateOpts) ([]string, error) {
+	count, size, volumeType := 1, defaultDataVolumeSizeGB, defaultDataVolumeType
+	if opts.DataDiskCount > 0 {
+		count = opts.DataDiskCount
+	}
+	if opts.DataDiskSizeGB > 0 {
+		size = opts.DataDiskSizeGB
+	}
+	if opts.DataDiskType != "" {
+		volumeType = opts.DataDiskType
+	}
+	if count > maxDataVolumes {
+		return nil, errors.Errorf("at most %d data volumes can be attached, not %d", maxDataVolumes, count)
+	}
+	if !volumeTypes[volumeType] {
+		return nil, errors.Errorf("invalid data volume type %s", volumeType)
+	}
+
+	ret := make([]string, count)
+	for i := range ret {
+		ret[i] = fmt.Sprintf("DeviceName=/dev/sd%c,Ebs={VolumeSize=%d,VolumeType=%s,DeleteOnTermination=true}",
+			firstDataDevice+i, size, volumeType)
+	}
+	return ret, nil
+}
+
+// A network is the subnet and security group into which the instances of an
+// availability zone are launched.
+type network struct {
+	subnetID        string
+	securityGroupID string
+	vpcID           string
+}
+
+// zoneNetwork returns the configured subnet of the availability zone, after
+// verifying that it exists in that zone and, if one was given, in the VPC of
+// the region. The security group of the region must be in the same VPC as the
+// subnet; if it is not, a group with the same name in the subnet's VPC is used
+// instead.
+func (p *Provider) zoneNetwork(ctx context.Context, zone string) (network, error) {
+	region, err := zoneToRegion(zone)
+	if err != nil {
+		return network{}, err
+	}
+
+	subnetMap, err := splitMap(p.opts.Subnets)
+	if err != nil {
+		return network{}, err
+	}
+	subnetID, ok := subnetMap[zone]
+	if !ok {
+		return network{}, errors.Errorf("could not find a subnet id for zone %s", zone)
+	}
+	sgMap, err := splitMap(p.opts.SecurityGroups)
+	if err != nil {
+		return network{}, err
+	}
+	sgID, ok := sgMap[region]
+	if !ok {
+		return network{}, errors.Errorf("could not find a security group id for region %s", region)
+	}
+	vpcMap, err := splitMap(p.opts.VPCs)
+	if err != nil {
+		return network{}, err
+	}
+
+	var subnets struct {
+		Subnets []struct {
+			AvailabilityZone string
+			VpcId            string
+		}
+	}
+	args := []string{
+		"ec2", "describe-subnets",
+		"--region", region,
+		"--filters", "Name=subnet-id,Values=" + subnetID,
+	}
+	if err := runJSONCommand(ctx, args, &subnets); err != nil {
+		return network{}, err
+	}
+	if len(subnets.Subnets) == 0 {
+		return network{}, errors.Errorf("subnet %s does not exist in region %s", subnetID, region)
+	}
+	subnet := subnets.Subnets[0]
+	if subnet.AvailabilityZone != zone {
+		return network{}, errors.Errorf("subnet %s is in zone %s, not %s",
+			subnetID, subnet.AvailabilityZone, zone)
+	}
+	if vpcID, ok := vpcMap[region]; ok && subnet.VpcId != vpcID {
+		return network{}, errors.Errorf("subnet %s is in VPC %s, not %s",
+			subnetID, subnet.VpcId, vpcID)
+	}
+
+	type securityGroups struct {
+		SecurityGroups []struct {
+			GroupId   string
+			GroupName string
+			VpcId     string
+		}
+	}
+	var groups securityGroups
+	args = []string{
+		"ec2", "describe-security-groups",
+		"--region", region,
+		"--group-ids", sgID,
+	}
+	if err := runJSONCommand(ctx, args, &groups); err != nil {
+		return network{}, err
+	}
+	if len(groups.SecurityGroups) == 0 {
+		return network{}, errors.Errorf("security group %s does not exist in region %s", sgID, region)
+	}
+	group := groups.SecurityGroups[0]
+	if group.VpcId == subnet.VpcId {
+		return network{subnetID: subnetID, securityGroupID: sgID, vpcID: subnet.VpcId}, nil
+	}
+
+	var matching securityGroups
+	args = []string{
+		"ec2", "describe-security-groups",
+		"--region", region,
+		"--filters",
+		"Name=vpc-id,Values=" + subnet.VpcId,
+		"Name=group-name,Values=" + group.GroupName,
+	}
+	if err := runJSONCommand(ctx, args, &matching); err != nil {
+		return network{}, err
+	}
+	if len(matching.SecurityGroups) == 0 {
+		return network{}, errors.Errorf(
+			"security group %s is not in VPC %s of subnet %s and the VPC has no group named %s; "+
+				"use --%s-sg to choose one", sgID, subnet.VpcId, subnetID, group.GroupName, ProviderName)
+	}
+	return network{
+		subnetID:        subnetID,
+		securityGroupID: matching.SecurityGroups[0].GroupId,
+		vpcID:           subnet.VpcId,
+	}, nil
+}
+
+// osImage returns the AMI from which the instances in the region are
+// launched: the roachprod image given by vm.CreateOpts.Image, the newest AMI
+// matching --aws-os-image, or the region's --aws-ami, in that order. It
+// returns an error if the AMI is not available in the region.
+func (p *Provider) osImage(ctx context.Context, region string, opts vm.CreateOpts) (string, error) {
+	args := []string{"ec2", "describe-images", "--region", region}
+	var desc string
+	switch {
+	case opts.Image != "":
+		// N.B. AMIs are regional, so the image must exist in the region
+		// that the instance is being placed in.
+		args = append(args, "--image-ids", opts.Image)
+		desc = opts.Image
+	case opts.OSImage != "":
+		args = append(args, "--image-ids", opts.OSImage)
+		desc = opts.OSImage
+	case p.opts.OSImage != "":
+		args = append(args,
+			"--owners", p.opts.OSImageOwner,
+			"--filters", "Name=name,Values="+p.opts.OSImage, "Name=state,Values=available")
+		desc = p.opts.OSImage
+	default:
+		amiMap, err := splitMap(p.opts.AMI)
+		if err != nil {
+			return "", err
+		}
+		amiID, ok := amiMap[region]
+		if !ok {
+			return "", errors.Errorf("could not find an AMI image id for region %s", region)
+		}
+		args = append(args, "--image-ids", amiID)
+		desc = amiID
+	}
+
+	var data struct {
+		Images []struct {
+			ImageId      string
+			CreationDate string
+			State        string
+		}
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return "", errors.Wrapf(err, "AMI %s is not available in %s", desc, region)
+	}
+	if len(data.Images) == 0 {
+		return "", errors.Errorf("no AMI matching %s is available in %s", desc, region)
+	}
+	// The creation dates are in ISO 8601 format, so they sort lexically.
+	sort.Slice(data.Images, func(i, j int) bool {
+		return data.Images[i].CreationDate > data.Images[j].CreationDate
+	})
+	if image := data.Images[0]; image.State != "available" {
+		return "", errors.Errorf("AMI %s is %s in %s", image.ImageId, image.State, region)
+	}
+	return data.Images[0].ImageId, nil
+}
+
+// checkIAMProfile returns an error if the IAM instance profile does not exist.
+// IAM is a global service, so no region is needed.
+func checkIAMProfile(ctx context.Context, name string) error {
+	args := []string{"iam", "get-instance-profile", "--instance-profile-name", name}
+	if err := runCommand(ctx, args); err != nil {
+		return errors.Wrapf(err, "could not find IAM instance profile %s", name)
+	}
+	return nil
+}
+
+// launchTemplateInstanceType returns the instance type of the default version
+// of the named launch template in the region. An error is returned if the
+// template does not exist in the region or leaves the instance type to the
+// request.
+func launchTemplateInstanceType(ctx context.Context, region, name string) (string, error) {
+	args := []string{"ec2", "describe-launch-template-versions",
+		"--region", region,
+		"--launch-template-name", name,
+		"--versions", "$Default"}
+	var data struct {
+		LaunchTemplateVersions []struct {
+			LaunchTemplateData struct {
+				InstanceType string
+			}
+		}
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return "", errors.Wrapf(err, "could not find launch template %s in %s", name, region)
+	}
+	if len(data.LaunchTemplateVersions) == 0 {
+		return "", errors.Errorf("could not find launch template %s in %s", name, region)
+	}
+	instanceType := data.LaunchTemplateVersions[0].LaunchTemplateData.InstanceType
+	if instanceType == "" {
+		return "", errors.Errorf("launch template %s in %s has no instance type", name, region)
+	}
+	return instanceType, nil
+}
+
+// tagSpecifications returns the --tag-specifications of the named instance,
+// which tag it with its name, lifetime and labels.
+func tagSpecifications(name string, opts vm.CreateOpts) (string, error) {
+	extraTags, err := formatTags(opts.Labels)
+	if err != nil {
+		return "", err
+	}
+	// We avoid the need to make a second call to set the tags by jamming
+	// all of our metadata into the TagSpec.
+	return fmt.Sprintf(
+		"ResourceType=instance,Tags=["+
+			"{Key=%s,Value=%s},"+
+			"{Key=Name,Value=%s},"+
+			"{Key=Roachprod,Value=true},"+
+			"%s"+
+			"]", lifetimeTag, opts.Lifetime, name, extraTags), nil
+}
@@ -0,0 +1,116 @@
+package aws
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// zoneIDRE matches the IDs of availability zones, e.g. use1-az1, or
+// usw2-lax1-az1 for a Local Zone. Unlike the letters of zone names, which
+// are assigned per account, the ID of a zone is the same in every account.
+var zoneIDRE = regexp.MustCompile(`^[a-z]+[0-9]+(-[a-z]+[0-9]+)?-az[0-9]+$`)
+
+// isZoneID returns true if the zone, whose :count suffix is ignored, is the
+// ID of an availability zone rather than its name.
+func isZoneID(zone string) bool {
+	return zoneIDRE.MatchString(strings.SplitN(zone, ":", 2)[0])
+}
+
+// zoneNames memoizes the result of zoneNamesByID, which only changes when
+// regions are enabled for the account.
+var zoneNames struct {
+	sync.Mutex
+	byID map[string]string
+}
+
+// zoneNamesByID returns the names in the account of the availability zones
+// of the configured regions, keyed by their IDs.
+func (p *Provider) zoneNamesByID(ctx context.Context) (map[string]string, error) {
+	zoneNames.Lock()
+	defer zoneNames.Unlock()
+	if zoneNames.byID != nil {
+		return zoneNames.byID, nil
+	}
+	regions, err := p.allRegions()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]map[string]string, len(regions))
+	if err := vm.ForEach(len(regions), func(i int) error {
+		var data struct {
+			AvailabilityZones []struct {
+				ZoneName string
+				ZoneId   string
+			}
+		}
+		args := []string{"ec2", "describe-availability-zones", "--region", regions[i], "--all-availability-zones"}
+		if err := runJSONCommand(ctx, args, &data); err != nil {
+			return errors.Wrapf(err, "could not list the availability zones of region %s", regions[i])
+		}
+		names[i] = make(map[string]string, len(data.AvailabilityZones))
+		for _, z := range data.AvailabilityZones {
+			names[i][z.ZoneId] = z.ZoneName
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	zoneNames.byID = make(map[string]string)
+	for _, m := range names {
+		for id, name := range m {
+			zoneNames.byID[id] = name
+		}
+	}
+	return zoneNames.byID, nil
+}
+
+// resolveZoneIDs returns opts with its zones, or those of --aws-zones, in
+// which the IDs of availability zones are replaced by the names of the zones
+// in the account, keeping their :count suffixes. The opts are returned
+// unchanged if none of the zones is an ID.
+func (p *Provider) resolveZoneIDs(ctx context.Context, opts vm.CreateOpts) (vm.CreateOpts, error) {
+	zones := p.opts.Zones
+	if len(opts.Zones) > 0 {
+		zones = opts.Zones
+	}
+	hasIDs := false
+	for _, zone := range zones {
+		hasIDs = hasIDs || isZoneID(zone)
+	}
+	if !hasIDs {
+		return opts, nil
+	}
+	byID, err := p.zoneNamesByID(ctx)
+	if err != nil {
+		return opts, err
+	}
+	resolved := make([]string, len(zones))
+	var unknown []string
+	for i, zone := range zones {
+		resolved[i] = zone
+		if !isZoneID(zone) {
+			continue
+		}
+		parts := strings.SplitN(zone, ":", 2)
+		name, ok := byID[parts[0]]
+		if !ok {
+			unknown = append(unknown, parts[0])
+			continue
+		}
+		parts[0] = name
+		resolved[i] = strings.Join(parts, ":")
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return opts, errors.Errorf("the availability zones %s are not in any of the configured regions",
+			strings.Join(unknown, ", "))
+	}
+	opts.Zones = resolved
+	return opts, nil
+}
@@ -0,0 +1,919 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const (
+	ProviderName = "azure"
+
+	// defaultSSHKeyPath is the private key whose public half is authorized
+	// on the VMs, unless overridden by --ssh-key or --azure-ssh-key.
+	defaultSSHKeyPath = "${HOME}/.ssh/id_rsa"
+
+	// The tags with which roachprod identifies its VMs and their lifetime.
+	roachprodTag = "roachprod"
+	lifetimeTag  = "lifetime"
+
+	// nsgName is the network security group of each resource group, which
+	// admits ssh and cockroach traffic from anywhere.
+	nsgName = "roachprod"
+
+	// The size of the data disk of VMs without --local-ssd, unless data disks
+	// are requested explicitly.
+	defaultDataDiskSizeGB = 500
+
+	// defaultRemoteUser is the user as which the VMs are logged into unless
+	// another is chosen (see remoteUser).
+	defaultRemoteUser = "ubuntu"
+)
+
+// init will register the Azure provider with vm.MustRegister, but only if
+// the az tool is available on the local path and has been logged in.
+func init() {
+	if _, err := exec.LookPath("az"); err == nil {
+		// Checking the credentials would require a request, which is not
+		// something we want to do at startup.
+		if _, err := os.Stat(os.ExpandEnv("${HOME}/.azure/azureProfile.json")); err == nil {
+			vm.MustRegister(ProviderName, &Provider{})
+		}
+	}
+}
+
+// providerOpts implements the vm.ProviderFlags interface for azure.Provider.
+type providerOpts struct {
+	MachineType string
+	// MachineTypeFallbacks are used, in order, in zones which do not offer
+	// MachineType.
+	MachineTypeFallbacks []string
+	OSImage              string
+	RemoteUserName       string
+	SSHKey               string
+	Bastion              string
+	Zones                []string
+}
+
+// ConfigureCreateFlags is part of the vm.ProviderFlags interface.
+func (o *providerOpts) ConfigureCreateFlags(flags *pflag.FlagSet) {
+	zones := vm.EnvDefaultZones("ROACHPROD_AZURE_ZONE", []string{"eastus2-1", "westus2-1", "westeurope-1"})
+
+	// Standard_D4s_v3 is a 4 core, 16GB instance, approximately equal to a
+	// GCE n1-standard-4, with a 32GB temporary SSD.
+	flags.StringVar(&o.MachineType, ProviderName+"-machine-type",
+		vm.EnvDefault("ROACHPROD_AZURE_MACHINE_TYPE", "Standard_D4s_v3"),
+		"Machine type (see https://docs.microsoft.com/en-us/azure/virtual-machines/sizes)")
+	flags.StringSliceVar(&o.MachineTypeFallbacks, ProviderName+"-machine-type-fallbacks", nil,
+		"Machine types to use, in order, in zones which do not offer --"+ProviderName+"-machine-type")
+	flags.StringSliceVar(&o.Zones, ProviderName+"-zones", zones,
+		"Zones for cluster, optionally with a node count per zone (e.g. eastus2-1:3,westus2:2); "+
+			"a zone is a location, optionally followed by the number of an availability zone")
+	flags.StringVar(&o.OSImage, ProviderName+"-os-image", "Canonical:UbuntuServer:16.04-LTS:latest",
+		"URN (publisher:offer:sku:version) of the image to boot the VMs from")
+	flags.StringVar(&o.RemoteUserName, ProviderName+"-user", "",
+		"Name of the admin user of the VMs to SSH as (defaults to --ssh-user, or "+defaultRemoteUser+")")
+}
+
+// ConfigureClusterFlags is part of the vm.ProviderFlags interface.
+func (o *providerOpts) ConfigureClusterFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&subscription, ProviderName+"-subscription", os.Getenv("ROACHPROD_AZURE_SUBSCRIPTION"),
+		"Name or id of the subscription to use (defaults to the one set by az account set)")
+	flags.StringVar(&o.SSHKey, ProviderName+"-ssh-key", "",
+		"Private ssh key whose public half is authorized on the VMs "+
+			"(defaults to --ssh-key or ~/.ssh/id_rsa; generated if missing)")
+	flags.StringVar(&o.Bastion, ProviderName+"-bastion", os.Getenv("ROACHPROD_AZURE_BASTION"),
+		"Jump host (host[:port]) for the VMs without public IPs (defaults to --bastion)")
+}
+
+// Provider implements the vm.Provider interface for Microsoft Azure.
+//
+// The VMs of a cluster in each location are kept in a resource group of
+// their own, along with their network interfaces, public IP addresses,
+// disks and the virtual network connecting them. Azure has no notion of
+// lifetimes, so they are recorded in a tag for "roachprod gc".
+type Provider struct {
+	opts providerOpts
+}
+
+// Capabilities is part of the vm.Provider interface.
+func (p *Provider) Capabilities() vm.ProviderCapabilities {
+	return vm.ProviderCapabilities{
+		LocalSSD:        true,
+		MaxLocalSSDs:    1,
+		Preemptible:     true,
+		OSImages:        true,
+		StartupScripts:  true,
+		BootDisks:       true,
+		DataDisks:       true,
+		MaxDataDisks:    64,
+		PrivateIPs:      true,
+		Extend:          true,
+		Reboot:          true,
+		Resize:          true,
+		Suspend:         true,
+		SpreadPlacement: true,
+		MachineSizes:    true,
+		GeoWeights:      true,
+	}
+}
+
+// CheckCredentials is part of the vm.Provider interface. Obtaining an access
+// token requires valid credentials, regardless of their permissions.
+func (p *Provider) CheckCredentials(ctx context.Context) error {
+	return runCommand(ctx, []string{"account", "get-access-token"})
+}
+
+// CleanSSH is part of the vm.Provider interface. This implementation only
+// removes the bastion configuration, since the public key is passed to each
+// VM when it is created.
+func (p *Provider) CleanSSH(ctx context.Context) error {
+	return vm.CleanBastionSSH(ProviderName)
+}
+
+// ConfigSSH is part of the vm.Provider interface. This implementation
+// ensures that the key pair exists, since the public key is passed to each
+// VM when it is created, and configures the bastion, if any, through which
+// the VMs without public IPs are reached.
+func (p *Provider) ConfigSSH(ctx context.Context) error {
+	if _, err := vm.SSHPublicKey(p.sshKeyPath()); err != nil {
+		return err
+	}
+	return vm.ConfigBastionSSH(ctx, p, vm.BastionFor(p.opts.Bastion))
+}
+
+// CostEstimate is part of the vm.Provider interface. Azure prices are not
+// known to roachprod, so every VM is excluded from the estimate.
+func (p *Provider) CostEstimate(vms vm.List) (float64, error) {
+	for i := range vms {
+		vms[i].Errors = append(vms[i].Errors, vm.ErrUnknownPrice)
+	}
+	return 0, nil
+}
+
+// placements returns the zone of each of count VMs created with opts. Unless
+// explicit per-zone node counts or location weights were given, the VMs are
+// placed round-robin over the zones.
+func (p *Provider) placements(opts vm.CreateOpts, count int) ([]string, error) {
+	zones := p.opts.Zones
+	if len(opts.Zones) > 0 {
+		zones = opts.Zones
+	}
+	zones, zoneCounts, err := vm.ParseZoneCounts(zones, count)
+	if err != nil {
+		return nil, err
+	}
+	if len(zones) == 0 {
+		return nil, errors.New("no zones given via --" + ProviderName + "-zones")
+	}
+	for _, zone := range zones {
+		if _, _, err := parseZone(zone); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.GeoWeights) > 0 {
+		if zoneCounts != nil {
+			return nil, errors.New("zone node counts cannot be combined with --geo-weights")
+		}
+		zoneCounts, err = vm.WeightedZoneCounts(ProviderName, zones, func(zone string) (string, error) {
+			location, _, err := parseZone(zone)
+			return location, err
+		}, opts.GeoWeights, count)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var placements []string
+	if zoneCounts != nil {
+		for i, zone := range zones {
+			for j := 0; j < zoneCounts[i]; j++ {
+				placements = append(placements, zone)
+			}
+		}
+	} else {
+		if !opts.GeoDistributed {
+			zones = zones[:1]
+		}
+		for i := 0; i < count; i++ {
+			placements = append(placements, zones[i%len(zones)])
+		}
+	}
+	return placements, nil
+}
+
+// Create is part of the vm.Provider interface. The resource group and
+// network security group of each location are created first, followed by
+// the VMs, each of which comes with its own network interface, public IP
+// address and disks.
+func (p *Provider) Create(ctx context.Context, names []string, opts vm.CreateOpts) error {
+	for _, name := range names {
+		if err := vm.ValidateName(name); err != nil {
+			return err
+		}
+	}
+	if opts.GPUCount > 0 {
+		return errors.New("azure clusters do not support GPUs")
+	}
+	if opts.Image != "" {
+		return errors.New("azure clusters do not support images")
+	}
+	if opts.UseLocalSSD && opts.LocalSSDCount > 1 {
+		return errors.New("azure VMs have a single temporary disk, so --local-ssd-count must be 1")
+	}
+	if err := vm.ValidateDataDisks(opts); err != nil {
+		return err
+	}
+	if err := checkSubscriptionAccess(ctx); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := startupScript(name, opts); err != nil {
+			return err
+		}
+	}
+
+	placements, err := p.placements(opts, len(names))
+	if err != nil {
+		return err
+	}
+	usedZones := vm.UniqueZones(placements)
+	locationCounts := make(map[string]int)
+	for _, zone := range placements {
+		location, _, _ := parseZone(zone)
+		locationCounts[location]++
+	}
+	if len(opts.GeoWeights) > 0 {
+		vm.LogRegionCounts(ProviderName, locationCounts, opts.GeoWeights)
+	}
+
+	publicKey, err := vm.SSHPublicKey(p.sshKeyPath())
+	if err != nil {
+		return err
+	}
+
+	user, err := p.FindActiveAccount(ctx)
+	if err != nil {
+		return err
+	}
+	tags := vm.StandardLabels(opts.Labels, user, names[0], time.Now())
+	tags[roachprodTag] = "true"
+	tags[lifetimeTag] = opts.Lifetime.String()
+	tags[vm.SSHUserLabel] = p.remoteUser(opts)
+	cluster := tags[vm.ClusterLabel]
+	if opts.Placement != "" {
+		tags[vm.PlacementLabel] = opts.Placement
+		if err := checkAvailabilitySet(placements); err != nil {
+			return err
+		}
+	}
+
+	// The commands which set up each location, in order, keyed by location.
+	var locations []string
+	groupArgs := make(map[string][][]string)
+	for _, zone := range placements {
+		location, _, _ := parseZone(zone)
+		if _, ok := groupArgs[location]; ok {
+			continue
+		}
+		locations = append(locations, location)
+		group := resourceGroupName(cluster, location)
+		groupArgs[location] = [][]string{
+			append([]string{"group", "create",
+				"--name", group,
+				"--location", location,
+				"--tags"}, formatTags(tags)...),
+			{"network", "nsg", "create",
+				"--resource-group", group,
+				"--name", nsgName,
+				"--location", location},
+			{"network", "nsg", "rule", "create",
+				"--resource-group", group,
+				"--nsg-name", nsgName,
+				"--name", "roachprod",
+				"--priority", "100",
+				"--direction", "Inbound",
+				"--access", "Allow",
+				"--protocol", "Tcp",
+				"--destination-port-ranges", "22", "8080", "26257"},
+		}
+		// The availability set is kept in the resource group, so it is
+		// deleted along with the last VM of the location.
+		if opts.Placement != "" {
+			groupArgs[location] = append(groupArgs[location], []string{"vm", "availability-set", "create",
+				"--resource-group", group,
+				"--name", vm.PlacementGroupName(cluster),
+				"--location", location,
+				"--platform-fault-domain-count", fmt.Sprint(availabilitySetFaultDomains)})
+		}
+	}
+	sort.Strings(locations)
+
+	machineType, err := p.machineType(opts)
+	if err != nil {
+		return err
+	}
+	machineTypes, err := vm.MachineTypes(ctx, p, usedZones, machineType, p.opts.MachineTypeFallbacks)
+	if err != nil {
+		return err
+	}
+
+	osImage := p.opts.OSImage
+	if opts.OSImage != "" {
+		osImage = opts.OSImage
+	}
+
+	vmArgs := make([][]string, len(names))
+	for i, name := range names {
+		location, availabilityZone, _ := parseZone(placements[i])
+		customData, err := startupScript(name, opts)
+		if err != nil {
+			return err
+		}
+		args := []string{
+			"vm", "create",
+			"--resource-group", resourceGroupName(cluster, location),
+			"--name", name,
+			"--location", location,
+			"--image", osImage,
+			"--size", machineTypes[placements[i]],
+			"--admin-username", tags[vm.SSHUserLabel],
+			"--ssh-key-values", strings.TrimSpace(string(publicKey)),
+			"--nsg", nsgName,
+			"--nic-delete-option", "Delete",
+			"--os-disk-delete-option", "Delete",
+			"--data-disk-delete-option", "Delete",
+			"--custom-data", customData,
+		}
+		// An empty name creates the VM without a public IP address.
+		if !opts.NoPublicIP {
+			args = append(args, "--public-ip-address", publicIPName(name), "--public-ip-sku", "Standard")
+		} else {
+			args = append(args, "--public-ip-address", "")
+		}
+		if availabilityZone != "" {
+			args = append(args, "--zone", availabilityZone)
+		}
+		if opts.Placement != "" {
+			args = append(args, "--availability-set", vm.PlacementGroupName(cluster))
+		}
+		if opts.BootDiskSizeGB > 0 {
+			args = append(args, "--os-disk-size-gb", fmt.Sprint(opts.BootDiskSizeGB))
+		}
+		// The storage SKUs of the boot and data disks are given together,
+		// keyed by os or by the LUN of each data disk.
+		var skus []string
+		if opts.BootDiskType != "" {
+			skus = append(skus, "os="+opts.BootDiskType)
+		}
+		// With --local-ssd, the data directory is on the temporary disk.
+		// Otherwise, we need to attach data disks.
+		if !opts.UseLocalSSD {
+			count, size := 1, defaultDataDiskSizeGB
+			if opts.DataDiskCount > 0 {
+				count = opts.DataDiskCount
+			}
+			if opts.DataDiskSizeGB > 0 {
+				size = opts.DataDiskSizeGB
+			}
+			args = append(args, "--data-disk-sizes-gb")
+			for lun := 0; lun < count; lun++ {
+				args = append(args, fmt.Sprint(size))
+				if opts.DataDiskType != "" {
+					skus = append(skus, fmt.Sprintf("%d=%s", lun, opts.DataDiskType))
+				}
+			}
+		}
+		if len(skus) > 0 {
+			args = append(args, "--storage-sku")
+			args = append(args, skus...)
+		}
+		if opts.Preemptible {
+			// A maximum price of -1 caps the spot price at the on-demand price.
+			args = append(args, "--priority", "Spot", "--eviction-policy", "Delete", "--max-price", "-1")
+		}
+		args = append(args, "--tags")
+		vmArgs[i] = append(args, formatTags(tags)...)
+	}
+
+	if config.DryRun {
+		var planned vm.List
+		for i, name := range names {
+			planned = append(planned, vm.VM{
+				Name:        name,
+				Provider:    ProviderName,
+				Zone:        placements[i],
+				MachineType: machineTypes[placements[i]],
+				Preemptible: opts.Preemptible,
+			})
+		}
+		vm.PrintPlan(p, planned)
+		for _, location := range locations {
+			for _, args := range groupArgs[location] {
+				vm.PrintDryRun("az", args)
+			}
+		}
+		for _, args := range vmArgs {
+			// The custom data is the whole startup script, which would
+			// drown out the rest of the command.
+			printed := append([]string(nil), args...)
+			for i := range printed {
+				if printed[i] == "--custom-data" && i+1 < len(printed) {
+					printed[i+1] = fmt.Sprintf("<%d bytes>", len(printed[i+1]))
+				}
+			}
+			vm.PrintDryRun("az", printed)
+		}
+		return nil
+	}
+
+	if err := vm.ForEach(len(locations), func(i int) error {
+		for _, args := range groupArgs[locations[i]] {
+			if err := runCommand(ctx, args); err != nil {
+				return errors.Wrapf(err, "unable to set up location %s", locations[i])
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var created []string
+	failedZones := make(map[string]bool)
+	err = vm.ForEach(len(names), func(i int) error {
+		if err := runCommand(ctx, vmArgs[i]); err != nil {
+			mu.Lock()
+			failedZones[placements[i]] = true
+			mu.Unlock()
+			return errors.Wrapf(err, "%s in zone %s", names[i], placements[i])
+		}
+		mu.Lock()
+		created = append(created, names[i])
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		// Report what we know to exist so that the user can clean up.
+		sort.Strings(created)
+		return errors.Wrapf(err, "created %d/%d instances %v, failed in %s",
+			len(created), len(names), created, vm.JoinZones(failedZones))
+	}
+	return nil
+}
+
+// CreateImage is part of the vm.Provider interface. This implementation
+// returns an error.
+func (p *Provider) CreateImage(ctx context.Context, vms vm.List, imageName string) ([]string, error) {
+	return nil, errors.New("azure clusters do not support images")
+}
+
+// machineType returns the size requested by opts: the size given explicitly,
+// the closest to the requested vm.MachineSize, or the configured size.
+func (p *Provider) machineType(opts vm.CreateOpts) (string, error) {
+	switch {
+	case opts.MachineType != "":
+		return opts.MachineType, nil
+	case !opts.Size.IsZero():
+		return vm.ClosestMachineType(machineTypeSizes, opts.Size, "--"+ProviderName+"-machine-type")
+	default:
+		return p.opts.MachineType, nil
+	}
+}
+
+// CreatedMachineTypes is part of the vm.Provider interface.
+func (p *Provider) CreatedMachineTypes(opts vm.CreateOpts) ([]string, error) {
+	machineType, err := p.machineType(opts)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{machineType}, p.opts.MachineTypeFallbacks...), nil
+}
+
+// CreatedZones is part of the vm.Provider interface.
+func (p *Provider) CreatedZones(ctx context.Context, opts vm.CreateOpts, count int) ([]string, error) {
+	placements, err := p.placements(opts, count)
+	if err != nil {
+		return nil, err
+	}
+	return vm.UniqueZones(placements), nil
+}
+
+// Delete is part of the vm.Provider interface. The network interfaces and
+// disks are deleted along with the VMs. Their public IP addresses are
+// deleted separately, and a resource group is deleted once it has no VMs
+// left, which takes the remaining network resources with it.
+func (p *Provider) Delete(ctx context.Context, vms vm.List) error {
+	if err := checkSubscriptionAccess(ctx); err != nil {
+		return err
+	}
+	byGroup, err := groupMap(vms)
+	if err != nil {
+		return err
+	}
+	groups := groupNames(byGroup)
+
+	deleteArgs := func(group string) [][]string {
+		vmArgs := []string{"vm", "delete", "--yes", "--ids"}
+		ipArgs := []string{"network", "public-ip", "delete", "--ids"}
+		var ips int
+		for _, v := range byGroup[group] {
+			vmArgs = append(vmArgs, v.ProviderID)
+			// VMs created without a public IP address have none to delete.
+			if v.PublicIP != "" {
+				ipArgs = append(ipArgs, fmt.Sprintf("%s/providers/Microsoft.Network/publicIPAddresses/%s",
+					group, publicIPName(v.Name)))
+				ips++
+			}
+		}
+		if ips == 0 {
+			return [][]string{vmArgs}
+		}
+		return [][]string{vmArgs, ipArgs}
+	}
+	if config.DryRun {
+		for _, group := range groups {
+			for _, args := range deleteArgs(group) {
+				vm.PrintDryRun("az", args)
+			}
+		}
+		return nil
+	}
+
+	return vm.ForEach(len(groups), func(i int) error {
+		group := groups[i]
+		for _, args := range deleteArgs(group) {
+			if err := runCommand(ctx, args); err != nil {
+				return err
+			}
+		}
+
+		// The group id ends with its name.
+		name := group[strings.LastIndex(group, "/")+1:]
+		var remaining []string
+		if err := runJSONCommand(ctx, []string{
+			"vm", "list", "--resource-group", name, "--query", "[].name",
+		}, &remaining); err != nil {
+			return err
+		}
+		if len(remaining) > 0 {
+			return nil
+		}
+		return runCommand(ctx, []string{"group", "delete", "--name", name, "--yes", "--no-wait"})
+	})
+}
+
+// Describe is part of the vm.Provider interface.
+func (p *Provider) Describe(ctx context.Context, v vm.VM) (map[string]interface{}, error) {
+	var ret map[string]interface{}
+	args := []string{"vm", "show", "--show-details", "--ids", v.ProviderID}
+	if err := runJSONCommand(ctx, args, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Extend is part of the vm.Provider interface.
+// This will update the lifetime tag on the VMs.
+func (p *Provider) Extend(ctx context.Context, vms vm.List, lifetime time.Duration) error {
+	args := []string{"vm", "update", "--set", fmt.Sprintf("tags.%s=%s", lifetimeTag, lifetime), "--ids"}
+	return runCommand(ctx, append(args, vms.ProviderIDs()...))
+}
+
+// cachedActiveAccount memoizes the return value from FindActiveAccount
+var cachedActiveAccount string
+
+// FindActiveAccount is part of the vm.Provider interface.
+// This queries the az command for the user signed into --azure-subscription,
+// whose user principal name is usually an email address.
+func (p *Provider) FindActiveAccount(ctx context.Context) (string, error) {
+	if len(cachedActiveAccount) > 0 {
+		return cachedActiveAccount, nil
+	}
+	var account struct {
+		User struct {
+			Name string
+			Type string
+		}
+	}
+	if err := runJSONCommand(ctx, []string{"account", "show"}, &account); err != nil {
+		return "", err
+	}
+	if account.User.Type != "user" {
+		return "", errors.Errorf("the active azure account %q is a %s; please set --username",
+			account.User.Name, account.User.Type)
+	}
+	cachedActiveAccount = strings.Split(account.User.Name, "@")[0]
+	return cachedActiveAccount, nil
+}
+
+// Flags is part of the vm.Provider interface.
+func (p *Provider) Flags() vm.ProviderFlags {
+	return &p.opts
+}
+
+// GetMetadata is part of the vm.Provider interface. This implementation
+// returns an error.
+func (p *Provider) GetMetadata(ctx context.Context, v vm.VM) (map[string]string, error) {
+	return nil, errors.New("azure clusters do not support metadata")
+}
+
+// List is part of the vm.Provider interface.
+func (p *Provider) List(ctx context.Context, filter vm.LabelFilter) (vm.List, error) {
+	if err := checkSubscriptionAccess(ctx); err != nil {
+		return nil, err
+	}
+	var data []struct {
+		ID              string
+		Name            string
+		Location        string
+		Zones           []string
+		ResourceGroup   string
+		Priority        string
+		PowerState      string
+		PrivateIps      string
+		PublicIps       string
+		Fqdns           string
+		HardwareProfile struct {
+			VMSize string
+		}
+		StorageProfile struct {
+			ImageReference struct {
+				Publisher    string
+				Offer        string
+				Sku          string
+				ExactVersion string
+			}
+			OsDisk    azureDisk
+			DataDisks []azureDisk
+		}
+		ProvisioningState string
+		Tags              map[string]string
+	}
+	// az follows the next links of the listing itself, so every page is
+	// returned, and the query is applied to all of them.
+	args := []string{
+		"vm", "list", "--show-details",
+		"--query", fmt.Sprintf("[?tags.%s=='true']", roachprodTag),
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return nil, err
+	}
+
+	var ret vm.List
+	for _, in := range data {
+		var status vm.Status
+		switch {
+		case in.ProvisioningState == "Deleting":
+			status = vm.StatusTerminating
+		case in.PowerState == "VM running":
+			status = vm.StatusRunning
+		case in.PowerState == "VM starting":
+			status = vm.StatusPending
+		case strings.HasPrefix(in.PowerState, "VM stop"), strings.HasPrefix(in.PowerState, "VM dealloc"):
+			status = vm.StatusStopped
+		default:
+			status = vm.StatusUnknown
+		}
+
+		var errs []error
+		createdAt, err := time.Parse(vm.CreatedLabelFormat, in.Tags[vm.CreatedLabel])
+		if err != nil {
+			errs = append(errs, vm.ErrNoExpiration.Wrap(err))
+		}
+
+		var lifetime time.Duration
+		if lifeText, ok := in.Tags[lifetimeTag]; ok {
+			lifetime, err = time.ParseDuration(lifeText)
+			if err != nil {
+				errs = append(errs, vm.ErrBadLifetime.Wrap(err))
+			}
+		} else {
+			errs = append(errs, vm.ErrNoExpiration)
+		}
+
+		if in.HardwareProfile.VMSize == "" {
+			errs = append(errs, vm.ErrNoMachineType)
+		}
+
+		zone := strings.ToLower(in.Location)
+		if len(in.Zones) > 0 {
+			zone += "-" + in.Zones[0]
+		}
+
+		var osImage string
+		if ref := in.StorageProfile.ImageReference; ref.Publisher != "" {
+			osImage = strings.Join([]string{ref.Publisher, ref.Offer, ref.Sku, ref.ExactVersion}, ":")
+		}
+
+		// The VMs created before the user was recorded use the default one.
+		remoteUser := in.Tags[vm.SSHUserLabel]
+		if remoteUser == "" {
+			remoteUser = defaultRemoteUser
+		}
+
+		disks := []vm.Disk{in.StorageProfile.OsDisk.toDisk(true)}
+		for _, d := range in.StorageProfile.DataDisks {
+			disks = append(disks, d.toDisk(false))
+		}
+
+		// A VM with several addresses lists them comma-separated, and each
+		// resource group has a virtual network of its own.
+		ret = append(ret, vm.VM{
+			CreatedAt:   createdAt,
+			DNS:         in.Name,
+			Name:        in.Name,
+			Errors:      errs,
+			Lifetime:    lifetime,
+			PrivateIP:   strings.Split(in.PrivateIps, ",")[0],
+			Provider:    ProviderName,
+			ProviderID:  in.ID,
+			PublicIP:    strings.Split(in.PublicIps, ",")[0],
+			RemoteUser:  remoteUser,
+			VPC:         strings.ToLower(in.ResourceGroup),
+			MachineType: in.HardwareProfile.VMSize,
+			Zone:        zone,
+			Status:      status,
+			Preemptible: in.Priority == "Spot",
+			OSImage:     osImage,
+			Labels:      in.Tags,
+			Disks:       disks,
+		})
+	}
+	return ret, nil
+}
+
+// ListScope is part of the vm.Provider interface. The VMs are those of
+// --azure-subscription.
+func (p *Provider) ListScope() string {
+	return "subscription=" + subscription
+}
+
+// MachineTypeAvailable is part of the vm.Provider interface. A size may be
+// offered in a location, but restricted in the subscription, or only offered
+// in some of its availability zones.
+func (p *Provider) MachineTypeAvailable(ctx context.Context, zone, machineType string) (bool, error) {
+	location, availabilityZone, err := parseZone(zone)
+	if err != nil {
+		return false, err
+	}
+	var data []struct {
+		Name         string
+		LocationInfo []struct {
+			Zones []string
+		}
+		Restrictions []struct {
+			Type            string
+			RestrictionInfo struct {
+				Zones []string
+			}
+		}
+	}
+	args := []string{
+		"vm", "list-skus",
+		"--resource-type", "virtualMachines",
+		"--location", location,
+		"--size", machineType,
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return false, err
+	}
+
+	contains := func(zones []string, zone string) bool {
+		for _, z := range zones {
+			if z == zone {
+				return true
+			}
+		}
+		return false
+	}
+	for _, sku := range data {
+		// The --size flag matches prefixes of the names.
+		if !strings.EqualFold(sku.Name, machineType) {
+			continue
+		}
+		for _, r := range sku.Restrictions {
+			if r.Type == "Location" ||
+				(r.Type == "Zone" && contains(r.RestrictionInfo.Zones, availabilityZone)) {
+				return false, nil
+			}
+		}
+		if availabilityZone == "" {
+			return true, nil
+		}
+		for _, info := range sku.LocationInfo {
+			if contains(info.Zones, availabilityZone) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Name is part of the vm.Provider interface. This returns "azure".
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// Reboot is part of the vm.Provider interface. The restart command waits
+// for the VMs to be running again.
+func (p *Provider) Reboot(ctx context.Context, vms vm.List) error {
+	return runCommand(ctx, append([]string{"vm", "restart", "--ids"}, vms.ProviderIDs()...))
+}
+
+// Resize is part of the vm.Provider interface. Azure restarts each VM to
+// resize it, and the contents of the temporary disk may be lost.
+func (p *Provider) Resize(ctx context.Context, vms vm.List, machineType string) error {
+	var mu sync.Mutex
+	var resized []string
+	err := vm.ForEach(len(vms), func(i int) error {
+		args := []string{"vm", "resize", "--size", machineType, "--ids", vms[i].ProviderID}
+		if err := runCommand(ctx, args); err != nil {
+			return err
+		}
+		mu.Lock()
+		resized = append(resized, vms[i].Name)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		sort.Strings(resized)
+		return errors.Wrapf(err, "resized %d of %d instances %v", len(resized), len(vms), resized)
+	}
+	return nil
+}
+
+// SSHAccess is part of the vm.Provider interface.
+func (p *Provider) SSHAccess() vm.SSHAccess {
+	return vm.SSHAccess{KeyPath: p.sshKeyPath(), Bastion: vm.BastionFor(p.opts.Bastion)}
+}
+
+// SetMetadata is part of the vm.Provider interface. This implementation
+// returns an error.
+func (p *Provider) SetMetadata(ctx context.Context, v vm.VM, kv map[string]string) error {
+	return errors.New("azure clusters do not support metadata")
+}
+
+// Start is part of the vm.Provider interface.
+func (p *Provider) Start(ctx context.Context, vms vm.List) error {
+	return runCommand(ctx, append([]string{"vm", "start", "--ids"}, vms.ProviderIDs()...))
+}
+
+// Stop is part of the vm.Provider interface. The VMs are deallocated, so that
+// they are no longer billed, which also discards their temporary disks. The
+// static public IPs are kept.
+func (p *Provider) Stop(ctx context.Context, vms vm.List) error {
+	return runCommand(ctx, append([]string{"vm", "deallocate", "--ids"}, vms.ProviderIDs()...))
+}
+
+// ZoneCatalog is part of the vm.Provider interface. Each location is a zone
+// of its own region, as is each of its availability zones.
+func (p *Provider) ZoneCatalog(ctx context.Context) (vm.ZoneCatalog, error) {
+	var locations []struct {
+		Name                     string
+		AvailabilityZoneMappings []struct {
+			LogicalZone string
+		}
+	}
+	if err := runJSONCommand(ctx, []string{"account", "list-locations"}, &locations); err != nil {
+		return nil, err
+	}
+	ret := make(vm.ZoneCatalog)
+	for _, l := range locations {
+		ret[l.Name] = l.Name
+		for _, z := range l.AvailabilityZoneMappings {
+			ret[l.Name+"-"+z.LogicalZone] = l.Name
+		}
+	}
+	return ret, nil
+}
+
+func (p *Provider) sshKeyPath() string {
+	return vm.SSHKeyPath(p.opts.SSHKey, defaultSSHKeyPath)
+}
+
+// remoteUser returns the admin user of the VMs created with opts, as which
+// they are logged into: that of --azure-user, or else CreateOpts.SSHUser, or
+// else defaultRemoteUser. Azure creates the admin user on any image, so that
+// the user of the distribution does not matter.
+func (p *Provider) remoteUser(opts vm.CreateOpts) string {
+	switch {
+	case p.opts.RemoteUserName != "":
+		return p.opts.RemoteUserName
+	case opts.SSHUser != "":
+		return opts.SSHUser
+	default:
+		return defaultRemoteUser
+	}
+}
@@ -0,0 +1,176 @@
+package azure
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// The names of the quotas of a location which are checked by CheckQuota. The
+// vCPUs of spot VMs only count against lowPriorityCoresQuota, whereas those
+// of regular VMs count against coresQuota and the quota of their family.
+const (
+	coresQuota            = "cores"
+	lowPriorityCoresQuota = "lowPriorityCores"
+	publicIPQuota         = "StandardSkuPublicIpAddresses"
+)
+
+// An azureUsage is the limit and current usage of a quota, as reported by `az
+// vm list-usage` and `az network list-usages`.
+type azureUsage struct {
+	Name struct {
+		Value string
+	}
+	CurrentValue float64
+	Limit        float64
+}
+
+// locationQuotas returns the compute and network quotas of the location,
+// keyed by name.
+func locationQuotas(ctx context.Context, location string) (map[string]azureUsage, error) {
+	ret := make(map[string]azureUsage)
+	for _, args := range [][]string{
+		{"vm", "list-usage", "--location", location},
+		{"network", "list-usages", "--location", location},
+	} {
+		var data []azureUsage
+		if err := runJSONCommand(ctx, args, &data); err != nil {
+			return nil, errors.Wrapf(err, "could not get the quotas of location %s", location)
+		}
+		for _, u := range data {
+			ret[u.Name.Value] = u
+		}
+	}
+	return ret, nil
+}
+
+// A skuSize is the family of a size and its number of vCPUs.
+type skuSize struct {
+	family string
+	cpus   int
+}
+
+// describeSize returns the family and vCPUs of a size in the location.
+func describeSize(ctx context.Context, location, machineType string) (skuSize, error) {
+	var data []struct {
+		Name         string
+		Family       string
+		Capabilities []struct {
+			Name  string
+			Value string
+		}
+	}
+	args := []string{
+		"vm", "list-skus",
+		"--resource-type", "virtualMachines",
+		"--location", location,
+		"--size", machineType,
+	}
+	if err := runJSONCommand(ctx, args, &data); err != nil {
+		return skuSize{}, err
+	}
+	for _, sku := range data {
+		// The --size flag matches prefixes of the names.
+		if !strings.EqualFold(sku.Name, machineType) {
+			continue
+		}
+		ret := skuSize{family: sku.Family}
+		for _, c := range sku.Capabilities {
+			if c.Name == "vCPUs" {
+				ret.cpus, _ = strconv.Atoi(c.Value)
+			}
+		}
+		return ret, nil
+	}
+	return skuSize{}, errors.Errorf("size %s is not offered in location %s", machineType, location)
+}
+
+// CheckQuota is part of the vm.Provider interface. The vCPUs of the VMs are
+// checked against the quotas of the location on all vCPUs and on those of
+// their family, or on spot vCPUs, and their public IP addresses against the
+// quota on Standard SKU addresses.
+func (p *Provider) CheckQuota(ctx context.Context, opts vm.CreateOpts, count int) error {
+	if count == 0 {
+		return nil
+	}
+	placements, err := p.placements(opts, count)
+	if err != nil {
+		return err
+	}
+	var usedZones []string
+	seenZones := make(map[string]bool)
+	for _, zone := range placements {
+		if !seenZones[zone] {
+			seenZones[zone] = true
+			usedZones = append(usedZones, zone)
+		}
+	}
+	machineType, err := p.machineType(opts)
+	if err != nil {
+		return err
+	}
+	machineTypes, err := vm.MachineTypes(ctx, p, usedZones, machineType, p.opts.MachineTypeFallbacks)
+	if err != nil {
+		return err
+	}
+
+	// The size of each zone, keyed by location and name.
+	sizes := make(map[string]skuSize)
+	locationSet := make(map[string]bool)
+	for _, zone := range usedZones {
+		location, _, _ := parseZone(zone)
+		locationSet[location] = true
+		key := location + "/" + machineTypes[zone]
+		if _, ok := sizes[key]; ok {
+			continue
+		}
+		if sizes[key], err = describeSize(ctx, location, machineTypes[zone]); err != nil {
+			return err
+		}
+	}
+	locations := make([]string, 0, len(locationSet))
+	for location := range locationSet {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	quotas := make([]map[string]azureUsage, len(locations))
+	if err := vm.ForEach(len(locations), func(i int) error {
+		var err error
+		quotas[i], err = locationQuotas(ctx, locations[i])
+		return err
+	}); err != nil {
+		return err
+	}
+	locationUsage := make(map[string]map[string]azureUsage, len(locations))
+	for i, location := range locations {
+		locationUsage[location] = quotas[i]
+	}
+
+	demands := make(map[string]*vm.QuotaDemand)
+	for _, zone := range placements {
+		location, _, _ := parseZone(zone)
+		size := sizes[location+"/"+machineTypes[zone]]
+		if opts.Preemptible {
+			vm.AddQuotaDemand(demands, location, lowPriorityCoresQuota, "vCPUs", float64(size.cpus))
+		} else {
+			vm.AddQuotaDemand(demands, location, coresQuota, "vCPUs", float64(size.cpus))
+			vm.AddQuotaDemand(demands, location, size.family, "vCPUs", float64(size.cpus))
+		}
+		if !opts.NoPublicIP {
+			vm.AddQuotaDemand(demands, location, publicIPQuota, "addresses", 1)
+		}
+	}
+	for key, d := range demands {
+		u, ok := locationUsage[d.Region][d.Quota]
+		if !ok {
+			delete(demands, key)
+			continue
+		}
+		d.Limit, d.Usage = u.Limit, u.CurrentValue
+	}
+	return vm.CheckQuotaDemands(ProviderName, demands)
+}
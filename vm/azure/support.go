@@ -0,0 +1,334 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// The data disks created for VMs without --local-ssd are attached at LUNs 0
+// onwards, which the Azure udev rules expose under /dev/disk/azure. Several
+// data disks are striped into a RAID 0 volume. With --local-ssd, the data
+// directory is on the temporary (resource) disk, which waagent mounts at /mnt.
+// https://docs.microsoft.com/en-us/azure/virtual-machines/linux/attach-disk-portal
+const azureStartupScript = `#!/usr/bin/env bash
+set -x
+
+mountpoint="/mnt/data1"
+disks=($(ls /dev/disk/azure/scsi1/lun* 2>/dev/null))
+if grep -e " ${mountpoint} " /etc/fstab > /dev/null; then
+  echo "${mountpoint} already configured, skipping..."
+elif [ "${#disks[@]}" -eq "1" ]; then
+  echo "Data disk found, creating ${mountpoint}"
+  disk=${disks[0]}
+  mkdir -p ${mountpoint}
+  mkfs.ext4 -F -E nodiscard ${disk}
+  mount -o discard,defaults ${disk} ${mountpoint}
+  chmod 777 ${mountpoint}
+  echo "${disk} ${mountpoint} ext4 discard,defaults,nofail 1 1" | tee -a /etc/fstab
+elif [ "${#disks[@]}" -gt "1" ]; then
+  echo "${#disks[@]} data disks found, creating ${mountpoint} using RAID 0"
+  apt-get update
+  apt-get install -qy --no-install-recommends mdadm
+  mkdir -p ${mountpoint}
+  raiddisk="/dev/md0"
+  mdadm --create ${raiddisk} --level=0 --raid-devices=${#disks[@]} "${disks[@]}"
+  mkfs.ext4 -F -E nodiscard ${raiddisk}
+  mount -o discard,defaults ${raiddisk} ${mountpoint}
+  chmod 777 ${mountpoint}
+  echo "${raiddisk} ${mountpoint} ext4 discard,defaults,nofail 1 1" | tee -a /etc/fstab
+else
+  echo "No data disk, creating ${mountpoint} on the resource disk"
+  mkdir -p ${mountpoint}
+  chmod 777 ${mountpoint}
+fi
+
+# Azure VMs synchronize their clocks with the host via the PTP device.
+sudo apt-get update
+sudo apt-get install -qy chrony
+echo -e "\nrefclock PHC /dev/ptp0 poll 3 dpoll -2 offset 0" | sudo tee -a /etc/chrony/chrony.conf
+echo -e "\nmakestep 0.1 3" | sudo tee -a /etc/chrony/chrony.conf
+sudo /etc/init.d/chrony restart
+sudo chronyc -a waitsync 30 0.01 | sudo tee -a /root/chrony.log
+
+# increase the default maximum number of open file descriptors for
+# root and non-root users. Load generators running a lot of concurrent
+# workers bump into this often.
+sudo sh -c 'echo "root - nofile 65536\n* - nofile 65536" > /etc/security/limits.d/10-roachprod-nofiles.conf'
+sudo touch /mnt/data1/.roachprod-initialized
+`
+
+// maxCustomDataSize is the limit on the base64-encoded custom data of a VM.
+// See https://docs.microsoft.com/en-us/azure/virtual-machines/custom-data
+const maxCustomDataSize = 64 << 10
+
+// startupScript returns the custom data of the named VM, which includes the
+// user-supplied startup script, if any.
+func startupScript(name string, opts vm.CreateOpts) (string, error) {
+	userScript, err := vm.RenderStartupScript(opts.StartupScript, name)
+	if err != nil {
+		return "", err
+	}
+	script := vm.AppendStartupScript(azureStartupScript, userScript)
+	if n := base64.StdEncoding.EncodedLen(len(script)); n > maxCustomDataSize {
+		return "", errors.Errorf("the custom data of %s is %d bytes when encoded, but Azure allows at most %d",
+			name, n, maxCustomDataSize)
+	}
+	return script, nil
+}
+
+// transientErrorRE matches the Azure error codes for errors which are
+// expected to succeed if retried: throttling and temporary service
+// unavailability.
+// See https://docs.microsoft.com/en-us/azure/azure-resource-manager/management/request-limits-and-throttling
+var transientErrorRE = regexp.MustCompile(
+	`TooManyRequests|ServiceUnavailable|InternalServerError|GatewayTimeout|RetryableError`)
+
+// isTransientError returns true if the error of an az command is worth
+// retrying.
+func isTransientError(err error) bool {
+	return transientErrorRE.MatchString(err.Error())
+}
+
+// rateLimiter paces all of the az commands issued by the provider.
+var rateLimiter = vm.RateLimiter{Provider: ProviderName}
+
+// subscription is the name or id of the subscription, selected by
+// --azure-subscription, in which every az command is run. The subscription
+// set by az account set is used if it is empty.
+var subscription string
+
+// subscriptionAccess memoizes the result of checkSubscriptionAccess, which is
+// needed only once per invocation.
+var subscriptionAccess struct {
+	sync.Once
+	err error
+}
+
+// checkSubscriptionAccess returns an error if the subscription selected by
+// --azure-subscription does not exist or the signed-in user cannot access it.
+func checkSubscriptionAccess(ctx context.Context) error {
+	if subscription == "" {
+		return nil
+	}
+	subscriptionAccess.Do(func() {
+		if err := runCommand(ctx, []string{"account", "show"}); err != nil {
+			subscriptionAccess.err = errors.Wrapf(err, "subscription %s is not accessible", subscription)
+		}
+	})
+	return subscriptionAccess.err
+}
+
+// runAzCommand invokes an az command, retrying transient errors, and returns
+// its standard output. The error includes the command's stderr so that it
+// can be classified.
+func runAzCommand(ctx context.Context, args []string) ([]byte, error) {
+	if subscription != "" {
+		args = append(args[:len(args):len(args)], "--subscription", subscription)
+	}
+	var stdout []byte
+	err := vm.Retry(ctx, &rateLimiter, isTransientError, func() error {
+		cmd := exec.CommandContext(ctx, "az", args...)
+
+		var err error
+		stdout, err = cmd.Output()
+		if err != nil {
+			var stderr []byte
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				stderr = exitErr.Stderr
+			}
+			return errors.Wrapf(err, "failed to run: az %s: %s",
+				strings.Join(args, " "), bytes.TrimSpace(stderr))
+		}
+		return nil
+	})
+	return stdout, err
+}
+
+// runCommand is used to invoke an az command for which no output is expected.
+func runCommand(ctx context.Context, args []string) error {
+	_, err := runAzCommand(ctx, append(args[:len(args):len(args)], "--output", "none"))
+	return err
+}
+
+// runJSONCommand invokes an az command and parses the json output.
+func runJSONCommand(ctx context.Context, args []string, parsed interface{}) error {
+	// force json output in case the user has overridden the default behavior
+	args = append(args[:len(args):len(args)], "--output", "json")
+
+	rawJSON, err := runAzCommand(ctx, args)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(rawJSON, &parsed); err != nil {
+		return errors.Wrapf(err, "failed to parse json %s", rawJSON)
+	}
+
+	return nil
+}
+
+// zoneRE matches an Azure location (e.g. eastus2), optionally followed by
+// the number of one of its availability zones (e.g. eastus2-1).
+var zoneRE = regexp.MustCompile(`^([a-z]+[0-9]*)(?:-([0-9]+))?$`)
+
+// parseZone splits a zone like eastus2-1 into its location and availability
+// zone. The availability zone is empty for a location without one.
+func parseZone(zone string) (location, availabilityZone string, err error) {
+	match := zoneRE.FindStringSubmatch(zone)
+	if match == nil {
+		return "", "", errors.Errorf("invalid Azure zone %q: expected a location with an optional "+
+			"availability zone, e.g. eastus2 or eastus2-1", zone)
+	}
+	return match[1], match[2], nil
+}
+
+// azureDisk is a managed disk of a VM, as reported by az vm list.
+type azureDisk struct {
+	Name        string
+	DiskSizeGb  int
+	Lun         int
+	ManagedDisk struct {
+		StorageAccountType string
+	}
+}
+
+// toDisk converts the disk into a vm.Disk, whose device is its LUN unless it
+// is the boot disk.
+func (d azureDisk) toDisk(boot bool) vm.Disk {
+	ret := vm.Disk{
+		Name:   d.Name,
+		SizeGB: d.DiskSizeGb,
+		Type:   d.ManagedDisk.StorageAccountType,
+		Boot:   boot,
+	}
+	if !boot {
+		ret.Device = fmt.Sprintf("lun%d", d.Lun)
+	}
+	return ret
+}
+
+// resourceGroupName returns the resource group which holds the VMs of a
+// cluster in a location, along with their network resources.
+func resourceGroupName(cluster, location string) string {
+	return fmt.Sprintf("%s-%s", cluster, location)
+}
+
+// The fault domains over which the availability set of vm.PlacementSpread
+// spreads the VMs of a location, which every location supports, and the
+// number of VMs which the set may hold.
+const (
+	availabilitySetFaultDomains = 2
+	maxAvailabilitySetVMs       = 200
+)
+
+// checkAvailabilitySet returns an error if the VMs to be created in
+// placements, the zone of each VM, cannot be placed in availability sets,
+// which cannot be combined with availability zones.
+func checkAvailabilitySet(placements []string) error {
+	counts := make(map[string]int)
+	for _, zone := range placements {
+		location, availabilityZone, err := parseZone(zone)
+		if err != nil {
+			return err
+		}
+		if availabilityZone != "" {
+			return errors.Errorf("spread placement uses availability sets, which cannot be combined "+
+				"with availability zones such as %s; use the location %s instead", zone, location)
+		}
+		counts[location]++
+		if counts[location] > maxAvailabilitySetVMs {
+			return errors.Errorf("an availability set holds at most %d VMs, which the cluster exceeds in %s",
+				maxAvailabilitySetVMs, location)
+		}
+	}
+	return nil
+}
+
+// publicIPName returns the name of the public IP address of the named VM.
+func publicIPName(name string) string {
+	return name + "-ip"
+}
+
+// resourceGroupID returns the id of the resource group containing the
+// resource with the given id, which is of the form
+// /subscriptions/<id>/resourceGroups/<name>/providers/....
+func resourceGroupID(id string) (string, error) {
+	i := strings.Index(strings.ToLower(id), "/providers/")
+	if i == -1 {
+		return "", errors.Errorf("unable to determine the resource group of %s", id)
+	}
+	return id[:i], nil
+}
+
+// formatTags converts a map of tags into the key=value pairs expected by the
+// az --tags flag.
+func formatTags(tags map[string]string) []string {
+	keys := vm.MetadataKeys(tags)
+	ret := make([]string, len(keys))
+	for i, k := range keys {
+		ret[i] = fmt.Sprintf("%s=%s", k, tags[k])
+	}
+	return ret
+}
+
+// groupMap collates VMs by their resource group id.
+func groupMap(vms vm.List) (map[string]vm.List, error) {
+	ret := make(map[string]vm.List)
+	for _, v := range vms {
+		if v.Provider != ProviderName {
+			return nil, errors.Errorf("%s received VM instance from %s", ProviderName, v.Provider)
+		}
+		group, err := resourceGroupID(v.ProviderID)
+		if err != nil {
+			return nil, err
+		}
+		ret[group] = append(ret[group], v)
+	}
+	return ret, nil
+}
+
+// groupNames returns the sorted keys of a groupMap.
+func groupNames(byGroup map[string]vm.List) []string {
+	ret := make([]string, 0, len(byGroup))
+	for group := range byGroup {
+		ret = append(ret, group)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// machineTypeSizes are the sizes to which a vm.MachineSize is mapped: those
+// of the general purpose Dsv3 series first, followed by the compute
+// optimized Fsv2 and memory optimized Esv3 series.
+var machineTypeSizes = func() []vm.MachineTypeSize {
+	var ret []vm.MachineTypeSize
+	for _, s := range []struct {
+		format       string
+		memoryPerCPU float64
+		cpus         []int
+	}{
+		{"Standard_D%ds_v3", 4, []int{2, 4, 8, 16, 32, 48, 64}},
+		{"Standard_F%ds_v2", 2, []int{2, 4, 8, 16, 32, 48, 64, 72}},
+		{"Standard_E%ds_v3", 8, []int{2, 4, 8, 16, 32, 48, 64}},
+	} {
+		for _, cpus := range s.cpus {
+			ret = append(ret, vm.MachineTypeSize{
+				Name:     fmt.Sprintf(s.format, cpus),
+				CPUs:     cpus,
+				MemoryGB: s.memoryPerCPU * float64(cpus),
+			})
+		}
+	}
+	return ret
+}()
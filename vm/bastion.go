@@ -0,0 +1,214 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/pkg/errors"
+)
+
+// A Bastion is a jump host through which ssh connects to VMs which have no
+// public IP address.
+type Bastion struct {
+	// Host is the address of the bastion, optionally followed by a port.
+	Host    string
+	User    string
+	KeyPath string
+}
+
+// BastionFor returns the bastion of a provider, which is providerHost if it
+// is set and config.BastionHost otherwise. The zero Bastion is returned if
+// neither is set.
+func BastionFor(providerHost string) Bastion {
+	host := providerHost
+	if host == "" {
+		host = config.BastionHost
+	}
+	if host == "" {
+		return Bastion{}
+	}
+	return Bastion{Host: host, User: config.BastionUser, KeyPath: os.ExpandEnv(config.BastionKeyPath)}
+}
+
+// sshArgs returns the arguments of an ssh command which forwards its standard
+// input and output to the port of target via the bastion.
+func (b Bastion) sshArgs(target string) []string {
+	host, port := b.Host, ""
+	if h, p, err := net.SplitHostPort(b.Host); err == nil {
+		host, port = h, p
+	}
+	args := []string{"-q"}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	if b.KeyPath != "" {
+		args = append(args, "-i", b.KeyPath)
+	}
+	if b.User != "" {
+		host = b.User + "@" + host
+	}
+	return append(args, "-W", target, host)
+}
+
+// bastions are the bastions configured by ConfigBastionSSH, keyed by provider
+// name, which WaitForSSH uses to reach VMs without public IPs.
+var bastions struct {
+	sync.Mutex
+	byProvider map[string]Bastion
+}
+
+// bastionOf returns the bastion through which the VM is reached, if any.
+func bastionOf(v VM) (Bastion, bool) {
+	if v.PublicIP != "" {
+		return Bastion{}, false
+	}
+	bastions.Lock()
+	defer bastions.Unlock()
+	b, ok := bastions.byProvider[v.Provider]
+	return b, ok
+}
+
+// sshConfigPath is the ssh configuration which ConfigBastionSSH edits.
+const sshConfigPath = "${HOME}/.ssh/config"
+
+// sshConfigMu serializes the edits of the ssh configuration.
+var sshConfigMu sync.Mutex
+
+// bastionSection returns the lines which delimit the section of the ssh
+// configuration which holds the bastion configuration of a provider.
+func bastionSection(provider string) (begin, end string) {
+	return "# roachprod bastion: " + provider, "# end roachprod bastion: " + provider
+}
+
+// ConfigBastionSSH routes ssh connections to the provider's VMs which have no
+// public IP address through the bastion, by adding a ProxyCommand for their
+// private IPs to ~/.ssh/config. The ssh commands run by roachprod pick it up
+// from there, as do those run by the user. The section previously added for
+// the provider is replaced. Without a bastion, the section is removed.
+func ConfigBastionSSH(ctx context.Context, p Provider, b Bastion) error {
+	if b.Host == "" {
+		return CleanBastionSSH(p.Name())
+	}
+	vms, err := CachedList(ctx, p, nil)
+	if err != nil {
+		return err
+	}
+	var hosts []string
+	for _, v := range vms {
+		if v.PublicIP == "" && v.PrivateIP != "" {
+			hosts = append(hosts, v.PrivateIP)
+		}
+	}
+	sort.Strings(hosts)
+
+	bastions.Lock()
+	if bastions.byProvider == nil {
+		bastions.byProvider = make(map[string]Bastion)
+	}
+	bastions.byProvider[p.Name()] = b
+	bastions.Unlock()
+
+	if len(hosts) == 0 {
+		return CleanBastionSSH(p.Name())
+	}
+	begin, end := bastionSection(p.Name())
+	var section bytes.Buffer
+	fmt.Fprintln(&section, begin)
+	fmt.Fprintf(&section, "Host %s\n", strings.Join(hosts, " "))
+	fmt.Fprintf(&section, "  ProxyCommand ssh %s\n", strings.Join(b.sshArgs("%h:%p"), " "))
+	fmt.Fprintln(&section, end)
+	return editSSHConfig(p.Name(), section.String())
+}
+
+// CleanBastionSSH removes the bastion configuration of a provider from
+// ~/.ssh/config.
+func CleanBastionSSH(provider string) error {
+	return editSSHConfig(provider, "")
+}
+
+// editSSHConfig replaces the bastion section of the provider in the ssh
+// configuration with the given section, which is appended. The file is
+// replaced atomically, since ssh may be reading it concurrently.
+func editSSHConfig(provider, section string) error {
+	sshConfigMu.Lock()
+	defer sshConfigMu.Unlock()
+
+	// The configuration may be a symlink, e.g. into a dotfiles repository,
+	// which is to be kept, so the file it points to is replaced instead.
+	path := os.ExpandEnv(sshConfigPath)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "unable to read %s", path)
+	}
+
+	begin, end := bastionSection(provider)
+	var buf bytes.Buffer
+	inSection, found := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == begin:
+			inSection, found = true, true
+		case line == end:
+			inSection = false
+		case !inSection:
+			fmt.Fprintln(&buf, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "unable to read %s", path)
+	}
+	if !found && section == "" {
+		return nil
+	}
+	buf.WriteString(section)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpFile := path + ".roachprod.tmp"
+	if err := ioutil.WriteFile(tmpFile, buf.Bytes(), 0600); err != nil {
+		return errors.Wrapf(err, "unable to write %s", path)
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// waitForSSHVia checks whether the ssh port of host accepts connections from
+// the bastion, by forwarding a connection to it and reading the ssh banner.
+func waitForSSHVia(ctx context.Context, b Bastion, host string) error {
+	cmd := exec.CommandContext(ctx, "ssh", b.sshArgs(net.JoinHostPort(host, "22"))...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	banner, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return errors.Errorf("unexpected ssh banner from %s: %q", host, banner)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestEditSSHConfigKeepsSymlink checks that the bastion section is removed
+// from the file which ~/.ssh/config links to, rather than the link being
+// replaced by a copy.
+func TestEditSSHConfigKeepsSymlink(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	target := filepath.Join(home, "dotfiles", "ssh_config")
+	link := filepath.Join(home, ".ssh", "config")
+	for _, dir := range []string{filepath.Dir(target), filepath.Dir(link)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	begin, end := bastionSection("aws")
+	contents := "Host *\n  ServerAliveInterval 60\n" +
+		begin + "\nHost 10.0.0.1\n  ProxyCommand ssh -W %h:%p bastion\n" + end + "\n"
+	if err := ioutil.WriteFile(target, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CleanBastionSSH("aws"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(link); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("%s is no longer a symlink", link)
+	}
+	data, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Host *\n  ServerAliveInterval 60\n"; string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+}
+
+func TestBastionTo(t *testing.T) {
+	access := SSHAccess{Bastion: Bastion{Host: "bastion.example.com:2222"}}
+	for _, tc := range []struct {
+		access   SSHAccess
+		host     string
+		expected bool
+	}{
+		{access, "10.1.2.3", true},
+		{access, "192.168.0.1", true},
+		{access, "35.1.2.3", false},
+		{access, "n1.example.com", false},
+		{SSHAccess{}, "10.1.2.3", false},
+	} {
+		if _, ok := tc.access.BastionTo(tc.host); ok != tc.expected {
+			t.Errorf("BastionTo(%q) = %t, expected %t", tc.host, ok, tc.expected)
+		}
+	}
+	if addr := access.Bastion.Addr(); addr != "bastion.example.com:2222" {
+		t.Errorf("unexpected address %s", addr)
+	}
+	if addr := (Bastion{Host: "bastion"}).Addr(); addr != "bastion:22" {
+		t.Errorf("unexpected address %s", addr)
+	}
+}
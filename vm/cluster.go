@@ -0,0 +1,175 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/pkg/errors"
+)
+
+// nameFormat describes the names of the VMs of a cluster, as returned by Name.
+const nameFormat = "user-<clusterid>-<nodeid>"
+
+// A Cluster is a set of VMs whose names share a cluster name, which is the
+// name of each VM without its node number (see Name). The VMs may be hosted
+// by several providers.
+type Cluster struct {
+	Name string `json:"name"`
+	User string `json:"user"`
+	// This is the earliest creation and shortest lifetime across VMs.
+	CreatedAt time.Time     `json:"created_at"`
+	Lifetime  time.Duration `json:"lifetime"`
+	// VMs are sorted by their node number.
+	VMs List `json:"vms"`
+}
+
+// NodeNumber returns the node number of a VM, parsed from the suffix of its
+// name.
+func NodeNumber(name string) (int, error) {
+	parts := strings.Split(name, "-")
+	i, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return 0, errors.Errorf("expected VM name in the form %s, got %s", nameFormat, name)
+	}
+	return i, nil
+}
+
+// ClusterName returns the user and the name of the cluster to which the VM
+// belongs, which are parsed from its name. The VMs of the local cluster
+// belong to the local user.
+func (vm *VM) ClusterName() (user, cluster string, err error) {
+	if vm.IsLocal() {
+		return config.Local, config.Local, nil
+	}
+	parts := strings.Split(vm.Name, "-")
+	if len(parts) < 3 {
+		return "", "", fmt.Errorf("expected VM name in the form %s, got %s", nameFormat, vm.Name)
+	}
+	return parts[0], strings.Join(parts[:len(parts)-1], "-"), nil
+}
+
+// GroupClusters collates the VMs into clusters, keyed by name. The cluster of
+// a VM is that of its ClusterLabel, if it has one, and is otherwise parsed
+// from its name. VMs with errors, including those whose cluster cannot be
+// told and which have ErrInvalidName appended, are returned separately.
+func GroupClusters(vms List) (map[string]*Cluster, List) {
+	clusters := make(map[string]*Cluster)
+	var bad List
+	for _, v := range vms {
+		user, name, err := v.ClusterName()
+		if label := v.Labels[ClusterLabel]; label != "" && strings.Contains(label, "-") {
+			user, name, err = strings.SplitN(label, "-", 2)[0], label, nil
+		}
+		if err != nil {
+			v.Errors = append(v.Errors, ErrInvalidName)
+		}
+		if len(v.Errors) > 0 {
+			bad = append(bad, v)
+			continue
+		}
+
+		c, ok := clusters[name]
+		if !ok {
+			c = &Cluster{
+				Name:      name,
+				User:      user,
+				CreatedAt: v.CreatedAt,
+				Lifetime:  v.Lifetime,
+			}
+			clusters[name] = c
+		}
+		// Bound the cluster creation time and overall lifetime to the
+		// earliest and/or shortest VM.
+		c.VMs = append(c.VMs, v)
+		if v.CreatedAt.Before(c.CreatedAt) {
+			c.CreatedAt = v.CreatedAt
+		}
+		if v.Lifetime < c.Lifetime {
+			c.Lifetime = v.Lifetime
+		}
+	}
+
+	// Sort the VMs of each cluster, so that we always have the same order.
+	for _, c := range clusters {
+		sort.Sort(c.VMs)
+	}
+	sort.Sort(bad)
+	return clusters, bad
+}
+
+// Clouds returns the names of all of the various cloud providers used
+// by the VMs in the cluster.
+func (c *Cluster) Clouds() []string {
+	present := make(map[string]bool)
+	for _, m := range c.VMs {
+		present[m.Provider] = true
+	}
+
+	var ret []string
+	for provider := range present {
+		ret = append(ret, provider)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// IsLocal returns true for the local cluster.
+func (c *Cluster) IsLocal() bool {
+	return c.Name == config.Local
+}
+
+// ExpiresAt returns the time at which the cluster's lifetime elapses.
+func (c *Cluster) ExpiresAt() time.Time {
+	return c.CreatedAt.Add(c.Lifetime)
+}
+
+// HasExpiration returns false for the local cluster and for clusters whose
+// lifetime is unknown. Such clusters are never garbage collected.
+func (c *Cluster) HasExpiration() bool {
+	return !c.IsLocal() && c.Lifetime > 0
+}
+
+// Expired returns true if the cluster has an expiration which has passed.
+func (c *Cluster) Expired() bool {
+	return c.HasExpiration() && time.Now().After(c.ExpiresAt())
+}
+
+// ExpiresWithin returns true if the cluster has an expiration which passes
+// within d from now, or has already passed.
+func (c *Cluster) ExpiresWithin(d time.Duration) bool {
+	return c.HasExpiration() && c.ExpiresAt().Before(time.Now().Add(d))
+}
+
+// Nodes returns the node numbers of the VMs, in order. VMs whose name has no
+// node number are omitted.
+func (c *Cluster) Nodes() []int {
+	ret := make([]int, 0, len(c.VMs))
+	for _, v := range c.VMs {
+		if node, err := NodeNumber(v.Name); err == nil {
+			ret = append(ret, node)
+		}
+	}
+	return ret
+}
+
+// PublicIPs returns the public IP addresses of the VMs, in order.
+func (c *Cluster) PublicIPs() []string {
+	ret := make([]string, len(c.VMs))
+	for i, v := range c.VMs {
+		ret[i] = v.PublicIP
+	}
+	return ret
+}
+
+// PrivateIPs returns the private IP addresses of the VMs, in order.
+func (c *Cluster) PrivateIPs() []string {
+	ret := make([]string, len(c.VMs))
+	for i, v := range c.VMs {
+		ret[i] = v.PrivateIP
+	}
+	return ret
+}
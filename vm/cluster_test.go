@@ -0,0 +1,49 @@
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupClusters(t *testing.T) {
+	vms := List{
+		{Name: "alice-test-0002"},
+		{Name: "alice-test-0001"},
+		// The label names the cluster even if the name does not.
+		{Name: "alice-test-0003", Labels: map[string]string{ClusterLabel: "alice-other"}},
+		{Name: "bob-x-y-0001", Labels: map[string]string{ClusterLabel: "bob-x-y"}},
+		{Name: "renamed", Labels: map[string]string{ClusterLabel: "carol-test"}},
+		{Name: "unlabeled"},
+	}
+	clusters, bad := GroupClusters(vms)
+
+	expected := map[string][]string{
+		"alice-test":  {"alice-test-0001", "alice-test-0002"},
+		"alice-other": {"alice-test-0003"},
+		"bob-x-y":     {"bob-x-y-0001"},
+		"carol-test":  {"renamed"},
+	}
+	if len(clusters) != len(expected) {
+		t.Errorf("got %d clusters, expected %d", len(clusters), len(expected))
+	}
+	for name, names := range expected {
+		c, ok := clusters[name]
+		if !ok {
+			t.Errorf("cluster %s is missing", name)
+			continue
+		}
+		if got := c.VMs.Names(); !reflect.DeepEqual(got, names) {
+			t.Errorf("cluster %s has the VMs %v, expected %v", name, got, names)
+		}
+	}
+	if c := clusters["carol-test"]; c != nil && c.User != "carol" {
+		t.Errorf("cluster carol-test belongs to %s, expected carol", c.User)
+	}
+
+	if len(bad) != 1 || bad[0].Name != "unlabeled" {
+		t.Fatalf("expected only unlabeled to be bad, got %v", bad.Names())
+	}
+	if !bad[0].HasError(ErrorCodeInvalidName) {
+		t.Errorf("expected unlabeled to have an invalid name, got %v", bad[0].Errors)
+	}
+}
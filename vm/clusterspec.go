@@ -0,0 +1,179 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A ClusterSpec is the declarative description of a cluster which `roachprod
+// create -f` reads from a file, in place of the flags of the command. Its
+// NodeSpec sets the machine type and disks of all of the nodes, which
+// NodeSpecs override for single nodes. The fields which are left out keep the
+// values of the flags.
+type ClusterSpec struct {
+	Name  string `json:"name"`
+	Nodes int    `json:"nodes"`
+	// Clouds are the providers over which the nodes are distributed.
+	Clouds []string `json:"clouds,omitempty"`
+	// Zones, which may carry a :count suffix as in --gce-zones, override the
+	// zones of the cloud. As with NodeSpec.MachineType, they require that
+	// the cluster spans a single cloud.
+	Zones []string `json:"zones,omitempty"`
+	Geo   *bool    `json:"geo,omitempty"`
+	// GeoWeights weigh the regions as in --geo-weights and imply Geo. Like
+	// Zones, they require a single cloud.
+	GeoWeights map[string]int    `json:"geo_weights,omitempty"`
+	Lifetime   string            `json:"lifetime,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	// Preemptible, if set, overrides --preemptible.
+	Preemptible *bool `json:"preemptible,omitempty"`
+	NodeSpec
+	NodeSpecs map[string]NodeSpec `json:"node_specs,omitempty"`
+}
+
+// ParseClusterSpec parses a ClusterSpec from JSON, rejecting unknown fields,
+// and validates it. The error of an invalid spec lists all of its problems.
+// The name is not checked, since the caller may supply one of its own.
+func ParseClusterSpec(data []byte) (ClusterSpec, error) {
+	var spec ClusterSpec
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		return ClusterSpec{}, errors.Wrap(err, "invalid cluster spec")
+	}
+	if problems := spec.problems(); len(problems) > 0 {
+		return ClusterSpec{}, errors.Errorf("invalid cluster spec:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return spec, nil
+}
+
+// problems returns a description of each of the invalid fields of the spec.
+func (s ClusterSpec) problems() []string {
+	var ret []string
+	add := func(format string, args ...interface{}) {
+		ret = append(ret, fmt.Sprintf(format, args...))
+	}
+	checkNodeSpec := func(field string, spec NodeSpec) {
+		switch {
+		case spec.CPUs < 0 || spec.MemoryGB < 0:
+			add("%s: cpus and mem_gb must not be negative", field)
+		case spec.MemoryGB > 0 && spec.CPUs == 0:
+			add("%s: mem_gb requires cpus", field)
+		case spec.CPUs > 0 && spec.MachineType != "":
+			add("%s: cpus cannot be combined with machine_type", field)
+		}
+		if spec.BootDiskSizeGB < 0 || spec.LocalSSDCount < 0 || spec.DataDiskCount < 0 || spec.DataDiskSizeGB < 0 {
+			add("%s: disk sizes and counts must not be negative", field)
+		}
+		if err := ValidateDataDisks(spec.Apply(CreateOpts{})); err != nil {
+			add("%s: %s", field, err)
+		}
+	}
+
+	if s.Nodes < 1 || s.Nodes > 999 {
+		add("nodes: must be in [1..999], not %d", s.Nodes)
+	}
+	for _, cloud := range s.Clouds {
+		if _, ok := LookupProvider(cloud); !ok {
+			add("clouds: unknown or unavailable cloud %q, expected one of %s", cloud, AllProviderNames())
+		}
+	}
+	if len(s.Clouds) > 1 && (len(s.Zones) > 0 || s.MachineType != "") {
+		add("zones and machine_type require a single cloud, use cpus and mem_gb for several")
+	}
+	if len(s.Zones) > 0 && s.Nodes > 0 {
+		if _, counts, err := ParseZoneCounts(s.Zones, s.Nodes); err != nil {
+			add("zones: %s", err)
+		} else if counts != nil && len(s.GeoWeights) > 0 {
+			add("zones: node counts cannot be combined with geo_weights")
+		}
+	}
+	if len(s.Clouds) > 1 && len(s.GeoWeights) > 0 {
+		add("geo_weights require a single cloud")
+	}
+	for region, w := range s.GeoWeights {
+		if w <= 0 {
+			add("geo_weights: the weight of region %s must be positive, not %d", region, w)
+		}
+	}
+	if s.Lifetime != "" {
+		if d, err := time.ParseDuration(s.Lifetime); err != nil || d <= 0 {
+			add("lifetime: %q is not a positive duration", s.Lifetime)
+		}
+	}
+	for k := range s.Labels {
+		if k == "" {
+			add("labels: empty label key")
+		}
+	}
+	if err := CheckLabels(s.Labels); err != nil {
+		add("labels: %s", err)
+	}
+	checkNodeSpec("cluster", s.NodeSpec)
+
+	keys := make([]string, 0, len(s.NodeSpecs))
+	for key := range s.NodeSpecs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		node, err := strconv.Atoi(key)
+		if err != nil || node < 1 || node > s.Nodes {
+			add("node_specs: %q is not a node number in [1..%d]", key, s.Nodes)
+			continue
+		}
+		checkNodeSpec(fmt.Sprintf("node_specs[%d]", node), s.NodeSpecs[key])
+	}
+	return ret
+}
+
+// Apply returns opts with the fields which are set in the spec. The labels
+// of the spec are added to those of opts, and its NodeSpecs replace those of
+// opts. The spec must have been parsed by ParseClusterSpec.
+func (s ClusterSpec) Apply(opts CreateOpts) CreateOpts {
+	if len(s.Clouds) > 0 {
+		opts.VMProviders = s.Clouds
+	}
+	if len(s.Zones) > 0 {
+		opts.Zones = s.Zones
+	}
+	if s.Geo != nil {
+		opts.GeoDistributed = *s.Geo
+	}
+	if len(s.GeoWeights) > 0 {
+		opts.GeoWeights = s.GeoWeights
+		opts.GeoDistributed = true
+	}
+	if s.Lifetime != "" {
+		opts.Lifetime, _ = time.ParseDuration(s.Lifetime)
+	}
+	if s.Preemptible != nil {
+		opts.Preemptible = *s.Preemptible
+	}
+	if len(s.Labels) > 0 {
+		labels := make(map[string]string, len(opts.Labels)+len(s.Labels))
+		for k, v := range opts.Labels {
+			labels[k] = v
+		}
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		opts.Labels = labels
+	}
+	opts = s.NodeSpec.Apply(opts)
+	if len(s.NodeSpecs) > 0 {
+		opts.NodeSpecs = make(map[int]NodeSpec, len(s.NodeSpecs))
+		for key, spec := range s.NodeSpecs {
+			node, _ := strconv.Atoi(key)
+			opts.NodeSpecs[node] = spec
+		}
+	}
+	return opts
+}
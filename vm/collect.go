@@ -0,0 +1,197 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CollectManifestFile is the name of the manifest which Collect writes to the
+// local directory.
+const CollectManifestFile = "manifest.json"
+
+// collectConnectTimeout bounds how long Collect waits for the ssh connection
+// to a VM, so that VMs which are down fail quickly.
+const collectConnectTimeout = 10 * time.Second
+
+// A CollectEntry records the result of copying one remote path from a VM.
+// LocalPath is relative to the directory given to Collect. Missing is set if
+// the path did not exist on the VM, which is not an error, since not every
+// node has e.g. core dumps.
+type CollectEntry struct {
+	VM         string `json:"vm"`
+	Host       string `json:"host,omitempty"`
+	RemotePath string `json:"remote_path"`
+	LocalPath  string `json:"local_path,omitempty"`
+	Missing    bool   `json:"missing,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// A CollectManifest lists what Collect copied from where. Entries are in the
+// order of the VMs and remote paths.
+type CollectManifest struct {
+	CollectedAt time.Time      `json:"collected_at"`
+	Entries     []CollectEntry `json:"entries"`
+}
+
+// Failed returns the entries which could not be copied.
+func (m CollectManifest) Failed() []CollectEntry {
+	var ret []CollectEntry
+	for _, e := range m.Entries {
+		if e.Error != "" {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// Collect copies the remote paths, which may be directories or globs and are
+// relative to the home directory of the remote user unless absolute, from
+// each of the VMs into localDir/<VM name>/<remote path>. The VMs are reached
+// with scp as described by the SSHAccess of their providers, through the
+// bastion if they have no public IP, and are copied from in parallel. VMs
+// which are not running or cannot be reached are recorded as failed rather
+// than failing the collection, as are paths which cannot be copied, and the
+// manifest of the collection is written to localDir/manifest.json. An error
+// is returned if the manifest cannot be written, or if nothing at all could
+// be copied.
+func Collect(ctx context.Context, vms List, remotePaths []string, localDir string) (CollectManifest, error) {
+	manifest := CollectManifest{CollectedAt: time.Now().UTC()}
+	if len(vms) == 0 || len(remotePaths) == 0 {
+		return manifest, errors.New("no VMs or paths to collect")
+	}
+	entries := make([][]CollectEntry, len(vms))
+	var mu sync.Mutex
+	copied := 0
+	// The failures are recorded in the entries, so ForEach never fails.
+	_ = ForEach(len(vms), func(i int) error {
+		v := vms[i]
+		entries[i] = make([]CollectEntry, len(remotePaths))
+		for j, remote := range remotePaths {
+			entries[i][j] = CollectEntry{VM: v.Name, Host: v.Host(), RemotePath: remote}
+		}
+		fail := func(err error) error {
+			for j := range entries[i] {
+				entries[i][j].Error = err.Error()
+			}
+			return nil
+		}
+		if v.Status != StatusRunning {
+			return fail(errors.Errorf("%s is %s", v.Name, v.Status))
+		}
+		p, ok := LookupProvider(v.Provider)
+		if !ok {
+			return fail(errors.Errorf("%s: unknown provider %s", v.Name, v.Provider))
+		}
+		target, err := NewSSHTarget(v, p.SSHAccess())
+		if err != nil {
+			return fail(err)
+		}
+		for j, remote := range remotePaths {
+			local := collectLocalPath(v.Name, remote)
+			e := &entries[i][j]
+			missing, err := collectPath(ctx, target, remote, filepath.Join(localDir, local))
+			switch {
+			case err != nil:
+				e.Error = err.Error()
+			case missing:
+				e.Missing = true
+			default:
+				e.LocalPath = local
+				mu.Lock()
+				copied++
+				mu.Unlock()
+			}
+		}
+		return nil
+	})
+	for _, e := range entries {
+		manifest.Entries = append(manifest.Entries, e...)
+	}
+
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return manifest, errors.Wrapf(err, "could not create %s", localDir)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	manifestPath := filepath.Join(localDir, CollectManifestFile)
+	if err := ioutil.WriteFile(manifestPath, append(data, '\n'), 0644); err != nil {
+		return manifest, errors.Wrapf(err, "could not write %s", manifestPath)
+	}
+	if copied == 0 && len(manifest.Failed()) > 0 {
+		return manifest, errors.Errorf("nothing could be collected from the %d VMs, see %s", len(vms), manifestPath)
+	}
+	return manifest, nil
+}
+
+// collectLocalPath returns the path, relative to the directory of Collect, to
+// which the remote path of the VM is copied. Absolute and relative remote
+// paths are kept apart, under root and home respectively, so that they cannot
+// collide.
+func collectLocalPath(vmName, remote string) string {
+	cleaned := path.Clean(remote)
+	base := "home"
+	if path.IsAbs(cleaned) {
+		base = "root"
+	}
+	cleaned = strings.TrimPrefix(cleaned, "/")
+	return filepath.Join(vmName, base, filepath.FromSlash(cleaned))
+}
+
+// collectPath copies the remote path of the target to dest with scp. A glob
+// is copied into dest as a directory. It returns true, without an error, if
+// the remote path does not exist.
+func collectPath(ctx context.Context, target SSHTarget, remote, dest string) (missing bool, _ error) {
+	dir := filepath.Dir(dest)
+	if strings.ContainsAny(remote, "*?[") {
+		dir = dest
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+
+	args := []string{"-r", "-C", "-q",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", fmt.Sprintf("ConnectTimeout=%d", int(collectConnectTimeout.Seconds())),
+	}
+	if target.IdentityFile != "" {
+		args = append(args, "-i", target.IdentityFile, "-o", "IdentitiesOnly=yes")
+	}
+	// As in NewSSHTarget, a bastion with a key of its own is reached by a
+	// ProxyCommand.
+	if target.BastionIdentityFile != "" {
+		args = append(args, "-o", "ProxyCommand=ssh "+strings.Join(target.bastion.sshArgs("%h:%p"), " "))
+	} else if target.ProxyJump != "" {
+		args = append(args, "-o", "ProxyJump="+target.ProxyJump)
+	}
+	host := target.Host
+	if target.User != "" {
+		host = target.User + "@" + host
+	}
+	args = append(args, host+":"+remote, dest)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "scp", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		out := bytes.TrimSpace(stderr.Bytes())
+		if bytes.Contains(out, []byte("No such file or directory")) {
+			return true, nil
+		}
+		return false, errors.Wrapf(err, "scp %s: %s", remote, out)
+	}
+	return false, nil
+}
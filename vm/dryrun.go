@@ -0,0 +1,71 @@
+package vm
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// shellSafeRE matches the arguments which need no quoting.
+var shellSafeRE = regexp.MustCompile(`^[a-zA-Z0-9_./:=,@%+-]+$`)
+
+// PrintDryRun prints a command which a provider would run if config.DryRun
+// were not set, quoted such that it could be pasted into a shell.
+func PrintDryRun(command string, args []string) {
+	quoted := make([]string, 0, len(args)+1)
+	quoted = append(quoted, command)
+	for _, arg := range args {
+		if shellSafeRE.MatchString(arg) {
+			quoted = append(quoted, arg)
+		} else {
+			quoted = append(quoted, "'"+strings.Replace(arg, "'", `'\''`, -1)+"'")
+		}
+	}
+	fmt.Println(strings.Join(quoted, " "))
+}
+
+// PrintPlan prints the VMs which a provider would create if config.DryRun
+// were not set, grouped by zone and machine type, along with their estimated
+// hourly cost.
+func PrintPlan(p Provider, planned List) {
+	type group struct {
+		zone, machineType string
+	}
+	counts := make(map[group]int)
+	var groups []group
+	for _, v := range planned {
+		g := group{v.Zone, v.MachineType}
+		if counts[g] == 0 {
+			groups = append(groups, g)
+		}
+		counts[g]++
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].zone != groups[j].zone {
+			return groups[i].zone < groups[j].zone
+		}
+		return groups[i].machineType < groups[j].machineType
+	})
+	for _, g := range groups {
+		fmt.Printf("%s: would create %d %s VMs in %s\n", p.Name(), counts[g], g.machineType, g.zone)
+	}
+
+	cost, err := p.CostEstimate(planned)
+	if err != nil {
+		fmt.Printf("%s: unable to estimate the cost: %s\n", p.Name(), err)
+		return
+	}
+	var unknown int
+	for _, v := range planned {
+		if len(v.Errors) > 0 {
+			unknown++
+		}
+	}
+	if unknown > 0 {
+		fmt.Printf("%s: estimated cost $%.2f/hour, excluding %d VMs of unknown price\n",
+			p.Name(), cost, unknown)
+	} else {
+		fmt.Printf("%s: estimated cost $%.2f/hour\n", p.Name(), cost)
+	}
+}
@@ -0,0 +1,48 @@
+package vm
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// endpointTimeout bounds the request with which CheckEndpoint reaches an
+// endpoint.
+const endpointTimeout = 10 * time.Second
+
+// ValidateEndpoint returns an error if the API endpoint with which a provider
+// overrides the public one of its cloud is not an http or https URL.
+func ValidateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "invalid endpoint %q", endpoint)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("invalid endpoint %q, expected an http or https URL", endpoint)
+	}
+	return nil
+}
+
+// CheckEndpoint returns an error if the endpoint is invalid or does not
+// respond to a request. Any response, even an error status, means that the
+// endpoint is reachable; whether the credentials are accepted is left to the
+// provider.
+func CheckEndpoint(ctx context.Context, endpoint string) error {
+	if err := ValidateEndpoint(endpoint); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, endpointTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return errors.Wrapf(err, "invalid endpoint %q", endpoint)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "endpoint %s is not reachable", endpoint)
+	}
+	return resp.Body.Close()
+}
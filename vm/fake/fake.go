@@ -0,0 +1,596 @@
+// Package fake provides an in-memory vm.Provider for testing code which
+// embeds roachprod, such as roachtest, without making calls to a cloud. Its
+// VMs are seeded or created in memory, failures and latency can be injected
+// per method, and the calls it receives are recorded.
+//
+// Unlike the other providers, it is not registered by importing the
+// package. A test registers it with Register, under ProviderName, and
+// removes it with Unregister.
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// ProviderName is the name under which Register adds the provider.
+const ProviderName = "fake"
+
+// The zone and machine type of the VMs created without CreateOpts.Zones or
+// CreateOpts.MachineType.
+const (
+	DefaultZone        = "fake-zone"
+	DefaultMachineType = "fake-machine"
+)
+
+// maxMetadataValueLen is the longest metadata value which SetMetadata
+// accepts, the smallest limit of the real providers.
+const maxMetadataValueLen = 256
+
+// Register registers a new Provider with vm.Register under ProviderName, replacing
+// any earlier one, and returns it.
+func Register() *Provider {
+	p := New()
+	vm.Unregister(ProviderName)
+	vm.MustRegister(ProviderName, p)
+	return p
+}
+
+// Unregister removes the Provider added by Register from the vm providers.
+func Unregister() {
+	vm.Unregister(ProviderName)
+}
+
+// A Call is a method call recorded by the Provider. Names are those of the
+// VMs which the call was given, if any.
+type Call struct {
+	Method string
+	Names  []string
+}
+
+// A Provider implements vm.Provider in memory. The exported fields configure
+// its behavior and must not be changed while it is in use; the VMs, failures
+// and calls are guarded by the Provider, and may be changed at any time.
+type Provider struct {
+	// Caps is returned by Capabilities.
+	Caps vm.ProviderCapabilities
+	// Account is returned by FindActiveAccount and is the user of the VMs
+	// created.
+	Account string
+	// Latency delays every call by the Provider. A call whose context is
+	// done first returns the context's error.
+	Latency time.Duration
+	// HourlyCost is the cost in USD of each VM which CostEstimate reports.
+	HourlyCost float64
+	// Zones is returned by ZoneCatalog.
+	Zones vm.ZoneCatalog
+	// Now returns the creation time of the VMs created.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	vms      map[string]vm.VM
+	metadata map[string]map[string]string
+	failures map[string]error
+	calls    []Call
+	created  int
+}
+
+var _ vm.Provider = &Provider{}
+
+// New returns an empty Provider which supports the features it can emulate:
+// metadata, extension, rebooting, resizing and suspension.
+func New() *Provider {
+	return &Provider{
+		Caps: vm.ProviderCapabilities{
+			Metadata: true,
+			Extend:   true,
+			Reboot:   true,
+			Resize:   true,
+			Suspend:  true,
+		},
+		Account:  "fake-user",
+		Zones:    vm.ZoneCatalog{DefaultZone: ProviderName},
+		Now:      func() time.Time { return time.Now().UTC() },
+		vms:      make(map[string]vm.VM),
+		metadata: make(map[string]map[string]string),
+		failures: make(map[string]error),
+	}
+}
+
+// Seed adds the VMs to the provider, replacing those of the same names. The
+// Provider of each VM is set to ProviderName, and its ProviderID to its name
+// if it has none.
+func (p *Provider) Seed(vms ...vm.VM) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, v := range vms {
+		v.Provider = ProviderName
+		if v.ProviderID == "" {
+			v.ProviderID = v.Name
+		}
+		p.vms[v.Name] = v
+	}
+}
+
+// VMs returns the VMs of the provider, sorted by name.
+func (p *Provider) VMs() vm.List {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ret := make(vm.List, 0, len(p.vms))
+	for _, v := range p.vms {
+		ret = append(ret, v)
+	}
+	sort.Sort(ret)
+	return ret
+}
+
+// FailOn makes the calls of the named method, e.g. "Create", return err
+// until FailOn is called again for it with a nil error. The call is still
+// recorded.
+func (p *Provider) FailOn(method string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		delete(p.failures, method)
+	} else {
+		p.failures[method] = err
+	}
+}
+
+// Calls returns the calls recorded since the Provider was created or Reset,
+// in the order in which they were made.
+func (p *Provider) Calls() []Call {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Call(nil), p.calls...)
+}
+
+// CallsTo returns the recorded calls of the named method.
+func (p *Provider) CallsTo(method string) []Call {
+	var ret []Call
+	for _, c := range p.Calls() {
+		if c.Method == method {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// Reset forgets the recorded calls.
+func (p *Provider) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = nil
+}
+
+// call records a call of the method, waits for the Latency and returns the
+// failure injected for the method, if any.
+func (p *Provider) call(ctx context.Context, method string, names ...string) error {
+	p.mu.Lock()
+	p.calls = append(p.calls, Call{Method: method, Names: names})
+	err := p.failures[method]
+	p.mu.Unlock()
+
+	if p.Latency > 0 {
+		select {
+		case <-time.After(p.Latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// update calls fn with each of the VMs, by name, and stores the VMs it
+// modifies. An error is returned if any of the VMs do not exist, in which
+// case none are modified.
+func (p *Provider) update(vms vm.List, fn func(v *vm.VM)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.checkExistLocked(vms); err != nil {
+		return err
+	}
+	for _, v := range vms {
+		stored := p.vms[v.Name]
+		fn(&stored)
+		p.vms[v.Name] = stored
+	}
+	return nil
+}
+
+// checkExistLocked returns an error naming the VMs which do not exist. The
+// caller must hold p.mu.
+func (p *Provider) checkExistLocked(vms vm.List) error {
+	var missing []string
+	for _, v := range vms {
+		if _, ok := p.vms[v.Name]; !ok {
+			missing = append(missing, v.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("VMs %s do not exist", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// emptyFlags is the vm.ProviderFlags of the Provider, which has no flags.
+type emptyFlags struct{}
+
+// ConfigureCreateFlags is part of vm.ProviderFlags. This implementation is a no-op.
+func (o *emptyFlags) ConfigureCreateFlags(*pflag.FlagSet) {
+}
+
+// ConfigureClusterFlags is part of vm.ProviderFlags. This implementation is a no-op.
+func (o *emptyFlags) ConfigureClusterFlags(*pflag.FlagSet) {
+}
+
+// Capabilities is part of the vm.Provider interface.
+func (p *Provider) Capabilities() vm.ProviderCapabilities {
+	return p.Caps
+}
+
+// CheckCredentials is part of the vm.Provider interface.
+func (p *Provider) CheckCredentials(ctx context.Context) error {
+	return p.call(ctx, "CheckCredentials")
+}
+
+// CheckQuota is part of the vm.Provider interface. The quota is unlimited.
+func (p *Provider) CheckQuota(ctx context.Context, opts vm.CreateOpts, count int) error {
+	return p.call(ctx, "CheckQuota")
+}
+
+// CleanSSH is part of the vm.Provider interface.
+func (p *Provider) CleanSSH(ctx context.Context) error {
+	return p.call(ctx, "CleanSSH")
+}
+
+// ConfigSSH is part of the vm.Provider interface.
+func (p *Provider) ConfigSSH(ctx context.Context) error {
+	return p.call(ctx, "ConfigSSH")
+}
+
+// CostEstimate is part of the vm.Provider interface. Every VM costs
+// HourlyCost.
+func (p *Provider) CostEstimate(vms vm.List) (float64, error) {
+	if err := p.call(context.Background(), "CostEstimate", vms.Names()...); err != nil {
+		return 0, err
+	}
+	return p.HourlyCost * float64(len(vms)), nil
+}
+
+// Create is part of the vm.Provider interface. The VMs are running and
+// spread over the zones of opts in turn. The nth VM created by the Provider
+// has the private IP 10.0.0.n and the public IP 203.0.113.n, with n wrapping
+// around after 254, so that the addresses are deterministic.
+func (p *Provider) Create(ctx context.Context, names []string, opts vm.CreateOpts) error {
+	if err := p.call(ctx, "Create", names...); err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return errors.New("no VMs to create")
+	}
+	zones := createdZones(opts)
+	machineType := opts.MachineType
+	if machineType == "" {
+		machineType = DefaultMachineType
+	}
+	now := p.Now()
+	labels := vm.StandardLabels(opts.Labels, p.Account, names[0], now)
+	remoteUser := p.Account
+	if opts.SSHUser != "" {
+		labels[vm.SSHUserLabel] = opts.SSHUser
+		remoteUser = opts.SSHUser
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, name := range names {
+		if _, ok := p.vms[name]; ok {
+			return errors.Errorf("VM %s already exists", name)
+		}
+	}
+	for i, name := range names {
+		p.created++
+		host := (p.created-1)%254 + 1
+		p.vms[name] = vm.VM{
+			Name:        name,
+			CreatedAt:   now,
+			Lifetime:    opts.Lifetime,
+			Provider:    ProviderName,
+			ProviderID:  name,
+			PrivateIP:   fmt.Sprintf("10.0.0.%d", host),
+			PublicIP:    fmt.Sprintf("203.0.113.%d", host),
+			RemoteUser:  remoteUser,
+			VPC:         ProviderName,
+			MachineType: machineType,
+			Zone:        zones[i%len(zones)],
+			Labels:      labels,
+			Status:      vm.StatusRunning,
+			Disks:       p.createdDisks(name, opts),
+		}
+	}
+	return nil
+}
+
+// createdDisks returns the disks of a VM created with opts: its boot disk,
+// its local SSDs if Caps.ListsLocalSSDs is set, and its data disks, of which
+// a VM without local SSDs has at least one unless Caps.ListsLocalSSDs is set.
+func (p *Provider) createdDisks(name string, opts vm.CreateOpts) []vm.Disk {
+	disks := []vm.Disk{{Name: name + "-boot", SizeGB: opts.BootDiskSizeGB, Type: opts.BootDiskType, Boot: true}}
+	if opts.UseLocalSSD {
+		if p.Caps.ListsLocalSSDs {
+			for i := 0; i < opts.LocalSSDCount || i == 0; i++ {
+				disks = append(disks, vm.Disk{Name: fmt.Sprintf("%s-ssd-%d", name, i), Local: true})
+			}
+		}
+		return disks
+	}
+	count := opts.DataDiskCount
+	if count == 0 && !p.Caps.ListsLocalSSDs {
+		count = 1
+	}
+	for i := 0; i < count; i++ {
+		disks = append(disks, vm.Disk{
+			Name:   fmt.Sprintf("%s-data-%d", name, i),
+			SizeGB: opts.DataDiskSizeGB,
+			Type:   opts.DataDiskType,
+		})
+	}
+	return disks
+}
+
+// CreateImage is part of the vm.Provider interface. The images are named as
+// described by vm.Provider, but not recorded.
+func (p *Provider) CreateImage(ctx context.Context, vms vm.List, imageName string) ([]string, error) {
+	if err := p.call(ctx, "CreateImage", vms.Names()...); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.checkExistLocked(vms); err != nil {
+		return nil, err
+	}
+	if len(vms) == 1 {
+		return []string{imageName}, nil
+	}
+	ret := make([]string, len(vms))
+	for i, v := range vms {
+		node, err := vm.NodeNumber(v.Name)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = fmt.Sprintf("%s-%d", imageName, node)
+	}
+	return ret, nil
+}
+
+// CreatedZones is part of the vm.Provider interface. The VMs are placed in
+// the zones round-robin.
+func (p *Provider) CreatedZones(ctx context.Context, opts vm.CreateOpts, count int) ([]string, error) {
+	if err := p.call(ctx, "CreatedZones"); err != nil {
+		return nil, err
+	}
+	zones := createdZones(opts)
+	if count < len(zones) {
+		zones = zones[:count]
+	}
+	return vm.UniqueZones(zones), nil
+}
+
+// createdZones returns the zones of opts, without their node counts, or the
+// DefaultZone.
+func createdZones(opts vm.CreateOpts) []string {
+	if len(opts.Zones) == 0 {
+		return []string{DefaultZone}
+	}
+	zones := make([]string, len(opts.Zones))
+	for i, zone := range opts.Zones {
+		zones[i] = strings.SplitN(zone, ":", 2)[0]
+	}
+	return zones
+}
+
+// CreatedMachineTypes is part of the vm.Provider interface.
+func (p *Provider) CreatedMachineTypes(opts vm.CreateOpts) ([]string, error) {
+	if err := p.call(context.Background(), "CreatedMachineTypes"); err != nil {
+		return nil, err
+	}
+	if opts.MachineType != "" {
+		return []string{opts.MachineType}, nil
+	}
+	return []string{DefaultMachineType}, nil
+}
+
+// Delete is part of the vm.Provider interface.
+func (p *Provider) Delete(ctx context.Context, vms vm.List) error {
+	if err := p.call(ctx, "Delete", vms.Names()...); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.checkExistLocked(vms); err != nil {
+		return err
+	}
+	for _, v := range vms {
+		delete(p.vms, v.Name)
+		delete(p.metadata, v.Name)
+	}
+	return nil
+}
+
+// Describe is part of the vm.Provider interface. This implementation
+// returns the stored VM.
+func (p *Provider) Describe(ctx context.Context, v vm.VM) (map[string]interface{}, error) {
+	if err := p.call(ctx, "Describe", v.Name); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	stored, ok := p.vms[v.Name]
+	p.mu.Unlock()
+	if !ok {
+		return nil, errors.Errorf("VM %s does not exist", v.Name)
+	}
+	bytes, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	var ret map[string]interface{}
+	if err := json.Unmarshal(bytes, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Extend is part of the vm.Provider interface.
+func (p *Provider) Extend(ctx context.Context, vms vm.List, lifetime time.Duration) error {
+	if err := p.call(ctx, "Extend", vms.Names()...); err != nil {
+		return err
+	}
+	return p.update(vms, func(v *vm.VM) { v.Lifetime = lifetime })
+}
+
+// FindActiveAccount is part of the vm.Provider interface.
+func (p *Provider) FindActiveAccount(ctx context.Context) (string, error) {
+	if err := p.call(ctx, "FindActiveAccount"); err != nil {
+		return "", err
+	}
+	return p.Account, nil
+}
+
+// Flags is part of the vm.Provider interface. The Provider has no flags.
+func (p *Provider) Flags() vm.ProviderFlags {
+	return &emptyFlags{}
+}
+
+// GetMetadata is part of the vm.Provider interface.
+func (p *Provider) GetMetadata(ctx context.Context, v vm.VM) (map[string]string, error) {
+	if err := p.call(ctx, "GetMetadata", v.Name); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.vms[v.Name]; !ok {
+		return nil, errors.Errorf("VM %s does not exist", v.Name)
+	}
+	ret := make(map[string]string, len(p.metadata[v.Name]))
+	for k, value := range p.metadata[v.Name] {
+		ret[k] = value
+	}
+	return ret, nil
+}
+
+// List is part of the vm.Provider interface. The VMs are sorted by name.
+func (p *Provider) List(ctx context.Context, filter vm.LabelFilter) (vm.List, error) {
+	if err := p.call(ctx, "List"); err != nil {
+		return nil, err
+	}
+	var ret vm.List
+	for _, v := range p.VMs() {
+		if filter.Matches(v.Labels) {
+			ret = append(ret, v)
+		}
+	}
+	return ret, nil
+}
+
+// ListScope is part of the vm.Provider interface. The VMs are kept in memory
+// and never cached.
+func (p *Provider) ListScope() string {
+	return ""
+}
+
+// MachineTypeAvailable is part of the vm.Provider interface. Every machine
+// type is available in the zones of Zones.
+func (p *Provider) MachineTypeAvailable(ctx context.Context, zone, machineType string) (bool, error) {
+	if err := p.call(ctx, "MachineTypeAvailable"); err != nil {
+		return false, err
+	}
+	_, ok := p.Zones[zone]
+	return ok, nil
+}
+
+// Name is part of the vm.Provider interface.
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// Reboot is part of the vm.Provider interface. The VMs are left unchanged.
+func (p *Provider) Reboot(ctx context.Context, vms vm.List) error {
+	if err := p.call(ctx, "Reboot", vms.Names()...); err != nil {
+		return err
+	}
+	return p.update(vms, func(*vm.VM) {})
+}
+
+// Resize is part of the vm.Provider interface.
+func (p *Provider) Resize(ctx context.Context, vms vm.List, machineType string) error {
+	if err := p.call(ctx, "Resize", vms.Names()...); err != nil {
+		return err
+	}
+	return p.update(vms, func(v *vm.VM) { v.MachineType = machineType })
+}
+
+// SSHAccess is part of the vm.Provider interface. This implementation
+// returns the zero SSHAccess.
+func (p *Provider) SSHAccess() vm.SSHAccess {
+	return vm.SSHAccess{}
+}
+
+// SetMetadata is part of the vm.Provider interface.
+func (p *Provider) SetMetadata(ctx context.Context, v vm.VM, kv map[string]string) error {
+	if err := p.call(ctx, "SetMetadata", v.Name); err != nil {
+		return err
+	}
+	if err := vm.CheckMetadata(kv, maxMetadataValueLen); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.vms[v.Name]; !ok {
+		return errors.Errorf("VM %s does not exist", v.Name)
+	}
+	if p.metadata[v.Name] == nil {
+		p.metadata[v.Name] = make(map[string]string)
+	}
+	for k, value := range kv {
+		if value == "" {
+			delete(p.metadata[v.Name], k)
+		} else {
+			p.metadata[v.Name][k] = value
+		}
+	}
+	return nil
+}
+
+// Start is part of the vm.Provider interface.
+func (p *Provider) Start(ctx context.Context, vms vm.List) error {
+	if err := p.call(ctx, "Start", vms.Names()...); err != nil {
+		return err
+	}
+	return p.update(vms, func(v *vm.VM) { v.Status = vm.StatusRunning })
+}
+
+// Stop is part of the vm.Provider interface.
+func (p *Provider) Stop(ctx context.Context, vms vm.List) error {
+	if err := p.call(ctx, "Stop", vms.Names()...); err != nil {
+		return err
+	}
+	return p.update(vms, func(v *vm.VM) { v.Status = vm.StatusStopped })
+}
+
+// ZoneCatalog is part of the vm.Provider interface.
+func (p *Provider) ZoneCatalog(ctx context.Context) (vm.ZoneCatalog, error) {
+	if err := p.call(ctx, "ZoneCatalog"); err != nil {
+		return nil, err
+	}
+	return p.Zones, nil
+}
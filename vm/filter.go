@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A LabelClause matches VMs whose label Key has the given Value or, if Negate
+// is set, VMs which do not.
+type LabelClause struct {
+	Key    string
+	Value  string
+	Negate bool
+}
+
+// A LabelFilter matches VMs which match all of its clauses. An empty filter
+// matches all VMs.
+type LabelFilter []LabelClause
+
+// ParseLabelFilter parses a comma-separated list of `key=value` clauses, each
+// of which may be negated with a leading `!`.
+func ParseLabelFilter(s string) (LabelFilter, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ret LabelFilter
+	for _, clause := range strings.Split(s, ",") {
+		var c LabelClause
+		if strings.HasPrefix(clause, "!") {
+			c.Negate = true
+			clause = clause[1:]
+		}
+		parts := strings.SplitN(clause, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid filter clause %q, expected [!]key=value", clause)
+		}
+		c.Key, c.Value = parts[0], parts[1]
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+// Matches returns true if the labels satisfy every clause of the filter.
+func (f LabelFilter) Matches(labels map[string]string) bool {
+	for _, c := range f {
+		v, ok := labels[c.Key]
+		if (ok && v == c.Value) == c.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply returns the VMs whose labels match the filter.
+func (f LabelFilter) Apply(vms List) List {
+	if len(f) == 0 {
+		return vms
+	}
+	var ret List
+	for _, v := range vms {
+		if f.Matches(v.Labels) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
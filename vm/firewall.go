@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultIngressPorts are the ports which are opened by DefaultIngressRules:
+// ssh, and the SQL and HTTP ports of cockroach.
+var DefaultIngressPorts = []int{22, 26257, 8080}
+
+// FirewallLabel is attached to the VMs created with CreateOpts.Firewall.
+const FirewallLabel = "roachprod-firewall"
+
+// FirewallName returns the name of the firewall of a cluster, which the
+// providers give to the firewall rules or security group which they create
+// for it.
+func FirewallName(cluster string) string {
+	return cluster + "-fw"
+}
+
+// An IngressRule admits TCP connections from the CIDR to the ports FromPort
+// through ToPort.
+type IngressRule struct {
+	FromPort int    `json:"from_port"`
+	ToPort   int    `json:"to_port"`
+	CIDR     string `json:"cidr"`
+}
+
+// String returns the rule in the form accepted by ParseIngressRule.
+func (r IngressRule) String() string {
+	return r.Ports() + "@" + r.CIDR
+}
+
+// Ports returns the port range of the rule, e.g. 26257 or 8080-8090.
+func (r IngressRule) Ports() string {
+	if r.FromPort == r.ToPort {
+		return strconv.Itoa(r.FromPort)
+	}
+	return fmt.Sprintf("%d-%d", r.FromPort, r.ToPort)
+}
+
+// ParseIngressRule parses a rule of the form <port>[-<port>]@<cidr>, e.g.
+// 26257@203.0.113.0/24 or 8080-8090@10.0.0.0/8.
+func ParseIngressRule(s string) (IngressRule, error) {
+	i := strings.LastIndex(s, "@")
+	if i == -1 {
+		return IngressRule{}, errors.Errorf("invalid ingress rule %q: expected <port>[-<port>]@<cidr>", s)
+	}
+	ports, cidr := s[:i], s[i+1:]
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		return IngressRule{}, errors.Errorf("invalid ingress rule %q: %s", s, err)
+	}
+	from, to := ports, ports
+	if j := strings.Index(ports, "-"); j != -1 {
+		from, to = ports[:j], ports[j+1:]
+	}
+	r := IngressRule{CIDR: cidr}
+	var err error
+	if r.FromPort, err = strconv.Atoi(from); err == nil {
+		r.ToPort, err = strconv.Atoi(to)
+	}
+	if err != nil || r.FromPort < 1 || r.ToPort > 65535 || r.FromPort > r.ToPort {
+		return IngressRule{}, errors.Errorf("invalid ingress rule %q: invalid port range %s", s, ports)
+	}
+	return r, nil
+}
+
+// DefaultIngressRules returns the rules which admit connections to the
+// DefaultIngressPorts from each of the CIDRs.
+func DefaultIngressRules(cidrs []string) ([]IngressRule, error) {
+	var ret []IngressRule
+	for _, cidr := range cidrs {
+		for _, port := range DefaultIngressPorts {
+			r, err := ParseIngressRule(fmt.Sprintf("%d@%s", port, cidr))
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,202 @@
+package gce
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// jsonAddress is a static external address, as reported by gcloud compute
+// addresses list.
+type jsonAddress struct {
+	Name    string
+	Address string
+	// Region is the URL of the region.
+	Region string
+	// RESERVED, or IN_USE while it is attached to an instance.
+	Status string
+	// The URLs of the instances using the address.
+	Users []string
+	// PREMIUM or STANDARD.
+	NetworkTier string
+}
+
+// addressQuotaRE matches the errors of exhausted static address quotas, which
+// are per region.
+var addressQuotaRE = regexp.MustCompile(`QUOTA_EXCEEDED|Quota '[A-Z_]*ADDRESSES' exceeded`)
+
+// zoneRegion returns the region of a zone, e.g. us-east1 for us-east1-b.
+func zoneRegion(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// listAddresses returns the static IPs of the named VMs which exist, keyed by
+// the name of the VM.
+func (p *Provider) listAddresses(ctx context.Context, names []string) (map[string]jsonAddress, error) {
+	byAddress := make(map[string]string, len(names))
+	patterns := make([]string, len(names))
+	for i, name := range names {
+		byAddress[vm.StaticIPName(name)] = name
+		patterns[i] = regexp.QuoteMeta(vm.StaticIPName(name))
+	}
+	args := []string{"compute", "addresses", "list", "--project", p.opts.Project,
+		"--filter", fmt.Sprintf("name ~ ^(%s)$", strings.Join(patterns, "|")), "--format", "json"}
+	var addresses []jsonAddress
+	if err := runJSONCommand(ctx, args, &addresses); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]jsonAddress, len(addresses))
+	for _, a := range addresses {
+		if name, ok := byAddress[a.Name]; ok {
+			ret[name] = a
+		}
+	}
+	return ret, nil
+}
+
+// reserveAddresses ensures that a static IP exists for each VM in zones, which
+// maps the names of the VMs to their zones. The addresses left by previous VMs
+// of the same names are reused, provided that they are in the right region,
+// unused and of the network tier, if any, which is otherwise the default one
+// of the project. The names of the VMs whose addresses were reserved are returned,
+// keyed by region. If any of the addresses cannot be reserved, e.g. because
+// the quota of a region is exhausted, those reserved here are released.
+func (p *Provider) reserveAddresses(
+	ctx context.Context, zones map[string]string, networkTier string,
+) (map[string][]string, error) {
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	existing, err := p.listAddresses(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make(map[string][]string)
+	for _, name := range names {
+		region := zoneRegion(zones[name])
+		a, ok := existing[name]
+		addressRegion := a.Region[strings.LastIndex(a.Region, "/")+1:]
+		switch {
+		case !ok:
+			missing[region] = append(missing[region], name)
+		case addressRegion != region:
+			return nil, errors.Errorf("static IP %s is reserved in region %s, but %s is in zone %s",
+				a.Name, addressRegion, name, zones[name])
+		case a.Status == "IN_USE":
+			return nil, errors.Errorf("static IP %s (%s) is in use by %s",
+				a.Name, a.Address, strings.Join(a.Users, ", "))
+		case networkTier != "" && a.NetworkTier != networkTier:
+			return nil, errors.Errorf("static IP %s (%s) is of network tier %s, not %s",
+				a.Name, a.Address, a.NetworkTier, networkTier)
+		}
+	}
+
+	regions := make([]string, 0, len(missing))
+	for region := range missing {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	createArgs := func(region string) []string {
+		args := []string{"compute", "addresses", "create",
+			"--project", p.opts.Project, "--region", region}
+		if networkTier != "" {
+			args = append(args, "--network-tier", networkTier)
+		}
+		for _, name := range missing[region] {
+			args = append(args, vm.StaticIPName(name))
+		}
+		return args
+	}
+	if config.DryRun {
+		for _, region := range regions {
+			vm.PrintDryRun("gcloud", createArgs(region))
+		}
+		return missing, nil
+	}
+
+	var mu sync.Mutex
+	reserved := make(map[string][]string)
+	err = vm.ForEach(len(regions), func(i int) error {
+		region := regions[i]
+		if err := runCommand(ctx, createArgs(region)); err != nil {
+			if addressQuotaRE.MatchString(err.Error()) {
+				return errors.Errorf("the static IP quota of region %s does not allow %d more addresses; "+
+					"release unused addresses or create the cluster without --static-ip: %s",
+					region, len(missing[region]), err)
+			}
+			return errors.Wrapf(err, "could not reserve static IPs in region %s", region)
+		}
+		mu.Lock()
+		reserved[region] = missing[region]
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		// A failed command may still have reserved some of its addresses, so
+		// all of those which were missing are released.
+		if releaseErr := p.releaseAddresses(ctx, missing); releaseErr != nil {
+			vm.Warningf("unable to release the static IPs reserved for %v: %s", names, releaseErr)
+		}
+		return nil, err
+	}
+	return reserved, nil
+}
+
+// releaseAddresses deletes the static IPs of the VMs whose names are keyed by
+// region. Addresses which do not exist are ignored.
+func (p *Provider) releaseAddresses(ctx context.Context, byRegion map[string][]string) error {
+	var names []string
+	for _, regionNames := range byRegion {
+		names = append(names, regionNames...)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	var existing map[string]jsonAddress
+	if !config.DryRun {
+		var err error
+		if existing, err = p.listAddresses(ctx, names); err != nil {
+			return err
+		}
+	}
+
+	regions := make([]string, 0, len(byRegion))
+	deleteArgs := make(map[string][]string)
+	for region, regionNames := range byRegion {
+		args := []string{"compute", "addresses", "delete", "--quiet",
+			"--project", p.opts.Project, "--region", region}
+		n := len(args)
+		for _, name := range regionNames {
+			if _, ok := existing[name]; ok || config.DryRun {
+				args = append(args, vm.StaticIPName(name))
+			}
+		}
+		if len(args) > n {
+			regions = append(regions, region)
+			deleteArgs[region] = args
+		}
+	}
+	sort.Strings(regions)
+	if config.DryRun {
+		for _, region := range regions {
+			vm.PrintDryRun("gcloud", deleteArgs[region])
+		}
+		return nil
+	}
+	return vm.ForEach(len(regions), func(i int) error {
+		return runCommand(ctx, deleteArgs[regions[i]])
+	})
+}
@@ -0,0 +1,61 @@
+package gce
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// instanceArgs returns the gcloud flags which only apply to the named
+// instance: its static IP and its existing disk, if any.
+func instanceArgs(name string, opts vm.CreateOpts) []string {
+	var args []string
+	if opts.StaticIP {
+		args = append(args, "--address", vm.StaticIPName(name))
+	}
+	if disk := opts.ExistingDisk(name); disk != "" {
+		autoDelete := "yes"
+		if opts.KeepExistingDisks {
+			autoDelete = "no"
+		}
+		args = append(args, "--disk", fmt.Sprintf("name=%s,device-name=%s,mode=rw,boot=no,auto-delete=%s",
+			disk, existingDiskDeviceName, autoDelete))
+	}
+	return args
+}
+
+// checkExistingDisks returns an error if any of the existing disks of the
+// instances, whose zones are keyed by name, is not in the zone of its
+// instance or is attached to another instance.
+func (p *Provider) checkExistingDisks(ctx context.Context, nameZones map[string]string, opts vm.CreateOpts) error {
+	var names []string
+	for name := range nameZones {
+		if opts.ExistingDisk(name) != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return vm.ForEach(len(names), func(i int) error {
+		disk, zone := opts.ExistingDisk(names[i]), nameZones[names[i]]
+		args := []string{"compute", "disks", "describe", disk,
+			"--project", p.opts.Project, "--zone", zone, "--format", "json"}
+		var parsed struct {
+			Users []string
+		}
+		if err := runJSONCommand(ctx, args, &parsed); err != nil {
+			return errors.Wrapf(err, "disk %s of %s is not in zone %s", disk, names[i], zone)
+		}
+		if len(parsed.Users) > 0 {
+			users := make([]string, len(parsed.Users))
+			for j, u := range parsed.Users {
+				users[j] = u[strings.LastIndex(u, "/")+1:]
+			}
+			return errors.Errorf("disk %s of %s is attached to %s", disk, names[i], strings.Join(users, ", "))
+		}
+		return nil
+	})
+}
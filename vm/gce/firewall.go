@@ -0,0 +1,149 @@
+package gce
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// The priorities of the firewall rules of a cluster. Rules with lower
+// numbers take precedence, so the rules of the cluster are evaluated before
+// those of the network, which have the default priority of 1000: connections
+// which the cluster's allow rules do not admit are denied.
+const (
+	firewallAllowPriority = "800"
+	firewallDenyPriority  = "900"
+)
+
+// firewallRuleArgs returns the commands which create the firewall rules of a
+// cluster, which apply to the instances with the network tag named after the
+// firewall. The instances of the cluster may connect to each other, and
+// otherwise only the ingress rules are allowed.
+func (p *Provider) firewallRuleArgs(cluster string, ingress []vm.IngressRule) [][]string {
+	name := vm.FirewallName(cluster)
+	create := func(rule string, args ...string) []string {
+		return append([]string{"compute", "firewall-rules", "create", rule,
+			"--project", p.opts.Project, "--network", "default", "--direction", "INGRESS",
+			"--target-tags", name}, args...)
+	}
+	ret := [][]string{
+		create(name+"-internal", "--action", "allow", "--rules", "all",
+			"--source-tags", name, "--priority", firewallAllowPriority),
+	}
+	for i, r := range ingress {
+		ret = append(ret, create(fmt.Sprintf("%s-ingress-%d", name, i+1),
+			"--action", "allow", "--rules", "tcp:"+r.Ports(),
+			"--source-ranges", r.CIDR, "--priority", firewallAllowPriority))
+	}
+	return append(ret, create(name+"-deny", "--action", "deny", "--rules", "all",
+		"--source-ranges", "0.0.0.0/0", "--priority", firewallDenyPriority))
+}
+
+// listFirewallRules returns the names of the firewall rules of a cluster.
+func (p *Provider) listFirewallRules(ctx context.Context, cluster string) ([]string, error) {
+	args := []string{"compute", "firewall-rules", "list", "--project", p.opts.Project,
+		"--filter", fmt.Sprintf("name ~ ^%s-", regexp.QuoteMeta(vm.FirewallName(cluster))),
+		"--format", "json"}
+	var rules []struct {
+		Name string
+	}
+	if err := runJSONCommand(ctx, args, &rules); err != nil {
+		return nil, err
+	}
+	ret := make([]string, len(rules))
+	for i, r := range rules {
+		ret[i] = r.Name
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// ensureFirewall creates the firewall rules of a cluster with the ingress
+// rules, unless the cluster already has a firewall, which is left as it is.
+func (p *Provider) ensureFirewall(ctx context.Context, cluster string, ingress []vm.IngressRule) error {
+	existing, err := p.listFirewallRules(ctx, cluster)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+	if len(ingress) == 0 {
+		return errors.Errorf("cluster %s has no firewall, and no ingress rules were given to create one", cluster)
+	}
+	commands := p.firewallRuleArgs(cluster, ingress)
+	if config.DryRun {
+		for _, args := range commands {
+			vm.PrintDryRun("gcloud", args)
+		}
+		return nil
+	}
+	err = vm.ForEach(len(commands), func(i int) error {
+		return runCommand(ctx, commands[i])
+	})
+	if err != nil {
+		// Rules which allow connections without the rule which denies the
+		// others would be pointless, so none are kept.
+		if deleteErr := p.deleteFirewall(ctx, cluster); deleteErr != nil {
+			vm.Warningf("unable to delete the firewall rules of %s: %s", cluster, deleteErr)
+		}
+		return errors.Wrapf(err, "could not create the firewall of cluster %s", cluster)
+	}
+	return nil
+}
+
+// deleteFirewall deletes the firewall rules of a cluster, if it has any.
+func (p *Provider) deleteFirewall(ctx context.Context, cluster string) error {
+	rules, err := p.listFirewallRules(ctx, cluster)
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	args := append([]string{"compute", "firewall-rules", "delete", "--quiet",
+		"--project", p.opts.Project}, rules...)
+	if config.DryRun {
+		vm.PrintDryRun("gcloud", args)
+		return nil
+	}
+	return runCommand(ctx, args)
+}
+
+// deleteUnusedFirewalls deletes the firewall rules of the clusters which
+// have no instances besides those named by deleted, which maps the names of
+// the clusters to the instances being deleted.
+func (p *Provider) deleteUnusedFirewalls(ctx context.Context, deleted map[string][]string) error {
+	clusters := make([]string, 0, len(deleted))
+	for cluster := range deleted {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	for _, cluster := range clusters {
+		gone := make(map[string]bool, len(deleted[cluster]))
+		for _, name := range deleted[cluster] {
+			gone[name] = true
+		}
+		args := []string{"compute", "instances", "list", "--project", p.opts.Project,
+			"--filter", "tags.items=" + vm.FirewallName(cluster), "--format", "json"}
+		var instances []struct {
+			Name string
+		}
+		if err := runJSONCommand(ctx, args, &instances); err != nil {
+			return err
+		}
+		inUse := false
+		for _, in := range instances {
+			inUse = inUse || !gone[in.Name]
+		}
+		if inUse {
+			continue
+		}
+		if err := p.deleteFirewall(ctx, cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,14 +2,18 @@ package gce
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"math"
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/roachprod/config"
@@ -22,31 +26,105 @@ import (
 const (
 	defaultProject = "cockroach-ephemeral"
 	ProviderName   = "gce"
+
+	// GCE unconditionally stops preemptible instances after 24 hours.
+	maxPreemptibleLifetime = 24 * time.Hour
+
+	defaultBootDiskSizeGB = 10
+	defaultBootDiskType   = "pd-ssd"
+
+	defaultDataDiskSizeGB = 500
+	defaultDataDiskType   = "pd-ssd"
+
+	// The data disks are attached as /dev/disk/by-id/google-<device name>,
+	// where gceLocalSSDStartupScript finds them.
+	dataDiskDevicePrefix = "roachprod-data-"
+	// The existing disk of vm.CreateOpts.ExistingDisks is attached as
+	// /dev/disk/by-id/google-<device name>.
+	existingDiskDeviceName = "roachprod-existing"
+
+	// The key which gcloud generates and uses by default.
+	defaultSSHKeyPath = "${HOME}/.ssh/google_compute_engine"
 )
 
-// init will inject the GCE provider into vm.Providers, but only if the gcloud tool is available on the local path.
+// validLocalSSDCounts are the numbers of local SSDs which may be attached to
+// an instance. Not every machine type supports every count.
+// See https://cloud.google.com/compute/docs/disks/local-ssd
+var validLocalSSDCounts = map[int]bool{
+	1: true, 2: true, 3: true, 4: true, 5: true, 6: true, 7: true, 8: true, 16: true, 24: true,
+}
+
+// init will register the GCE provider with vm.MustRegister, but only if the gcloud tool is available on the local path.
 func init() {
 	if _, err := exec.LookPath("gcloud"); err == nil {
-		vm.Providers[ProviderName] = &Provider{}
+		vm.MustRegister(ProviderName, &Provider{})
 	} else {
-		log.Printf("please install the gcloud CLI utilities (https://cloud.google.com/sdk/downloads)")
+		vm.Warningf("please install the gcloud CLI utilities (https://cloud.google.com/sdk/downloads)")
 	}
 }
 
-func runJSONCommand(args []string, parsed interface{}) error {
-	cmd := exec.Command("gcloud", args...)
+// rateLimiter paces all of the gcloud commands issued by the provider.
+var rateLimiter = vm.RateLimiter{Provider: ProviderName}
 
-	rawJSON, err := cmd.Output()
-	if err != nil {
-		var stderr []byte
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			stderr = exitErr.Stderr
+// computeEndpoint, set by --gce-compute-endpoint, overrides the public
+// endpoint of the Compute Engine API, e.g. with a Private Service Connect
+// endpoint or an emulator.
+var computeEndpoint string
+
+// gcloudCommand returns the gcloud command with the args, which is pointed at
+// the computeEndpoint, if any.
+func gcloudCommand(ctx context.Context, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "gcloud", args...)
+	if computeEndpoint != "" {
+		cmd.Env = append(os.Environ(), "CLOUDSDK_API_ENDPOINT_OVERRIDES_COMPUTE="+computeEndpoint)
+	}
+	return cmd
+}
+
+// gcloudOutput runs a gcloud command and returns its standard output, or its
+// combined output if combined is set. Tests replace it to stub out the CLI.
+var gcloudOutput = func(ctx context.Context, args []string, combined bool) ([]byte, error) {
+	cmd := gcloudCommand(ctx, args)
+	if combined {
+		return cmd.CombinedOutput()
+	}
+	return cmd.Output()
+}
+
+// runCommand invokes a gcloud command for which no output is expected,
+// retrying transient errors.
+func runCommand(ctx context.Context, args []string) error {
+	return vm.Retry(ctx, &rateLimiter, retryClassifier(args), func() error {
+		output, err := gcloudOutput(ctx, args, true)
+		if err != nil {
+			return errors.Wrapf(err, "Command: gcloud %s\nOutput: %s", args, output)
 		}
-		// TODO(peter): Remove this hack once gcloud is behaving again.
-		if matched, _ := regexp.Match(`europe-north.*Unknown zone`, stderr); !matched {
-			return errors.Errorf("failed to run: gcloud %s: %s\nstdout: %s\nstderr: %s",
-				strings.Join(args, " "), err, bytes.TrimSpace(rawJSON), bytes.TrimSpace(stderr))
+		return nil
+	})
+}
+
+// runJSONCommand invokes a gcloud command and parses the json output,
+// retrying transient errors.
+func runJSONCommand(ctx context.Context, args []string, parsed interface{}) error {
+	var rawJSON []byte
+	err := vm.Retry(ctx, &rateLimiter, retryClassifier(args), func() error {
+		var err error
+		rawJSON, err = gcloudOutput(ctx, args, false)
+		if err != nil {
+			var stderr []byte
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				stderr = exitErr.Stderr
+			}
+			// TODO(peter): Remove this hack once gcloud is behaving again.
+			if matched, _ := regexp.Match(`europe-north.*Unknown zone`, stderr); !matched {
+				return errors.Errorf("failed to run: gcloud %s: %s\nstdout: %s\nstderr: %s",
+					strings.Join(args, " "), err, bytes.TrimSpace(rawJSON), bytes.TrimSpace(stderr))
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	if err := json.Unmarshal(rawJSON, &parsed); err != nil {
@@ -62,15 +140,50 @@ type jsonVM struct {
 	Labels            map[string]string
 	CreationTimestamp time.Time
 	NetworkInterfaces []struct {
+		Name          string
 		Network       string
+		Subnetwork    string
 		NetworkIP     string
 		AccessConfigs []struct {
-			Name  string
-			NatIP string
+			Name        string
+			NatIP       string
+			NetworkTier string
+		}
+		// Set for dual-stack subnets only.
+		Ipv6Address       string
+		Ipv6AccessConfigs []struct {
+			ExternalIpv6 string
 		}
 	}
 	MachineType string
-	Zone        string
+	Scheduling  struct {
+		Preemptible bool
+		// OnHostMaintenance is MIGRATE or TERMINATE, and AutomaticRestart
+		// is unset if it has its default of true.
+		OnHostMaintenance string
+		AutomaticRestart  *bool
+	}
+	Status string
+	Zone   string
+	Disks  []struct {
+		Boot       bool
+		DeviceName string
+		DiskSizeGb string
+		Source     string
+		// PERSISTENT or SCRATCH (local SSD).
+		Type string
+	}
+	// LastStartTimestamp is unset until the instance has first started.
+	LastStartTimestamp time.Time
+}
+
+// toScheduling returns the scheduling of the instance.
+func (jsonVM *jsonVM) toScheduling() *vm.Scheduling {
+	s := jsonVM.Scheduling
+	return &vm.Scheduling{
+		MaintenancePolicy: s.OnHostMaintenance,
+		AutoRestart:       s.AutomaticRestart == nil || *s.AutomaticRestart,
+	}
 }
 
 // Convert the JSON VM data into our common VM type
@@ -82,7 +195,7 @@ func (jsonVM *jsonVM) toVM(project string) *vm.VM {
 	var lifetime time.Duration
 	if lifetimeStr, ok := jsonVM.Labels["lifetime"]; ok {
 		if lifetime, err = time.ParseDuration(lifetimeStr); err != nil {
-			vmErrors = append(vmErrors, vm.ErrNoExpiration)
+			vmErrors = append(vmErrors, vm.ErrNoExpiration.Wrap(err))
 		}
 	} else {
 		vmErrors = append(vmErrors, vm.ErrNoExpiration)
@@ -99,22 +212,58 @@ func (jsonVM *jsonVM) toVM(project string) *vm.VM {
 	}
 
 	// Extract network information
-	var publicIP, privateIP, vpc string
+	var publicIP, privateIP, publicIPv6, privateIPv6, vpc, networkTier string
 	if len(jsonVM.NetworkInterfaces) == 0 {
 		vmErrors = append(vmErrors, vm.ErrBadNetwork)
 	} else {
 		privateIP = jsonVM.NetworkInterfaces[0].NetworkIP
-		if len(jsonVM.NetworkInterfaces[0].AccessConfigs) == 0 {
+		privateIPv6 = jsonVM.NetworkInterfaces[0].Ipv6Address
+		if configs := jsonVM.NetworkInterfaces[0].Ipv6AccessConfigs; len(configs) > 0 {
+			publicIPv6 = configs[0].ExternalIpv6
+		}
+		// Instances created without a public IP have no access config.
+		if configs := jsonVM.NetworkInterfaces[0].AccessConfigs; len(configs) > 0 {
+			publicIP = configs[0].NatIP
+			networkTier = configs[0].NetworkTier
+		} else if privateIP == "" {
 			vmErrors = append(vmErrors, vm.ErrBadNetwork)
-		} else {
-			publicIP = jsonVM.NetworkInterfaces[0].AccessConfigs[0].NatIP
-			vpc = lastComponent(jsonVM.NetworkInterfaces[0].Network)
 		}
+		vpc = lastComponent(jsonVM.NetworkInterfaces[0].Network)
+	}
+
+	var staticIP string
+	if jsonVM.Labels[vm.StaticIPLabel] != "" {
+		staticIP = publicIP
 	}
 
 	machineType := lastComponent(jsonVM.MachineType)
+	if machineType == "" {
+		vmErrors = append(vmErrors, vm.ErrNoMachineType)
+	}
 	zone := lastComponent(jsonVM.Zone)
 
+	// The type of a persistent disk is only reported by the disk itself.
+	var disks []vm.Disk
+	for _, d := range jsonVM.Disks {
+		disk := vm.Disk{
+			Name:   lastComponent(d.Source),
+			Device: d.DeviceName,
+			Boot:   d.Boot,
+			Local:  d.Type == "SCRATCH",
+		}
+		if disk.Local {
+			disk.Name = d.DeviceName
+			disk.Type = "local-ssd"
+		}
+		disk.SizeGB, _ = strconv.Atoi(d.DiskSizeGb)
+		disks = append(disks, disk)
+	}
+
+	remoteUser := config.OSUser.Username
+	if user := jsonVM.Labels[vm.SSHUserLabel]; user != "" {
+		remoteUser = user
+	}
+
 	return &vm.VM{
 		Name:       jsonVM.Name,
 		CreatedAt:  jsonVM.CreationTimestamp,
@@ -125,12 +274,41 @@ func (jsonVM *jsonVM) toVM(project string) *vm.VM {
 		Provider:   ProviderName,
 		ProviderID: jsonVM.Name,
 		PublicIP:   publicIP,
+		StaticIP:   staticIP,
 		// N.B. gcloud uses the local username to log into instances rather
-		// than the username on the authenticated Google account.
-		RemoteUser:  config.OSUser.Username,
+		// than the username on the authenticated Google account, unless the
+		// instances were created with --ssh-user.
+		RemoteUser:  remoteUser,
 		VPC:         vpc,
 		MachineType: machineType,
 		Zone:        zone,
+		NetworkTier: networkTier,
+		Status:      toStatus(jsonVM.Status),
+		Preemptible: jsonVM.Scheduling.Preemptible,
+		Scheduling:  jsonVM.toScheduling(),
+		Labels:      jsonVM.Labels,
+		PrivateIPv6: privateIPv6,
+		PublicIPv6:  publicIPv6,
+		OSImage:     jsonVM.Labels[osImageLabel],
+		Disks:       disks,
+
+		NetworkInterfaces: jsonVM.toNetworkInterfaces(),
+	}
+}
+
+// toStatus converts a GCE instance status into a vm.Status. Note that GCE
+// reports stopped instances as TERMINATED.
+// See https://cloud.google.com/compute/docs/instances/instance-life-cycle
+func toStatus(status string) vm.Status {
+	switch status {
+	case "PROVISIONING", "STAGING":
+		return vm.StatusPending
+	case "RUNNING":
+		return vm.StatusRunning
+	case "STOPPING", "STOPPED", "SUSPENDING", "SUSPENDED", "TERMINATED":
+		return vm.StatusStopped
+	default:
+		return vm.StatusUnknown
 	}
 }
 
@@ -141,24 +319,62 @@ type jsonAuth struct {
 
 // User-configurable, provider-specific options
 type providerOpts struct {
-	Project        string
+	Project string
+	// ServiceAccount is set by --gce-service-account, which defaults to the
+	// GCE_SERVICE_ACCOUNT environment variable.
 	ServiceAccount string
 	MachineType    string
-	Zones          []string
+	// MachineTypeFallbacks are used, in order, in zones which do not offer
+	// MachineType.
+	MachineTypeFallbacks []string
+	OSImage              string
+	OSImageProject       string
+	SSHKey               string
+	Bastion              string
+	// NICSubnets are the subnets of the network interfaces beyond the
+	// first, which must each be in a VPC network of its own.
+	NICSubnets []string
+	// Shielded creates Shielded VMs, with secure boot, a virtual TPM and
+	// integrity monitoring enabled.
+	Shielded bool
+	// Template is an instance template which determines all of the
+	// properties of the instances but their names, zones and labels.
+	Template string
+	Zones    []string
+	// DiscardLocalSSD lets Stop discard the contents of the local SSDs of
+	// the instances, which are otherwise preserved.
+	DiscardLocalSSD bool
 }
 
 func (o *providerOpts) ConfigureCreateFlags(flags *pflag.FlagSet) {
-	flags.StringVar(&o.MachineType, "machine-type", "n1-standard-4", "DEPRECATED")
+	machineType := vm.EnvDefault("ROACHPROD_GCE_MACHINE_TYPE", "n1-standard-4")
+	zones := vm.EnvDefaultZones("ROACHPROD_GCE_ZONE", []string{"us-east1-b", "us-west1-b", "europe-west2-b"})
+
+	flags.StringVar(&o.MachineType, "machine-type", machineType, "DEPRECATED")
 	flags.MarkDeprecated("machine-type", "use "+ProviderName+"-machine-type instead")
-	flags.StringSliceVar(&o.Zones, "zones", []string{"us-east1-b", "us-west1-b", "europe-west2-b"}, "DEPRECATED")
+	flags.StringSliceVar(&o.Zones, "zones", zones, "DEPRECATED")
 	flags.MarkDeprecated("zones", "use "+ProviderName+"-zones instead")
 
 	flags.StringVar(&o.ServiceAccount, ProviderName+"-service-account",
-		os.Getenv("GCE_SERVICE_ACCOUNT"), "Service account to use")
-	flags.StringVar(&o.MachineType, ProviderName+"-machine-type", "n1-standard-4",
+		os.Getenv("GCE_SERVICE_ACCOUNT"),
+		"Service account to attach to the VMs, giving them access to the cloud APIs allowed by its roles "+
+			"(defaults to $GCE_SERVICE_ACCOUNT)")
+	flags.StringVar(&o.MachineType, ProviderName+"-machine-type", machineType,
 		"Machine type (see https://cloud.google.com/compute/docs/machine-types)")
-	flags.StringSliceVar(&o.Zones, ProviderName+"-zones",
-		[]string{"us-east1-b", "us-west1-b", "europe-west2-b"}, "Zones for cluster")
+	flags.StringSliceVar(&o.MachineTypeFallbacks, ProviderName+"-machine-type-fallbacks", nil,
+		"Machine types to use, in order, in zones which do not offer --"+ProviderName+"-machine-type")
+	flags.StringSliceVar(&o.Zones, ProviderName+"-zones", zones,
+		"Zones for cluster, optionally with a node count per zone (e.g. us-east1-b:3,us-west1-b:2)")
+	flags.StringVar(&o.OSImage, ProviderName+"-os-image", "ubuntu-1604-xenial-v20181030",
+		"Image to boot the VMs from, or family/<name> for the latest image of an image family")
+	flags.StringVar(&o.OSImageProject, ProviderName+"-os-image-project", "ubuntu-os-cloud",
+		"Project containing --"+ProviderName+"-os-image")
+	flags.StringSliceVar(&o.NICSubnets, ProviderName+"-nic-subnets", nil,
+		"Subnets of the network interfaces beyond the first of --nics, each in another VPC network than default")
+	flags.BoolVar(&o.Shielded, ProviderName+"-shielded", false,
+		"Create Shielded VMs with secure boot, vTPM and integrity monitoring; requires a UEFI-compatible image")
+	flags.StringVar(&o.Template, ProviderName+"-template", "",
+		"Instance template to create the VMs from; only their names, zones and labels are set by roachprod")
 }
 
 func (o *providerOpts) ConfigureClusterFlags(flags *pflag.FlagSet) {
@@ -168,130 +384,798 @@ func (o *providerOpts) ConfigureClusterFlags(flags *pflag.FlagSet) {
 	}
 	flags.StringVar(&o.Project, ProviderName+"-project", project,
 		"Project to create cluster in")
+	flags.StringVar(&o.Project, "gcp-project", project,
+		"Alias of --"+ProviderName+"-project")
+	flags.StringVar(&computeEndpoint, ProviderName+"-compute-endpoint", os.Getenv("ROACHPROD_GCE_COMPUTE_ENDPOINT"),
+		"URL of the Compute Engine API to use in place of the public one "+
+			"(e.g. https://compute-myendpoint.p.googleapis.com/compute/v1/)")
+	flags.StringVar(&o.SSHKey, ProviderName+"-ssh-key", "",
+		"Private ssh key whose public half is added to the project "+
+			"(defaults to --ssh-key or ~/.ssh/google_compute_engine; generated if missing)")
+	flags.StringVar(&o.Bastion, ProviderName+"-bastion", os.Getenv("ROACHPROD_GCE_BASTION"),
+		"Jump host (host[:port]) for the instances without public IPs (defaults to --bastion)")
+	flags.BoolVar(&o.DiscardLocalSSD, ProviderName+"-discard-local-ssd", false,
+		"Discard the contents of the local SSDs of the instances which are suspended, rather than preserving them")
 }
 
 type Provider struct {
 	opts providerOpts
 }
 
-func (p *Provider) CleanSSH() error {
+// Capabilities is part of the vm.Provider interface.
+func (p *Provider) Capabilities() vm.ProviderCapabilities {
+	return vm.ProviderCapabilities{
+		LocalSSD:        true,
+		MaxLocalSSDs:    24,
+		Preemptible:     true,
+		GPUs:            true,
+		MaxGPUs:         8,
+		Images:          true,
+		OSImages:        true,
+		Metadata:        true,
+		StartupScripts:  true,
+		BootDisks:       true,
+		DataDisks:       true,
+		MaxDataDisks:    127,
+		PrivateIPs:      true,
+		Extend:          true,
+		Reboot:          true,
+		Resize:          true,
+		Suspend:         true,
+		StaticIPs:       true,
+		Firewalls:       true,
+		SpreadPlacement: true,
+		MachineSizes:    true,
+		MTU:             true,
+
+		NetworkInterfaces:      true,
+		MaxNetworkInterfaces:   maxNetworkInterfaces,
+		ExistingDisks:          true,
+		NetworkTiers:           true,
+		GeoWeights:             true,
+		AutoRestart:            true,
+		MaintenancePolicies:    true,
+		MaxPreemptibleLifetime: maxPreemptibleLifetime,
+		ListsLocalSSDs:         true,
+	}
+}
+
+// CheckCredentials is part of the vm.Provider interface. Printing an access
+// token fails if the gcloud credentials are missing or have expired. The
+// selected project must also be accessible, and the endpoint of
+// --gce-compute-endpoint, if any, reachable.
+func (p *Provider) CheckCredentials(ctx context.Context) error {
+	if computeEndpoint != "" {
+		if err := vm.CheckEndpoint(ctx, computeEndpoint); err != nil {
+			return err
+		}
+	}
+	if err := runCommand(ctx, []string{"auth", "print-access-token", "--quiet"}); err != nil {
+		return err
+	}
+	return p.checkProjectAccess(ctx)
+}
+
+// CleanSSH is part of the vm.Provider interface. It removes the section of
+// ~/.ssh/config which ConfigSSH added and leaves any other entries, as well as
+// the keys added to the project, untouched.
+func (p *Provider) CleanSSH(ctx context.Context) error {
 	args := []string{"compute", "config-ssh", "--project", p.opts.Project, "--quiet", "--remove"}
-	cmd := exec.Command("gcloud", args...)
+	if err := runCommand(ctx, args); err != nil {
+		return err
+	}
+	return vm.CleanBastionSSH(ProviderName)
+}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "Command: gcloud %s\nOutput: %s", args, output)
+// ConfigSSH is part of the vm.Provider interface. It adds the public half of
+// the ssh key to the project metadata, generating the key if necessary, and
+// adds the project's instances to ~/.ssh/config. The instances without
+// public IPs, which gcloud skips, are reached via the bastion, if any.
+func (p *Provider) ConfigSSH(ctx context.Context) error {
+	args := []string{"compute", "config-ssh", "--project", p.opts.Project, "--quiet",
+		"--ssh-key-file", vm.SSHKeyPath(p.opts.SSHKey, defaultSSHKeyPath)}
+	if err := runCommand(ctx, args); err != nil {
+		return err
 	}
-	return nil
+	return vm.ConfigBastionSSH(ctx, p, vm.BastionFor(p.opts.Bastion))
 }
 
-func (p *Provider) ConfigSSH() error {
-	args := []string{"compute", "config-ssh", "--project", p.opts.Project, "--quiet"}
-	cmd := exec.Command("gcloud", args...)
+// sshKeysMetadata returns the ssh-keys metadata entry which authorizes the
+// public half of the ssh key for the user. ConfigSSH only adds the key to the
+// project for the local user, so that instances which are logged into as
+// another user need the key in their own metadata.
+func (p *Provider) sshKeysMetadata(user string) (string, error) {
+	key, err := vm.SSHPublicKey(vm.SSHKeyPath(p.opts.SSHKey, defaultSSHKeyPath))
+	if err != nil {
+		return "", err
+	}
+	// The comment of the key is replaced by the user, as gcloud does.
+	fields := strings.Fields(string(key))
+	if len(fields) < 2 {
+		return "", errors.New("the public ssh key is malformed")
+	}
+	return fmt.Sprintf("ssh-keys=%s:%s %s %s", user, fields[0], fields[1], user), nil
+}
 
-	output, err := cmd.CombinedOutput()
+// zoneCounts returns the zones over which count instances are created with
+// opts, and the number of instances in each of them. With region weights,
+// the instances are distributed over the regions of the zones by weight.
+func (p *Provider) zoneCounts(opts vm.CreateOpts, count int) ([]string, []int, error) {
+	zones := p.opts.Zones
+	if len(opts.Zones) > 0 {
+		zones = opts.Zones
+	}
+	zones, zoneCounts, err := vm.ParseZoneCounts(zones, count)
 	if err != nil {
-		return errors.Wrapf(err, "Command: gcloud %s\nOutput: %s", args, output)
+		return nil, nil, err
 	}
-	return nil
+	if len(opts.GeoWeights) > 0 {
+		if zoneCounts != nil {
+			return nil, nil, errors.New("zone node counts cannot be combined with --geo-weights")
+		}
+		zoneCounts, err = vm.WeightedZoneCounts(ProviderName, zones, func(zone string) (string, error) {
+			return zoneRegion(zone), nil
+		}, opts.GeoWeights, count)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if zoneCounts == nil {
+		// This is calculating the number of machines to allocate per zone by taking the ceiling of the the total number
+		// of machines left divided by the number of zones left. If the the number of machines isn't
+		// divisible by the number of zones, then the extra machines will be allocated one per zone until there are
+		// no more extra machines left.
+		if !opts.GeoDistributed {
+			zones = zones[:1]
+		}
+		totalNodes := float64(count)
+		totalZones := float64(len(zones))
+		zoneCounts = make([]int, len(zones))
+		for i, remaining := 0, count; i < len(zones) && remaining > 0; i++ {
+			nodesPerZone := int(math.Ceil(totalNodes / totalZones))
+			zoneCounts[i] = nodesPerZone
+			remaining -= nodesPerZone
+			totalNodes -= float64(nodesPerZone)
+			totalZones--
+		}
+	}
+	return zones, zoneCounts, nil
 }
 
-func (p *Provider) Create(names []string, opts vm.CreateOpts) error {
+func (p *Provider) Create(ctx context.Context, names []string, opts vm.CreateOpts) error {
+	for _, name := range names {
+		if err := vm.ValidateName(name); err != nil {
+			return err
+		}
+	}
+	if err := vm.ValidateDataDisks(opts); err != nil {
+		return err
+	}
+	if err := vm.ValidateScheduling(opts); err != nil {
+		return err
+	}
+	if err := p.checkProjectAccess(ctx); err != nil {
+		return err
+	}
+
 	if p.opts.Project != defaultProject {
-		fmt.Printf("WARNING: --lifetime functionality requires "+
-			"`roachprod gc --gce-project=%s` cronjob\n", p.opts.Project)
+		vm.Warningf("--lifetime functionality requires "+
+			"`roachprod gc --gce-project=%s` cronjob", p.opts.Project)
 	}
 
-	// Create GCE startup script file.
-	filename, err := writeStartupScript()
-	if err != nil {
-		return errors.Wrapf(err, "could not write GCE startup script to temp file")
+	if opts.Preemptible && opts.Lifetime > maxPreemptibleLifetime {
+		return errors.Errorf("preemptible instances have a maximum lifetime of %s", maxPreemptibleLifetime)
 	}
-	defer os.Remove(filename)
 
-	if !opts.GeoDistributed {
-		p.opts.Zones = []string{p.opts.Zones[0]}
+	zones, zoneCounts, err := p.zoneCounts(opts, len(names))
+	if err != nil {
+		return err
+	}
+	if len(opts.GeoWeights) > 0 {
+		regionCounts := make(map[string]int)
+		for i, zone := range zones {
+			regionCounts[zoneRegion(zone)] += zoneCounts[i]
+		}
+		vm.LogRegionCounts(ProviderName, regionCounts, opts.GeoWeights)
+	}
+	if p.opts.Template != "" {
+		if p.opts.Shielded {
+			return errors.Errorf("--%s-shielded cannot be combined with --%s-template, "+
+				"which determines the shielded instance config", ProviderName, ProviderName)
+		}
+		if len(p.opts.NICSubnets) > 0 {
+			return errors.Errorf("--%s-nic-subnets cannot be combined with --%s-template, "+
+				"which determines the network interfaces", ProviderName, ProviderName)
+		}
+		return p.createFromTemplate(ctx, names, zones, zoneCounts, opts)
+	}
+	machineType, err := p.machineType(opts)
+	if err != nil {
+		return err
 	}
 
-	totalNodes := float64(len(names))
-	totalZones := float64(len(p.opts.Zones))
-	nodesPerZone := int(math.Ceil(totalNodes / totalZones))
+	if opts.Image != "" && (opts.BootDiskSizeGB > 0 || opts.BootDiskType != "") {
+		return errors.New("the boot disk of a machine image cannot be changed")
+	}
+	if opts.Image != "" && opts.DataDiskCount > 0 {
+		return errors.New("data disks cannot be added to a machine image")
+	}
 
-	ct := int(0)
-	i := 0
+	usedZones := zonesInUse(zones, zoneCounts)
+	machineTypes, err := vm.MachineTypes(ctx, p, usedZones, machineType, p.opts.MachineTypeFallbacks)
+	if err != nil {
+		return err
+	}
+	if err := p.checkNetworkInterfaces(ctx, usedZones, machineTypes, opts); err != nil {
+		return err
+	}
+	if opts.MTU > 0 {
+		if err := p.checkMTU(ctx, opts.MTU); err != nil {
+			return err
+		}
+	}
+	for _, zone := range usedZones {
+		if opts.GPUCount > 0 {
+			args := []string{"compute", "accelerator-types", "describe", opts.GPUType,
+				"--project", p.opts.Project, "--zone", zone, "--format", "json"}
+			var parsed struct{ Name string }
+			if err := runJSONCommand(ctx, args, &parsed); err != nil {
+				return errors.Wrapf(err, "GPU type %s is not available in zone %s", opts.GPUType, zone)
+			}
+		}
+		for _, diskType := range []string{opts.BootDiskType, opts.DataDiskType} {
+			if diskType == "" {
+				continue
+			}
+			args := []string{"compute", "disk-types", "describe", diskType,
+				"--project", p.opts.Project, "--zone", zone, "--format", "json"}
+			var parsed struct{ Name string }
+			if err := runJSONCommand(ctx, args, &parsed); err != nil {
+				return errors.Wrapf(err, "disk type %s is not available in zone %s", diskType, zone)
+			}
+		}
+	}
 
 	// Fixed args.
 	args := []string{
 		"compute", "instances", "create",
-		"--subnet", "default",
-		"--maintenance-policy", "MIGRATE",
 		"--scopes", "default,storage-rw",
-		"--image", "ubuntu-1604-xenial-v20181030",
-		"--image-project", "ubuntu-os-cloud",
-		"--boot-disk-size", "10",
-		"--boot-disk-type", "pd-ssd",
 	}
+	args = append(args, p.networkInterfaceArgs(opts)...)
 
-	if p.opts.Project == defaultProject && p.opts.ServiceAccount == "" {
-		p.opts.ServiceAccount = "21965078311-compute@developer.gserviceaccount.com"
+	// A machine image captures the disks and instance properties of the
+	// source instance, so the boot disk must not be specified separately.
+	var osImage string
+	if opts.Image != "" {
+		args = append(args, "--source-machine-image", opts.Image)
+	} else {
+		var err error
+		image := p.opts.OSImage
+		if opts.OSImage != "" {
+			image = opts.OSImage
+		}
+		if osImage, err = p.resolveOSImage(ctx, image); err != nil {
+			return err
+		}
+		bootDiskSize := defaultBootDiskSizeGB
+		if opts.BootDiskSizeGB > 0 {
+			bootDiskSize = opts.BootDiskSizeGB
+		}
+		bootDiskType := defaultBootDiskType
+		if opts.BootDiskType != "" {
+			bootDiskType = opts.BootDiskType
+		}
+		args = append(args,
+			"--image", osImage,
+			"--image-project", p.opts.OSImageProject,
+			"--boot-disk-size", strconv.Itoa(bootDiskSize),
+			"--boot-disk-type", bootDiskType,
+		)
 	}
+
 	if p.opts.ServiceAccount != "" {
-		args = append(args, "--service-account", p.opts.ServiceAccount)
+		// A service account chosen by the user is presumably needed to access
+		// other cloud APIs (e.g. GCS for backups), which is controlled by its
+		// roles rather than by the instance's access scopes.
+		if err := checkServiceAccount(ctx, p.opts.ServiceAccount); err != nil {
+			return err
+		}
+		args = append(args, "--service-account", p.opts.ServiceAccount, "--scopes", "cloud-platform")
+	} else if p.opts.Project == defaultProject {
+		args = append(args, "--service-account", "21965078311-compute@developer.gserviceaccount.com")
 	}
 
 	// Dynamic args.
+	if opts.Preemptible {
+		args = append(args, "--preemptible")
+	}
+	if opts.GPUCount > 0 {
+		args = append(args, "--accelerator",
+			fmt.Sprintf("type=%s,count=%d", opts.GPUType, opts.GPUCount))
+	}
+	// Neither preemptible instances nor instances with GPUs can be
+	// live-migrated.
+	maintenancePolicy := opts.MaintenancePolicy
+	if maintenancePolicy == "" {
+		if opts.Preemptible || opts.GPUCount > 0 {
+			maintenancePolicy = vm.MaintenanceTerminate
+		} else {
+			maintenancePolicy = vm.MaintenanceMigrate
+		}
+	}
+	args = append(args, "--maintenance-policy", maintenancePolicy)
+	if opts.AutoRestart != nil {
+		if *opts.AutoRestart {
+			args = append(args, "--restart-on-failure")
+		} else {
+			args = append(args, "--no-restart-on-failure")
+		}
+	}
+	// The shielded instance config is recorded in the metadata of the
+	// instances, where it is shown by `roachprod metadata`.
+	if p.opts.Shielded {
+		args = append(args, "--shielded-secure-boot", "--shielded-vtpm", "--shielded-integrity-monitoring",
+			"--metadata", vm.MetadataPrefix+vm.SecurityMetadataKey+"=shielded-vm")
+	}
 	if opts.UseLocalSSD {
-		args = append(args, "--local-ssd", "interface=SCSI")
+		count := opts.LocalSSDCount
+		if count == 0 {
+			count = 1
+		}
+		if !validLocalSSDCounts[count] {
+			return errors.Errorf("GCE supports 1-8, 16 or 24 local SSDs, not %d", count)
+		}
+		for i := 0; i < count; i++ {
+			args = append(args, "--local-ssd", "interface=SCSI")
+		}
+	}
+	if opts.DataDiskCount > 0 {
+		dataDiskSize := defaultDataDiskSizeGB
+		if opts.DataDiskSizeGB > 0 {
+			dataDiskSize = opts.DataDiskSizeGB
+		}
+		dataDiskType := defaultDataDiskType
+		if opts.DataDiskType != "" {
+			dataDiskType = opts.DataDiskType
+		}
+		// The disks are named after the instance by gcloud, since several
+		// instances are created at once.
+		for i := 1; i <= opts.DataDiskCount; i++ {
+			args = append(args, "--create-disk", fmt.Sprintf(
+				"size=%dGB,type=%s,device-name=%s%d,auto-delete=yes",
+				dataDiskSize, dataDiskType, dataDiskDevicePrefix, i))
+		}
 	}
-	args = append(args, "--machine-type", p.opts.MachineType)
-	args = append(args, "--labels", fmt.Sprintf("lifetime=%s", opts.Lifetime))
 
-	args = append(args, "--metadata-from-file", fmt.Sprintf("startup-script=%s", filename))
+	user, err := p.FindActiveAccount(ctx)
+	if err != nil {
+		return err
+	}
+	labelMap := vm.StandardLabels(opts.Labels, user, names[0], time.Now())
+	delete(labelMap, osImageLabel)
+	if osImage != "" {
+		labelMap[osImageLabel] = osImage
+	}
+	if opts.StaticIP {
+		labelMap[vm.StaticIPLabel] = vm.StaticIPPolicy(opts)
+	}
+	cluster := labelMap[vm.ClusterLabel]
+	if opts.Firewall {
+		labelMap[vm.FirewallLabel] = "true"
+		args = append(args, "--tags", vm.FirewallName(cluster))
+	}
+	// The number of instances in each region, over which the placement
+	// policy of the region spreads them.
+	placementRegions := make(map[string]int)
+	if opts.SSHUser != "" {
+		metadata, err := p.sshKeysMetadata(opts.SSHUser)
+		if err != nil {
+			return err
+		}
+		labelMap[vm.SSHUserLabel] = opts.SSHUser
+		args = append(args, "--metadata", metadata)
+	}
+	if opts.Placement != "" {
+		labelMap[vm.PlacementLabel] = opts.Placement
+		args = append(args, "--resource-policies", vm.PlacementGroupName(cluster))
+		for i, zone := range zones {
+			placementRegions[zoneRegion(zone)] += zoneCounts[i]
+		}
+	}
+	labels, err := normalizeLabels(labelMap)
+	if err != nil {
+		return err
+	}
+	labels = append(labels, fmt.Sprintf("lifetime=%s", opts.Lifetime))
+	args = append(args, "--labels", strings.Join(labels, ","))
+
 	args = append(args, "--project", p.opts.Project)
 
-	var g errgroup.Group
+	// Create GCE startup script files. A templated user-supplied script may
+	// differ between VMs, which then have to be created separately.
+	scriptFiles := make(map[string]string)
+	defer func() {
+		if config.DryRun {
+			return
+		}
+		for _, filename := range scriptFiles {
+			os.Remove(filename)
+		}
+	}()
 
-	// This is calculating the number of machines to allocate per zone by taking the ceiling of the the total number
-	// of machines left divided by the number of zones left. If the the number of machines isn't
-	// divisible by the number of zones, then the extra machines will be allocated one per zone until there are
-	// no more extra machines left.
-	for i < len(names) {
-		argsWithZone := append(args[:len(args):len(args)], "--zone", p.opts.Zones[ct])
-		ct++
-		argsWithZone = append(argsWithZone, names[i:i+nodesPerZone]...)
-		i += nodesPerZone
+	var batchArgs, batchNames [][]string
+	var batchZones []string
+	nameZones := make(map[string]string, len(names))
+	for i, j := 0, 0; i < len(zones); i++ {
+		if zoneCounts[i] == 0 {
+			continue
+		}
+		argsWithZone := append(args[:len(args):len(args)],
+			"--machine-type", machineTypes[zones[i]], "--zone", zones[i])
+		zoneNames := names[j : j+zoneCounts[i]]
+		j += zoneCounts[i]
 
-		totalNodes -= float64(nodesPerZone)
-		totalZones -= 1
-		nodesPerZone = int(math.Ceil(totalNodes / totalZones))
+		var files []string
+		byFile := make(map[string][]string)
+		for _, name := range zoneNames {
+			nameZones[name] = zones[i]
+			script, err := startupScript(name, opts)
+			if err != nil {
+				return err
+			}
+			filename, ok := scriptFiles[script]
+			if !ok && config.DryRun {
+				filename = fmt.Sprintf("<startup-script-%d>", len(scriptFiles)+1)
+				scriptFiles[script] = filename
+			} else if !ok {
+				filename, err = writeStartupScript(script)
+				if err != nil {
+					return errors.Wrapf(err, "could not write GCE startup script to temp file")
+				}
+				scriptFiles[script] = filename
+			}
+			if _, ok := byFile[filename]; !ok {
+				files = append(files, filename)
+			}
+			byFile[filename] = append(byFile[filename], name)
+		}
+		for _, filename := range files {
+			batch := append(argsWithZone[:len(argsWithZone):len(argsWithZone)],
+				"--metadata-from-file", fmt.Sprintf("startup-script=%s", filename))
+			var shared []string
+			for _, name := range byFile[filename] {
+				instanceArgs := instanceArgs(name, opts)
+				if len(instanceArgs) == 0 {
+					shared = append(shared, name)
+					continue
+				}
+				// The instances with an address or disk of their own have
+				// to be created one at a time.
+				batchArgs = append(batchArgs, append(append(batch[:len(batch):len(batch)], instanceArgs...), name))
+				batchNames = append(batchNames, []string{name})
+				batchZones = append(batchZones, zones[i])
+			}
+			if len(shared) > 0 {
+				batchArgs = append(batchArgs, append(batch, shared...))
+				batchNames = append(batchNames, shared)
+				batchZones = append(batchZones, zones[i])
+			}
+		}
+	}
+	if err := p.checkExistingDisks(ctx, nameZones, opts); err != nil {
+		return err
+	}
 
-		g.Go(func() error {
-			cmd := exec.Command("gcloud", argsWithZone...)
+	if config.DryRun {
+		var planned vm.List
+		for i := range batchNames {
+			for _, name := range batchNames[i] {
+				planned = append(planned, vm.VM{
+					Name:        name,
+					Provider:    ProviderName,
+					Zone:        batchZones[i],
+					MachineType: machineTypes[batchZones[i]],
+					Preemptible: opts.Preemptible,
+				})
+			}
+		}
+		vm.PrintPlan(p, planned)
+		if opts.Firewall {
+			if err := p.ensureFirewall(ctx, cluster, opts.Ingress); err != nil {
+				return err
+			}
+		}
+		if opts.Placement != "" {
+			if err := p.ensurePlacementPolicies(ctx, cluster, placementRegions); err != nil {
+				return err
+			}
+		}
+		if opts.StaticIP {
+			if _, err := p.reserveAddresses(ctx, nameZones, opts.NetworkTier); err != nil {
+				return err
+			}
+		}
+		for _, args := range batchArgs {
+			vm.PrintDryRun("gcloud", args)
+		}
+		return nil
+	}
 
-			output, err := cmd.CombinedOutput()
-			if err != nil {
-				return errors.Wrapf(err, "Command: gcloud %s\nOutput: %s", args, output)
+	if opts.Firewall {
+		if err := p.ensureFirewall(ctx, cluster, opts.Ingress); err != nil {
+			return err
+		}
+	}
+	if opts.Placement != "" {
+		if err := p.ensurePlacementPolicies(ctx, cluster, placementRegions); err != nil {
+			return err
+		}
+	}
+	var reserved map[string][]string
+	if opts.StaticIP {
+		if reserved, err = p.reserveAddresses(ctx, nameZones, opts.NetworkTier); err != nil {
+			return err
+		}
+	}
+
+	var mu sync.Mutex
+	var created []string
+	failedZones := make(map[string]bool)
+	failedNames := make(map[string]bool)
+	err = vm.ForEach(len(batchArgs), func(i int) error {
+		if err := runCommand(ctx, batchArgs[i]); err != nil {
+			mu.Lock()
+			failedZones[batchZones[i]] = true
+			for _, name := range batchNames[i] {
+				failedNames[name] = true
 			}
-			return nil
+			mu.Unlock()
+			return errors.Wrapf(err, "in zone %s", batchZones[i])
+		}
+		mu.Lock()
+		created = append(created, batchNames[i]...)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		// Report what we know to exist so that the user can clean up. Note
+		// that a failed gcloud invocation may still have created some of the
+		// instances it was asked to create.
+		//
+		// The static IPs reserved above for the instances which failed are
+		// released, which fails for those in use by an instance that was
+		// created after all.
+		unused := make(map[string][]string)
+		for region, regionNames := range reserved {
+			for _, name := range regionNames {
+				if failedNames[name] {
+					unused[region] = append(unused[region], name)
+				}
+			}
+		}
+		if releaseErr := p.releaseAddresses(ctx, unused); releaseErr != nil {
+			vm.Warningf("unable to release unused static IPs: %s", releaseErr)
+		}
+		sort.Strings(created)
+		return errors.Wrapf(err, "created %d/%d instances %v, failed in %s",
+			len(created), len(names), created, vm.JoinZones(failedZones))
+	}
+	return nil
+}
+
+// createFromTemplate creates the instances from --gce-template, zoneCounts[i]
+// of them in zones[i]. The template determines everything but the names,
+// zones and labels of the instances, including the disks and the startup
+// script, which must prepare /mnt/data1 like roachprod's own.
+func (p *Provider) createFromTemplate(
+	ctx context.Context, names []string, zones []string, zoneCounts []int, opts vm.CreateOpts,
+) error {
+	if err := vm.ValidateTemplateOpts(opts, "--"+ProviderName+"-template"); err != nil {
+		return err
+	}
+	var template struct {
+		Properties struct {
+			MachineType string
+		}
+	}
+	if err := runJSONCommand(ctx, []string{"compute", "instance-templates", "describe", p.opts.Template,
+		"--project", p.opts.Project, "--format", "json"}, &template); err != nil {
+		return errors.Wrapf(err, "could not find instance template %s", p.opts.Template)
+	}
+
+	user, err := p.FindActiveAccount(ctx)
+	if err != nil {
+		return err
+	}
+	labelMap := vm.StandardLabels(opts.Labels, user, names[0], time.Now())
+	var metadataArgs []string
+	if opts.SSHUser != "" {
+		metadata, err := p.sshKeysMetadata(opts.SSHUser)
+		if err != nil {
+			return err
+		}
+		labelMap[vm.SSHUserLabel] = opts.SSHUser
+		metadataArgs = []string{"--metadata", metadata}
+	}
+	labels, err := normalizeLabels(labelMap)
+	if err != nil {
+		return err
+	}
+	labels = append(labels, fmt.Sprintf("lifetime=%s", opts.Lifetime))
+
+	var batchArgs, batchNames [][]string
+	var batchZones []string
+	var planned vm.List
+	for i, j := 0, 0; i < len(zones); i++ {
+		if zoneCounts[i] == 0 {
+			continue
+		}
+		zoneNames := names[j : j+zoneCounts[i]]
+		j += zoneCounts[i]
+		args := []string{"compute", "instances", "create",
+			"--source-instance-template", p.opts.Template,
+			"--labels", strings.Join(labels, ","),
+			"--project", p.opts.Project,
+			"--zone", zones[i]}
+		args = append(args, metadataArgs...)
+		batchArgs = append(batchArgs, append(args, zoneNames...))
+		batchNames = append(batchNames, zoneNames)
+		batchZones = append(batchZones, zones[i])
+		for _, name := range zoneNames {
+			planned = append(planned, vm.VM{
+				Name:        name,
+				Provider:    ProviderName,
+				Zone:        zones[i],
+				MachineType: template.Properties.MachineType,
+			})
+		}
+	}
+
+	if config.DryRun {
+		vm.PrintPlan(p, planned)
+		for _, args := range batchArgs {
+			vm.PrintDryRun("gcloud", args)
+		}
+		return nil
+	}
+
+	var mu sync.Mutex
+	var created []string
+	err = vm.ForEach(len(batchArgs), func(i int) error {
+		if err := runCommand(ctx, batchArgs[i]); err != nil {
+			return errors.Wrapf(err, "in zone %s", batchZones[i])
+		}
+		mu.Lock()
+		created = append(created, batchNames[i]...)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		sort.Strings(created)
+		return errors.Wrapf(err, "created %d/%d instances %v", len(created), len(names), created)
+	}
+	return nil
+}
+
+// CreateImage is part of the vm.Provider interface. It creates a GCE machine
+// image, which includes all of the instance's disks. Machine images are
+// global resources, so the identifier is simply the image name.
+func (p *Provider) CreateImage(ctx context.Context, vms vm.List, imageName string) ([]string, error) {
+	for _, v := range vms {
+		if v.Provider != ProviderName {
+			return nil, errors.Errorf("%s received VM instance from %s", ProviderName, v.Provider)
+		}
+	}
+
+	names := vm.ImageNames(vms, imageName)
+	var g errgroup.Group
+
+	for i := range vms {
+		v := vms[i]
+		args := []string{"compute", "machine-images", "create", names[i]}
+
+		args = append(args, "--project", p.opts.Project)
+		args = append(args, "--source-instance", v.Name)
+		args = append(args, "--source-instance-zone", v.Zone)
+
+		// The gcloud command blocks until the machine image is ready.
+		g.Go(func() error {
+			return runCommand(ctx, args)
 		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
 
+// machineType returns the machine type requested by opts: the type given
+// explicitly, the closest to the requested size, or the configured type.
+func (p *Provider) machineType(opts vm.CreateOpts) (string, error) {
+	switch {
+	case opts.MachineType != "":
+		return opts.MachineType, nil
+	case !opts.Size.IsZero():
+		return vm.ClosestMachineType(machineTypeSizes(opts.GPUCount > 0), opts.Size, "--"+ProviderName+"-machine-type")
+	default:
+		return p.opts.MachineType, nil
 	}
+}
 
-	return g.Wait()
+// CreatedZones is part of the vm.Provider interface.
+func (p *Provider) CreatedZones(ctx context.Context, opts vm.CreateOpts, count int) ([]string, error) {
+	zones, zoneCounts, err := p.zoneCounts(opts, count)
+	if err != nil {
+		return nil, err
+	}
+	return zonesInUse(zones, zoneCounts), nil
+}
+
+// zonesInUse returns the zones of zoneCounts which are given any instances.
+func zonesInUse(zones []string, zoneCounts []int) []string {
+	var ret []string
+	for i, zone := range zones {
+		if zoneCounts[i] > 0 {
+			ret = append(ret, zone)
+		}
+	}
+	return ret
+}
+
+// CreatedMachineTypes is part of the vm.Provider interface. The machine type
+// of the instances created from --gce-template is that of the template, which
+// is not known.
+func (p *Provider) CreatedMachineTypes(opts vm.CreateOpts) ([]string, error) {
+	if p.opts.Template != "" {
+		return nil, nil
+	}
+	machineType, err := p.machineType(opts)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{machineType}, p.opts.MachineTypeFallbacks...), nil
 }
 
-func (p *Provider) Delete(vms vm.List) error {
+func (p *Provider) Delete(ctx context.Context, vms vm.List) error {
+	if err := p.checkProjectAccess(ctx); err != nil {
+		return err
+	}
 	zoneMap := make(map[string][]string)
+	// The VMs whose static IPs are to be released, keyed by region.
+	releasedAddresses := make(map[string][]string)
+	// The VMs behind the firewall of their cluster, keyed by cluster, and the
+	// regions of the placement policies of the clusters.
+	firewalled := make(map[string][]string)
+	placed := make(map[string][]string)
+	seenPlacements := make(map[string]bool)
 	for _, v := range vms {
 		if v.Provider != ProviderName {
 			return errors.Errorf("%s received VM instance from %s", ProviderName, v.Provider)
 		}
 		zoneMap[v.Zone] = append(zoneMap[v.Zone], v.Name)
+		if v.Labels[vm.StaticIPLabel] == vm.StaticIPRelease {
+			region := zoneRegion(v.Zone)
+			releasedAddresses[region] = append(releasedAddresses[region], v.Name)
+		}
+		if v.Labels[vm.FirewallLabel] != "" {
+			cluster := v.Labels[vm.ClusterLabel]
+			firewalled[cluster] = append(firewalled[cluster], v.Name)
+		}
+		if cluster, region := v.Labels[vm.ClusterLabel], zoneRegion(v.Zone); v.Labels[vm.PlacementLabel] != "" &&
+			!seenPlacements[cluster+"/"+region] {
+			seenPlacements[cluster+"/"+region] = true
+			placed[cluster] = append(placed[cluster], region)
+		}
 	}
 
-	var g errgroup.Group
+	zones := make([]string, 0, len(zoneMap))
+	for zone := range zoneMap {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
 
-	for zone, names := range zoneMap {
+	deleteArgs := func(zone string) []string {
 		args := []string{
 			"compute", "instances", "delete",
 			"--delete-disks", "all",
@@ -299,48 +1183,72 @@ func (p *Provider) Delete(vms vm.List) error {
 
 		args = append(args, "--project", p.opts.Project)
 		args = append(args, "--zone", zone)
-		args = append(args, names...)
-
-		g.Go(func() error {
-			cmd := exec.Command("gcloud", args...)
-
-			output, err := cmd.CombinedOutput()
-			if err != nil {
-				return errors.Wrapf(err, "Command: gcloud %s\nOutput: %s", args, output)
-			}
-			return nil
-		})
+		return append(args, zoneMap[zone]...)
 	}
+	if config.DryRun {
+		for _, zone := range zones {
+			vm.PrintDryRun("gcloud", deleteArgs(zone))
+		}
+	} else if err := vm.ForEach(len(zones), func(i int) error {
+		return runCommand(ctx, deleteArgs(zones[i]))
+	}); err != nil {
+		return err
+	}
+	// The static IPs, firewalls and placement policies are only deleted once
+	// they are no longer in use.
+	if err := p.releaseAddresses(ctx, releasedAddresses); err != nil {
+		return err
+	}
+	if err := p.deletePlacementPolicies(ctx, placed); err != nil {
+		return err
+	}
+	return p.deleteUnusedFirewalls(ctx, firewalled)
+}
 
-	return g.Wait()
+// Describe is part of the vm.Provider interface.
+func (p *Provider) Describe(ctx context.Context, v vm.VM) (map[string]interface{}, error) {
+	if v.Zone == "" {
+		return nil, errors.Errorf("zone of %s is unknown", v.Name)
+	}
+	args := []string{"compute", "instances", "describe", v.Name,
+		"--project", p.opts.Project, "--zone", v.Zone, "--format", "json"}
+	var ret map[string]interface{}
+	if err := runJSONCommand(ctx, args, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
 
-func (p *Provider) Extend(vms vm.List, lifetime time.Duration) error {
+func (p *Provider) Extend(ctx context.Context, vms vm.List, lifetime time.Duration) error {
 	// The gcloud command only takes a single instance.  Unlike Delete() above, we have to
 	// perform the iteration here.
-	for _, v := range vms {
+	return vm.ForEach(len(vms), func(i int) error {
+		// GCE stops preemptible instances after at most 24 hours, so a longer
+		// lifetime would never be reached.
+		lifetime := lifetime
+		if vms[i].Preemptible && lifetime > maxPreemptibleLifetime {
+			lifetime = maxPreemptibleLifetime
+		}
+
 		args := []string{"compute", "instances", "add-labels"}
 
 		args = append(args, "--project", p.opts.Project)
-		args = append(args, "--zone", v.Zone)
+		args = append(args, "--zone", vms[i].Zone)
 		args = append(args, "--labels", fmt.Sprintf("lifetime=%s", lifetime))
-		args = append(args, v.Name)
-
-		cmd := exec.Command("gcloud", args...)
+		args = append(args, vms[i].Name)
 
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return errors.Wrapf(err, "Command: gcloud %s\nOutput: %s", args, output)
-		}
-	}
-	return nil
+		return runCommand(ctx, args)
+	})
 }
 
-func (p *Provider) FindActiveAccount() (string, error) {
+// FindActiveAccount is part of the vm.Provider interface. The gcloud
+// credentials are not tied to a project, so the active account is the one
+// used in whichever project --gce-project selects.
+func (p *Provider) FindActiveAccount(ctx context.Context) (string, error) {
 	args := []string{"auth", "list", "--format", "json", "--filter", "status~ACTIVE"}
 
 	accounts := make([]jsonAuth, 0)
-	if err := runJSONCommand(args, &accounts); err != nil {
+	if err := runJSONCommand(ctx, args, &accounts); err != nil {
 		return "", err
 	}
 
@@ -361,25 +1269,370 @@ func (p *Provider) Flags() vm.ProviderFlags {
 	return &p.opts
 }
 
-// Query gcloud to produce a list of VM info objects.
-func (p *Provider) List() (vm.List, error) {
+// GetMetadata is part of the vm.Provider interface.
+func (p *Provider) GetMetadata(ctx context.Context, v vm.VM) (map[string]string, error) {
+	items, err := p.instanceMetadata(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string)
+	for k, value := range items {
+		if strings.HasPrefix(k, vm.MetadataPrefix) {
+			ret[strings.TrimPrefix(k, vm.MetadataPrefix)] = value
+		}
+	}
+	return ret, nil
+}
+
+// instanceMetadata returns all of the metadata of an instance, including
+// the startup script.
+func (p *Provider) instanceMetadata(ctx context.Context, v vm.VM) (map[string]string, error) {
+	args := []string{"compute", "instances", "describe", v.Name,
+		"--project", p.opts.Project, "--zone", v.Zone, "--format", "json"}
+	var parsed struct {
+		Metadata struct {
+			Items []struct {
+				Key   string
+				Value string
+			}
+		}
+	}
+	if err := runJSONCommand(ctx, args, &parsed); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string, len(parsed.Metadata.Items))
+	for _, item := range parsed.Metadata.Items {
+		ret[item.Key] = item.Value
+	}
+	return ret, nil
+}
+
+// listPageSize is the number of instances requested per page by List.
+const listPageSize = 500
+
+// List queries gcloud to produce a list of VM info objects. The label filter
+// is translated into a gcloud filter expression.
+func (p *Provider) List(ctx context.Context, filter vm.LabelFilter) (vm.List, error) {
+	if err := p.checkProjectAccess(ctx); err != nil {
+		return nil, err
+	}
 	args := []string{"compute", "instances", "list", "--project", p.opts.Project, "--format", "json"}
+	if len(filter) > 0 {
+		args = append(args, "--filter", listFilter(filter))
+	}
+	// gcloud follows the page tokens itself and returns every page, as long
+	// as no --limit is given. --page-size only bounds each request.
+	args = append(args, "--page-size", strconv.Itoa(listPageSize))
 
 	// Run the command, extracting the JSON payload
 	jsonVMS := make([]jsonVM, 0)
-	if err := runJSONCommand(args, &jsonVMS); err != nil {
+	if err := runJSONCommand(ctx, args, &jsonVMS); err != nil {
 		return nil, err
 	}
 
 	// Now, convert the json payload into our common VM type
 	vms := make(vm.List, len(jsonVMS))
+	var stopped []int
 	for i, jsonVM := range jsonVMS {
 		vms[i] = *jsonVM.toVM(p.opts.Project)
+		if vms[i].Preemptible && vms[i].Status == vm.StatusStopped {
+			stopped = append(stopped, i)
+		}
+	}
+	if len(stopped) == 0 {
+		return vms, nil
 	}
 
+	// Preempted instances are TERMINATED, just like stopped ones, so they
+	// are told apart by a preemption since they were last started.
+	preempted, err := p.preemptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range stopped {
+		key := vms[i].Zone + "/" + vms[i].Name
+		if at, ok := preempted[key]; ok && at.After(jsonVMS[i].LastStartTimestamp) {
+			vms[i].Status = vm.StatusPreempted
+		}
+	}
 	return vms, nil
 }
 
+// preemptions returns the time of the latest preemption of each instance
+// which GCE still has a record of, keyed by zone and instance name.
+func (p *Provider) preemptions(ctx context.Context) (map[string]time.Time, error) {
+	args := []string{"compute", "operations", "list", "--project", p.opts.Project,
+		"--filter", "operationType=compute.instances.preempted", "--format", "json"}
+	var ops []struct {
+		// TargetLink is the URL of the instance, which includes its zone.
+		TargetLink string
+		InsertTime time.Time
+	}
+	if err := runJSONCommand(ctx, args, &ops); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]time.Time, len(ops))
+	for _, op := range ops {
+		parts := strings.Split(op.TargetLink, "/")
+		if len(parts) < 3 {
+			continue
+		}
+		key := parts[len(parts)-3] + "/" + parts[len(parts)-1]
+		if op.InsertTime.After(ret[key]) {
+			ret[key] = op.InsertTime
+		}
+	}
+	return ret, nil
+}
+
+// ListScope is part of the vm.Provider interface. The instances are those of
+// --gce-project.
+func (p *Provider) ListScope() string {
+	return "project=" + p.opts.Project
+}
+
+// MachineTypeAvailable is part of the vm.Provider interface. Custom machine
+// types, e.g. custom-4-16384 or n2-custom-4-16384-ext, are not listed, so
+// only their family is checked, and gcloud rejects sizes which the family
+// does not offer. The N1 family of custom-4-16384 is offered everywhere.
+func (p *Provider) MachineTypeAvailable(ctx context.Context, zone, machineType string) (bool, error) {
+	if strings.HasPrefix(machineType, "custom-") {
+		return true, nil
+	}
+	filter := "name=" + machineType
+	if i := strings.Index(machineType, "-custom-"); i > 0 {
+		filter = fmt.Sprintf("name~^%s-", machineType[:i])
+	}
+	args := []string{"compute", "machine-types", "list",
+		"--project", p.opts.Project,
+		"--zones", zone,
+		"--filter", filter,
+		"--limit", "1",
+		"--format", "json"}
+	var parsed []struct{ Name string }
+	if err := runJSONCommand(ctx, args, &parsed); err != nil {
+		return false, err
+	}
+	return len(parsed) > 0, nil
+}
+
 func (p *Provider) Name() string {
 	return ProviderName
 }
+
+// Reboot is part of the vm.Provider interface. The instances are hard-reset,
+// which preserves the contents of local SSDs. The gcloud command blocks until
+// the reset operation has completed and the instances are running again.
+func (p *Provider) Reboot(ctx context.Context, vms vm.List) error {
+	zoneMap := make(map[string][]string)
+	for _, v := range vms {
+		if v.Provider != ProviderName {
+			return errors.Errorf("%s received VM instance from %s", ProviderName, v.Provider)
+		}
+		zoneMap[v.Zone] = append(zoneMap[v.Zone], v.Name)
+	}
+
+	var g errgroup.Group
+
+	for zone, names := range zoneMap {
+		args := []string{"compute", "instances", "reset"}
+
+		args = append(args, "--project", p.opts.Project)
+		args = append(args, "--zone", zone)
+		args = append(args, names...)
+
+		g.Go(func() error {
+			return runCommand(ctx, args)
+		})
+	}
+
+	return g.Wait()
+}
+
+// Resize is part of the vm.Provider interface. Each instance is stopped,
+// has its machine type changed, and is then started again.
+func (p *Provider) Resize(ctx context.Context, vms vm.List, machineType string) error {
+	zones := make(map[string]bool)
+	for _, v := range vms {
+		if v.Provider != ProviderName {
+			return errors.Errorf("%s received VM instance from %s", ProviderName, v.Provider)
+		}
+		zones[v.Zone] = true
+	}
+
+	// Make sure the machine type is available in every zone before we stop
+	// any of the instances.
+	for zone := range zones {
+		args := []string{"compute", "machine-types", "describe", machineType,
+			"--project", p.opts.Project, "--zone", zone, "--format", "json"}
+		var parsed struct{ Name string }
+		if err := runJSONCommand(ctx, args, &parsed); err != nil {
+			return errors.Wrapf(err, "machine type %s is not available in zone %s", machineType, zone)
+		}
+	}
+
+	var mu sync.Mutex
+	var resized []string
+	var g errgroup.Group
+
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			for _, args := range [][]string{
+				{"compute", "instances", "stop"},
+				{"compute", "instances", "set-machine-type", "--machine-type", machineType},
+				{"compute", "instances", "start"},
+			} {
+				args = append(args, "--project", p.opts.Project, "--zone", v.Zone, v.Name)
+				if err := runCommand(ctx, args); err != nil {
+					return err
+				}
+			}
+			mu.Lock()
+			resized = append(resized, v.Name)
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		sort.Strings(resized)
+		return errors.Wrapf(err, "resized %d of %d instances %v", len(resized), len(vms), resized)
+	}
+	return nil
+}
+
+// SSHAccess is part of the vm.Provider interface. The key is the one which
+// ConfigSSH adds to the project metadata.
+func (p *Provider) SSHAccess() vm.SSHAccess {
+	return vm.SSHAccess{
+		KeyPath: vm.SSHKeyPath(p.opts.SSHKey, defaultSSHKeyPath),
+		Bastion: vm.BastionFor(p.opts.Bastion),
+	}
+}
+
+// Limits on the metadata of an instance.
+// See https://cloud.google.com/compute/docs/metadata/setting-custom-metadata#limitations
+const (
+	maxMetadataValueSize = 256 << 10
+	maxMetadataSize      = 512 << 10
+)
+
+// SetMetadata is part of the vm.Provider interface. The values are passed
+// to gcloud via temp files, so that they may contain arbitrary characters.
+func (p *Provider) SetMetadata(ctx context.Context, v vm.VM, kv map[string]string) error {
+	if err := vm.CheckMetadata(kv, maxMetadataValueSize); err != nil {
+		return err
+	}
+
+	// The limit applies to all of the instance's metadata together.
+	items, err := p.instanceMetadata(ctx, v)
+	if err != nil {
+		return err
+	}
+	for k, value := range kv {
+		items[vm.MetadataPrefix+k] = value
+	}
+	size := 0
+	for k, value := range items {
+		size += len(k) + len(value)
+	}
+	if size > maxMetadataSize {
+		return errors.Errorf("the metadata of %s would be %d bytes, but GCE allows at most %d",
+			v.Name, size, maxMetadataSize)
+	}
+
+	var added, removed []string
+	for _, k := range vm.MetadataKeys(kv) {
+		if kv[k] == "" {
+			removed = append(removed, vm.MetadataPrefix+k)
+			continue
+		}
+		tmpfile, err := ioutil.TempFile("", "gce-metadata")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpfile.Name())
+		_, err = tmpfile.WriteString(kv[k])
+		if closeErr := tmpfile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "could not write metadata to temp file")
+		}
+		added = append(added, fmt.Sprintf("%s%s=%s", vm.MetadataPrefix, k, tmpfile.Name()))
+	}
+
+	if len(added) > 0 {
+		args := []string{"compute", "instances", "add-metadata", v.Name,
+			"--project", p.opts.Project, "--zone", v.Zone,
+			"--metadata-from-file", strings.Join(added, ",")}
+		if err := runCommand(ctx, args); err != nil {
+			return err
+		}
+	}
+	if len(removed) > 0 {
+		args := []string{"compute", "instances", "remove-metadata", v.Name,
+			"--project", p.opts.Project, "--zone", v.Zone,
+			"--keys", strings.Join(removed, ",")}
+		if err := runCommand(ctx, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start is part of the vm.Provider interface.
+func (p *Provider) Start(ctx context.Context, vms vm.List) error {
+	return p.runInstancesCommand(ctx, vms, "start")
+}
+
+// Stop is part of the vm.Provider interface. gcloud refuses to stop instances
+// with local SSDs unless it is told whether to discard their contents, which
+// are preserved unless --gce-discard-local-ssd is given.
+func (p *Provider) Stop(ctx context.Context, vms vm.List) error {
+	return p.runInstancesCommand(ctx, vms, "stop",
+		fmt.Sprintf("--discard-local-ssd=%t", p.opts.DiscardLocalSSD))
+}
+
+// runInstancesCommand runs gcloud compute instances <verb> on the VMs of each
+// zone in parallel. gcloud waits for the operation to complete.
+func (p *Provider) runInstancesCommand(ctx context.Context, vms vm.List, verb string, flags ...string) error {
+	zoneMap := make(map[string][]string)
+	for _, v := range vms {
+		if v.Provider != ProviderName {
+			return errors.Errorf("%s received VM instance from %s", ProviderName, v.Provider)
+		}
+		zoneMap[v.Zone] = append(zoneMap[v.Zone], v.Name)
+	}
+
+	var g errgroup.Group
+	for zone, names := range zoneMap {
+		args := append([]string{"compute", "instances", verb}, flags...)
+		args = append(args, "--project", p.opts.Project, "--zone", zone)
+		args = append(args, names...)
+		g.Go(func() error {
+			return runCommand(ctx, args)
+		})
+	}
+	return g.Wait()
+}
+
+// ZoneCatalog is part of the vm.Provider interface. The zones are the same
+// in every project.
+func (p *Provider) ZoneCatalog(ctx context.Context) (vm.ZoneCatalog, error) {
+	args := []string{"compute", "zones", "list", "--project", p.opts.Project, "--format", "json"}
+	var zones []struct {
+		Name string
+		// Region is the URL of the region.
+		Region string
+	}
+	if err := runJSONCommand(ctx, args, &zones); err != nil {
+		return nil, err
+	}
+	ret := make(vm.ZoneCatalog, len(zones))
+	for _, z := range zones {
+		ret[z.Name] = z.Region[strings.LastIndex(z.Region, "/")+1:]
+	}
+	return ret, nil
+}
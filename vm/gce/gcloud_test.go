@@ -0,0 +1,157 @@
+package gce
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/roachprod/vm"
+)
+
+// stubGcloud replaces the gcloud CLI with fn for the duration of the test.
+func stubGcloud(t *testing.T, fn func(args []string) ([]byte, error)) {
+	old := gcloudOutput
+	gcloudOutput = func(_ context.Context, args []string, _ bool) ([]byte, error) {
+		return fn(args)
+	}
+	t.Cleanup(func() { gcloudOutput = old })
+}
+
+// argValue returns the value of the flag in args, or "" if it is absent.
+func argValue(args []string, flag string) string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// TestMetadataRoundTrip checks that the metadata which SetMetadata adds to an
+// instance is read back by GetMetadata, and that it leaves the other metadata
+// alone.
+func TestMetadataRoundTrip(t *testing.T) {
+	items := map[string]string{"startup-script": "#!/bin/bash"}
+	stubGcloud(t, func(args []string) ([]byte, error) {
+		switch strings.Join(args[:3], " ") {
+		case "compute instances describe":
+			type item struct{ Key, Value string }
+			var parsed struct {
+				Metadata struct{ Items []item }
+			}
+			for k, v := range items {
+				parsed.Metadata.Items = append(parsed.Metadata.Items, item{k, v})
+			}
+			return json.Marshal(parsed)
+		case "compute instances add-metadata":
+			for _, kv := range strings.Split(argValue(args, "--metadata-from-file"), ",") {
+				parts := strings.SplitN(kv, "=", 2)
+				value, err := ioutil.ReadFile(parts[1])
+				if err != nil {
+					return nil, err
+				}
+				items[parts[0]] = string(value)
+			}
+			return nil, nil
+		case "compute instances remove-metadata":
+			for _, k := range strings.Split(argValue(args, "--keys"), ",") {
+				delete(items, k)
+			}
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("unexpected command %v", args)
+		}
+	})
+
+	p := &Provider{}
+	v := vm.VM{Name: "user-test-0001", Zone: "us-east1-b"}
+	ctx := context.Background()
+	if err := p.SetMetadata(ctx, v, map[string]string{
+		"lock":  "user, 2020-01-02",
+		"notes": "a=b,\"c\"\nd",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetMetadata(ctx, v, map[string]string{"lock": ""}); err != nil {
+		t.Fatal(err)
+	}
+	md, err := p.GetMetadata(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md) != 1 || md["notes"] != "a=b,\"c\"\nd" {
+		t.Errorf("unexpected metadata %v", md)
+	}
+	if items["startup-script"] != "#!/bin/bash" {
+		t.Errorf("the other metadata was changed: %v", items)
+	}
+}
+
+// TestStopLocalSSD checks that Stop preserves the contents of local SSDs
+// unless they may be discarded.
+func TestStopLocalSSD(t *testing.T) {
+	for _, discard := range []bool{false, true} {
+		var stopped [][]string
+		stubGcloud(t, func(args []string) ([]byte, error) {
+			stopped = append(stopped, args)
+			return nil, nil
+		})
+		p := &Provider{}
+		p.opts.DiscardLocalSSD = discard
+		if err := p.Stop(context.Background(), vm.List{
+			{Name: "user-test-0001", Provider: ProviderName, Zone: "us-east1-b"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf("--discard-local-ssd=%t", discard)
+		if len(stopped) != 1 || strings.Join(stopped[0][:4], " ") != "compute instances stop "+expected {
+			t.Errorf("expected a single stop with %s, got %v", expected, stopped)
+		}
+	}
+}
+
+// TestDescribeUnknownZone checks that Describe fails without running gcloud
+// when the zone of the VM is unknown.
+func TestDescribeUnknownZone(t *testing.T) {
+	stubGcloud(t, func(args []string) ([]byte, error) {
+		t.Errorf("unexpected command %v", args)
+		return nil, nil
+	})
+	_, err := (&Provider{}).Describe(context.Background(), vm.VM{Name: "user-test-0001", ProviderID: "i-1"})
+	if err == nil || err.Error() != "zone of user-test-0001 is unknown" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// TestRetryClassifier checks that rate limited requests are retried, except by
+// the commands which create resources, and that requests which failed because
+// the API was unavailable are only retried by the commands which read
+// resources.
+func TestRetryClassifier(t *testing.T) {
+	limited := errors.New("ERROR: (gcloud.compute.instances.list) Rate Limit Exceeded")
+	unavailable := errors.New("ERROR: (gcloud.compute.instances.delete) Error 503 (Service Unavailable): backendError")
+	quota := errors.New("ERROR: (gcloud.compute.instances.create) Quota 'CPUS' exceeded. Limit: 24.0 in region us-east1.")
+	for _, tc := range []struct {
+		args     []string
+		err      error
+		expected bool
+	}{
+		{[]string{"compute", "instances", "list"}, limited, true},
+		{[]string{"compute", "instances", "list"}, unavailable, true},
+		{[]string{"compute", "instances", "describe", "user-test-0001"}, unavailable, true},
+		{[]string{"config", "get-value", "account"}, unavailable, true},
+		{[]string{"compute", "instances", "delete", "user-test-0001"}, limited, true},
+		{[]string{"compute", "instances", "delete", "user-test-0001"}, unavailable, false},
+		{[]string{"compute", "instances", "create", "user-test-0001"}, limited, false},
+		{[]string{"compute", "instances", "create", "user-test-0001"}, quota, false},
+		{[]string{"compute", "instances", "list"}, quota, false},
+	} {
+		if actual := retryClassifier(tc.args)(tc.err); actual != tc.expected {
+			t.Errorf("%v: expected %q to be retried: %t", tc.args, tc.err, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package gce
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// The network of the first network interface of the instances, and the MTU
+// of a VPC network which does not report one.
+const (
+	defaultNetwork    = "default"
+	defaultNetworkMTU = 1460
+)
+
+// maxNetworkInterfaces is the largest number of network interfaces of any
+// instance. See networkInterfaceLimit.
+const maxNetworkInterfaces = 8
+
+// networkInterfaceLimit returns the number of network interfaces of an
+// instance with the number of vCPUs: two up to two vCPUs, and one per vCPU
+// beyond that, up to maxNetworkInterfaces.
+// See https://cloud.google.com/vpc/docs/create-use-multiple-interfaces#max-interfaces
+func networkInterfaceLimit(cpus int) int {
+	switch {
+	case cpus <= 2:
+		return 2
+	case cpus > maxNetworkInterfaces:
+		return maxNetworkInterfaces
+	default:
+		return cpus
+	}
+}
+
+// machineTypeCPUs returns the number of vCPUs of the machine type in the
+// zone.
+func (p *Provider) machineTypeCPUs(ctx context.Context, zone, machineType string) (int, error) {
+	args := []string{"compute", "machine-types", "describe", machineType,
+		"--project", p.opts.Project, "--zone", zone, "--format", "json"}
+	var parsed struct {
+		GuestCpus int
+	}
+	if err := runJSONCommand(ctx, args, &parsed); err != nil {
+		return 0, errors.Wrapf(err, "could not describe machine type %s", machineType)
+	}
+	return parsed.GuestCpus, nil
+}
+
+// checkNetworkInterfaces returns an error if the additional network
+// interfaces of opts do not each have a subnet of --gce-nic-subnets, or if the
+// machine type of any of the zones does not support as many interfaces.
+func (p *Provider) checkNetworkInterfaces(
+	ctx context.Context, zones []string, machineTypes map[string]string, opts vm.CreateOpts,
+) error {
+	extra := opts.NetworkInterfaces - 1
+	if extra < 0 {
+		extra = 0
+	}
+	if len(p.opts.NICSubnets) != extra {
+		return errors.Errorf("--%s-nic-subnets has %d subnets, but %d VPC networks are needed "+
+			"for the additional network interfaces of --nics", ProviderName, len(p.opts.NICSubnets), extra)
+	}
+	if extra == 0 {
+		return nil
+	}
+	if opts.StaticIP {
+		return errors.New("static IPs cannot be combined with several network interfaces on " + ProviderName)
+	}
+	for _, zone := range zones {
+		cpus, err := p.machineTypeCPUs(ctx, zone, machineTypes[zone])
+		if err != nil {
+			return err
+		}
+		if limit := networkInterfaceLimit(cpus); opts.NetworkInterfaces > limit {
+			return errors.Errorf("machine type %s supports at most %d network interfaces in zone %s, not %d",
+				machineTypes[zone], limit, zone, opts.NetworkInterfaces)
+		}
+	}
+	return nil
+}
+
+// checkMTU returns an error if the MTU exceeds that of the default network,
+// which is the largest that the instances can use on their first interface.
+// The networks of --gce-nic-subnets are not checked.
+func (p *Provider) checkMTU(ctx context.Context, mtu int) error {
+	args := []string{"compute", "networks", "describe", defaultNetwork,
+		"--project", p.opts.Project, "--format", "json"}
+	var parsed struct {
+		Mtu int
+	}
+	if err := runJSONCommand(ctx, args, &parsed); err != nil {
+		return errors.Wrapf(err, "could not describe network %s", defaultNetwork)
+	}
+	if parsed.Mtu == 0 {
+		parsed.Mtu = defaultNetworkMTU
+	}
+	if mtu < vm.MinMTU || mtu > parsed.Mtu {
+		return errors.Errorf("the MTU must be between %d and %d, the MTU of network %s, not %d",
+			vm.MinMTU, parsed.Mtu, defaultNetwork, mtu)
+	}
+	return nil
+}
+
+// networkInterfaceArgs returns the gcloud flags of the network interfaces of
+// the instances: the first in the default subnet, with an external address of
+// opts.NetworkTier unless opts.NoPublicIP is set, and the others in
+// --gce-nic-subnets, without one.
+func (p *Provider) networkInterfaceArgs(opts vm.CreateOpts) []string {
+	if len(p.opts.NICSubnets) == 0 {
+		args := []string{"--subnet", defaultNetwork}
+		if opts.NoPublicIP {
+			args = append(args, "--no-address")
+		} else if opts.NetworkTier != "" {
+			args = append(args, "--network-tier", opts.NetworkTier)
+		}
+		return args
+	}
+	first := "subnet=" + defaultNetwork
+	if opts.NoPublicIP {
+		first += ",no-address"
+	} else if opts.NetworkTier != "" {
+		first += ",network-tier=" + opts.NetworkTier
+	}
+	args := []string{"--network-interface", first}
+	for _, subnet := range p.opts.NICSubnets {
+		args = append(args, "--network-interface", fmt.Sprintf("subnet=%s,no-address", subnet))
+	}
+	return args
+}
+
+// toNetworkInterfaces returns the network interfaces of an instance with more
+// than one, and nil otherwise.
+func (jsonVM *jsonVM) toNetworkInterfaces() []vm.NetworkInterface {
+	if len(jsonVM.NetworkInterfaces) < 2 {
+		return nil
+	}
+	ret := make([]vm.NetworkInterface, len(jsonVM.NetworkInterfaces))
+	for i, nic := range jsonVM.NetworkInterfaces {
+		ret[i] = vm.NetworkInterface{
+			Name:      nic.Name,
+			Subnet:    nic.Subnetwork[strings.LastIndex(nic.Subnetwork, "/")+1:],
+			PrivateIP: nic.NetworkIP,
+		}
+	}
+	return ret
+}
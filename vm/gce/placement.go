@@ -0,0 +1,109 @@
+package gce
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// maxAvailabilityDomains is the largest number of availability domains over
+// which a spread placement policy distributes its instances.
+const maxAvailabilityDomains = 8
+
+// placementPolicyRegions returns the regions in which the placement policy of
+// a cluster exists.
+func (p *Provider) placementPolicyRegions(ctx context.Context, cluster string) (map[string]bool, error) {
+	args := []string{"compute", "resource-policies", "list", "--project", p.opts.Project,
+		"--filter", "name=" + vm.PlacementGroupName(cluster), "--format", "json"}
+	var policies []struct {
+		Name string
+		// Region is the URL of the region.
+		Region string
+	}
+	if err := runJSONCommand(ctx, args, &policies); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]bool, len(policies))
+	for _, policy := range policies {
+		ret[policy.Region[strings.LastIndex(policy.Region, "/")+1:]] = true
+	}
+	return ret, nil
+}
+
+// ensurePlacementPolicies creates the spread placement policy of a cluster in
+// each of the regions which does not have it yet. The regions map to the
+// number of instances to be created in them, over which the instances are
+// spread: an instance per availability domain, up to maxAvailabilityDomains.
+func (p *Provider) ensurePlacementPolicies(ctx context.Context, cluster string, regions map[string]int) error {
+	existing, err := p.placementPolicyRegions(ctx, cluster)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for region := range regions {
+		if !existing[region] {
+			missing = append(missing, region)
+		}
+	}
+	sort.Strings(missing)
+	createArgs := func(region string) []string {
+		// A spread policy has at least two availability domains.
+		domains := regions[region]
+		if domains < 2 {
+			domains = 2
+		} else if domains > maxAvailabilityDomains {
+			domains = maxAvailabilityDomains
+		}
+		return []string{"compute", "resource-policies", "create", "group-placement",
+			vm.PlacementGroupName(cluster), "--project", p.opts.Project, "--region", region,
+			"--availability-domain-count", strconv.Itoa(domains)}
+	}
+	if config.DryRun {
+		for _, region := range missing {
+			vm.PrintDryRun("gcloud", createArgs(region))
+		}
+		return nil
+	}
+	return vm.ForEach(len(missing), func(i int) error {
+		if err := runCommand(ctx, createArgs(missing[i])); err != nil {
+			return errors.Wrapf(err, "could not create the placement policy of cluster %s in region %s",
+				cluster, missing[i])
+		}
+		return nil
+	})
+}
+
+// deletePlacementPolicies deletes the placement policies of the clusters,
+// which map to the regions which their deleted instances were in. A policy
+// which is still used by other instances of its cluster is left for the last
+// of them.
+func (p *Provider) deletePlacementPolicies(ctx context.Context, clusters map[string][]string) error {
+	names := make([]string, 0, len(clusters))
+	for cluster := range clusters {
+		names = append(names, cluster)
+	}
+	sort.Strings(names)
+	for _, cluster := range names {
+		regions := append([]string(nil), clusters[cluster]...)
+		sort.Strings(regions)
+		for _, region := range regions {
+			args := []string{"compute", "resource-policies", "delete", vm.PlacementGroupName(cluster),
+				"--quiet", "--project", p.opts.Project, "--region", region}
+			if config.DryRun {
+				vm.PrintDryRun("gcloud", args)
+				continue
+			}
+			err := runCommand(ctx, args)
+			if err != nil && !strings.Contains(err.Error(), "resourceInUseByAnotherResource") &&
+				!strings.Contains(err.Error(), "was not found") {
+				return errors.Wrapf(err, "could not delete the placement policy of cluster %s", cluster)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package gce
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/vm"
+)
+
+// On-demand prices in USD for the us-east1 region. These are only intended
+// to provide a rough estimate and will drift from the published prices.
+// See https://cloud.google.com/compute/pricing
+const (
+	// Per vCPU-hour prices for the predefined n1 machine families.
+	standardVCPUPrice = 0.0475
+	highcpuVCPUPrice  = 0.0354
+	highmemVCPUPrice  = 0.0592
+
+	// The 10GB pd-ssd boot disk, at $0.17 per GB-month.
+	bootDiskPrice = 10 * 0.17 / 730
+)
+
+var machineTypeRE = regexp.MustCompile(`^n1-(standard|highcpu|highmem)-(\d+)$`)
+
+// Approximate price multipliers for regions whose pricing differs from
+// us-east1.
+var regionPriceMultipliers = map[string]float64{
+	"europe-west2": 1.2,
+	"us-west2":     1.2,
+	"asia-east1":   1.16,
+}
+
+// hourlyPrice returns the hourly on-demand price of the given machine type
+// in the given zone.
+func hourlyPrice(machineType, zone string) (float64, bool) {
+	match := machineTypeRE.FindStringSubmatch(machineType)
+	if match == nil {
+		return 0, false
+	}
+	vcpus, err := strconv.Atoi(match[2])
+	if err != nil {
+		return 0, false
+	}
+
+	var price float64
+	switch match[1] {
+	case "standard":
+		price = standardVCPUPrice
+	case "highcpu":
+		price = highcpuVCPUPrice
+	case "highmem":
+		price = highmemVCPUPrice
+	}
+	price *= float64(vcpus)
+
+	// Zones are of the form us-east1-b.
+	if i := strings.LastIndex(zone, "-"); i != -1 {
+		if m, ok := regionPriceMultipliers[zone[:i]]; ok {
+			price *= m
+		}
+	}
+	return price + bootDiskPrice, true
+}
+
+// CostEstimate is part of the vm.Provider interface. Local SSDs are not
+// included in the estimate.
+func (p *Provider) CostEstimate(vms vm.List) (float64, error) {
+	var total float64
+	for i := range vms {
+		price, ok := hourlyPrice(vms[i].MachineType, vms[i].Zone)
+		if !ok {
+			vms[i].Errors = append(vms[i].Errors, vm.ErrUnknownPrice)
+			continue
+		}
+		total += price
+	}
+	return total, nil
+}
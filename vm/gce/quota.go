@@ -0,0 +1,175 @@
+package gce
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
+)
+
+// localSSDSizeGB is the size of each local SSD of an instance.
+const localSSDSizeGB = 375
+
+// A regionQuota is one of the quotas of a region, as described by `gcloud
+// compute regions describe`.
+type regionQuota struct {
+	Metric string
+	Limit  float64
+	Usage  float64
+}
+
+// regionQuotas returns the quotas of each of the regions, keyed by metric.
+func (p *Provider) regionQuotas(
+	ctx context.Context, regions []string,
+) (map[string]map[string]regionQuota, error) {
+	quotas := make([]map[string]regionQuota, len(regions))
+	if err := vm.ForEach(len(regions), func(i int) error {
+		args := []string{"compute", "regions", "describe", regions[i],
+			"--project", p.opts.Project, "--format", "json"}
+		var parsed struct {
+			Quotas []regionQuota
+		}
+		if err := runJSONCommand(ctx, args, &parsed); err != nil {
+			return errors.Wrapf(err, "could not get the quotas of region %s", regions[i])
+		}
+		quotas[i] = make(map[string]regionQuota, len(parsed.Quotas))
+		for _, q := range parsed.Quotas {
+			quotas[i][q.Metric] = q
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]map[string]regionQuota, len(regions))
+	for i, region := range regions {
+		ret[region] = quotas[i]
+	}
+	return ret, nil
+}
+
+// diskQuota returns the regional quota which a persistent disk of the type
+// counts against, or "" if it is not checked.
+func diskQuota(diskType string) string {
+	switch diskType {
+	case "pd-ssd", "pd-balanced":
+		return "SSD_TOTAL_GB"
+	case "pd-standard":
+		return "DISKS_TOTAL_GB"
+	}
+	return ""
+}
+
+// CheckQuota is part of the vm.Provider interface. The vCPUs of the instances
+// are checked against the quota of their machine family, if their region has
+// one, or the preemptible or overall CPU quota; their addresses, persistent
+// disks and local SSDs against the quotas on in-use addresses and storage.
+// Instances created from a template are not checked.
+func (p *Provider) CheckQuota(ctx context.Context, opts vm.CreateOpts, count int) error {
+	if p.opts.Template != "" || count == 0 {
+		return nil
+	}
+	zones, zoneCounts, err := p.zoneCounts(opts, count)
+	if err != nil {
+		return err
+	}
+	machineType, err := p.machineType(opts)
+	if err != nil {
+		return err
+	}
+	var usedZones []string
+	regionSet := make(map[string]bool)
+	for i, zone := range zones {
+		if zoneCounts[i] > 0 {
+			usedZones = append(usedZones, zone)
+			regionSet[zoneRegion(zone)] = true
+		}
+	}
+	machineTypes, err := vm.MachineTypes(ctx, p, usedZones, machineType, p.opts.MachineTypeFallbacks)
+	if err != nil {
+		return err
+	}
+	regions := make([]string, 0, len(regionSet))
+	for region := range regionSet {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	quotas, err := p.regionQuotas(ctx, regions)
+	if err != nil {
+		return err
+	}
+
+	// The vCPUs of each machine type, which is described in the first zone
+	// in which it is used.
+	cpus := make(map[string]int)
+	for _, zone := range usedZones {
+		mt := machineTypes[zone]
+		if _, ok := cpus[mt]; ok {
+			continue
+		}
+		if cpus[mt], err = p.machineTypeCPUs(ctx, zone, mt); err != nil {
+			return err
+		}
+	}
+
+	bootDiskSize, bootDiskType := defaultBootDiskSizeGB, defaultBootDiskType
+	if opts.BootDiskSizeGB > 0 {
+		bootDiskSize = opts.BootDiskSizeGB
+	}
+	if opts.BootDiskType != "" {
+		bootDiskType = opts.BootDiskType
+	}
+	dataDiskSize, dataDiskType := defaultDataDiskSizeGB, defaultDataDiskType
+	if opts.DataDiskSizeGB > 0 {
+		dataDiskSize = opts.DataDiskSizeGB
+	}
+	if opts.DataDiskType != "" {
+		dataDiskType = opts.DataDiskType
+	}
+	localSSDs := 0
+	if opts.UseLocalSSD {
+		localSSDs = opts.LocalSSDCount
+		if localSSDs == 0 {
+			localSSDs = 1
+		}
+	}
+
+	demands := make(map[string]*vm.QuotaDemand)
+	for i, zone := range zones {
+		n := float64(zoneCounts[i])
+		if n == 0 {
+			continue
+		}
+		region := zoneRegion(zone)
+		mt := machineTypes[zone]
+		cpuQuota := "CPUS"
+		if family := strings.ToUpper(strings.SplitN(mt, "-", 2)[0]) + "_CPUS"; quotas[region][family].Limit > 0 {
+			cpuQuota = family
+		}
+		if opts.Preemptible && quotas[region]["PREEMPTIBLE_CPUS"].Limit > 0 {
+			cpuQuota = "PREEMPTIBLE_CPUS"
+		}
+		vm.AddQuotaDemand(demands, region, cpuQuota, "vCPUs", n*float64(cpus[mt]))
+		if !opts.NoPublicIP {
+			vm.AddQuotaDemand(demands, region, "IN_USE_ADDRESSES", "addresses", n)
+		}
+		// The boot disk of a machine image is that of its source instance.
+		if q := diskQuota(bootDiskType); q != "" && opts.Image == "" {
+			vm.AddQuotaDemand(demands, region, q, "GB", n*float64(bootDiskSize))
+		}
+		if q := diskQuota(dataDiskType); q != "" {
+			vm.AddQuotaDemand(demands, region, q, "GB", n*float64(opts.DataDiskCount*dataDiskSize))
+		}
+		vm.AddQuotaDemand(demands, region, "LOCAL_SSD_TOTAL_GB", "GB", n*float64(localSSDs*localSSDSizeGB))
+	}
+	for key, d := range demands {
+		q, ok := quotas[d.Region][d.Quota]
+		if !ok {
+			delete(demands, key)
+			continue
+		}
+		d.Limit, d.Usage = q.Limit, q.Usage
+	}
+	return vm.CheckQuotaDemands(ProviderName, demands)
+}
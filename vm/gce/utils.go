@@ -1,31 +1,52 @@
 package gce
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/pkg/errors"
 )
 
-// Startup script used to find/format/mount all local SSDs in GCE.
-// Each disk is mounted to /mnt/data<disknum> and chmoded to all users.
+// Startup script used to find/format/mount all local SSDs or persistent data
+// disks in GCE. A single disk is mounted to /mnt/data1, while several disks
+// are striped into a RAID 0 volume mounted there. The mount is chmoded to all
+// users.
 const gceLocalSSDStartupScript = `#!/usr/bin/env bash
-disknum=0
+disks=()
+mountpoint="/mnt/data1"
 # Assume google.
-for d in $(ls /dev/disk/by-id/google-local-ssd-*); do
-  let "disknum++"
-  grep -e "${d}" /etc/fstab > /dev/null
-  if [ $? -ne 0 ]; then
-    echo "Disk ${disknum}: ${d} not mounted, creating..."
-    mountpoint="/mnt/data${disknum}"
-    sudo mkdir -p "${mountpoint}"
-    sudo mkfs.ext4 -F ${d}
-    sudo mount -o discard,defaults ${d} ${mountpoint}
-    echo "${d} ${mountpoint} ext4 discard,defaults 1 1" | sudo tee -a /etc/fstab
-  else
-    echo "Disk ${disknum}: ${d} already mounted, skipping..."
-  fi
+for d in $(ls /dev/disk/by-id/google-local-ssd-* /dev/disk/by-id/google-` + dataDiskDevicePrefix + `* 2>/dev/null); do
+  disks+=("${d}")
 done
-if [ "${disknum}" -eq "0" ]; then
-  echo "No disks mounted, creating /mnt/data1"
-  sudo mkdir -p /mnt/data1
+# The startup script runs on every boot, but the disks are only set up once.
+if grep -e " ${mountpoint} " /etc/fstab > /dev/null; then
+  echo "${mountpoint} already configured, skipping..."
+elif [ "${#disks[@]}" -eq "0" ]; then
+  echo "No disks mounted, creating ${mountpoint}"
+  sudo mkdir -p ${mountpoint}
+elif [ "${#disks[@]}" -eq "1" ]; then
+  echo "One disk mounted, creating ${mountpoint}"
+  sudo mkdir -p ${mountpoint}
+  disk=${disks[0]}
+  sudo mkfs.ext4 -F ${disk}
+  sudo mount -o discard,defaults ${disk} ${mountpoint}
+  echo "${disk} ${mountpoint} ext4 discard,defaults 1 1" | sudo tee -a /etc/fstab
+else
+  echo "${#disks[@]} disks mounted, creating ${mountpoint} using RAID 0"
+  sudo apt-get update
+  sudo apt-get install -qy --no-install-recommends mdadm
+  sudo mkdir -p ${mountpoint}
+  raiddisk="/dev/md0"
+  sudo mdadm --create ${raiddisk} --level=0 --raid-devices=${#disks[@]} "${disks[@]}"
+  sudo mkfs.ext4 -F ${raiddisk}
+  sudo mount -o discard,defaults ${raiddisk} ${mountpoint}
+  echo "${raiddisk} ${mountpoint} ext4 discard,defaults 1 1" | sudo tee -a /etc/fstab
 fi
 
 sudo chmod 777 /mnt/data1
@@ -48,18 +69,240 @@ EOF
 sysctl --system  # reload sysctl settings
 `
 
+// maxStartupScriptSize is the limit on the size of a metadata value.
+// See https://cloud.google.com/compute/docs/metadata/setting-custom-metadata#limitations
+const maxStartupScriptSize = 256 << 10
+
+// startupScript returns the startup script of the named VM, which includes
+// the user-supplied script, if any.
+func startupScript(name string, opts vm.CreateOpts) (string, error) {
+	userScript, err := vm.RenderStartupScript(opts.StartupScript, name)
+	if err != nil {
+		return "", err
+	}
+	var existingDisk string
+	if opts.ExistingDisk(name) != "" {
+		existingDisk = "/dev/disk/by-id/google-" + existingDiskDeviceName
+	}
+	builtin := vm.InsertStartupScript(gceLocalSSDStartupScript, vm.ExistingDiskStartupScript(existingDisk))
+	script := vm.AppendStartupScript(builtin+vm.MTUStartupScript(opts.MTU), userScript)
+	if len(script) > maxStartupScriptSize {
+		return "", errors.Errorf("the startup script of %s is %d bytes, but GCE allows at most %d",
+			name, len(script), maxStartupScriptSize)
+	}
+	return script, nil
+}
+
 // write the startup script to a temp file.
 // Returns the path to the file.
 // After use, the caller should delete the temp file.
-func writeStartupScript() (string, error) {
+func writeStartupScript(script string) (string, error) {
 	tmpfile, err := ioutil.TempFile("", "gce-startup-script")
 	if err != nil {
 		return "", err
 	}
 	defer tmpfile.Close()
 
-	if _, err := tmpfile.WriteString(gceLocalSSDStartupScript); err != nil {
+	if _, err := tmpfile.WriteString(script); err != nil {
 		return "", err
 	}
 	return tmpfile.Name(), nil
 }
+
+// See https://cloud.google.com/compute/docs/labeling-resources#restrictions
+var (
+	labelKeyRE   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValueRE = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+)
+
+// normalizeLabels lower-cases the user-supplied labels and validates them
+// against the GCE restrictions. It returns the labels as a sorted list of
+// key=value pairs suitable for passing to gcloud.
+func normalizeLabels(labels map[string]string) ([]string, error) {
+	var ret []string
+	for k, v := range labels {
+		k = strings.ToLower(k)
+		v = strings.ToLower(v)
+		if k == "lifetime" {
+			return nil, errors.Errorf("label %q is reserved", k)
+		}
+		if !labelKeyRE.MatchString(k) {
+			return nil, errors.Errorf("invalid GCE label key %q", k)
+		}
+		if !labelValueRE.MatchString(v) {
+			return nil, errors.Errorf("invalid GCE label value %q for key %q", v, k)
+		}
+		ret = append(ret, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// checkServiceAccount returns an error if the service account does not exist
+// or is not visible to the user.
+func checkServiceAccount(ctx context.Context, email string) error {
+	args := []string{"iam", "service-accounts", "describe", email, "--format", "json"}
+	if err := runCommand(ctx, args); err != nil {
+		return errors.Wrapf(err, "could not find service account %s", email)
+	}
+	return nil
+}
+
+// projectAccess memoizes the result of checkProjectAccess, which is needed
+// only once per invocation.
+var projectAccess struct {
+	sync.Once
+	err error
+}
+
+// checkProjectAccess returns an error if the project selected by
+// --gce-project does not exist or is not visible to the user. The default
+// project is assumed to be accessible.
+func (p *Provider) checkProjectAccess(ctx context.Context) error {
+	if p.opts.Project == defaultProject {
+		return nil
+	}
+	projectAccess.Do(func() {
+		args := []string{"projects", "describe", p.opts.Project, "--format", "json"}
+		if err := runCommand(ctx, args); err != nil {
+			projectAccess.err = errors.Wrapf(err, "project %s is not accessible", p.opts.Project)
+		}
+	})
+	return projectAccess.err
+}
+
+// osImageLabel records the image from which a VM was booted, since the
+// instance itself only refers to its boot disk.
+const osImageLabel = "roachprod-os-image"
+
+// resolveOSImage returns the name of the image selected by --gce-os-image or
+// by image, resolving an image family to its latest image, and checks that it
+// can be booted from, as a Shielded VM if --gce-shielded is set. Images are
+// global resources, so they are available in every zone.
+func (p *Provider) resolveOSImage(ctx context.Context, image string) (string, error) {
+	args := []string{"compute", "images", "describe", image}
+	if family := strings.TrimPrefix(image, "family/"); family != image {
+		args = []string{"compute", "images", "describe-from-family", family}
+	}
+	args = append(args, "--project", p.opts.OSImageProject, "--format", "json")
+	var parsed struct {
+		Name       string
+		Status     string
+		Deprecated struct {
+			State string
+		}
+		GuestOsFeatures []struct {
+			Type string
+		}
+	}
+	if err := runJSONCommand(ctx, args, &parsed); err != nil {
+		return "", errors.Wrapf(err, "could not find image %s in project %s",
+			image, p.opts.OSImageProject)
+	}
+	if parsed.Status != "READY" {
+		return "", errors.Errorf("image %s is %s", parsed.Name, parsed.Status)
+	}
+	switch parsed.Deprecated.State {
+	case "OBSOLETE", "DELETED":
+		return "", errors.Errorf("image %s is %s", parsed.Name, strings.ToLower(parsed.Deprecated.State))
+	}
+	if p.opts.Shielded {
+		uefi := false
+		for _, f := range parsed.GuestOsFeatures {
+			uefi = uefi || f.Type == "UEFI_COMPATIBLE"
+		}
+		if !uefi {
+			return "", errors.Errorf("image %s is not UEFI-compatible, so it cannot boot Shielded VMs (--%s-shielded)",
+				parsed.Name, ProviderName)
+		}
+	}
+	return parsed.Name, nil
+}
+
+// transientErrorRE matches the gcloud error output for requests which were
+// rate limited, and so were rejected without effect and are expected to
+// succeed if retried. Neither RESOURCE_EXHAUSTED, which mostly reports
+// exhausted quotas or stockouts, nor backend errors, after which the request
+// may have been carried out regardless, are retried.
+var transientErrorRE = regexp.MustCompile(
+	`rateLimitExceeded|userRateLimitExceeded|Rate Limit Exceeded|Error 429|code: 429`)
+
+// isTransientError is used with vm.Retry to classify gcloud errors.
+func isTransientError(err error) bool {
+	return transientErrorRE.MatchString(err.Error())
+}
+
+// unavailableErrorRE matches the gcloud error output for requests which
+// failed because the API was temporarily unavailable (HTTP 503). They are
+// only retried by the commands which read resources, which are safe to
+// repeat.
+var unavailableErrorRE = regexp.MustCompile(
+	`backendError|Error 503|code: 503|Service Unavailable|UNAVAILABLE`)
+
+// readOnlyVerbs are the gcloud commands which only read resources.
+var readOnlyVerbs = map[string]bool{"list": true, "describe": true, "get-value": true}
+
+// retryClassifier returns the classifier of the errors of the gcloud command
+// for vm.Retry. The commands which create resources are never retried: gcloud
+// issues a request per resource, so that a command which was rate limited may
+// still have created some of them. The commands which only read resources
+// also retry the errors of unavailableErrorRE.
+func retryClassifier(args []string) func(error) bool {
+	if len(args) > 2 && args[0] == "compute" && args[2] == "create" {
+		return func(error) bool { return false }
+	}
+	for i := 1; i < len(args) && i <= 2; i++ {
+		if readOnlyVerbs[args[i]] {
+			return func(err error) bool {
+				return isTransientError(err) || unavailableErrorRE.MatchString(err.Error())
+			}
+		}
+	}
+	return isTransientError
+}
+
+// listFilter converts a vm.LabelFilter into a gcloud filter expression.
+// See `gcloud topic filters`.
+func listFilter(filter vm.LabelFilter) string {
+	terms := make([]string, len(filter))
+	for i, c := range filter {
+		terms[i] = fmt.Sprintf("labels.%s=%q", c.Key, c.Value)
+		if c.Negate {
+			terms[i] = "NOT " + terms[i]
+		}
+	}
+	return strings.Join(terms, " AND ")
+}
+
+// machineTypeSizes returns the machine types to which a vm.MachineSize is
+// mapped: those of the general purpose n2-standard family first, followed by
+// the n2-highcpu and n2-highmem families and the corresponding n1 families.
+// GPUs can only be attached to the n1 families, so only those are returned if
+// gpus is set.
+func machineTypeSizes(gpus bool) []vm.MachineTypeSize {
+	var ret []vm.MachineTypeSize
+	for _, f := range []struct {
+		family       string
+		memoryPerCPU float64
+		cpus         []int
+	}{
+		{"n2-standard", 4, []int{2, 4, 8, 16, 32, 48, 64, 80}},
+		{"n2-highcpu", 1, []int{2, 4, 8, 16, 32, 48, 64, 80}},
+		{"n2-highmem", 8, []int{2, 4, 8, 16, 32, 48, 64, 80}},
+		{"n1-standard", 3.75, []int{1, 2, 4, 8, 16, 32, 64, 96}},
+		{"n1-highcpu", 0.9, []int{2, 4, 8, 16, 32, 64, 96}},
+		{"n1-highmem", 6.5, []int{2, 4, 8, 16, 32, 64, 96}},
+	} {
+		if gpus && !strings.HasPrefix(f.family, "n1-") {
+			continue
+		}
+		for _, cpus := range f.cpus {
+			ret = append(ret, vm.MachineTypeSize{
+				Name:     fmt.Sprintf("%s-%d", f.family, cpus),
+				CPUs:     cpus,
+				MemoryGB: f.memoryPerCPU * float64(cpus),
+			})
+		}
+	}
+	return ret
+}
@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseGeoWeights converts a list of `region=weight` pairs, e.g. us-east1=3,
+// into the map of CreateOpts.GeoWeights. The weights must be positive.
+func ParseGeoWeights(pairs []string) (map[string]int, error) {
+	ret := make(map[string]int, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid region weight %q, expected region=weight", pair)
+		}
+		w, err := strconv.Atoi(parts[1])
+		if err != nil || w <= 0 {
+			return nil, errors.Errorf("the weight of region %s must be a positive integer, not %q", parts[0], parts[1])
+		}
+		if _, ok := ret[parts[0]]; ok {
+			return nil, errors.Errorf("region %s is weighted more than once", parts[0])
+		}
+		ret[parts[0]] = w
+	}
+	return ret, nil
+}
+
+// WeightedZoneCounts returns the number of nodes to place in each of the
+// zones of a provider, whose regions are given by region, so that the
+// regions of weights get shares of the nodes in proportion to their weights.
+// The nodes of a region are spread round-robin over its zones, in order, and
+// the zones of the other regions get none. The shares are rounded by largest
+// remainder, with ties going to the heavier region and then to the region
+// which sorts first, so that the same weights always yield the same counts.
+func WeightedZoneCounts(
+	provider string, zones []string, region func(zone string) (string, error), weights map[string]int, nodes int,
+) ([]int, error) {
+	regions := make([]string, 0, len(weights))
+	total := 0
+	for r, w := range weights {
+		if w <= 0 {
+			return nil, errors.Errorf("the weight of region %s must be positive, not %d", r, w)
+		}
+		regions = append(regions, r)
+		total += w
+	}
+	if len(regions) == 0 {
+		return nil, errors.New("no region weights given")
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		if weights[regions[i]] != weights[regions[j]] {
+			return weights[regions[i]] > weights[regions[j]]
+		}
+		return regions[i] < regions[j]
+	})
+
+	// The zones of each region, in order.
+	regionZones := make(map[string][]int)
+	for i, zone := range zones {
+		r, err := region(zone)
+		if err != nil {
+			return nil, err
+		}
+		regionZones[r] = append(regionZones[r], i)
+	}
+	var missing []string
+	for _, r := range regions {
+		if len(regionZones[r]) == 0 {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, errors.Errorf("%s has no zones in the weighted regions %s", provider, strings.Join(missing, ", "))
+	}
+
+	shares := make(map[string]int, len(regions))
+	remainders := make(map[string]int, len(regions))
+	left := nodes
+	for _, r := range regions {
+		shares[r] = nodes * weights[r] / total
+		remainders[r] = nodes * weights[r] % total
+		left -= shares[r]
+	}
+	byRemainder := append([]string(nil), regions...)
+	sort.SliceStable(byRemainder, func(i, j int) bool {
+		return remainders[byRemainder[i]] > remainders[byRemainder[j]]
+	})
+	for _, r := range byRemainder[:left] {
+		shares[r]++
+	}
+
+	counts := make([]int, len(zones))
+	for _, r := range regions {
+		rz := regionZones[r]
+		for j, i := range rz {
+			counts[i] = shares[r] / len(rz)
+			if j < shares[r]%len(rz) {
+				counts[i]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// LogRegionCounts logs the number of nodes which the provider places in each
+// of the weighted regions, given the number of nodes of each region.
+func LogRegionCounts(provider string, counts, weights map[string]int) {
+	regions := make([]string, 0, len(weights))
+	total, nodes := 0, 0
+	for r, w := range weights {
+		regions = append(regions, r)
+		total += w
+		nodes += counts[r]
+	}
+	sort.Strings(regions)
+	for _, r := range regions {
+		Infof("%s: placing %d of %d nodes in region %s (weight %d of %d)",
+			provider, counts[r], nodes, r, weights[r], total)
+	}
+}
@@ -0,0 +1,51 @@
+package vm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/pkg/errors"
+)
+
+// MaxLifetime returns the longest lifetime which may be given to the VM of
+// the provider p, along with what imposes it, or zero if there is no limit.
+// The limit is the lesser of config.MaxLifetime and the provider's
+// MaxPreemptibleLifetime for preemptible VMs.
+func MaxLifetime(p Provider, v VM) (time.Duration, string) {
+	max, reason := config.MaxLifetime, "--max-lifetime"
+	if limit := p.Capabilities().MaxPreemptibleLifetime; v.Preemptible && limit > 0 && (max == 0 || limit < max) {
+		max, reason = limit, fmt.Sprintf("preemptible %s VMs", p.Name())
+	}
+	return max, reason
+}
+
+// A LifetimeClamp reports that the lifetime requested for a VM was capped.
+type LifetimeClamp struct {
+	VM        string
+	Requested time.Duration
+	Applied   time.Duration
+	// Reason is what imposes the limit, as returned by MaxLifetime.
+	Reason string
+}
+
+func (c LifetimeClamp) String() string {
+	return fmt.Sprintf("%s: lifetime capped at %s by %s (%s requested)",
+		c.VM, c.Applied, c.Reason, c.Requested)
+}
+
+// ClampLifetime returns the lifetime to give to the VM of the provider p
+// when lifetime is requested, which is capped at MaxLifetime. A clamp is
+// returned if it was capped, or an error instead if
+// config.RejectLongLifetimes is set.
+func ClampLifetime(p Provider, v VM, lifetime time.Duration) (time.Duration, *LifetimeClamp, error) {
+	max, reason := MaxLifetime(p, v)
+	if max == 0 || lifetime <= max {
+		return lifetime, nil, nil
+	}
+	if config.RejectLongLifetimes {
+		return 0, nil, errors.Errorf("the lifetime of %s cannot exceed %s, the maximum for %s",
+			v.Name, max, reason)
+	}
+	return max, &LifetimeClamp{VM: v.Name, Requested: lifetime, Applied: max, Reason: reason}, nil
+}
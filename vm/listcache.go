@@ -0,0 +1,146 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/pkg/errors"
+)
+
+// listCacheMu serializes access to the cache files by concurrent callers
+// within this process. Other roachprod processes are guarded against by
+// replacing the files atomically.
+var listCacheMu sync.Mutex
+
+// A listCacheEntry is the content of a cache file.
+type listCacheEntry struct {
+	ListedAt time.Time `json:"listed_at"`
+	VMs      List      `json:"vms"`
+}
+
+// listCachePath returns the cache file of a provider, account and
+// Provider.ListScope. The scope is hashed, since it may contain characters
+// which file names cannot.
+func listCachePath(provider, account, scope string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(scope))
+	name := fmt.Sprintf("%s-%s-%x.json", provider, account, h.Sum64())
+	return filepath.Join(os.ExpandEnv(config.ListCacheDir), name)
+}
+
+// CachedList returns the VMs of the provider. If config.UseListCache is set
+// and the provider's VMs were listed within config.ListCacheTTL, they are
+// read from the cache. Otherwise they are listed and, unless the listing was
+// narrowed by the filter, the cache is updated. The VMs are listed without
+// the cache if the provider has no Provider.ListScope or its active account
+// cannot be determined. The CreatedAt of the VMs is in UTC. As with
+// Provider.List, the caller is responsible for applying the filter.
+func CachedList(ctx context.Context, p Provider, filter LabelFilter) (List, error) {
+	scope := p.ListScope()
+	if scope == "" {
+		return listUTC(ctx, p, filter)
+	}
+	account, err := p.FindActiveAccount(ctx)
+	if err != nil {
+		Debugf("not caching the VMs of %s: %s", p.Name(), err)
+		return listUTC(ctx, p, filter)
+	}
+	path := listCachePath(p.Name(), account, scope)
+
+	if config.UseListCache {
+		listCacheMu.Lock()
+		data, err := ioutil.ReadFile(path)
+		listCacheMu.Unlock()
+		var entry listCacheEntry
+		if err == nil && json.Unmarshal(data, &entry) == nil &&
+			time.Since(entry.ListedAt) < config.ListCacheTTL {
+			return entry.VMs, nil
+		}
+	}
+
+	// Only complete listings are cached.
+	if len(filter) > 0 && !config.UseListCache {
+		return listUTC(ctx, p, filter)
+	}
+
+	// Changes made while the VMs are listed may not be reflected, so the
+	// listing is only valid as of its start.
+	listedAt := time.Now()
+	vms, err := listUTC(ctx, p, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCacheFile(path, listCacheEntry{ListedAt: listedAt, VMs: vms}); err != nil {
+		// The cache is only an optimization.
+		Warningf("unable to cache the VMs of %s: %s", p.Name(), err)
+	}
+	return vms, nil
+}
+
+// listUTC lists the VMs of the provider, with their CreatedAt in UTC.
+func listUTC(ctx context.Context, p Provider, filter LabelFilter) (List, error) {
+	vms, err := p.List(ctx, filter)
+	for i := range vms {
+		vms[i].CreatedAt = vms[i].CreatedAt.UTC()
+	}
+	return vms, err
+}
+
+// writeCacheFile atomically replaces the cache file at path with v, encoded
+// as JSON.
+func writeCacheFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	listCacheMu.Lock()
+	defer listCacheMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	_, err = tmpfile.Write(data)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfile.Name(), path)
+}
+
+// InvalidateListCache drops the cached VMs of the named provider, for all
+// accounts. It must be called after the provider's VMs are changed.
+func InvalidateListCache(provider string) {
+	listCacheMu.Lock()
+	defer listCacheMu.Unlock()
+	dir := os.ExpandEnv(config.ListCacheDir)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		Warningf("unable to invalidate the cached VMs of %s: %s", provider, err)
+		return
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), provider+"-") && strings.HasSuffix(f.Name(), ".json") {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil && !os.IsNotExist(err) {
+				Warningf("unable to invalidate the cached VMs of %s: %s",
+					provider, errors.Wrap(err, f.Name()))
+			}
+		}
+	}
+}
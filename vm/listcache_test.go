@@ -0,0 +1,64 @@
+package vm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/cockroachdb/roachprod/vm/fake"
+)
+
+// TestCachedListUTC checks that the creation times of the listed VMs are in
+// UTC, whatever the zones in which the provider reports them, and that the
+// cluster's creation time and expiry are those of its earliest VM.
+func TestCachedListUTC(t *testing.T) {
+	p := fake.Register()
+	t.Cleanup(fake.Unregister)
+
+	pst := time.FixedZone("PST", -8*60*60)
+	cet := time.FixedZone("CET", 1*60*60)
+	// Node 1 is the last to be created, although its wall clock time is
+	// the earliest.
+	p.Seed(
+		vm.VM{Name: "user-test-0001", Lifetime: 12 * time.Hour,
+			CreatedAt: time.Date(2020, 1, 2, 10, 0, 0, 0, pst)},
+		vm.VM{Name: "user-test-0002", Lifetime: 12 * time.Hour,
+			CreatedAt: time.Date(2020, 1, 2, 18, 0, 0, 0, cet)},
+		vm.VM{Name: "user-test-0003", Lifetime: 12 * time.Hour,
+			CreatedAt: time.Date(2020, 1, 2, 17, 30, 0, 0, time.UTC)},
+	)
+
+	vms, err := vm.CachedList(context.Background(), p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]time.Time{
+		"user-test-0001": time.Date(2020, 1, 2, 18, 0, 0, 0, time.UTC),
+		"user-test-0002": time.Date(2020, 1, 2, 17, 0, 0, 0, time.UTC),
+		"user-test-0003": time.Date(2020, 1, 2, 17, 30, 0, 0, time.UTC),
+	}
+	for _, v := range vms {
+		if v.CreatedAt.Location() != time.UTC {
+			t.Errorf("%s was created at %s, which is not in UTC", v.Name, v.CreatedAt)
+		}
+		if v.CreatedAt != expected[v.Name] {
+			t.Errorf("%s was created at %s, expected %s", v.Name, v.CreatedAt, expected[v.Name])
+		}
+	}
+
+	clusters, bad := vm.GroupClusters(vms)
+	if len(bad) > 0 {
+		t.Fatalf("unexpected bad VMs %v", bad.Names())
+	}
+	c := clusters["user-test"]
+	if c == nil {
+		t.Fatal("cluster user-test is missing")
+	}
+	if want := expected["user-test-0002"]; c.CreatedAt != want {
+		t.Errorf("the cluster was created at %s, expected %s", c.CreatedAt, want)
+	}
+	if want := expected["user-test-0002"].Add(12 * time.Hour); c.ExpiresAt() != want {
+		t.Errorf("the cluster expires at %s, expected %s", c.ExpiresAt(), want)
+	}
+}
@@ -0,0 +1,65 @@
+package local
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// The ports of the nodes of a local cluster: node n listens on basePort +
+// (n-1)*portsPerNode for SQL and RPC, and on the next port for the admin UI,
+// as install.Cockroach.NodePort and install.GetAdminUIPort assign them.
+const (
+	basePort     = 26257
+	portsPerNode = 2
+)
+
+// distinctBlock is the /24 block of the addresses of the nodes which get
+// addresses of their own. It is clear of 127.0.0.1 and of 127.0.1.1, which
+// some distributions give the hostname. Since there is a single local
+// cluster, the block is the same for every cluster.
+const distinctBlock = "127.1.1"
+
+// maxDistinctNodes is the largest number of nodes which get addresses of
+// their own, one per host of distinctBlock.
+const maxDistinctNodes = 254
+
+// PortLabel records the first port of a local node, as allocated by
+// Allocate, on the VMs which List returns.
+const PortLabel = "roachprod-port"
+
+// An Allocation is the loopback address and the first port of the range
+// of portsPerNode ports of a node of a local cluster.
+type Allocation struct {
+	Node int
+	Host string
+	Port int
+}
+
+// Allocate returns the allocations of the nodes of the local cluster. The
+// nodes share 127.0.0.1 unless distinct is set, in which case node n gets the
+// address n of distinctBlock. Either way, each node has a range of ports of
+// its own, so that neither the addresses nor the ports of two nodes collide.
+// The allocations depend only on the number of nodes, so that a cluster which
+// is created again reuses them.
+func Allocate(nodes int, distinct bool) ([]Allocation, error) {
+	if nodes < 1 {
+		return nil, errors.New("local clusters require at least one node")
+	}
+	if last := basePort + nodes*portsPerNode - 1; last > 65535 {
+		return nil, errors.Errorf("%d local nodes need ports up to %d, beyond 65535", nodes, last)
+	}
+	if distinct && nodes > maxDistinctNodes {
+		return nil, errors.Errorf("at most %d local nodes can have addresses of their own, not %d",
+			maxDistinctNodes, nodes)
+	}
+	ret := make([]Allocation, nodes)
+	for i := range ret {
+		host := "127.0.0.1"
+		if distinct {
+			host = fmt.Sprintf("%s.%d", distinctBlock, i+1)
+		}
+		ret[i] = Allocation{Node: i + 1, Host: host, Port: basePort + i*portsPerNode}
+	}
+	return ret, nil
+}
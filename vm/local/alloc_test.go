@@ -0,0 +1,73 @@
+package local
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	for _, tc := range []struct {
+		nodes    int
+		distinct bool
+		err      string
+	}{
+		{nodes: 1},
+		{nodes: 1, distinct: true},
+		{nodes: 254},
+		{nodes: 254, distinct: true},
+		{nodes: 255},
+		{nodes: 255, distinct: true, err: "at most 254 local nodes"},
+		{nodes: 0, err: "at least one node"},
+		{nodes: 20000, err: "beyond 65535"},
+	} {
+		t.Run(fmt.Sprintf("nodes=%d,distinct=%t", tc.nodes, tc.distinct), func(t *testing.T) {
+			allocs, err := Allocate(tc.nodes, tc.distinct)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(allocs) != tc.nodes {
+				t.Fatalf("got %d allocations, expected %d", len(allocs), tc.nodes)
+			}
+			hosts := make(map[string]bool)
+			ports := make(map[int]bool)
+			for i, a := range allocs {
+				if a.Node != i+1 {
+					t.Errorf("allocation %d is of node %d", i, a.Node)
+				}
+				if tc.distinct {
+					if a.Host == "127.0.0.1" || a.Host == "127.0.1.1" {
+						t.Errorf("node %d has the reserved address %s", a.Node, a.Host)
+					}
+					if hosts[a.Host] {
+						t.Errorf("node %d shares the address %s", a.Node, a.Host)
+					}
+				} else if a.Host != "127.0.0.1" {
+					t.Errorf("node %d has the address %s rather than 127.0.0.1", a.Node, a.Host)
+				}
+				hosts[a.Host] = true
+				for port := a.Port; port < a.Port+portsPerNode; port++ {
+					if ports[port] {
+						t.Errorf("node %d shares the port %d", a.Node, port)
+					}
+					ports[port] = true
+				}
+			}
+
+			again, err := Allocate(tc.nodes, tc.distinct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(allocs, again) {
+				t.Errorf("the allocations differ between calls")
+			}
+		})
+	}
+}
@@ -1,9 +1,13 @@
 package local
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"text/tabwriter"
 	"time"
 
@@ -18,36 +22,113 @@ import (
 const ProviderName = config.Local
 
 func init() {
-	vm.Providers[ProviderName] = &Provider{}
+	vm.MustRegister(ProviderName, &Provider{})
 }
 
 // A Provider is used to create stub VM objects.
-type Provider struct{}
+type Provider struct {
+	opts providerOpts
+}
 
-// No-op implementation of ProviderFlags
-type emptyFlags struct{}
+// providerOpts implements the vm.ProviderFlags interface for the local
+// provider.
+type providerOpts struct {
+	// Addresses gives each node a loopback address of its own (see
+	// Allocate).
+	Addresses bool
+}
 
-// ConfigureCreateFlags is part of ProviderFlags.  This implementation is a no-op.
-func (o *emptyFlags) ConfigureCreateFlags(flags *pflag.FlagSet) {
+// ConfigureCreateFlags is part of ProviderFlags.
+func (o *providerOpts) ConfigureCreateFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&o.Addresses, ProviderName+"-addresses", false,
+		"Give each node of the local cluster a loopback address of its own, 127.1.1.<node>, "+
+			"rather than 127.0.0.1")
 }
 
 // ConfigureClusterFlags is part of ProviderFlags.  This implementation is a no-op.
-func (o *emptyFlags) ConfigureClusterFlags(*pflag.FlagSet) {
+func (o *providerOpts) ConfigureClusterFlags(*pflag.FlagSet) {
+}
+
+// Capabilities is part of the vm.Provider interface. Local clusters support
+// none of the optional features.
+func (p *Provider) Capabilities() vm.ProviderCapabilities {
+	return vm.ProviderCapabilities{}
+}
+
+// CheckCredentials is part of the vm.Provider interface.  This implementation is a no-op.
+func (p *Provider) CheckCredentials(ctx context.Context) error {
+	return nil
+}
+
+// CheckQuota is part of the vm.Provider interface.  This implementation is a no-op.
+func (p *Provider) CheckQuota(ctx context.Context, opts vm.CreateOpts, count int) error {
+	return nil
 }
 
 // CleanSSH is part of the vm.Provider interface.  This implementation is a no-op.
-func (p *Provider) CleanSSH() error {
+func (p *Provider) CleanSSH(ctx context.Context) error {
 	return nil
 }
 
 // ConfigSSH is part of the vm.Provider interface.  This implementation is a no-op.
-func (p *Provider) ConfigSSH() error {
+func (p *Provider) ConfigSSH(ctx context.Context) error {
 	return nil
 }
 
-// Create just creates fake host-info entries in the local filesystem
-func (p *Provider) Create(names []string, opts vm.CreateOpts) error {
+// CostEstimate is part of the vm.Provider interface. Local clusters are free.
+func (p *Provider) CostEstimate(vms vm.List) (float64, error) {
+	return 0, nil
+}
+
+// Create just creates fake host-info entries in the local filesystem, one per
+// requested name, with the loopback addresses of Allocate. Unless
+// --local-addresses is given, the nodes share 127.0.0.1 and are
+// distinguished by their ports, and each keeps its data in the
+// ${HOME}/local/<node> directory assigned by the install package.
+func (p *Provider) Create(ctx context.Context, names []string, opts vm.CreateOpts) error {
+	if len(names) == 0 {
+		return errors.New("local clusters require at least one node")
+	}
+	if opts.Preemptible {
+		return errors.New("local clusters do not support preemptible instances")
+	}
+	if opts.Image != "" || opts.OSImage != "" {
+		return errors.New("local clusters do not support images")
+	}
+	if opts.GPUCount > 0 {
+		return errors.New("local clusters do not support GPUs")
+	}
+	if opts.StartupScript != "" {
+		return errors.New("local clusters do not support startup scripts")
+	}
+	if opts.BootDiskSizeGB > 0 || opts.BootDiskType != "" {
+		return errors.New("local clusters do not support boot disk options")
+	}
+	if opts.DataDiskCount > 0 {
+		return errors.New("local clusters do not support data disks")
+	}
+	if opts.NoPublicIP {
+		return errors.New("local clusters do not support private-only VMs")
+	}
+	if opts.SSHUser != "" {
+		return errors.New("local clusters are logged into as the local user")
+	}
+
+	allocs, err := Allocate(len(names), p.opts.Addresses)
+	if err != nil {
+		return err
+	}
+	if p.opts.Addresses && runtime.GOOS == "darwin" {
+		vm.Warningf("%s: macOS only answers on 127.0.0.1 by default, so the addresses %s to %s "+
+			"must be aliased on lo0, e.g. with sudo ifconfig lo0 alias %s up", ProviderName,
+			allocs[0].Host, allocs[len(allocs)-1].Host, allocs[0].Host)
+	}
+
 	path := filepath.Join(os.ExpandEnv(config.DefaultHostDir), config.Local)
+	if config.DryRun {
+		fmt.Printf("%s: would write %d nodes to %s\n", ProviderName, len(names), path)
+		return nil
+	}
 	file, err := os.Create(path)
 	if err != nil {
 		return errors.Wrapf(err, "problem creating file %s", path)
@@ -57,9 +138,9 @@ func (p *Provider) Create(names []string, opts vm.CreateOpts) error {
 	// Align columns left and separate with at least two spaces.
 	tw := tabwriter.NewWriter(file, 0, 8, 2, ' ', 0)
 	tw.Write([]byte("# user@host\tlocality\n"))
-	for i := 0; i < len(names); i++ {
+	for _, a := range allocs {
 		tw.Write([]byte(fmt.Sprintf(
-			"%s@%s\t%s\n", config.OSUser.Username, "127.0.0.1", "region=local,zone=local")))
+			"%s@%s\t%s\n", config.OSUser.Username, a.Host, "region=local,zone=local")))
 	}
 	if err := tw.Flush(); err != nil {
 		return errors.Wrapf(err, "problem writing file %s", path)
@@ -67,51 +148,142 @@ func (p *Provider) Create(names []string, opts vm.CreateOpts) error {
 	return nil
 }
 
+// CreateImage is part of the vm.Provider interface. This implementation returns an error.
+func (p *Provider) CreateImage(ctx context.Context, vms vm.List, imageName string) ([]string, error) {
+	return nil, errors.New("local clusters do not support images")
+}
+
+// CreatedMachineTypes is part of the vm.Provider interface. The VMs of the
+// local cluster are reported with the machine type "local".
+func (p *Provider) CreatedMachineTypes(opts vm.CreateOpts) ([]string, error) {
+	return []string{ProviderName}, nil
+}
+
+// CreatedZones is part of the vm.Provider interface. The local cluster has
+// no zones.
+func (p *Provider) CreatedZones(ctx context.Context, opts vm.CreateOpts, count int) ([]string, error) {
+	return nil, nil
+}
+
 // Delete is part of the vm.Provider interface. This implementation is a no-op.
-func (p *Provider) Delete(vms vm.List) error {
+func (p *Provider) Delete(ctx context.Context, vms vm.List) error {
 	return nil
 }
 
+// Describe is part of the vm.Provider interface. Local VMs have no provider
+// metadata, so this returns the VM itself.
+func (p *Provider) Describe(ctx context.Context, v vm.VM) (map[string]interface{}, error) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var ret map[string]interface{}
+	if err := json.Unmarshal(bytes, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 // Extend is part of the vm.Provider interface.  This implementation returns an error.
-func (p *Provider) Extend(vms vm.List, lifetime time.Duration) error {
+func (p *Provider) Extend(ctx context.Context, vms vm.List, lifetime time.Duration) error {
 	return errors.New("local clusters have unlimited lifetime")
 }
 
 // FindActiveAccount is part of the vm.Provider interface. This implementation is a no-op.
-func (p *Provider) FindActiveAccount() (string, error) {
+func (p *Provider) FindActiveAccount(ctx context.Context) (string, error) {
 	return "", nil
 }
 
-// Flags is part of the vm.Provider interface. This implementation is a no-op.
+// Flags is part of the vm.Provider interface.
 func (p *Provider) Flags() vm.ProviderFlags {
-	return &emptyFlags{}
+	return &p.opts
+}
+
+// GetMetadata is part of the vm.Provider interface. This implementation returns an error.
+func (p *Provider) GetMetadata(ctx context.Context, v vm.VM) (map[string]string, error) {
+	return nil, errors.New("local clusters do not support metadata")
 }
 
 // List constructs N-many localhost VM instances, using SyncedCluster as a way to remember
-// how many nodes we should have
-func (p *Provider) List() (ret vm.List, _ error) {
+// how many nodes we should have.  The VMs are named in the same way as cloud VMs
+// (e.g. local-0001) so that they can be told apart, and carry the loopback
+// address which Create recorded and the first port of their range.
+func (p *Provider) List(ctx context.Context, filter vm.LabelFilter) (ret vm.List, _ error) {
 	if sc, ok := install.Clusters[ProviderName]; ok {
 		now := time.Now()
-		for range sc.VMs {
+		for i, host := range sc.VMs {
+			name := vm.Name(ProviderName, i+1)
 			ret = append(ret, vm.VM{
-				Name:        "localhost",
+				Name:        name,
 				CreatedAt:   now,
 				Lifetime:    time.Hour,
-				PrivateIP:   "127.0.0.1",
+				PrivateIP:   host,
 				Provider:    ProviderName,
-				ProviderID:  ProviderName,
-				PublicIP:    "127.0.0.1",
+				ProviderID:  name,
+				PublicIP:    host,
 				RemoteUser:  config.OSUser.Username,
 				VPC:         ProviderName,
 				MachineType: ProviderName,
 				Zone:        ProviderName,
+				Labels:      map[string]string{PortLabel: strconv.Itoa(basePort + i*portsPerNode)},
+				Status:      vm.StatusRunning,
 			})
 		}
 	}
 	return
 }
 
+// ListScope is part of the vm.Provider interface. The local cluster is never
+// cached.
+func (p *Provider) ListScope() string {
+	return ""
+}
+
+// MachineTypeAvailable is part of the vm.Provider interface. The local
+// cluster runs on whatever machine roachprod is run on.
+func (p *Provider) MachineTypeAvailable(ctx context.Context, zone, machineType string) (bool, error) {
+	return true, nil
+}
+
 // Name returns the name of the Provider, which will also surface in VM.Provider
 func (p *Provider) Name() string {
 	return ProviderName
 }
+
+// Reboot is part of the vm.Provider interface. This implementation returns an error.
+func (p *Provider) Reboot(ctx context.Context, vms vm.List) error {
+	return errors.New("local clusters cannot be rebooted")
+}
+
+// Resize is part of the vm.Provider interface. This implementation returns an error.
+func (p *Provider) Resize(ctx context.Context, vms vm.List, machineType string) error {
+	return errors.New("local clusters cannot be resized")
+}
+
+// SSHAccess is part of the vm.Provider interface. This implementation returns
+// the zero SSHAccess, since the local host is reached with the user's own
+// ssh configuration.
+func (p *Provider) SSHAccess() vm.SSHAccess {
+	return vm.SSHAccess{}
+}
+
+// SetMetadata is part of the vm.Provider interface. This implementation returns an error.
+func (p *Provider) SetMetadata(ctx context.Context, v vm.VM, kv map[string]string) error {
+	return errors.New("local clusters do not support metadata")
+}
+
+// Start is part of the vm.Provider interface. This implementation returns an error.
+func (p *Provider) Start(ctx context.Context, vms vm.List) error {
+	return errors.New("local clusters cannot be started")
+}
+
+// Stop is part of the vm.Provider interface. This implementation returns an error.
+func (p *Provider) Stop(ctx context.Context, vms vm.List) error {
+	return errors.New("local clusters cannot be stopped")
+}
+
+// ZoneCatalog is part of the vm.Provider interface. The local cluster has a
+// single zone.
+func (p *Provider) ZoneCatalog(ctx context.Context) (vm.ZoneCatalog, error) {
+	return vm.ZoneCatalog{config.Local: config.Local}, nil
+}
@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A Level is the severity of a log message. A message is logged only if its
+// level is at most the verbosity set by SetVerbosity.
+type Level int
+
+// The levels, in order of increasing verbosity.
+const (
+	LevelError Level = iota
+	LevelWarning
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = []string{"error", "warning", "info", "debug"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name, e.g. "warning".
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level %q: expected one of %s",
+		name, strings.Join(levelNames, ", "))
+}
+
+// A Logger receives the messages logged by the vm package, the providers and
+// the cloud package. Implementations must be safe for concurrent use.
+type Logger interface {
+	Logf(level Level, format string, args ...interface{})
+}
+
+// stdLogger writes messages to the standard logger, prefixed by their level
+// unless they are informational.
+type stdLogger struct{}
+
+func (stdLogger) Logf(level Level, format string, args ...interface{}) {
+	if level != LevelInfo {
+		format = strings.ToUpper(level.String()) + ": " + format
+	}
+	log.Printf(format, args...)
+}
+
+var logging = struct {
+	sync.RWMutex
+	logger    Logger
+	verbosity Level
+}{
+	logger:    stdLogger{},
+	verbosity: LevelInfo,
+}
+
+// SetLogger replaces the logger, which writes to the standard logger by
+// default. A nil logger discards all messages.
+func SetLogger(l Logger) {
+	logging.Lock()
+	defer logging.Unlock()
+	logging.logger = l
+}
+
+// SetVerbosity sets the most verbose level which is logged. The default is
+// LevelInfo.
+func SetVerbosity(level Level) {
+	logging.Lock()
+	defer logging.Unlock()
+	logging.verbosity = level
+}
+
+// Logf logs a message at the given level.
+func Logf(level Level, format string, args ...interface{}) {
+	logging.RLock()
+	l, verbosity := logging.logger, logging.verbosity
+	logging.RUnlock()
+	if l == nil || level > verbosity {
+		return
+	}
+	l.Logf(level, format, args...)
+}
+
+// Warningf logs a message at LevelWarning.
+func Warningf(format string, args ...interface{}) {
+	Logf(LevelWarning, format, args...)
+}
+
+// Infof logs a message at LevelInfo.
+func Infof(format string, args ...interface{}) {
+	Logf(LevelInfo, format, args...)
+}
+
+// Debugf logs a message at LevelDebug.
+func Debugf(format string, args ...interface{}) {
+	Logf(LevelDebug, format, args...)
+}
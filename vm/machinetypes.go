@@ -0,0 +1,68 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MachineTypes returns the machine type to use in each of the zones. This is
+// machineType wherever the provider offers it and otherwise the first of the
+// fallbacks which it does offer. All of the zones are checked up front, so
+// that a create spanning regions fails before any VMs are created rather than
+// in the one region which lacks the machine type. The error lists the regions
+// where none of the machine types is available.
+func MachineTypes(
+	ctx context.Context, p Provider, zones []string, machineType string, fallbacks []string,
+) (map[string]string, error) {
+	candidates := append([]string{machineType}, fallbacks...)
+	chosen := make([]string, len(zones))
+	err := ForEach(len(zones), func(i int) error {
+		for _, t := range candidates {
+			ok, err := p.MachineTypeAvailable(ctx, zones[i], t)
+			if err != nil {
+				return errors.Wrapf(err, "unable to check machine type %s in zone %s", t, zones[i])
+			}
+			if ok {
+				chosen[i] = t
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	catalog, err := CachedZoneCatalog(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string, len(zones))
+	unavailable := make(map[string][]string)
+	for i, zone := range zones {
+		switch chosen[i] {
+		case "":
+			region := catalog[zone]
+			unavailable[region] = append(unavailable[region], zone)
+		case machineType:
+		default:
+			Warningf("%s: using machine type %s in %s, where %s is not available",
+				p.Name(), chosen[i], zone, machineType)
+		}
+		ret[zone] = chosen[i]
+	}
+	if len(unavailable) > 0 {
+		regions := make([]string, 0, len(unavailable))
+		for region, zones := range unavailable {
+			regions = append(regions, fmt.Sprintf("%s (%s)", region, strings.Join(zones, ", ")))
+		}
+		sort.Strings(regions)
+		return nil, errors.Errorf("%s does not offer machine type %s in regions %s",
+			p.Name(), strings.Join(candidates, " or "), strings.Join(regions, ", "))
+	}
+	return ret, nil
+}
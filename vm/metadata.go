@@ -0,0 +1,46 @@
+package vm
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// MetadataPrefix is prepended to the keys of the metadata managed by
+// Provider.SetMetadata, to distinguish it from the metadata, labels and tags
+// which roachprod and the cloud providers use internally.
+const MetadataPrefix = "roachprod-meta-"
+
+// SecurityMetadataKey is the key of the metadata (see Provider.GetMetadata) in
+// which the providers record the hardening options of the VMs created with
+// them, e.g. Shielded VM on GCE, for auditing.
+const SecurityMetadataKey = "security"
+
+// metadataKeyRE is the intersection of the keys allowed by the providers.
+var metadataKeyRE = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// CheckMetadata returns an error if a key is not valid on all providers, or
+// if a value is longer than maxValueLen.
+func CheckMetadata(kv map[string]string, maxValueLen int) error {
+	for _, k := range MetadataKeys(kv) {
+		if !metadataKeyRE.MatchString(k) {
+			return errors.Errorf("invalid metadata key %q: must be 1-64 letters, digits, hyphens or underscores", k)
+		}
+		if len(kv[k]) > maxValueLen {
+			return errors.Errorf("the value of metadata key %q is %d bytes, but at most %d are allowed",
+				k, len(kv[k]), maxValueLen)
+		}
+	}
+	return nil
+}
+
+// MetadataKeys returns the sorted keys of kv.
+func MetadataKeys(kv map[string]string) []string {
+	ret := make([]string, 0, len(kv))
+	for k := range kv {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
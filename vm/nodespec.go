@@ -0,0 +1,142 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// A NodeSpec overrides the machine type and disks of CreateOpts for a single
+// node. The zero values of its fields leave the options unchanged.
+type NodeSpec struct {
+	MachineType string `json:"machine_type,omitempty"`
+	// CPUs and MemoryGB request a MachineSize in place of a machine type.
+	CPUs           int     `json:"cpus,omitempty"`
+	MemoryGB       float64 `json:"mem_gb,omitempty"`
+	BootDiskSizeGB int     `json:"disk_size,omitempty"`
+	BootDiskType   string  `json:"disk_type,omitempty"`
+	// LocalSSD, if set, overrides CreateOpts.UseLocalSSD.
+	LocalSSD       *bool  `json:"local_ssd,omitempty"`
+	LocalSSDCount  int    `json:"local_ssd_count,omitempty"`
+	DataDiskCount  int    `json:"data_disk_count,omitempty"`
+	DataDiskSizeGB int    `json:"data_disk_size,omitempty"`
+	DataDiskType   string `json:"data_disk_type,omitempty"`
+}
+
+// Apply returns opts with the overrides of the spec. As with --data-disk-count,
+// data disks replace the local SSDs unless the spec requests both.
+func (s NodeSpec) Apply(opts CreateOpts) CreateOpts {
+	if s.MachineType != "" {
+		opts.MachineType = s.MachineType
+		opts.Size = MachineSize{}
+	}
+	if s.CPUs > 0 {
+		opts.MachineType = ""
+		opts.Size = MachineSize{CPUs: s.CPUs, MemoryGB: s.MemoryGB}
+	}
+	if s.BootDiskSizeGB > 0 {
+		opts.BootDiskSizeGB = s.BootDiskSizeGB
+	}
+	if s.BootDiskType != "" {
+		opts.BootDiskType = s.BootDiskType
+	}
+	if s.LocalSSDCount > 0 {
+		opts.LocalSSDCount = s.LocalSSDCount
+	}
+	if s.DataDiskCount > 0 {
+		opts.DataDiskCount = s.DataDiskCount
+		opts.UseLocalSSD = false
+	}
+	if s.DataDiskSizeGB > 0 {
+		opts.DataDiskSizeGB = s.DataDiskSizeGB
+	}
+	if s.DataDiskType != "" {
+		opts.DataDiskType = s.DataDiskType
+	}
+	if s.LocalSSD != nil {
+		opts.UseLocalSSD = *s.LocalSSD
+	}
+	return opts
+}
+
+// ParseNodeSpecs parses a JSON object which maps node numbers to their
+// NodeSpecs, e.g. {"1": {"machine_type": "n2-standard-16"}}.
+func ParseNodeSpecs(data []byte) (map[int]NodeSpec, error) {
+	var raw map[string]NodeSpec
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errors.Wrap(err, "invalid node specs")
+	}
+	ret := make(map[int]NodeSpec, len(raw))
+	for key, spec := range raw {
+		node, err := strconv.Atoi(key)
+		if err != nil || node < 1 {
+			return nil, errors.Errorf("invalid node specs: %q is not a node number", key)
+		}
+		if spec.MemoryGB > 0 && spec.CPUs == 0 {
+			return nil, errors.Errorf("invalid node specs: mem_gb of node %d requires cpus", node)
+		}
+		ret[node] = spec
+	}
+	return ret, nil
+}
+
+// NodeOpts returns the options of the named VM: opts with the NodeSpec of its
+// node, if opts.NodeSpecs has one.
+func NodeOpts(name string, opts CreateOpts) CreateOpts {
+	node, err := NodeNumber(name)
+	if err != nil {
+		return opts
+	}
+	if spec, ok := opts.NodeSpecs[node]; ok {
+		return spec.Apply(opts)
+	}
+	return opts
+}
+
+// GroupByNodeSpec groups the names of VMs whose options are the same given
+// the NodeSpecs of opts, in the order of their nodes. The VMs without a spec
+// of their own form the first group.
+func GroupByNodeSpec(names []string, opts CreateOpts) [][]string {
+	if len(opts.NodeSpecs) == 0 {
+		return [][]string{names}
+	}
+	// The VMs without a spec of their own are grouped under node 0.
+	groups := make(map[int][]string)
+	for _, name := range names {
+		node, err := NodeNumber(name)
+		if _, ok := opts.NodeSpecs[node]; err != nil || !ok {
+			node = 0
+		}
+		groups[node] = append(groups[node], name)
+	}
+	nodes := make([]int, 0, len(groups))
+	for node := range groups {
+		nodes = append(nodes, node)
+	}
+	sort.Ints(nodes)
+	ret := make([][]string, len(nodes))
+	for i, node := range nodes {
+		ret[i] = groups[node]
+	}
+	return ret
+}
+
+// CreateWithNodeSpecs creates the named VMs on the provider, honoring the
+// NodeSpecs of opts. The VMs whose options are the same are created together,
+// while the groups of VMs with different options are created one after the
+// other, so that they do not race to create the firewall or placement group
+// of their cluster.
+func CreateWithNodeSpecs(ctx context.Context, p Provider, names []string, opts CreateOpts) error {
+	if len(opts.NodeSpecs) == 0 {
+		return p.Create(ctx, names, opts)
+	}
+	for _, group := range GroupByNodeSpec(names, opts) {
+		if err := p.Create(ctx, group, NodeOpts(group[0], opts)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
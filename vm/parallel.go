@@ -0,0 +1,299 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/pkg/errors"
+)
+
+// ForEach invokes fn for each index in [0, n), running at most
+// config.MaxConcurrency invocations at a time. Every invocation runs to
+// completion, even if others fail, and all of the errors are returned
+// together.
+func ForEach(n int, fn func(i int) error) error {
+	limit := config.MaxConcurrency
+	if limit <= 0 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = fn(i)
+		}()
+	}
+	wg.Wait()
+
+	return CombineErrors(errs)
+}
+
+// cloudOps is the semaphore which bounds the number of cloud API requests in
+// flight to config.Parallelism. It is acquired by Retry around each request,
+// rather than by ForEach, FanOut and ProvidersParallel, since those nest: an
+// operation waiting for its callbacks must not hold a slot which they need.
+var cloudOps struct {
+	sync.Once
+	sem chan struct{}
+}
+
+// acquireCloudOp blocks until a cloud API request may be issued, or the
+// context is cancelled, and returns the function which releases its slot.
+func acquireCloudOp(ctx context.Context) (func(), error) {
+	cloudOps.Do(func() {
+		if config.Parallelism > 0 {
+			cloudOps.sem = make(chan struct{}, config.Parallelism)
+		}
+	})
+	if cloudOps.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case cloudOps.sem <- struct{}{}:
+		return func() { <-cloudOps.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// CombineErrors returns a single error describing all of the non-nil errors,
+// or nil if there are none.
+func CombineErrors(errs []error) error {
+	var msgs []string
+	var first error
+	for _, err := range errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			msgs = append(msgs, err.Error())
+		}
+	}
+	switch len(msgs) {
+	case 0:
+		return nil
+	case 1:
+		return first
+	default:
+		return fmt.Errorf("%d operations failed:\n%s", len(msgs), strings.Join(msgs, "\n"))
+	}
+}
+
+// A FanOutResult is the outcome of the callback of FanOutResults for the VMs
+// of one provider.
+type FanOutResult struct {
+	Provider string
+	VMs      List
+	Err      error
+}
+
+// FanOutResults collates a collection of VMs by their provider and invokes
+// the callback for each provider in parallel. Every callback runs to
+// completion, and the results are returned sorted by provider name.
+func FanOutResults(
+	ctx context.Context, list List, action func(context.Context, Provider, List) error,
+) []FanOutResult {
+	var m = map[string]List{}
+	for _, vm := range list {
+		m[vm.Provider] = append(m[vm.Provider], vm)
+	}
+
+	results := make([]FanOutResult, 0, len(m))
+	for name, vms := range m {
+		results = append(results, FanOutResult{Provider: name, VMs: vms})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Provider < results[j].Provider })
+
+	var wg sync.WaitGroup
+	for i := range results {
+		r := &results[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer trackInFlight(fmt.Sprintf("%s: %v", r.Provider, r.VMs.Names()))()
+			p, ok := LookupProvider(r.Provider)
+			if !ok {
+				r.Err = errors.Errorf("unknown provider name: %s", r.Provider)
+				return
+			}
+			r.Err = action(ctx, p, r.VMs)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// A FanOutError is returned by FanOut if the callback failed for some of the
+// providers. It retains the results of all of them, so that callers can
+// tell which VMs were affected.
+type FanOutError struct {
+	Results []FanOutResult
+}
+
+// Failed returns the VMs of the providers for which the callback failed.
+func (e *FanOutError) Failed() List {
+	var ret List
+	for _, r := range e.Results {
+		if r.Err != nil {
+			ret = append(ret, r.VMs...)
+		}
+	}
+	return ret
+}
+
+// Succeeded returns the VMs of the providers for which the callback
+// succeeded.
+func (e *FanOutError) Succeeded() List {
+	var ret List
+	for _, r := range e.Results {
+		if r.Err == nil {
+			ret = append(ret, r.VMs...)
+		}
+	}
+	return ret
+}
+
+// Error summarizes the outcome for each provider, e.g.:
+//
+//	failed for 3 of 7 VMs:
+//	  aws: 3 VMs failed: ...
+//	  gce: 4 VMs succeeded
+func (e *FanOutError) Error() string {
+	failed, total := len(e.Failed()), 0
+	var lines []string
+	for _, r := range e.Results {
+		total += len(r.VMs)
+		if r.Err != nil {
+			lines = append(lines, fmt.Sprintf("  %s: %d VMs failed: %s", r.Provider, len(r.VMs), r.Err))
+		} else {
+			lines = append(lines, fmt.Sprintf("  %s: %d VMs succeeded", r.Provider, len(r.VMs)))
+		}
+	}
+	return fmt.Sprintf("failed for %d of %d VMs:\n%s", failed, total, strings.Join(lines, "\n"))
+}
+
+// ResolveNames returns the VMs with the given names, which are looked up on
+// the named providers. Rather than listing every VM of a provider, only the
+// VMs whose ClusterLabel matches the cluster of each name are listed, unless
+// they are available from the list cache. VMs which predate the
+// ClusterLabel are then looked up in a complete listing. An error names the
+// VMs which could not be attributed to any of the providers.
+func ResolveNames(ctx context.Context, names []string, providers []string) (List, error) {
+	wanted := make(map[string]bool, len(names))
+	var filters []LabelFilter
+	seen := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+		// The cluster name is derived as in StandardLabels.
+		cluster := name
+		if i := strings.LastIndex(name, "-"); i > 0 {
+			cluster = name[:i]
+		}
+		if !seen[cluster] {
+			seen[cluster] = true
+			filters = append(filters, LabelFilter{{Key: ClusterLabel, Value: cluster}})
+		}
+	}
+
+	var mu sync.Mutex
+	found := make(map[string]VM, len(names))
+	lookup := func(ctx context.Context, p Provider, filter LabelFilter) error {
+		vms, err := CachedList(ctx, p, filter)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, v := range filter.Apply(vms) {
+			if wanted[v.Name] {
+				found[v.Name] = v
+			}
+		}
+		return nil
+	}
+
+	if err := ProvidersParallel(ctx, providers, func(ctx context.Context, p Provider) error {
+		for _, filter := range filters {
+			if err := lookup(ctx, p, filter); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(found) < len(wanted) {
+		if err := ProvidersParallel(ctx, providers, func(ctx context.Context, p Provider) error {
+			return lookup(ctx, p, nil)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	var ret List
+	var missing []string
+	for _, name := range names {
+		if v, ok := found[name]; ok {
+			ret = append(ret, v)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.Errorf("unable to find VMs %v on providers %v", missing, providers)
+	}
+	return ret, nil
+}
+
+// inFlight holds the descriptions of the provider operations in progress.
+var inFlight struct {
+	sync.Mutex
+	ops  map[int]string
+	next int
+}
+
+// trackInFlight records that the described operation is in progress, until
+// the returned function is called.
+func trackInFlight(desc string) func() {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	if inFlight.ops == nil {
+		inFlight.ops = make(map[int]string)
+	}
+	id := inFlight.next
+	inFlight.next++
+	inFlight.ops[id] = desc
+	return func() {
+		inFlight.Lock()
+		defer inFlight.Unlock()
+		delete(inFlight.ops, id)
+	}
+}
+
+// InFlight returns the sorted descriptions of the operations started via
+// ForProvider, ProvidersParallel, ProvidersSequential or FanOut which have
+// not completed, e.g. to report what was still running when a command timed
+// out.
+func InFlight() []string {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	ret := make([]string, 0, len(inFlight.ops))
+	for _, desc := range inFlight.ops {
+		ret = append(ret, desc)
+	}
+	sort.Strings(ret)
+	return ret
+}
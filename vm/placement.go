@@ -0,0 +1,31 @@
+package vm
+
+import "github.com/pkg/errors"
+
+// PlacementSpread is the placement policy of CreateOpts.Placement which puts
+// the VMs on distinct hardware, so that the failure of a single host or rack
+// takes out at most one of them: an AWS spread placement group, a GCE spread
+// placement policy, or an Azure availability set.
+const PlacementSpread = "spread"
+
+// PlacementLabel is attached to the VMs created with CreateOpts.Placement,
+// whose policy is its value.
+const PlacementLabel = "roachprod-placement"
+
+// PlacementGroupName returns the name of the placement group of a cluster,
+// which the providers give to the placement groups, policies or availability
+// sets which they create for it.
+func PlacementGroupName(cluster string) string {
+	return cluster + "-pg"
+}
+
+// ValidatePlacement returns an error unless policy is empty or one of the
+// known placement policies.
+func ValidatePlacement(policy string) error {
+	switch policy {
+	case "", PlacementSpread:
+		return nil
+	default:
+		return errors.Errorf("unknown placement policy %q: expected %q", policy, PlacementSpread)
+	}
+}
@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A QuotaDemand is the amount of one of a provider's quotas in a region which
+// the VMs to be created would use, along with the limit of the quota and its
+// current usage, as checked by Provider.CheckQuota.
+type QuotaDemand struct {
+	Region string
+	// Quota is the provider's name of the quota, e.g. CPUS or L-1216C47A.
+	Quota string
+	// Unit is the unit of the amounts, e.g. vCPUs or GB.
+	Unit      string
+	Limit     float64
+	Usage     float64
+	Requested float64
+}
+
+// AddQuotaDemand adds the requested amount of a quota to the demand in the
+// region, whose limit and usage are filled in later.
+func AddQuotaDemand(demands map[string]*QuotaDemand, region, quota, unit string, requested float64) {
+	if requested <= 0 {
+		return
+	}
+	key := region + "/" + quota
+	if d, ok := demands[key]; ok {
+		d.Requested += requested
+		return
+	}
+	demands[key] = &QuotaDemand{Region: region, Quota: quota, Unit: unit, Requested: requested}
+}
+
+// CheckQuotaDemands returns an error which names each of the demands that
+// would exceed its quota, and by how much.
+func CheckQuotaDemands(provider string, demands map[string]*QuotaDemand) error {
+	var exceeded []string
+	for _, d := range demands {
+		if over := d.Usage + d.Requested - d.Limit; over > 0 {
+			exceeded = append(exceeded, fmt.Sprintf(
+				"would exceed the %s quota in region %s by %g %s (limit %g, %g in use, %g requested)",
+				d.Quota, d.Region, over, d.Unit, d.Limit, d.Usage, d.Requested))
+		}
+	}
+	if len(exceeded) == 0 {
+		return nil
+	}
+	sort.Strings(exceeded)
+	return errors.Errorf("creating the %s VMs %s; raise the quotas, use other regions, "+
+		"or skip this check with --skip-quota-check", provider, strings.Join(exceeded, "; "))
+}
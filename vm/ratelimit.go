@@ -0,0 +1,95 @@
+package vm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/roachprod/config"
+)
+
+// A RateLimiter is a token bucket which limits the rate of a provider's API
+// requests to config.ProviderQPS, with bursts of up to one second's worth of
+// requests. Each provider has its own RateLimiter, which is shared by all of
+// its requests. The zero value is ready to use, and limits the requests to
+// config.MaxQPS.
+type RateLimiter struct {
+	// Provider is the name of the provider whose rate is used.
+	Provider string
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	// pausedUntil holds back all requests after the API has pushed back.
+	pausedUntil time.Time
+}
+
+// Wait blocks until a request may be issued or the context is canceled. It
+// is a no-op on a nil RateLimiter or if the rate of its provider is not
+// positive.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		wait, ok := l.reserve(time.Now())
+		if ok {
+			return nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// reserve takes a token if one is available and otherwise returns how long to
+// wait before trying again.
+func (l *RateLimiter) reserve(now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	qps := config.ProviderQPS(l.Provider)
+	if qps <= 0 {
+		return 0, true
+	}
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now), false
+	}
+	burst := qps
+	if burst < 1 {
+		burst = 1
+	}
+	l.tokens += now.Sub(l.last).Seconds() * qps
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - l.tokens) / qps * float64(time.Second)), false
+}
+
+// Pause holds back all requests for at least d, after which the bucket starts
+// out empty. It is
+// used when the API rejects a request due to rate limiting, so that all of
+// the concurrent requests back off rather than only the rejected one.
+func (l *RateLimiter) Pause(d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.pause(time.Now(), d)
+}
+
+func (l *RateLimiter) pause(now time.Time, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := now.Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	l.tokens, l.last = 0, l.pausedUntil
+}
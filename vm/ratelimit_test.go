@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/roachprod/config"
+)
+
+// setQPS sets config.MaxQPS and the config.ProviderMaxQPS of the providers
+// for the duration of the test.
+func setQPS(t *testing.T, max float64, providers map[string]float64) {
+	oldMax, oldProviders := config.MaxQPS, config.ProviderMaxQPS
+	config.MaxQPS, config.ProviderMaxQPS = max, providers
+	t.Cleanup(func() { config.MaxQPS, config.ProviderMaxQPS = oldMax, oldProviders })
+}
+
+// TestRateLimiterReserve checks the bucket maths of a RateLimiter, with the
+// rate of its provider rather than the default one.
+func TestRateLimiterReserve(t *testing.T) {
+	setQPS(t, 100, map[string]float64{"slow": 2})
+	l := RateLimiter{Provider: "slow"}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.last = now
+
+	// The bucket holds a burst of one second's worth of requests, i.e. two,
+	// however long it has been since the last request.
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if wait, ok := l.reserve(now); !ok {
+			t.Fatalf("request %d of the burst waits %s", i+1, wait)
+		}
+	}
+	if wait, ok := l.reserve(now); ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected the third request to wait 500ms, got %s (%t)", wait, ok)
+	}
+	// A quarter of a second refills half a token.
+	now = now.Add(250 * time.Millisecond)
+	if wait, ok := l.reserve(now); ok || wait != 250*time.Millisecond {
+		t.Fatalf("expected the third request to wait another 250ms, got %s (%t)", wait, ok)
+	}
+	now = now.Add(250 * time.Millisecond)
+	if wait, ok := l.reserve(now); !ok {
+		t.Fatalf("expected the third request to be issued, got a wait of %s", wait)
+	}
+
+	// Another provider has a rate of its own, and a zero rate is no limit.
+	setQPS(t, 0, map[string]float64{"slow": 2})
+	unlimited := RateLimiter{Provider: "fast"}
+	for i := 0; i < 1000; i++ {
+		if wait, ok := unlimited.reserve(now); !ok {
+			t.Fatalf("request %d of an unlimited provider waits %s", i+1, wait)
+		}
+	}
+}
+
+// TestRateLimiterPause checks that a paused RateLimiter holds back all
+// requests until the pause is over, and then starts with an empty bucket.
+func TestRateLimiterPause(t *testing.T) {
+	setQPS(t, 10, map[string]float64{})
+	var l RateLimiter
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.last = now.Add(-time.Minute)
+
+	l.pause(now, 3*time.Second)
+	// A shorter pause does not end the longer one.
+	l.pause(now, time.Second)
+	if wait, ok := l.reserve(now.Add(time.Second)); ok || wait != 2*time.Second {
+		t.Fatalf("expected a wait of 2s, got %s (%t)", wait, ok)
+	}
+	// The bucket starts out empty at the end of the pause.
+	now = now.Add(3 * time.Second)
+	if wait, ok := l.reserve(now); ok || wait != 100*time.Millisecond {
+		t.Fatalf("expected a wait of 100ms after the pause, got %s (%t)", wait, ok)
+	}
+	if wait, ok := l.reserve(now.Add(100 * time.Millisecond)); !ok {
+		t.Fatalf("expected a request to be issued 100ms after the pause, got a wait of %s", wait)
+	}
+}
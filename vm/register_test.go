@@ -0,0 +1,55 @@
+package vm_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/roachprod/vm"
+)
+
+func TestRegister(t *testing.T) {
+	p := registerFake(t, "fake-b")
+	registerFake(t, "fake-a")
+	if err := vm.Register("fake-b", namedFake{p, "fake-b"}); err == nil {
+		t.Error("expected a duplicate name to be rejected")
+	}
+	if err := vm.Register("fake-c", namedFake{p, "fake-b"}); err == nil {
+		t.Error("expected a name other than the provider's to be rejected")
+	}
+	if got, ok := vm.LookupProvider("fake-b"); !ok || got.Name() != "fake-b" {
+		t.Errorf("LookupProvider returned %v, %t", got, ok)
+	}
+
+	// The providers may be read while another is registered and
+	// unregistered.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := vm.Register("fake-x", namedFake{p, "fake-x"}); err != nil {
+				t.Error(err)
+			}
+			vm.Unregister("fake-x")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			vm.LookupProvider("fake-x")
+			vm.AllProviders()
+		}
+	}()
+	wg.Wait()
+
+	var names []string
+	for _, name := range vm.AllProviderNames() {
+		if name == "fake-a" || name == "fake-b" {
+			names = append(names, name)
+		}
+	}
+	if expected := []string{"fake-a", "fake-b"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
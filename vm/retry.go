@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/cockroachdb/roachprod/config"
+)
+
+// initialRetryBackoff is the upper bound of the first backoff interval.
+const initialRetryBackoff = 500 * time.Millisecond
+
+// Retry invokes fn until it succeeds, returns an error for which isTransient
+// is false, or config.MaxRetries retries have been performed. Retries are
+// spaced using jittered exponential backoff capped at config.MaxRetryBackoff.
+// Each attempt first waits for the limiter of its provider, which may be nil,
+// and only then for one of the config.Parallelism slots shared by all
+// providers, which it holds while fn runs. A throttled provider thus never
+// holds the slots which the other providers need. A transient error pauses
+// the limiter for the duration of the backoff.
+func Retry(
+	ctx context.Context, limiter *RateLimiter, isTransient func(error) bool, fn func() error,
+) error {
+	backoff := initialRetryBackoff
+	if backoff > config.MaxRetryBackoff {
+		backoff = config.MaxRetryBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		release, err := acquireCloudOp(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn()
+		release()
+		if err == nil || !isTransient(err) || attempt > config.MaxRetries {
+			return err
+		}
+
+		// Use "full jitter" so that concurrent callers which hit the same rate
+		// limit don't retry in lockstep.
+		var wait time.Duration
+		if backoff > 0 {
+			wait = time.Duration(rand.Int63n(int64(backoff)))
+		}
+		Debugf("retrying in %s after transient error (attempt %d of %d): %s",
+			wait.Round(time.Millisecond), attempt, config.MaxRetries, err)
+		limiter.Pause(wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+
+		backoff *= 2
+		if backoff > config.MaxRetryBackoff {
+			backoff = config.MaxRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/roachprod/config"
+)
+
+// setCloudOps bounds the cloud API requests in flight to n for the duration
+// of the test.
+func setCloudOps(t *testing.T, n int) {
+	cloudOps.Do(func() {})
+	old := cloudOps.sem
+	cloudOps.sem = make(chan struct{}, n)
+	t.Cleanup(func() { cloudOps.sem = old })
+}
+
+// TestRetryThrottledProvider checks that the requests of a provider whose
+// limiter is paused do not hold the slots which the requests of another
+// provider need.
+func TestRetryThrottledProvider(t *testing.T) {
+	setCloudOps(t, 1)
+	setQPS(t, 10, map[string]float64{})
+
+	throttled, other := RateLimiter{Provider: "throttled"}, RateLimiter{Provider: "other"}
+	throttled.Pause(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- Retry(ctx, &throttled, nil, func() error {
+			t.Error("the request of the paused provider was issued")
+			return nil
+		})
+	}()
+	// Give the request of the paused provider the time to start waiting.
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Retry(context.Background(), &other, nil, func() error { return nil })
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the request of the other provider was held back by the paused provider")
+	}
+
+	cancel()
+	if err := <-blocked; err != context.Canceled {
+		t.Errorf("expected the paused request to be canceled, got %v", err)
+	}
+}
+
+// TestRetry checks that Retry retries the transient errors, up to
+// config.MaxRetries times, and returns the other errors right away.
+func TestRetry(t *testing.T) {
+	oldRetries, oldBackoff := config.MaxRetries, config.MaxRetryBackoff
+	config.MaxRetries, config.MaxRetryBackoff = 3, time.Millisecond
+	t.Cleanup(func() { config.MaxRetries, config.MaxRetryBackoff = oldRetries, oldBackoff })
+
+	errTransient, errPermanent := errors.New("transient"), errors.New("permanent")
+	isTransient := func(err error) bool { return err == errTransient }
+	for _, tc := range []struct {
+		name     string
+		errs     []error
+		expected error
+		calls    int
+	}{
+		{name: "success", errs: []error{nil}, calls: 1},
+		{name: "permanent", errs: []error{errPermanent}, expected: errPermanent, calls: 1},
+		{name: "transient then success", errs: []error{errTransient, errTransient, nil}, calls: 3},
+		{name: "transient then permanent", errs: []error{errTransient, errPermanent}, expected: errPermanent, calls: 2},
+		{name: "always transient", errs: []error{errTransient}, expected: errTransient, calls: 4},
+	} {
+		calls := 0
+		err := Retry(context.Background(), nil, isTransient, func() error {
+			err := tc.errs[len(tc.errs)-1]
+			if calls < len(tc.errs) {
+				err = tc.errs[calls]
+			}
+			calls++
+			return err
+		})
+		if err != tc.expected || calls != tc.calls {
+			t.Errorf("%s: expected %v after %d calls, got %v after %d", tc.name, tc.expected, tc.calls, err, calls)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package vm
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The maintenance policies of CreateOpts.MaintenancePolicy: during
+// maintenance of its host, a VM is either live-migrated to another host or
+// stopped, and then restarted if it restarts automatically.
+const (
+	MaintenanceMigrate   = "MIGRATE"
+	MaintenanceTerminate = "TERMINATE"
+)
+
+// MaintenancePolicies are the values of CreateOpts.MaintenancePolicy.
+var MaintenancePolicies = []string{MaintenanceMigrate, MaintenanceTerminate}
+
+// Scheduling is what the provider does with a VM when its host is under
+// maintenance or fails, as reported by List.
+type Scheduling struct {
+	// MaintenancePolicy is one of MaintenancePolicies, or empty if the
+	// provider has no choice of policy.
+	MaintenancePolicy string `json:"maintenance_policy,omitempty"`
+	// AutoRestart is true if the provider restarts or recovers the VM after
+	// its host fails.
+	AutoRestart bool `json:"auto_restart"`
+}
+
+// ValidateScheduling returns an error if the maintenance policy and
+// automatic restart of opts are unknown or cannot be honored for the VMs of
+// opts: neither preemptible VMs nor VMs with GPUs can be live-migrated, and
+// preemptible VMs are never restarted.
+func ValidateScheduling(opts CreateOpts) error {
+	switch opts.MaintenancePolicy {
+	case "", MaintenanceTerminate:
+	case MaintenanceMigrate:
+		if opts.Preemptible {
+			return errors.New("preemptible VMs cannot be live-migrated, use --maintenance-policy=" +
+				MaintenanceTerminate)
+		}
+		if opts.GPUCount > 0 {
+			return errors.New("VMs with GPUs cannot be live-migrated, use --maintenance-policy=" +
+				MaintenanceTerminate)
+		}
+	default:
+		return errors.Errorf("--maintenance-policy must be one of %s, not %q",
+			strings.Join(MaintenancePolicies, ", "), opts.MaintenancePolicy)
+	}
+	if opts.AutoRestart != nil && *opts.AutoRestart && opts.Preemptible {
+		return errors.New("preemptible VMs cannot be restarted automatically")
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// A MachineSize is a provider-independent machine size, which each provider
+// maps to the closest of its own machine types (see ClosestMachineType).
+type MachineSize struct {
+	// CPUs is the number of vCPUs, which is zero if no size was requested.
+	CPUs int `json:"cpus,omitempty"`
+	// MemoryGB is the amount of memory, which is zero if any amount will do.
+	MemoryGB float64 `json:"memory_gb,omitempty"`
+}
+
+// IsZero returns true if no size was requested.
+func (s MachineSize) IsZero() bool {
+	return s.CPUs == 0
+}
+
+func (s MachineSize) String() string {
+	if s.MemoryGB == 0 {
+		return fmt.Sprintf("%d vCPUs", s.CPUs)
+	}
+	return fmt.Sprintf("%d vCPUs and %g GB of memory", s.CPUs, s.MemoryGB)
+}
+
+// A MachineTypeSize is the size of one of a provider's machine types.
+type MachineTypeSize struct {
+	Name     string
+	CPUs     int
+	MemoryGB float64
+}
+
+// MemoryTolerance is how far, as a fraction of the requested amount, the
+// memory of the machine type chosen by ClosestMachineType may differ.
+const MemoryTolerance = 0.25
+
+// ClosestMachineType returns the machine type in types which has the
+// requested number of vCPUs and the amount of memory closest to the requested
+// amount, preferring the earlier of equally close types. It returns an error
+// if there is no such type whose memory is within MemoryTolerance of the
+// requested amount, naming the flag which selects a machine type directly.
+func ClosestMachineType(types []MachineTypeSize, size MachineSize, flag string) (string, error) {
+	var best *MachineTypeSize
+	for i := range types {
+		t := &types[i]
+		if t.CPUs != size.CPUs {
+			continue
+		}
+		if best == nil || math.Abs(t.MemoryGB-size.MemoryGB) < math.Abs(best.MemoryGB-size.MemoryGB) {
+			best = t
+		}
+		if size.MemoryGB == 0 {
+			break
+		}
+	}
+	if best == nil {
+		return "", errors.Errorf("no machine type has %d vCPUs; use %s to choose one", size.CPUs, flag)
+	}
+	if size.MemoryGB > 0 && math.Abs(best.MemoryGB-size.MemoryGB) > MemoryTolerance*size.MemoryGB {
+		return "", errors.Errorf("no machine type has %s; the closest is %s with %g GB; use %s to choose one",
+			size, best.Name, best.MemoryGB, flag)
+	}
+	return best.Name, nil
+}
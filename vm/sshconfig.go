@@ -0,0 +1,172 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SSHAccess describes how ssh reaches the VMs of a provider.
+type SSHAccess struct {
+	// KeyPath is the private key whose public half the provider registers
+	// with its VMs, or empty if ssh picks the key itself.
+	KeyPath string
+	// Bastion is the jump host of the VMs without public IPs, if any.
+	Bastion Bastion
+}
+
+// SSHAccessOf returns the SSHAccess of the named provider, or the zero
+// SSHAccess if no such provider is registered.
+func SSHAccessOf(provider string) SSHAccess {
+	p, ok := LookupProvider(provider)
+	if !ok {
+		return SSHAccess{}
+	}
+	return p.SSHAccess()
+}
+
+// BastionTo returns the bastion through which ssh reaches host, the address of
+// a VM reached as described by the access. The VMs without public IPs, whose
+// address is their private IP, are reached through the bastion, if any.
+func (a SSHAccess) BastionTo(host string) (Bastion, bool) {
+	if a.Bastion.Host == "" {
+		return Bastion{}, false
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsPrivate() {
+		return Bastion{}, false
+	}
+	return a.Bastion, true
+}
+
+// Addr returns the host:port of the bastion's ssh server.
+func (b Bastion) Addr() string {
+	if _, _, err := net.SplitHostPort(b.Host); err == nil {
+		return b.Host
+	}
+	return net.JoinHostPort(b.Host, "22")
+}
+
+// jumpSpec returns the bastion as [user@]host[:port], as taken by ssh -J and
+// ProxyJump.
+func (b Bastion) jumpSpec() string {
+	if b.User != "" {
+		return b.User + "@" + b.Host
+	}
+	return b.Host
+}
+
+// hostName returns the host of the bastion without its port.
+func (b Bastion) hostName() string {
+	if host, _, err := net.SplitHostPort(b.Host); err == nil {
+		return host
+	}
+	return b.Host
+}
+
+// An SSHTarget is the ssh configuration of a VM, as printed by `roachprod
+// ssh-config`.
+type SSHTarget struct {
+	// Name is the name of the VM, which is the host alias in ssh_config.
+	Name string `json:"name"`
+	// Host is the address at which the VM is reached (see VM.Host).
+	Host string `json:"host"`
+	DNS  string `json:"dns,omitempty"`
+	User string `json:"user"`
+	// IdentityFile is the private key with which to log into the VM.
+	IdentityFile string `json:"identity_file,omitempty"`
+	// ProxyJump is the bastion through which the VM is reached, if it has no
+	// public IP, and BastionIdentityFile the key with which to log into it.
+	ProxyJump           string `json:"proxy_jump,omitempty"`
+	BastionIdentityFile string `json:"bastion_identity_file,omitempty"`
+	// Command is a ready-to-use ssh command which logs into the VM.
+	Command string `json:"command"`
+
+	bastion Bastion
+}
+
+// NewSSHTarget returns the ssh configuration of the VM, which is reached as
+// described by access. VMs without any IP address cannot be reached.
+func NewSSHTarget(v VM, access SSHAccess) (SSHTarget, error) {
+	t := SSHTarget{
+		Name:         v.Name,
+		Host:         v.Host(),
+		DNS:          v.DNS,
+		User:         v.RemoteUser,
+		IdentityFile: access.KeyPath,
+	}
+	if t.Host == "" {
+		return SSHTarget{}, errors.Errorf("%s has no IP address", v.Name)
+	}
+	if v.PublicIP == "" && access.Bastion.Host != "" {
+		t.bastion = access.Bastion
+		t.ProxyJump = access.Bastion.jumpSpec()
+		t.BastionIdentityFile = access.Bastion.KeyPath
+	}
+
+	args := []string{"ssh"}
+	if t.IdentityFile != "" {
+		args = append(args, "-i", t.IdentityFile)
+	}
+	// ssh -J cannot be given the key of the bastion, which then has to be
+	// reached by a ProxyCommand.
+	if t.BastionIdentityFile != "" {
+		args = append(args, fmt.Sprintf("-o 'ProxyCommand=ssh %s'", strings.Join(t.bastion.sshArgs("%h:%p"), " ")))
+	} else if t.ProxyJump != "" {
+		args = append(args, "-J", t.ProxyJump)
+	}
+	if t.User != "" {
+		args = append(args, t.User+"@"+t.Host)
+	} else {
+		args = append(args, t.Host)
+	}
+	t.Command = strings.Join(args, " ")
+	return t, nil
+}
+
+// WriteSSHConfig writes an ssh_config snippet with a Host entry for each of
+// the targets, which are reached via ProxyJump through their bastion, if
+// any. The keys of the bastions are configured by Host entries of their own.
+func WriteSSHConfig(w io.Writer, targets []SSHTarget) error {
+	bastionKeys := make(map[string]string)
+	for _, t := range targets {
+		if t.BastionIdentityFile != "" {
+			bastionKeys[t.bastion.hostName()] = t.BastionIdentityFile
+		}
+	}
+	var hosts []string
+	for host := range bastionKeys {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		if _, err := fmt.Fprintf(w, "Host %s\n  IdentityFile %s\n\n", host, bastionKeys[host]); err != nil {
+			return err
+		}
+	}
+
+	for i, t := range targets {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		lines := []string{"Host " + t.Name, "  HostName " + t.Host}
+		if t.User != "" {
+			lines = append(lines, "  User "+t.User)
+		}
+		if t.IdentityFile != "" {
+			lines = append(lines, "  IdentityFile "+t.IdentityFile, "  IdentitiesOnly yes")
+		}
+		if t.ProxyJump != "" {
+			lines = append(lines, "  ProxyJump "+t.ProxyJump)
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(lines, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/pkg/errors"
+)
+
+// SSHKeyPath returns the private key which a provider should register: the
+// provider-specific key if one was given, otherwise config.SSHKeyPath if it
+// was set, otherwise the provider's default key.
+func SSHKeyPath(providerKey, defaultKey string) string {
+	switch {
+	case providerKey != "":
+		return os.ExpandEnv(providerKey)
+	case config.SSHKeyPath != "":
+		return os.ExpandEnv(config.SSHKeyPath)
+	default:
+		return os.ExpandEnv(defaultKey)
+	}
+}
+
+// SSHPublicKey returns the public half of the key pair whose private key is
+// at path. If there is no key at path, a new RSA key pair without a
+// passphrase is generated.
+func SSHPublicKey(path string) ([]byte, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		cmd := exec.Command("ssh-keygen", "-q", "-t", "rsa", "-N", "", "-f", path)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, errors.Wrapf(err, "could not generate ssh key %s: %s", path, out)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	key, err := ioutil.ReadFile(path + ".pub")
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read the public key of %s", path)
+	}
+	return key, nil
+}
+
+// ConfigSSHError is returned by ConfigSSH if some of the providers could not
+// be configured.
+type ConfigSSHError struct {
+	// Failed maps the names of the providers which failed to their errors.
+	Failed map[string]error
+	// Configured are the names of the providers which were configured.
+	Configured []string
+}
+
+func (e *ConfigSSHError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "could not configure ssh for %s", strings.Join(names, ", "))
+	if len(e.Configured) > 0 {
+		fmt.Fprintf(&buf, " (%s configured); run \"roachprod sync\" again to retry",
+			strings.Join(e.Configured, ", "))
+	}
+	for _, name := range names {
+		fmt.Fprintf(&buf, "\n  %s: %s", name, e.Failed[name])
+	}
+	return buf.String()
+}
+
+// ConfigSSH runs Provider.CleanSSH and then Provider.ConfigSSH for each of the
+// named providers, one at a time since they edit the same ssh configuration.
+// A provider which fails does not keep the others from being configured, so
+// that the clusters on those remain reachable; a *ConfigSSHError then reports
+// the status of each provider. Since Provider.ConfigSSH only adds what is
+// missing, it is safe to run again after a failure.
+func ConfigSSH(ctx context.Context, named []string) error {
+	e := &ConfigSSHError{Failed: make(map[string]error)}
+	for _, name := range named {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p, ok := LookupProvider(name)
+		if !ok {
+			return errors.Errorf("unknown vm provider: %s", name)
+		}
+		err := func() error {
+			defer trackInFlight(name)()
+			if err := p.CleanSSH(ctx); err != nil {
+				return err
+			}
+			return p.ConfigSSH(ctx)
+		}()
+		if err != nil {
+			e.Failed[name] = err
+		} else {
+			e.Configured = append(e.Configured, name)
+		}
+	}
+	if len(e.Failed) > 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package vm_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/roachprod/vm"
+	"github.com/cockroachdb/roachprod/vm/fake"
+)
+
+// namedFake is a fake provider registered under a name of its own.
+type namedFake struct {
+	*fake.Provider
+	name string
+}
+
+func (p namedFake) Name() string { return p.name }
+
+// registerFake registers a fake provider under the name for the duration of
+// the test.
+func registerFake(t *testing.T, name string) *fake.Provider {
+	p := fake.New()
+	if err := vm.Register(name, namedFake{p, name}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { vm.Unregister(name) })
+	return p
+}
+
+// TestConfigSSHContinuesPastFailures checks that ConfigSSH configures the
+// providers which follow one which fails, and reports each.
+func TestConfigSSHContinuesPastFailures(t *testing.T) {
+	first := registerFake(t, "fake-first")
+	failing := registerFake(t, "fake-failing")
+	last := registerFake(t, "fake-last")
+	failure := errors.New("no credentials")
+	failing.FailOn("ConfigSSH", failure)
+
+	err := vm.ConfigSSH(context.Background(), []string{"fake-first", "fake-failing", "fake-last"})
+	e, ok := err.(*vm.ConfigSSHError)
+	if !ok {
+		t.Fatalf("expected a *vm.ConfigSSHError, got %v", err)
+	}
+	if !reflect.DeepEqual(e.Configured, []string{"fake-first", "fake-last"}) {
+		t.Errorf("configured %v, expected fake-first and fake-last", e.Configured)
+	}
+	if len(e.Failed) != 1 || e.Failed["fake-failing"] != failure {
+		t.Errorf("unexpected failures %v", e.Failed)
+	}
+	for _, p := range []*fake.Provider{first, failing, last} {
+		if calls := p.CallsTo("ConfigSSH"); len(calls) != 1 {
+			t.Errorf("expected one call of ConfigSSH, got %d", len(calls))
+		}
+	}
+
+	// Once the provider recovers, configuring again succeeds.
+	failing.FailOn("ConfigSSH", nil)
+	if err := vm.ConfigSSH(context.Background(), []string{"fake-first", "fake-failing", "fake-last"}); err != nil {
+		t.Errorf("expected ConfigSSH to succeed, got %s", err)
+	}
+}
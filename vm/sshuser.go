@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SSHUserLabel records the user as which a VM is logged into, if it was
+// chosen when the VM was created (see CreateOpts.SSHUser), so that the VM is
+// listed with it rather than with the provider's default.
+const SSHUserLabel = "roachprod-ssh-user"
+
+// sshUserRE matches the portable names of Linux users, which are also valid
+// label values on all of the providers.
+var sshUserRE = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// ValidateSSHUser returns an error if the user cannot be passed as
+// CreateOpts.SSHUser.
+func ValidateSSHUser(user string) error {
+	if !sshUserRE.MatchString(user) {
+		return errors.Errorf("invalid ssh user %q: must be 1-32 lowercase letters, digits, hyphens "+
+			"or underscores, starting with a letter or underscore", user)
+	}
+	return nil
+}
+
+// imageUsers are the users with which the cloud images of the Linux
+// distributions are published, keyed by a part of the image names. They are
+// tried in order, so that e.g. fedora-coreos matches coreos before fedora.
+var imageUsers = []struct {
+	pattern, user string
+}{
+	{"coreos", "core"},
+	{"flatcar", "core"},
+	{"ubuntu", "ubuntu"},
+	{"debian", "admin"},
+	{"amzn", "ec2-user"},
+	{"al2023", "ec2-user"},
+	{"rhel", "ec2-user"},
+	{"suse", "ec2-user"},
+	{"centos", "centos"},
+	{"rocky", "rocky"},
+	{"fedora", "fedora"},
+}
+
+// DefaultSSHUser returns the user as which the VMs booted from the named OS
+// image are logged into, based on the distribution which the name contains,
+// or the empty string if it names none of them.
+func DefaultSSHUser(image string) string {
+	image = strings.ToLower(image)
+	for _, u := range imageUsers {
+		if strings.Contains(image, u.pattern) {
+			return u.user
+		}
+	}
+	return ""
+}
@@ -0,0 +1,138 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// StartupScriptLog is the file on each VM to which the output of the
+// user-supplied startup script is written.
+const StartupScriptLog = "/var/log/roachprod-startup-script.log"
+
+// StartupScriptData is made available to the template of a user-supplied
+// startup script, e.g. {{.Cluster}} and {{.Node}}.
+type StartupScriptData struct {
+	Cluster string
+	Node    int
+}
+
+// RenderStartupScript expands the template in a user-supplied startup script
+// for the VM with the given name, as returned by Name.
+func RenderStartupScript(script, vmName string) (string, error) {
+	if script == "" {
+		return "", nil
+	}
+	var data StartupScriptData
+	if i := strings.LastIndex(vmName, "-"); i != -1 {
+		if node, err := strconv.Atoi(vmName[i+1:]); err == nil {
+			data.Cluster, data.Node = vmName[:i], node
+		}
+	}
+	if data.Cluster == "" {
+		return "", errors.Errorf("unable to determine the cluster and node of %s", vmName)
+	}
+
+	tmpl, err := template.New("startup-script").Parse(script)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid startup script template")
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "unable to render the startup script of %s", vmName)
+	}
+	return buf.String(), nil
+}
+
+// AppendStartupScript returns the provider's builtin bash startup script,
+// extended to run a user-supplied script when the VM first boots. The user
+// script runs as root after the disks have been set up, with its output in
+// StartupScriptLog. It is embedded as base64 so that it may have an
+// interpreter of its own.
+func AppendStartupScript(builtin, script string) string {
+	if script == "" {
+		return builtin
+	}
+	return builtin + fmt.Sprintf(`
+# Run the user-supplied startup script once.
+if [ ! -e /var/lib/roachprod/startup-script ]; then
+  sudo mkdir -p /var/lib/roachprod
+  echo %s | base64 -d | sudo tee /var/lib/roachprod/startup-script > /dev/null
+  sudo chmod +x /var/lib/roachprod/startup-script
+  sudo /var/lib/roachprod/startup-script > %s 2>&1
+  echo "startup script exited with status $?" | sudo tee -a %s
+fi
+`, base64.StdEncoding.EncodeToString([]byte(script)), StartupScriptLog, StartupScriptLog)
+}
+
+// MTUStartupScript returns the part of a provider's builtin startup script
+// which sets the MTU of the network interfaces of the VM to CreateOpts.MTU,
+// or "" if it is unset. A systemd unit sets it again on every boot, since
+// the providers' DHCP servers hand out the MTU of their network.
+func MTUStartupScript(mtu int) string {
+	if mtu == 0 {
+		return ""
+	}
+	return fmt.Sprintf(`
+# Set the MTU of the network interfaces, now and on every boot.
+sudo tee /etc/systemd/system/roachprod-mtu.service > /dev/null <<'EOF'
+[Unit]
+Description=Set the MTU of the network interfaces
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=/bin/sh -c 'for dev in $(ls /sys/class/net); do [ "$dev" = lo ] || ip link set dev "$dev" mtu %d; done'
+
+[Install]
+WantedBy=multi-user.target
+EOF
+sudo systemctl daemon-reload
+sudo systemctl enable --now roachprod-mtu.service
+`, mtu)
+}
+
+// ExistingDiskStartupScript returns the part of a provider's builtin startup
+// script which mounts the existing disk of CreateOpts.ExistingDisks at the
+// device path at /mnt/data1, waiting for the disk to be attached, or "" if
+// the path is empty. The disk is only formatted if it has no filesystem. It
+// must run before the provider's own setup of the disks, which skips
+// /mnt/data1 once it is in /etc/fstab. See InsertStartupScript.
+func ExistingDiskStartupScript(device string) string {
+	if device == "" {
+		return ""
+	}
+	return fmt.Sprintf(`
+# Mount the existing disk, which keeps the data of an earlier VM.
+existing_disk="%s"
+if ! grep -e " /mnt/data1 " /etc/fstab > /dev/null; then
+  for i in $(seq 1 300); do
+    [ -e "${existing_disk}" ] && break
+    echo "Waiting for ${existing_disk} to be attached"
+    sleep 1
+  done
+  sudo mkdir -p /mnt/data1
+  if ! sudo blkid "${existing_disk}" > /dev/null; then
+    sudo mkfs.ext4 -F "${existing_disk}"
+  fi
+  sudo mount -o discard,defaults "${existing_disk}" /mnt/data1
+  echo "${existing_disk} /mnt/data1 ext4 discard,defaults,nofail 1 1" | sudo tee -a /etc/fstab
+fi
+`, device)
+}
+
+// InsertStartupScript returns the builtin startup script with the part
+// inserted after its interpreter line, so that it runs first.
+func InsertStartupScript(builtin, part string) string {
+	if part == "" {
+		return builtin
+	}
+	i := strings.Index(builtin, "\n")
+	return builtin[:i+1] + strings.TrimPrefix(part, "\n") + builtin[i+1:]
+}
@@ -1,9 +1,16 @@
 package vm
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"os"
 	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/roachprod/config"
@@ -15,7 +22,10 @@ import (
 // A VM is an abstract representation of a specific machine instance.  This type is used across
 // the various cloud providers supported by roachprod.
 type VM struct {
-	Name      string    `json:"name"`
+	Name string `json:"name"`
+	// CreatedAt is in UTC when listed by CachedList, whatever the format in
+	// which the provider reports it, so that the creation times and
+	// expirations of VMs of different providers print and compare alike.
 	CreatedAt time.Time `json:"created_at"`
 	// If non-empty, indicates that some or all of the data in the VM instance
 	// is not present or otherwise invalid.
@@ -30,50 +40,447 @@ type VM struct {
 	ProviderID string `json:"provider_id"`
 	PrivateIP  string `json:"private_ip"`
 	PublicIP   string `json:"public_ip"`
+	// The IPv6 addresses of the VM instance, if it has any. Providers which
+	// only assign globally-routable IPv6 addresses set both fields.
+	PrivateIPv6 string `json:"private_ipv6"`
+	PublicIPv6  string `json:"public_ipv6"`
+	// StaticIP is the reserved external address of a VM created with
+	// CreateOpts.StaticIP, which is then also its PublicIP.
+	StaticIP string `json:"static_ip,omitempty"`
+	// NetworkTier is that of the PublicIP, if the provider has network
+	// tiers (see CreateOpts.NetworkTier).
+	NetworkTier string `json:"network_tier,omitempty"`
 	// The username that should be used to connect to the VM.
 	RemoteUser string `json:"remote_user"`
 	// The VPC value defines an equivalency set for VMs that can route
 	// to one another via private IP addresses.  We use this later on
 	// when determining whether or not cluster member should advertise
 	// their public or private IP.
-	VPC         string `json:"vpc"`
+	VPC string `json:"vpc"`
+	// The provider-specific machine or instance type (e.g. n1-standard-4).
 	MachineType string `json:"machine_type"`
 	Zone        string `json:"zone"`
+	// The lifecycle state of the VM instance.
+	Status Status `json:"status"`
+	// Preemptible is true if the VM may be reclaimed by the provider at any
+	// time (e.g. GCE preemptible or EC2 spot instances).
+	Preemptible bool `json:"preemptible"`
+	// Scheduling is nil if the provider does not report it.
+	Scheduling *Scheduling `json:"scheduling,omitempty"`
+	// The provider-specific OS image from which the VM was booted (e.g. an
+	// AMI id), if known.
+	OSImage string `json:"os_image"`
+	// Arbitrary key/value metadata attached to the VM instance.  This
+	// includes the labels or tags that roachprod itself uses for bookkeeping.
+	Labels map[string]string `json:"labels"`
+	// The disks attached to the VM instance, including the boot disk.
+	Disks []Disk `json:"disks"`
+	// The network interfaces of the VM instance, in the order of their
+	// device indexes, if it has more than one. The first is the interface
+	// of PrivateIP and PublicIP.
+	NetworkInterfaces []NetworkInterface `json:"network_interfaces,omitempty"`
+}
+
+// A Disk is a volume attached to a VM. Fields which the provider does not
+// report when listing VMs are left empty.
+type Disk struct {
+	// The provider-specific name or id of the disk.
+	Name string `json:"name"`
+	// The device name under which the disk is attached.
+	Device string `json:"device"`
+	SizeGB int    `json:"size_gb"`
+	// The provider-specific disk type (e.g. pd-ssd or gp2).
+	Type string `json:"type"`
+	Boot bool   `json:"boot"`
+	// Local is true for local SSDs, whose data is lost when the VM stops.
+	Local bool `json:"local"`
+}
+
+// A NetworkInterface is one of the network interfaces of a VM.
+type NetworkInterface struct {
+	// The provider-specific name or id of the interface.
+	Name string `json:"name"`
+	// The provider-specific name or id of the subnet of the interface.
+	Subnet    string `json:"subnet"`
+	PrivateIP string `json:"private_ip"`
+}
+
+// MarshalJSON implements json.Marshaler. The Errors field is rendered as a
+// list of VMErrors, with their code and message, since error values do not
+// otherwise serialize in a useful way. Durations are rendered as integral
+// nanoseconds. The time at which the VM expires is added, or null if its
+// lifetime is unknown.
+func (vm VM) MarshalJSON() ([]byte, error) {
+	// The alias type drops the MarshalJSON method to avoid infinite recursion.
+	type vmAlias VM
+	errs := make([]VMError, len(vm.Errors))
+	for i, err := range vm.Errors {
+		errs[i] = VMError{Code: ErrorCodeOf(err), Message: err.Error()}
+	}
+	var expiresAt *time.Time
+	if vm.Lifetime > 0 {
+		t := vm.CreatedAt.Add(vm.Lifetime)
+		expiresAt = &t
+	}
+	return json.Marshal(struct {
+		vmAlias
+		Errors    []VMError  `json:"errors"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}{vmAlias(vm), errs, expiresAt})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, reversing MarshalJSON. Errors
+// which match one of the ErrXXX values are restored to that value. Errors
+// rendered as plain messages, as they were before they had codes, are
+// accepted as well.
+func (vm *VM) UnmarshalJSON(data []byte) error {
+	type vmAlias VM
+	parsed := struct {
+		*vmAlias
+		Errors []json.RawMessage `json:"errors"`
+	}{vmAlias: (*vmAlias)(vm)}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	vm.Errors = nil
+	for _, raw := range parsed.Errors {
+		var e VMError
+		if err := json.Unmarshal(raw, &e.Message); err != nil {
+			if err := json.Unmarshal(raw, &e); err != nil {
+				return err
+			}
+		}
+		var err error
+		if e.Code == "" || e.Code == ErrorCodeUnknown {
+			err = errors.New(e.Message)
+		} else {
+			err = &VMError{Code: e.Code, Message: e.Message}
+		}
+		for _, known := range knownErrors {
+			if e.Message == known.Message {
+				err = known
+			}
+		}
+		vm.Errors = append(vm.Errors, err)
+	}
+	return nil
+}
+
+// HasError returns true if any of the Errors of the VM has the code.
+func (vm VM) HasError(code ErrorCode) bool {
+	for _, err := range vm.Errors {
+		if ErrorCodeOf(err) == code {
+			return true
+		}
+	}
+	return false
+}
+
+// A Status describes the lifecycle state of a VM instance.
+type Status string
+
+// Values for VM.Status
+const (
+	StatusPending     Status = "pending"
+	StatusRunning     Status = "running"
+	StatusStopped     Status = "stopped"
+	StatusTerminating Status = "terminating"
+	StatusUnknown     Status = "unknown"
+	// StatusPreempted is the status of a preemptible VM which the provider
+	// has reclaimed, and which can be recreated in its place (see
+	// cloud.RecreatePreempted).
+	StatusPreempted Status = "preempted"
+)
+
+// An ErrorCode identifies the kind of problem described by a VMError. The
+// codes are part of the JSON output and do not change.
+type ErrorCode string
+
+// Values for VMError.Code
+const (
+	ErrorCodeBadNetwork    ErrorCode = "bad_network"
+	ErrorCodeInvalidName   ErrorCode = "invalid_name"
+	ErrorCodeNoMachineType ErrorCode = "no_machine_type"
+	ErrorCodeNoExpiration  ErrorCode = "no_expiration"
+	ErrorCodeBadLifetime   ErrorCode = "bad_lifetime"
+	ErrorCodeUnknownPrice  ErrorCode = "unknown_price"
+	// ErrorCodeUnknown is the code of errors which are not VMErrors.
+	ErrorCodeUnknown ErrorCode = "unknown"
+)
+
+// A VMError is one of the problems with a VM which are recorded in
+// VM.Errors, e.g. a label which the provider could not parse when listing
+// the VM. Errors with the same Code are of the same kind, whatever their
+// Message.
+type VMError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *VMError) Error() string {
+	return e.Message
+}
+
+// Wrap returns an error with the code of e whose message adds that of
+// cause, e.g. the error of parsing a label.
+func (e *VMError) Wrap(cause error) *VMError {
+	return &VMError{Code: e.Code, Message: e.Message + ": " + cause.Error()}
+}
+
+// ErrorCodeOf returns the code of err if it is a VMError, and
+// ErrorCodeUnknown otherwise.
+func ErrorCodeOf(err error) ErrorCode {
+	if e, ok := err.(*VMError); ok {
+		return e.Code
+	}
+	return ErrorCodeUnknown
 }
 
 // Error values for VM.Error
 var (
-	ErrBadNetwork   = errors.New("could not determine network information")
-	ErrInvalidName  = errors.New("invalid VM name")
-	ErrNoExpiration = errors.New("could not determine expiration")
+	ErrBadNetwork    = &VMError{ErrorCodeBadNetwork, "could not determine network information"}
+	ErrInvalidName   = &VMError{ErrorCodeInvalidName, "invalid VM name"}
+	ErrNoMachineType = &VMError{ErrorCodeNoMachineType, "could not determine machine type"}
+	ErrNoExpiration  = &VMError{ErrorCodeNoExpiration, "could not determine expiration"}
+	ErrBadLifetime   = &VMError{ErrorCodeBadLifetime, "could not parse lifetime"}
+	ErrUnknownPrice  = &VMError{ErrorCodeUnknownPrice, "could not determine price of machine type"}
 )
 
+// knownErrors are the error values above, which are restored by
+// UnmarshalJSON.
+var knownErrors = []*VMError{
+	ErrBadNetwork, ErrInvalidName, ErrNoMachineType, ErrNoExpiration, ErrBadLifetime, ErrUnknownPrice,
+}
+
 var regionRE = regexp.MustCompile(`(.*[^-])-?[a-z]$`)
 
+// AWSZoneRE matches the names of AWS availability zones, capturing their
+// region: us-east-1a, as well as Local Zones such as us-west-2-lax-1a and
+// Wavelength Zones such as us-east-1-wl1-bos-wlz-1, which regionRE does not
+// parse.
+var AWSZoneRE = regexp.MustCompile(`^([a-z]{2}(?:-gov)?-[a-z]+-[0-9]+)(?:[a-z]|-[a-z0-9-]+)$`)
+
+// numberedZoneRE matches zones which are a region without hyphens, optionally
+// followed by a numbered availability zone, as on Azure (e.g. eastus2-1).
+var numberedZoneRE = regexp.MustCompile(`^([a-z]+[0-9]*)(?:-[0-9]+)?$`)
+
+// maxNameLength is the maximum length of a GCE instance name, which is also
+// the maximum length of a DNS label.
+const maxNameLength = 63
+
+// ValidateDataDisks returns an error if the data disks requested by opts are
+// invalid or are combined with local SSDs.
+func ValidateDataDisks(opts CreateOpts) error {
+	switch {
+	case opts.DataDiskCount < 0:
+		return errors.Errorf("invalid number of data disks: %d", opts.DataDiskCount)
+	case opts.DataDiskCount == 0 && (opts.DataDiskSizeGB != 0 || opts.DataDiskType != ""):
+		return errors.New("the size and type of data disks require a data disk count")
+	case opts.DataDiskCount > 0 && opts.UseLocalSSD:
+		return errors.New("data disks cannot be combined with local SSDs")
+	case opts.DataDiskSizeGB < 0:
+		return errors.Errorf("invalid data disk size: %dGB", opts.DataDiskSizeGB)
+	case opts.DataDiskCount > 0 && len(opts.ExistingDisks) > 0:
+		return errors.New("data disks cannot be combined with existing disks")
+	}
+	return nil
+}
+
+// ValidateTemplateOpts returns an error if opts request VM properties which
+// are determined by the instance template named by flag. Options which have
+// defaults, such as UseLocalSSD and the provider's machine type, are
+// overridden by the template instead.
+func ValidateTemplateOpts(opts CreateOpts, flag string) error {
+	var conflicts []string
+	if opts.BootDiskSizeGB > 0 || opts.BootDiskType != "" {
+		conflicts = append(conflicts, "--disk-size/--disk-type")
+	}
+	if opts.DataDiskCount > 0 {
+		conflicts = append(conflicts, "--data-disk-count")
+	}
+	if opts.GPUCount > 0 {
+		conflicts = append(conflicts, "--gpu-count")
+	}
+	if opts.Image != "" {
+		conflicts = append(conflicts, "--image")
+	}
+	if opts.NoPublicIP {
+		conflicts = append(conflicts, "--no-public-ip")
+	}
+	if opts.Preemptible {
+		conflicts = append(conflicts, "--preemptible")
+	}
+	if opts.StaticIP {
+		conflicts = append(conflicts, "--static-ip")
+	}
+	if opts.Firewall {
+		conflicts = append(conflicts, "--ingress/--ingress-cidr")
+	}
+	if opts.Placement != "" {
+		conflicts = append(conflicts, "--placement")
+	}
+	if !opts.Size.IsZero() {
+		conflicts = append(conflicts, "--cpus/--mem-gb")
+	}
+	if opts.StartupScript != "" {
+		conflicts = append(conflicts, "--startup-script")
+	}
+	if len(opts.NodeSpecs) > 0 {
+		conflicts = append(conflicts, "--node-spec")
+	}
+	if opts.MTU > 0 {
+		conflicts = append(conflicts, "--mtu")
+	}
+	if opts.NetworkInterfaces > 1 {
+		conflicts = append(conflicts, "--nics")
+	}
+	if len(opts.ExistingDisks) > 0 {
+		conflicts = append(conflicts, "--existing-disk")
+	}
+	if opts.NetworkTier != "" {
+		conflicts = append(conflicts, "--network-tier")
+	}
+	if opts.MaintenancePolicy != "" || opts.AutoRestart != nil {
+		conflicts = append(conflicts, "--maintenance-policy/--auto-restart")
+	}
+	if opts.MachineType != "" || opts.OSImage != "" {
+		conflicts = append(conflicts, "the machine type or OS image of an existing cluster")
+	}
+	if len(conflicts) > 0 {
+		return errors.Errorf("%s cannot be combined with %s, which determines the properties of the VMs",
+			strings.Join(conflicts, ", "), flag)
+	}
+	return nil
+}
+
+// ValidateName returns an error naming the violated rule if name cannot be
+// used as the name of a VM. The rules are those of the strictest provider
+// (GCE), so that a cluster can span providers, and ensure that the name is
+// also a valid host name.
+func ValidateName(name string) error {
+	var rule string
+	switch {
+	case name == "":
+		rule = "must not be empty"
+	case len(name) > maxNameLength:
+		rule = fmt.Sprintf("must be at most %d characters long", maxNameLength)
+	case strings.IndexFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '-'
+	}) != -1:
+		rule = "must only contain lowercase letters, digits and hyphens"
+	case name[0] < 'a' || name[0] > 'z':
+		rule = "must start with a lowercase letter"
+	case strings.HasSuffix(name, "-"):
+		rule = "must not end with a hyphen"
+	default:
+		return nil
+	}
+	return errors.Errorf("invalid VM name %q: %s", name, rule)
+}
+
+// Host returns the address at which roachprod connects to the VM: its public
+// IP address or, for VMs created without one, its private IP address.
+func (vm *VM) Host() string {
+	if vm.PublicIP != "" {
+		return vm.PublicIP
+	}
+	return vm.PrivateIP
+}
+
 // IsLocal returns true if the VM represents the local host.
 func (vm *VM) IsLocal() bool {
 	return vm.Zone == config.Local
 }
 
 // Locality returns the cloud, region, and zone for the VM.  We want to include the cloud, since
-// GCE and AWS use similarly-named regions (e.g. us-east-1)
+// GCE and AWS use similarly-named regions (e.g. us-east-1). Azure zones are a location (e.g.
+// eastus2), optionally with an availability zone number (e.g. eastus2-1). The region is taken
+// from the provider's ZoneCatalog if it has been loaded by CachedZoneCatalog, and is otherwise
+// parsed from the zone name. If that fails, the zone is used in its place and ErrBadNetwork is
+// recorded in Errors.
 func (vm *VM) Locality() string {
 	var region string
 	if vm.IsLocal() {
 		region = vm.Zone
+	} else if r, ok := catalogRegion(vm.Provider, vm.Zone); ok {
+		region = r
+	} else if match := AWSZoneRE.FindStringSubmatch(vm.Zone); len(match) == 2 {
+		region = match[1]
+	} else if match := numberedZoneRE.FindStringSubmatch(vm.Zone); len(match) == 2 {
+		region = match[1]
 	} else if match := regionRE.FindStringSubmatch(vm.Zone); len(match) == 2 {
 		region = match[1]
 	} else {
-		log.Fatalf("unable to parse region from zone %q", vm.Zone)
+		region = vm.Zone
+		vm.addError(ErrBadNetwork)
 	}
 	return fmt.Sprintf("cloud=%s,region=%s,zone=%s", vm.Provider, region, vm.Zone)
 }
 
+// addError appends err to Errors unless it is already present.
+func (vm *VM) addError(err error) {
+	for _, e := range vm.Errors {
+		if e == err {
+			return
+		}
+	}
+	vm.Errors = append(vm.Errors, err)
+}
+
 type List []VM
 
 func (vl List) Len() int           { return len(vl) }
 func (vl List) Swap(i, j int)      { vl[i], vl[j] = vl[j], vl[i] }
-func (vl List) Less(i, j int) bool { return vl[i].Name < vl[j].Name }
+func (vl List) Less(i, j int) bool { return lessName(vl[i].Name, vl[j].Name) }
+
+// Name returns the name of a cluster's VM. The node number is zero-padded so
+// that the names usually sort lexically as well.
+func Name(cluster string, node int) string {
+	return fmt.Sprintf("%s-%0.4d", cluster, node)
+}
+
+// NodeNames returns the names of count VMs of a cluster, numbered from first.
+func NodeNames(cluster string, first, count int) []string {
+	ret := make([]string, count)
+	for i := range ret {
+		ret[i] = Name(cluster, first+i)
+	}
+	return ret
+}
+
+// CreateNodes creates count VMs for a new cluster on a single Provider. The
+// VMs are named and numbered from 1 in the same way as by `roachprod
+// create`, and the names are validated before anything is created. Callers
+// needing other names may use Provider.Create directly.
+func CreateNodes(ctx context.Context, p Provider, cluster string, count int, opts CreateOpts) error {
+	if count <= 0 {
+		return errors.Errorf("cannot create %d VMs", count)
+	}
+	names := NodeNames(cluster, 1, count)
+	for _, name := range names {
+		if err := ValidateName(name); err != nil {
+			return err
+		}
+	}
+	defer InvalidateListCache(p.Name())
+	return CreateWithNodeSpecs(ctx, p, names, opts)
+}
+
+// lessName orders VM names lexically, except that the names of a cluster's
+// VMs are ordered by their node number. Node numbers are zero-padded to four
+// digits, which is not enough for the lexical order to be correct beyond
+// node 9999.
+func lessName(a, b string) bool {
+	ai, bi := strings.LastIndex(a, "-"), strings.LastIndex(b, "-")
+	if ai != -1 && bi != -1 && a[:ai] == b[:bi] {
+		an, aErr := strconv.Atoi(a[ai+1:])
+		bn, bErr := strconv.Atoi(b[bi+1:])
+		if aErr == nil && bErr == nil && an != bn {
+			return an < bn
+		}
+	}
+	return a < b
+}
 
 // Extract all VM.Name entries from the List
 func (vl List) Names() []string {
@@ -104,10 +511,339 @@ func (vl List) Zones() []string {
 
 // CreateOpts is the set of options when creating VMs.
 type CreateOpts struct {
-	UseLocalSSD    bool
+	// UseLocalSSD places the data directory on local SSD scratch disks,
+	// leaving the boot disk configured by BootDiskSizeGB and BootDiskType
+	// for the OS, logs and core dumps. Otherwise, the data directory is on the
+	// data disks below or, by default, on a separate EBS volume (AWS) or
+	// Azure disk, or on the boot disk itself (GCE).
+	UseLocalSSD bool
+	// DataDiskCount is the number of persistent data disks of DataDiskSizeGB
+	// and DataDiskType to attach, which then hold the data directory in place
+	// of the provider's default. Several disks are striped into a single RAID
+	// 0 volume. Unlike local SSDs, data disks keep their data when the VM is
+	// rebooted or stopped. They are deleted along with the VM. Data disks
+	// cannot be combined with UseLocalSSD. The zero size and type select the
+	// provider's default, and disk types are provider-specific.
+	DataDiskCount  int
+	DataDiskSizeGB int
+	DataDiskType   string
+	// LocalSSDCount is the number of local SSDs to attach when UseLocalSSD is
+	// set, striped into a single RAID 0 volume when greater than one. Zero is
+	// treated as one. On AWS the local SSDs come with the instance type, which
+	// must provide at least this many.
+	LocalSSDCount int
+	// BootDiskSizeGB and BootDiskType override the provider's default boot
+	// disk. The zero values select the default. Disk types are
+	// provider-specific (e.g. pd-ssd or gp3).
+	BootDiskSizeGB int
+	BootDiskType   string
 	Lifetime       time.Duration
+	// Preemptible requests preemptible (GCE) or spot (AWS) instances.
+	// Such instances may be reclaimed by the cloud provider before the
+	// requested Lifetime has elapsed. Providers which do not support
+	// preemptible instances return an error from Create.
+	Preemptible bool
+	// GPUCount is the number of GPUs of type GPUType to attach to each VM.
+	GPUCount       int
+	GPUType        string
 	GeoDistributed bool
-	VMProviders    []string
+	// GeoWeights, if non-empty, distributes the nodes over the weighted
+	// regions in proportion to their weights (see WeightedZoneCounts),
+	// rather than evenly over the zones. It implies GeoDistributed.
+	GeoWeights  map[string]int
+	VMProviders []string
+	// MachineType and Zones, if non-empty, override the provider's configured
+	// machine type and zones. They are used to match the shape of an
+	// existing cluster.
+	MachineType string
+	Zones       []string
+	// Image, if non-empty, names a provider-specific image previously
+	// captured via Provider.CreateImage from which the VMs are booted.
+	Image string
+	// NoPublicIP creates the VMs without external addresses. The VMs are
+	// then only reachable at their private IPs, so roachprod has to be run
+	// from within their network, e.g. on a bastion host.
+	NoPublicIP bool
+	// StaticIP reserves a static external address, named by StaticIPName,
+	// for each VM, or reuses the one kept by a previous VM of the same name,
+	// so that a recreated cluster keeps its addresses and DNS records. The
+	// addresses are released along with the VMs, unless KeepStaticIP is set.
+	// StaticIP cannot be combined with NoPublicIP.
+	StaticIP     bool
+	KeepStaticIP bool
+	// Firewall places the VMs behind a firewall dedicated to their cluster
+	// (see FirewallName), which only admits connections from the other VMs
+	// of the cluster and those allowed by Ingress. The firewall is created
+	// along with the first VMs of the cluster, while VMs added later are
+	// placed behind the existing firewall, whose rules are left unchanged.
+	// The providers delete it along with the last VM of the cluster.
+	Firewall bool
+	Ingress  []IngressRule
+	// Size, if set and MachineType is not, is mapped by each provider to the
+	// closest of its machine types in place of its configured machine type.
+	Size MachineSize
+	// Placement, if non-empty, is the placement policy (e.g. PlacementSpread)
+	// of the placement group of the cluster (see PlacementGroupName), into
+	// which the VMs are launched. As with the firewall, the placement group is
+	// created with the first VMs of the cluster and deleted with the last.
+	Placement string
+	// NodeSpecs override the machine type and disks above for the nodes
+	// which they are keyed by, as numbered by NodeNumber. See
+	// CreateWithNodeSpecs.
+	NodeSpecs map[int]NodeSpec
+	// OSImage, if non-empty, overrides the provider's configured OS image
+	// with one reported in VM.OSImage, in order to match the VMs of an
+	// existing cluster.
+	OSImage string
+	// Labels are additional key/value pairs to attach to the created VMs.
+	// Each Provider is responsible for validating them against the
+	// character set allowed by the hosting platform.
+	Labels map[string]string
+	// StartupScript, if non-empty, is run as root when each VM first boots,
+	// after the provider's own setup of the disks. It is a text/template
+	// which is expanded with StartupScriptData for each VM. See
+	// AppendStartupScript.
+	StartupScript string
+	// SkipQuotaCheck skips the Provider.CheckQuota of the VMs before they are
+	// created.
+	SkipQuotaCheck bool
+	// MTU, if non-zero, is the MTU of the network interfaces of the VMs,
+	// which is set by the startup script. It cannot exceed the MTU of the
+	// provider's network.
+	MTU int
+	// NetworkInterfaces is the number of network interfaces of each VM,
+	// which must be supported by its machine type. Zero is treated as one.
+	// The subnets of the additional interfaces are provider-specific.
+	NetworkInterfaces int
+	// ExistingDisks attach pre-existing persistent disks, e.g. one kept from
+	// an earlier cluster, to the nodes which they are keyed by, as numbered
+	// by NodeNumber: a GCE disk name or an EBS volume ID. Each disk must be
+	// in the zone of its node and not attached to another VM. It holds the
+	// data directory of its node and is mounted at /mnt/data1 as it is,
+	// unless it has no filesystem yet, in place of the node's local SSDs.
+	// Existing disks cannot be combined with data disks. They are deleted
+	// along with their VMs, unless KeepExistingDisks is set.
+	ExistingDisks     map[int]string
+	KeepExistingDisks bool
+	// NetworkTier, if non-empty, is the network tier of the public IPs of
+	// the VMs, one of NetworkTiers. It trades egress cost for latency.
+	NetworkTier string
+	// SSHUser, if non-empty, is the user as which the VMs are logged into,
+	// which must exist on their OS image. The providers otherwise pick the
+	// user from the image (see DefaultSSHUser) or their own configuration.
+	// The VMs are listed with the user of their SSHUserLabel, if any.
+	SSHUser string
+	// MaintenancePolicy, if non-empty, is one of MaintenancePolicies, which
+	// overrides the provider's choice of MaintenanceTerminate for
+	// preemptible VMs and VMs with GPUs, and MaintenanceMigrate otherwise.
+	MaintenancePolicy string
+	// AutoRestart, if non-nil, sets whether the VMs are restarted or
+	// recovered after a failure of their host, which the providers do by
+	// default unless the VMs are preemptible. See ValidateScheduling.
+	AutoRestart *bool
+}
+
+// ExistingDisk returns the existing disk of CreateOpts.ExistingDisks which
+// is attached to the named VM, or "" if there is none.
+func (opts CreateOpts) ExistingDisk(vmName string) string {
+	node, err := NodeNumber(vmName)
+	if err != nil {
+		return ""
+	}
+	return opts.ExistingDisks[node]
+}
+
+// The network tiers of CreateOpts.NetworkTier. Premium traffic stays on the
+// provider's network for as long as possible, while standard traffic is
+// handed over to the internet close to the VM, which costs less.
+const (
+	NetworkTierPremium  = "PREMIUM"
+	NetworkTierStandard = "STANDARD"
+)
+
+// NetworkTiers are the values of CreateOpts.NetworkTier.
+var NetworkTiers = []string{NetworkTierPremium, NetworkTierStandard}
+
+// MinMTU is the smallest MTU which every IPv4 host must accept.
+const MinMTU = 576
+
+// The labels which every Provider attaches to the VMs it creates, in addition
+// to CreateOpts.Labels. The keys and values only use characters which are
+// valid on all of the hosting platforms.
+const (
+	// UserLabel identifies the account which created the VM.
+	UserLabel = "roachprod-user"
+	// ClusterLabel is the name of the cluster to which the VM belongs.
+	ClusterLabel = "roachprod-cluster"
+	// CreatedLabel is the creation time of the VM, in CreatedLabelFormat.
+	CreatedLabel = "roachprod-created"
+	// VersionLabel and HostLabel are the version of the roachprod binary
+	// which created the VM (see BinaryVersion) and the host it ran on, which
+	// help to track down the origin of leaked VMs.
+	VersionLabel = "roachprod-version"
+	HostLabel    = "roachprod-host"
+)
+
+// StaticIPLabel is attached to the VMs created with CreateOpts.StaticIP. Its
+// value, StaticIPKeep or StaticIPRelease, records whether the address is to
+// be kept when the VM is deleted.
+const (
+	StaticIPLabel   = "roachprod-static-ip"
+	StaticIPKeep    = "keep"
+	StaticIPRelease = "release"
+)
+
+// StaticIPPolicy returns the value of the StaticIPLabel for opts.
+func StaticIPPolicy(opts CreateOpts) string {
+	if opts.KeepStaticIP {
+		return StaticIPKeep
+	}
+	return StaticIPRelease
+}
+
+// StaticIPName returns the name of the static IP reserved for the named VM.
+// The name only depends on that of the VM, so that the address is reused by
+// a VM created later with the same name.
+func StaticIPName(vmName string) string {
+	return vmName + "-ip"
+}
+
+// CreatedLabelFormat is the time format of the CreatedLabel, in UTC.
+const CreatedLabelFormat = "2006-01-02_15-04-05"
+
+// StandardLabels returns a copy of labels with the UserLabel, ClusterLabel,
+// CreatedLabel, VersionLabel and HostLabel added. The cluster name is derived
+// from vmName, which is the name of any of the VMs being created.
+func StandardLabels(labels map[string]string, user, vmName string, created time.Time) map[string]string {
+	ret := make(map[string]string, len(labels)+5)
+	for k, v := range labels {
+		ret[k] = v
+	}
+	cluster := vmName
+	if i := strings.LastIndex(vmName, "-"); i > 0 {
+		cluster = vmName[:i]
+	}
+	ret[UserLabel] = UserLabelValue(user)
+	ret[ClusterLabel] = cluster
+	ret[CreatedLabel] = created.UTC().Format(CreatedLabelFormat)
+	ret[VersionLabel] = labelValue(BinaryVersion())
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	ret[HostLabel] = labelValue(host)
+	return ret
+}
+
+// CheckLabels returns an error if any of the labels passed in
+// CreateOpts.Labels would be overwritten by StandardLabels.
+func CheckLabels(labels map[string]string) error {
+	for k := range labels {
+		switch strings.ToLower(k) {
+		case UserLabel, ClusterLabel, CreatedLabel, VersionLabel, HostLabel, SSHUserLabel:
+			return errors.Errorf("label %q is reserved", k)
+		}
+	}
+	return nil
+}
+
+// BinaryVersion returns the version of the roachprod binary: config.Version
+// if it was set at build time, or else the VCS revision of the build, with a
+// "-dirty" suffix if there were local modifications.
+func BinaryVersion() string {
+	if config.Version != "" {
+		return config.Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if revision == "" {
+		return "unknown"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// UserLabelValue returns the value of the UserLabel for an account name, as
+// for labelValue.
+func UserLabelValue(user string) string {
+	return labelValue(user)
+}
+
+// labelValue returns s as a label value: it is lowercased and any characters
+// which are not valid in a label value on all platforms are replaced with
+// underscores.
+func labelValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(s))
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// EnvDefault returns the value of the environment variable name, or builtin if
+// it is unset. Providers use it for the defaults of flags which users may
+// configure in their environment, so that a flag overrides the environment,
+// which overrides the built-in default.
+func EnvDefault(name, builtin string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return builtin
+}
+
+// EnvDefaultZones returns the built-in default zones of a provider, preceded
+// by the zone of the environment variable name, if it is set, so that the
+// zone which users configure in their environment is used by the clusters
+// which are not geo-distributed.
+func EnvDefaultZones(name string, builtin []string) []string {
+	preferred := os.Getenv(name)
+	if preferred == "" {
+		return builtin
+	}
+	ret := []string{preferred}
+	for _, z := range builtin {
+		if z != preferred {
+			ret = append(ret, z)
+		}
+	}
+	return ret
+}
+
+// ParseLabels converts a list of `key=value` pairs into a map.
+func ParseLabels(pairs []string) (map[string]string, error) {
+	ret := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid label %q, expected key=value", pair)
+		}
+		ret[parts[0]] = parts[1]
+	}
+	return ret, nil
 }
 
 // A hook point for Providers to supply additional, provider-specific flags to various
@@ -125,124 +861,592 @@ type ProviderFlags interface {
 }
 
 // A Provider is a source of virtual machines running on some hosting platform.
+//
+// Methods which interact with the hosting platform accept a context.Context
+// and should abort any in-flight requests when it is cancelled. Where
+// possible, an interrupted method should report which resources it had
+// already created or modified.
 type Provider interface {
-	CleanSSH() error
-	ConfigSSH() error
-	Create(names []string, opts CreateOpts) error
-	Delete(vms List) error
-	Extend(vms List, lifetime time.Duration) error
+	// Capabilities describes the optional features which the provider
+	// supports.
+	Capabilities() ProviderCapabilities
+	// CheckCredentials makes a lightweight request to the hosting platform
+	// to verify that the user's credentials are present and valid.
+	CheckCredentials(ctx context.Context) error
+	// CheckQuota returns an error if creating count VMs with the options
+	// would exceed any of the provider's quotas (e.g. on the vCPUs, IP
+	// addresses or storage of a region), given their current usage. See
+	// CheckQuotaDemands.
+	CheckQuota(ctx context.Context, opts CreateOpts, count int) error
+	CleanSSH(ctx context.Context) error
+	// ConfigSSH registers the user's ssh key with the provider and configures
+	// ssh to reach its VMs. It only adds the keys which are missing, so that
+	// running it again after a partial failure does not duplicate them.
+	ConfigSSH(ctx context.Context) error
+	// CostEstimate returns the estimated hourly cost of the given VMs in USD.
+	// VMs whose cost cannot be determined are excluded from the estimate
+	// and have ErrUnknownPrice appended to their Errors.
+	CostEstimate(vms List) (float64, error)
+	Create(ctx context.Context, names []string, opts CreateOpts) error
+	// CreateImage captures an image of each of the given VMs and waits for
+	// the images to become available. If more than one VM is given, the
+	// images are distinguished by suffixing imageName with the VM's node
+	// number. The provider-specific image identifiers are returned in the
+	// same order as vms.
+	CreateImage(ctx context.Context, vms List, imageName string) ([]string, error)
+	// CreatedMachineTypes returns the machine types which Create may give to
+	// the VMs created with opts: the requested machine type, followed by those
+	// used in its place in zones which do not offer it. Nil is returned if the
+	// machine type is not determined by roachprod.
+	CreatedMachineTypes(opts CreateOpts) ([]string, error)
+	// CreatedZones returns the zones in which Create would place count VMs
+	// created with opts. Nil is returned if the VMs have no zones.
+	CreatedZones(ctx context.Context, opts CreateOpts, count int) ([]string, error)
+	Delete(ctx context.Context, vms List) error
+	// Describe returns the provider's own, unnormalized description of the
+	// VM instance. It does not modify the instance.
+	Describe(ctx context.Context, v VM) (map[string]interface{}, error)
+	Extend(ctx context.Context, vms List, lifetime time.Duration) error
 	// Return the account name associated with the provider
-	FindActiveAccount() (string, error)
+	FindActiveAccount(ctx context.Context) (string, error)
 	// Returns a hook point for extending top-level roachprod tooling flags
 	Flags() ProviderFlags
-	List() (List, error)
+	// GetMetadata returns the metadata set on the VM via SetMetadata.
+	GetMetadata(ctx context.Context, v VM) (map[string]string, error)
+	// List returns the VMs managed by the provider. Providers may use the
+	// filter to narrow their queries, but callers are responsible for
+	// applying it to the returned VMs.
+	List(ctx context.Context, filter LabelFilter) (List, error)
+	// ListScope identifies the project, profile or subscription whose VMs
+	// List returns, so that CachedList keeps the VMs of each apart. It is
+	// empty if the VMs are not to be cached.
+	ListScope() string
+	// MachineTypeAvailable returns true if the machine type is offered in
+	// the zone. Callers should use MachineTypes to check several zones.
+	MachineTypeAvailable(ctx context.Context, zone, machineType string) (bool, error)
 	// The name of the Provider, which will also surface in the top-level Providers map.
 	Name() string
+	// Reboot restarts the given VMs and waits until they are running again.
+	Reboot(ctx context.Context, vms List) error
+	// Resize changes the machine type of the given VMs, which requires the
+	// VMs to be stopped and restarted. If some VMs could not be resized, the
+	// returned error identifies the VMs which were.
+	Resize(ctx context.Context, vms List, machineType string) error
+	// SSHAccess returns the key and bastion with which ssh reaches the VMs,
+	// as configured by ConfigSSH.
+	SSHAccess() SSHAccess
+	// SetMetadata adds the key/value pairs to the metadata (GCE) or tags
+	// (AWS) of a running or stopped VM, replacing existing values. Keys with
+	// empty values are removed.
+	SetMetadata(ctx context.Context, v VM, kv map[string]string) error
+	// Start starts the given stopped VMs and waits until they are running.
+	// The VMs may come back with new IP addresses, so callers have to list
+	// them again.
+	Start(ctx context.Context, vms List) error
+	// Stop stops the given VMs and waits until they are stopped. The VMs
+	// keep their persistent disks, but the contents of local SSDs are lost.
+	Stop(ctx context.Context, vms List) error
+	// ZoneCatalog lists the zones offered by the hosting platform. Callers
+	// should use CachedZoneCatalog instead.
+	ZoneCatalog(ctx context.Context) (ZoneCatalog, error)
+}
+
+// providers contains all known Provider instances, keyed by name. They are
+// added by the init functions of the provider packages with Register, and by
+// tests, which may remove them again with Unregister. They are read with
+// LookupProvider and AllProviders.
+var providers = struct {
+	sync.RWMutex
+	m map[string]Provider
+}{m: map[string]Provider{}}
+
+// LookupProvider returns the provider registered under the name, if any.
+func LookupProvider(name string) (Provider, bool) {
+	providers.RLock()
+	defer providers.RUnlock()
+	p, ok := providers.m[name]
+	return p, ok
+}
+
+// AllProviders returns the registered providers, sorted by name.
+func AllProviders() []Provider {
+	providers.RLock()
+	defer providers.RUnlock()
+	ret := make([]Provider, 0, len(providers.m))
+	for _, p := range providers.m {
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return ret
 }
 
-// Providers contains all known Provider instances. This is initialized by subpackage init() functions.
-var Providers = map[string]Provider{}
+// Register adds the provider to the known providers under the name, which
+// must be the provider's own. It returns an error if another provider is
+// already registered under the name, or if the provider is nil or has no
+// flags.
+func Register(name string, p Provider) error {
+	if p == nil {
+		return errors.Errorf("provider %q is nil", name)
+	}
+	if name == "" || p.Name() != name {
+		return errors.Errorf("provider %q cannot be registered as %q", p.Name(), name)
+	}
+	if p.Flags() == nil {
+		return errors.Errorf("provider %s has no flags", name)
+	}
+	providers.Lock()
+	defer providers.Unlock()
+	if _, ok := providers.m[name]; ok {
+		return errors.Errorf("provider %s is already registered", name)
+	}
+	providers.m[name] = p
+	return nil
+}
 
-// AllProviderNames returns the names of all known vm Providers.  This is useful with the
+// MustRegister is like Register, but panics on error. It is meant for the
+// init functions of the provider packages, for which a duplicate name is a
+// programming error.
+func MustRegister(name string, p Provider) {
+	if err := Register(name, p); err != nil {
+		panic(err)
+	}
+}
+
+// Unregister removes the provider registered under the name, if any.
+func Unregister(name string) {
+	providers.Lock()
+	defer providers.Unlock()
+	delete(providers.m, name)
+}
+
+// AllProviderNames returns the sorted names of all known vm Providers.  This is useful with the
 // ProvidersSequential or ProvidersParallel methods.
 func AllProviderNames() []string {
 	var ret []string
-	for name := range Providers {
-		ret = append(ret, name)
+	for _, p := range AllProviders() {
+		ret = append(ret, p.Name())
 	}
 	return ret
 }
 
-// FanOut collates a collection of VMs by their provider and invoke the callbacks in parallel.
-func FanOut(list List, action func(Provider, List) error) error {
-	var m = map[string]List{}
-	for _, vm := range list {
-		m[vm.Provider] = append(m[vm.Provider], vm)
+// ProviderCapabilities describes the optional features of a Provider. The
+// corresponding CreateOpts or Provider methods fail on providers which do
+// not support them, and CheckCreateOpts rejects such CreateOpts before any
+// VMs are created. The limits are per VM, and zero if there is none.
+type ProviderCapabilities struct {
+	// LocalSSD is set if the provider honors CreateOpts.UseLocalSSD, with up
+	// to MaxLocalSSDs of CreateOpts.LocalSSDCount.
+	LocalSSD     bool `json:"local_ssd"`
+	MaxLocalSSDs int  `json:"max_local_ssds,omitempty"`
+	// Preemptible is set if the provider honors CreateOpts.Preemptible, whose
+	// VMs live for at most MaxPreemptibleLifetime.
+	Preemptible bool `json:"preemptible"`
+	// GPUs is set if the provider honors CreateOpts.GPUCount, up to MaxGPUs.
+	GPUs    bool `json:"gpus"`
+	MaxGPUs int  `json:"max_gpus,omitempty"`
+	// Images is set if the provider implements CreateImage and honors
+	// CreateOpts.Image.
+	Images bool `json:"images"`
+	// OSImages is set if the provider honors CreateOpts.OSImage.
+	OSImages bool `json:"os_images"`
+	// Metadata is set if the provider implements GetMetadata and
+	// SetMetadata.
+	Metadata bool `json:"metadata"`
+	// StartupScripts is set if the provider honors CreateOpts.StartupScript.
+	StartupScripts bool `json:"startup_scripts"`
+	// BootDisks is set if the provider honors CreateOpts.BootDiskSizeGB and
+	// CreateOpts.BootDiskType.
+	BootDisks bool `json:"boot_disks"`
+	// DataDisks is set if the provider honors CreateOpts.DataDiskCount, up to
+	// MaxDataDisks.
+	DataDisks    bool `json:"data_disks"`
+	MaxDataDisks int  `json:"max_data_disks,omitempty"`
+	// PrivateIPs is set if the provider honors CreateOpts.NoPublicIP.
+	PrivateIPs bool `json:"private_ips"`
+	// Extend, Reboot, Resize and Suspend are set if the provider implements
+	// the corresponding methods; Suspend stands for Stop and Start.
+	Extend  bool `json:"extend"`
+	Reboot  bool `json:"reboot"`
+	Resize  bool `json:"resize"`
+	Suspend bool `json:"suspend"`
+	// StaticIPs is set if the provider honors CreateOpts.StaticIP.
+	StaticIPs bool `json:"static_ips"`
+	// Firewalls is set if the provider honors CreateOpts.Ingress.
+	Firewalls bool `json:"firewalls"`
+	// SpreadPlacement is set if the provider supports PlacementSpread.
+	SpreadPlacement bool `json:"spread_placement"`
+	// MachineSizes is set if the provider maps CreateOpts.Size to its
+	// machine types.
+	MachineSizes bool `json:"machine_sizes"`
+	// MTU is set if the provider honors CreateOpts.MTU.
+	MTU bool `json:"mtu"`
+	// NetworkInterfaces is set if the provider supports more than one
+	// network interface per VM, up to MaxNetworkInterfaces if non-zero. The
+	// machine type may allow fewer.
+	NetworkInterfaces    bool `json:"network_interfaces"`
+	MaxNetworkInterfaces int  `json:"max_network_interfaces,omitempty"`
+	// ExistingDisks is set if the provider attaches CreateOpts.ExistingDisks.
+	ExistingDisks bool `json:"existing_disks"`
+	// NetworkTiers is set if the provider honors CreateOpts.NetworkTier.
+	NetworkTiers bool `json:"network_tiers"`
+	// GeoWeights is set if the provider honors CreateOpts.GeoWeights.
+	GeoWeights bool `json:"geo_weights"`
+	// AutoRestart and MaintenancePolicies are set if the provider honors
+	// CreateOpts.AutoRestart and CreateOpts.MaintenancePolicy.
+	AutoRestart         bool `json:"auto_restart"`
+	MaintenancePolicies bool `json:"maintenance_policies"`
+	// MaxPreemptibleLifetime, if non-zero, is the longest that the
+	// provider lets preemptible VMs live.
+	MaxPreemptibleLifetime time.Duration `json:"max_preemptible_lifetime,omitempty"`
+	// ListsLocalSSDs is set if the provider reports the local SSDs of its
+	// VMs in VM.Disks. Otherwise, the local SSDs come with the machine type,
+	// and the VMs without them have a data disk of their own.
+	ListsLocalSSDs bool `json:"lists_local_ssds"`
+}
+
+// A Capability is one of the optional features of ProviderCapabilities.
+type Capability struct {
+	Name      string
+	Supported bool
+	// Limit is the maximum per VM, which is zero if there is none.
+	Limit int
+	// MaxLifetime is the longest that the VMs which use the feature may
+	// live, which is zero if there is no limit.
+	MaxLifetime time.Duration
+}
+
+// All returns all of the optional features, whether supported or not.
+// ListsLocalSSDs is left out, since it describes how the VMs of the provider
+// are listed rather than a feature which can be requested.
+func (c ProviderCapabilities) All() []Capability {
+	return []Capability{
+		{"local-ssd", c.LocalSSD, c.MaxLocalSSDs, 0},
+		{"preemptible", c.Preemptible, 0, c.MaxPreemptibleLifetime},
+		{"gpus", c.GPUs, c.MaxGPUs, 0},
+		{"images", c.Images, 0, 0},
+		{"os-images", c.OSImages, 0, 0},
+		{"metadata", c.Metadata, 0, 0},
+		{"startup-scripts", c.StartupScripts, 0, 0},
+		{"boot-disks", c.BootDisks, 0, 0},
+		{"data-disks", c.DataDisks, c.MaxDataDisks, 0},
+		{"private-ips", c.PrivateIPs, 0, 0},
+		{"extend", c.Extend, 0, 0},
+		{"reboot", c.Reboot, 0, 0},
+		{"resize", c.Resize, 0, 0},
+		{"suspend", c.Suspend, 0, 0},
+		{"static-ips", c.StaticIPs, 0, 0},
+		{"firewalls", c.Firewalls, 0, 0},
+		{"spread-placement", c.SpreadPlacement, 0, 0},
+		{"machine-sizes", c.MachineSizes, 0, 0},
+		{"mtu", c.MTU, 0, 0},
+		{"network-interfaces", c.NetworkInterfaces, c.MaxNetworkInterfaces, 0},
+		{"existing-disks", c.ExistingDisks, 0, 0},
+		{"network-tiers", c.NetworkTiers, 0, 0},
+		{"geo-weights", c.GeoWeights, 0, 0},
+		{"auto-restart", c.AutoRestart, 0, 0},
+		{"maintenance-policies", c.MaintenancePolicies, 0, 0},
 	}
+}
 
-	var g errgroup.Group
-	for name, vms := range m {
-		// capture loop variables
-		n := name
-		v := vms
-		g.Go(func() error {
-			p, ok := Providers[n]
-			if !ok {
-				return errors.Errorf("unknown provider name: %s", n)
-			}
-			return action(p, v)
-		})
+// Features returns the names of the supported features.
+func (c ProviderCapabilities) Features() []string {
+	var ret []string
+	for _, f := range c.All() {
+		if f.Supported {
+			ret = append(ret, f.Name)
+		}
 	}
+	return ret
+}
 
-	return g.Wait()
+// CheckCreateOpts returns an error naming the first of the options which the
+// provider cannot honor according to its capabilities. Options with defaults
+// which a provider ignores, such as UseLocalSSD, are only rejected if they
+// were changed.
+func CheckCreateOpts(p Provider, opts CreateOpts) error {
+	c := p.Capabilities()
+	unsupported := func(feature, flag string) error {
+		return errors.Errorf("%s does not support %s (requested by %s)", p.Name(), feature, flag)
+	}
+	tooMany := func(feature, flag string, n, limit int) error {
+		return errors.Errorf("%s supports at most %d %s per VM, not %d (requested by %s)",
+			p.Name(), limit, feature, n, flag)
+	}
+	switch {
+	case opts.UseLocalSSD && opts.LocalSSDCount > 1 && !c.LocalSSD:
+		return unsupported("local SSDs", "--local-ssd-count")
+	case opts.UseLocalSSD && c.MaxLocalSSDs > 0 && opts.LocalSSDCount > c.MaxLocalSSDs:
+		return tooMany("local SSDs", "--local-ssd-count", opts.LocalSSDCount, c.MaxLocalSSDs)
+	case opts.Preemptible && !c.Preemptible:
+		return unsupported("preemptible VMs", "--preemptible")
+	case opts.GPUCount > 0 && !c.GPUs:
+		return unsupported("GPUs", "--gpu-count")
+	case c.MaxGPUs > 0 && opts.GPUCount > c.MaxGPUs:
+		return tooMany("GPUs", "--gpu-count", opts.GPUCount, c.MaxGPUs)
+	case opts.Image != "" && !c.Images:
+		return unsupported("images", "--image")
+	case opts.OSImage != "" && !c.OSImages:
+		return unsupported("OS images", "the OS image of an existing cluster")
+	case opts.StartupScript != "" && !c.StartupScripts:
+		return unsupported("startup scripts", "--startup-script")
+	case (opts.BootDiskSizeGB > 0 || opts.BootDiskType != "") && !c.BootDisks:
+		return unsupported("boot disk options", "--disk-size/--disk-type")
+	case opts.DataDiskCount > 0 && !c.DataDisks:
+		return unsupported("data disks", "--data-disk-count")
+	case c.MaxDataDisks > 0 && opts.DataDiskCount > c.MaxDataDisks:
+		return tooMany("data disks", "--data-disk-count", opts.DataDiskCount, c.MaxDataDisks)
+	case opts.StaticIP && !c.StaticIPs:
+		return unsupported("static IPs", "--static-ip")
+	case opts.Firewall && !c.Firewalls:
+		return unsupported("firewalls", "--ingress/--ingress-cidr")
+	case opts.Placement == PlacementSpread && !c.SpreadPlacement:
+		return unsupported("spread placement", "--placement")
+	case !opts.Size.IsZero() && !c.MachineSizes:
+		return unsupported("machine sizes", "--cpus/--mem-gb")
+	case opts.NoPublicIP && !c.PrivateIPs:
+		return unsupported("VMs without public IPs", "--no-public-ip")
+	case opts.MTU > 0 && !c.MTU:
+		return unsupported("custom MTUs", "--mtu")
+	case opts.NetworkInterfaces > 1 && !c.NetworkInterfaces:
+		return unsupported("multiple network interfaces", "--nics")
+	case len(opts.ExistingDisks) > 0 && !c.ExistingDisks:
+		return unsupported("existing disks", "--existing-disk")
+	case opts.NetworkTier != "" && !c.NetworkTiers:
+		return unsupported("network tiers", "--network-tier")
+	case len(opts.GeoWeights) > 0 && !c.GeoWeights:
+		return unsupported("region weights", "--geo-weights")
+	case opts.AutoRestart != nil && !c.AutoRestart:
+		return unsupported("automatic restarts", "--auto-restart")
+	case opts.MaintenancePolicy != "" && !c.MaintenancePolicies:
+		return unsupported("maintenance policies", "--maintenance-policy")
+	case c.MaxNetworkInterfaces > 0 && opts.NetworkInterfaces > c.MaxNetworkInterfaces:
+		return tooMany("network interfaces", "--nics", opts.NetworkInterfaces, c.MaxNetworkInterfaces)
+	}
+	return nil
 }
 
-// Memoizes return value from FindActiveAccounts.
-var cachedActiveAccounts map[string]string
+// ProviderInfo describes a registered Provider and whether it can be used in
+// the current environment.
+type ProviderInfo struct {
+	Name string `json:"name"`
+	// Account is the active account, if the credentials are configured.
+	Account string `json:"account"`
+	// CredentialsError is set if the credentials are missing or invalid.
+	CredentialsError string               `json:"credentials_error,omitempty"`
+	Capabilities     ProviderCapabilities `json:"capabilities"`
+}
 
-// FindActiveAccount queries the active providers for the name of the user account.
-func FindActiveAccounts() (map[string]string, error) {
-	source := cachedActiveAccounts
+// Usable returns true if the provider's credentials are configured.
+func (i ProviderInfo) Usable() bool {
+	return i.CredentialsError == ""
+}
 
-	if source == nil {
-		// Ask each Provider for its active account name.
-		source = map[string]string{}
-		err := ProvidersSequential(AllProviderNames(), func(p Provider) error {
-			account, err := p.FindActiveAccount()
-			if err != nil {
-				return err
-			}
-			if len(account) > 0 {
-				source[p.Name()] = account
-			}
-			return nil
-		})
+// ListProviders concurrently checks the credentials of all known Providers
+// and returns a ProviderInfo for each of them, sorted by name.
+func ListProviders(ctx context.Context) []ProviderInfo {
+	names := AllProviderNames()
+	ret := make([]ProviderInfo, len(names))
+	// The action never fails, so neither does ProvidersParallel.
+	_ = ProvidersParallel(ctx, names, func(ctx context.Context, p Provider) error {
+		info := ProviderInfo{Name: p.Name(), Capabilities: p.Capabilities()}
+		if err := p.CheckCredentials(ctx); err != nil {
+			info.CredentialsError = err.Error()
+		} else if info.Account, err = p.FindActiveAccount(ctx); err != nil {
+			info.CredentialsError = err.Error()
+		}
+		ret[sort.SearchStrings(names, p.Name())] = info
+		return nil
+	})
+	return ret
+}
+
+// FanOut collates a collection of VMs by their provider and invoke the callbacks in parallel.
+// If any of the callbacks fail, the returned error is a *FanOutError.
+func FanOut(
+	ctx context.Context, list List, action func(context.Context, Provider, List) error,
+) error {
+	results := FanOutResults(ctx, list, action)
+	for _, r := range results {
+		if r.Err != nil {
+			return &FanOutError{Results: results}
+		}
+	}
+	return nil
+}
+
+// Memoizes the per-provider return values from FindActiveAccounts.
+var cachedActiveAccounts = map[string]string{}
+
+// FindActiveAccounts queries the named providers, or all providers if named is
+// empty, for the name of the user account. Providers without an active
+// account are omitted, unless they were explicitly named, in which case an
+// error is returned.
+func FindActiveAccounts(ctx context.Context, named []string) (map[string]string, error) {
+	required := len(named) > 0
+	if !required {
+		named = AllProviderNames()
+	}
+
+	// Ask each Provider for its active account name.
+	var missing []string
+	for _, name := range named {
+		if _, ok := cachedActiveAccounts[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	err := ProvidersSequential(ctx, missing, func(ctx context.Context, p Provider) error {
+		account, err := p.FindActiveAccount(ctx)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		cachedActiveAccounts = source
+		cachedActiveAccounts[p.Name()] = account
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Return a copy.
-	ret := make(map[string]string, len(source))
-	for k, v := range source {
-		ret[k] = v
+	ret := make(map[string]string, len(named))
+	for _, name := range named {
+		account := cachedActiveAccounts[name]
+		if len(account) > 0 {
+			ret[name] = account
+		} else if required {
+			return nil, errors.Errorf("no active account found for provider %s", name)
+		}
+	}
+
+	return ret, nil
+}
+
+// AccountMismatchError is returned by FindActiveAccount if the providers
+// report different active accounts.
+type AccountMismatchError struct {
+	// Accounts maps provider names to their active account.
+	Accounts map[string]string
+}
+
+func (e *AccountMismatchError) Error() string {
+	var pairs []string
+	for name, account := range e.Accounts {
+		pairs = append(pairs, fmt.Sprintf("%s: %s", name, account))
 	}
+	sort.Strings(pairs)
+	return fmt.Sprintf("providers disagree on the active account (%s)", strings.Join(pairs, ", "))
+}
 
+// FindActiveAccount returns the account name which the named providers, or
+// all providers if named is empty, agree on. An *AccountMismatchError is
+// returned if they disagree.
+func FindActiveAccount(ctx context.Context, named []string) (string, error) {
+	accounts, err := FindActiveAccounts(ctx, named)
+	if err != nil {
+		return "", err
+	}
+	var ret string
+	for _, account := range accounts {
+		if ret != "" && account != ret {
+			return "", &AccountMismatchError{Accounts: accounts}
+		}
+		ret = account
+	}
 	return ret, nil
 }
 
 // ForProvider resolves the Provider with the given name and executes the action.
-func ForProvider(named string, action func(Provider) error) error {
-	p, ok := Providers[named]
+func ForProvider(ctx context.Context, named string, action func(context.Context, Provider) error) error {
+	p, ok := LookupProvider(named)
 	if !ok {
 		return errors.Errorf("unknown vm provider: %s", named)
 	}
-	if err := action(p); err != nil {
+	defer trackInFlight(named)()
+	if err := action(ctx, p); err != nil {
 		return errors.Wrapf(err, "in provider: %s", named)
 	}
 	return nil
 }
 
 // ProvidersParallel concurrently executes actions for each named Provider.
-func ProvidersParallel(named []string, action func(Provider) error) error {
+func ProvidersParallel(
+	ctx context.Context, named []string, action func(context.Context, Provider) error,
+) error {
 	var g errgroup.Group
 	for _, name := range named {
 		// capture loop variable
 		n := name
 		g.Go(func() error {
-			return ForProvider(n, action)
+			return ForProvider(ctx, n, action)
 		})
 	}
 	return g.Wait()
 }
 
 // ProvidersSequential sequentially executes actions for each named Provider.
-func ProvidersSequential(named []string, action func(Provider) error) error {
+func ProvidersSequential(
+	ctx context.Context, named []string, action func(context.Context, Provider) error,
+) error {
 	for _, name := range named {
-		if err := ForProvider(name, action); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := ForProvider(ctx, name, action); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// ImageNames returns the image names that Provider.CreateImage should use
+// when capturing images of the given VMs.
+func ImageNames(vms List, imageName string) []string {
+	if len(vms) == 1 {
+		return []string{imageName}
+	}
+	ret := make([]string, len(vms))
+	for i, v := range vms {
+		// VM names end in the zero-padded node number.
+		parts := strings.Split(v.Name, "-")
+		ret[i] = fmt.Sprintf("%s-%s", imageName, parts[len(parts)-1])
+	}
+	return ret
+}
+
+// ParseZoneCounts splits a list of zones, each of which may carry a `:count`
+// suffix, into the zone names and the number of nodes to place in each zone.
+// If none of the zones has a count, the returned counts are nil and the
+// provider's default distribution applies. Otherwise, every zone must have a
+// count and the counts must add up to nodes.
+func ParseZoneCounts(zones []string, nodes int) ([]string, []int, error) {
+	names := make([]string, len(zones))
+	var counts []int
+	total := 0
+	for i, zone := range zones {
+		parts := strings.SplitN(zone, ":", 2)
+		names[i] = parts[0]
+		if len(parts) == 1 {
+			continue
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 {
+			return nil, nil, errors.Errorf("invalid node count in zone %q", zone)
+		}
+		if counts == nil {
+			counts = make([]int, len(zones))
+		}
+		counts[i] = n
+		total += n
+	}
+	if counts == nil {
+		return names, nil, nil
+	}
+	for i, zone := range zones {
+		if !strings.Contains(zone, ":") {
+			return nil, nil, errors.Errorf("zone %s has no node count", names[i])
+		}
+	}
+	if total != nodes {
+		return nil, nil, errors.Errorf("zone node counts add up to %d, but %d nodes were requested", total, nodes)
+	}
+	return names, counts, nil
+}
@@ -0,0 +1,115 @@
+package vm
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestName(t *testing.T) {
+	for _, tc := range []struct {
+		node     int
+		expected string
+	}{
+		{1, "user-test-0001"},
+		{9, "user-test-0009"},
+		{10, "user-test-0010"},
+		{100, "user-test-0100"},
+		{12345, "user-test-12345"},
+	} {
+		if name := Name("user-test", tc.node); name != tc.expected {
+			t.Errorf("node %d is named %s, expected %s", tc.node, name, tc.expected)
+		}
+		if node, err := NodeNumber(Name("user-test", tc.node)); err != nil || node != tc.node {
+			t.Errorf("node %d is parsed as %d (%v)", tc.node, node, err)
+		}
+	}
+}
+
+func TestListSort(t *testing.T) {
+	for _, count := range []int{1, 9, 10, 100} {
+		expected := NodeNames("user-test", 1, count)
+		// Names which are not zero-padded, such as those of the VMs created
+		// before the padding, are ordered by their node number as well.
+		unpadded := []string{"user-old-1", "user-old-2", "user-old-9", "user-old-10", "user-old-100"}
+		expected = append(unpadded, expected...)
+
+		vms := make(List, len(expected))
+		for i, j := range rand.Perm(len(expected)) {
+			vms[i] = VM{Name: expected[j]}
+		}
+		sort.Sort(vms)
+		if names := vms.Names(); !reflect.DeepEqual(names, expected) {
+			t.Errorf("%d nodes are sorted as %v, expected %v", count, names, expected)
+		}
+	}
+}
+
+func TestLessName(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		less bool
+	}{
+		{"user-test-0009", "user-test-0010", true},
+		{"user-test-9", "user-test-10", true},
+		{"user-test-10", "user-test-9", false},
+		{"user-test-0010", "user-test-9", false},
+		{"user-test-9999", "user-test-10000", true},
+		// The clusters are ordered by name before their nodes.
+		{"user-a-10", "user-b-9", true},
+		{"user-test-1", "user-test-1", false},
+	} {
+		if less := lessName(tc.a, tc.b); less != tc.less {
+			t.Errorf("lessName(%s, %s) = %t, expected %t", tc.a, tc.b, less, tc.less)
+		}
+	}
+}
+
+func TestEnvDefaultZones(t *testing.T) {
+	builtin := []string{"a-1", "b-1", "c-1"}
+	for _, tc := range []struct {
+		env      string
+		expected []string
+	}{
+		{"", []string{"a-1", "b-1", "c-1"}},
+		{"b-1", []string{"b-1", "a-1", "c-1"}},
+		{"d-1", []string{"d-1", "a-1", "b-1", "c-1"}},
+	} {
+		t.Setenv("ROACHPROD_TEST_ZONE", tc.env)
+		if zones := EnvDefaultZones("ROACHPROD_TEST_ZONE", builtin); !reflect.DeepEqual(zones, tc.expected) {
+			t.Errorf("with %q: expected %v, got %v", tc.env, tc.expected, zones)
+		}
+	}
+}
+
+// TestCapabilitiesAll checks that All lists the lifetime of preemptible VMs
+// along with the other limits.
+func TestCapabilitiesAll(t *testing.T) {
+	c := ProviderCapabilities{
+		Preemptible: true, MaxPreemptibleLifetime: 24 * time.Hour,
+		LocalSSD: true, MaxLocalSSDs: 8,
+	}
+	found := 0
+	for _, f := range c.All() {
+		switch f.Name {
+		case "preemptible":
+			found++
+			if !f.Supported || f.MaxLifetime != 24*time.Hour || f.Limit != 0 {
+				t.Errorf("unexpected preemptible feature %+v", f)
+			}
+		case "local-ssd":
+			found++
+			if !f.Supported || f.Limit != 8 || f.MaxLifetime != 0 {
+				t.Errorf("unexpected local-ssd feature %+v", f)
+			}
+		}
+	}
+	if found != 2 {
+		t.Errorf("expected the preemptible and local-ssd features, found %d", found)
+	}
+	if features := c.Features(); len(features) != 2 {
+		t.Errorf("expected two supported features, got %v", features)
+	}
+}
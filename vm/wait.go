@@ -0,0 +1,117 @@
+package vm
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sshPollInterval is the delay between attempts to connect to a VM's ssh port.
+const sshPollInterval = 2 * time.Second
+
+// WaitForSSH concurrently polls the ssh port of each of the VMs until it
+// accepts connections or timeout has elapsed. VMs without public IPs are
+// polled through the bastion of their provider, if ConfigBastionSSH set one.
+// The returned error lists the VMs which never became reachable.
+func WaitForSSH(ctx context.Context, vms List, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var unreachable []string
+	var wg sync.WaitGroup
+	for _, v := range vms {
+		v := v
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := waitForSSH(ctx, v); err != nil {
+				mu.Lock()
+				unreachable = append(unreachable, v.Name)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(unreachable) > 0 {
+		sort.Strings(unreachable)
+		return errors.Errorf("ssh did not become available within %s on: %s",
+			timeout, strings.Join(unreachable, ", "))
+	}
+	return nil
+}
+
+// waitForSSH polls the ssh port of the VM, which is reached via its bastion
+// if it has one.
+func waitForSSH(ctx context.Context, v VM) error {
+	host := v.Host()
+	if host == "" {
+		return ErrBadNetwork
+	}
+	b, viaBastion := bastionOf(v)
+	for {
+		if viaBastion {
+			if err := waitForSSHVia(ctx, b, host); err == nil {
+				return nil
+			}
+		} else if ok, _ := Reachable(ctx, v, 22, sshPollInterval); ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sshPollInterval):
+		}
+	}
+}
+
+// Reachable returns true if a TCP connection to the port of the VM can be
+// established within timeout. The VM is dialed at its public IP if it has
+// one, and otherwise at its private IP, which must then be routable from
+// here since bastions are not used. An error is only returned if the VM has
+// no IP address.
+func Reachable(ctx context.Context, v VM, port int, timeout time.Duration) (bool, error) {
+	host := v.Host()
+	if host == "" {
+		return false, ErrBadNetwork
+	}
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return false, nil
+	}
+	_ = conn.Close()
+	return true, nil
+}
+
+// A Reachability is the result of Reachable for a VM.
+type Reachability struct {
+	VM        VM
+	Reachable bool
+	Err       error
+}
+
+// CheckReachable concurrently checks whether each of the VMs is Reachable on
+// the port, and returns the results in the order of vms.
+func CheckReachable(ctx context.Context, vms List, port int, timeout time.Duration) []Reachability {
+	ret := make([]Reachability, len(vms))
+	var wg sync.WaitGroup
+	for i := range vms {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := Reachable(ctx, vms[i], port, timeout)
+			ret[i] = Reachability{VM: vms[i], Reachable: ok, Err: err}
+		}()
+	}
+	wg.Wait()
+	return ret
+}
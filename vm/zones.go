@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/roachprod/config"
+	"github.com/pkg/errors"
+)
+
+// A ZoneCatalog maps the names of the zones offered by a provider to the
+// names of their regions.
+type ZoneCatalog map[string]string
+
+// zoneCatalogTTL is how long the zone catalogs are cached on disk. Providers
+// add zones rarely.
+const zoneCatalogTTL = 24 * time.Hour
+
+// zoneCatalogs memoizes the catalogs returned by CachedZoneCatalog, keyed by
+// provider name.
+var zoneCatalogs struct {
+	sync.Mutex
+	byProvider map[string]ZoneCatalog
+}
+
+// A zoneCatalogEntry is the content of a zone catalog cache file.
+type zoneCatalogEntry struct {
+	ListedAt time.Time   `json:"listed_at"`
+	Zones    ZoneCatalog `json:"zones"`
+}
+
+// CachedZoneCatalog returns the provider's ZoneCatalog, which is read from
+// the cache in config.ListCacheDir if it was fetched within the last day.
+func CachedZoneCatalog(ctx context.Context, p Provider) (ZoneCatalog, error) {
+	zoneCatalogs.Lock()
+	catalog, ok := zoneCatalogs.byProvider[p.Name()]
+	zoneCatalogs.Unlock()
+	if ok {
+		return catalog, nil
+	}
+
+	path := filepath.Join(os.ExpandEnv(config.ListCacheDir), "zones-"+p.Name()+".json")
+	var entry zoneCatalogEntry
+	listCacheMu.Lock()
+	data, err := ioutil.ReadFile(path)
+	listCacheMu.Unlock()
+	if err == nil && json.Unmarshal(data, &entry) == nil &&
+		time.Since(entry.ListedAt) < zoneCatalogTTL && len(entry.Zones) > 0 {
+		catalog = entry.Zones
+	} else {
+		listedAt := time.Now()
+		if catalog, err = p.ZoneCatalog(ctx); err != nil {
+			return nil, errors.Wrapf(err, "unable to list the zones of %s", p.Name())
+		}
+		if err := writeCacheFile(path, zoneCatalogEntry{ListedAt: listedAt, Zones: catalog}); err != nil {
+			// The cache is only an optimization.
+			Warningf("unable to cache the zones of %s: %s", p.Name(), err)
+		}
+	}
+
+	zoneCatalogs.Lock()
+	defer zoneCatalogs.Unlock()
+	if zoneCatalogs.byProvider == nil {
+		zoneCatalogs.byProvider = make(map[string]ZoneCatalog)
+	}
+	zoneCatalogs.byProvider[p.Name()] = catalog
+	return catalog, nil
+}
+
+// ValidateZones returns an error naming all of the zones which the provider
+// does not offer. CreateCluster calls it before any VMs are created, with the
+// zones of Provider.CreatedZones.
+func ValidateZones(ctx context.Context, p Provider, zones []string) error {
+	if len(zones) == 0 {
+		return nil
+	}
+	catalog, err := CachedZoneCatalog(ctx, p)
+	if err != nil {
+		return err
+	}
+	var invalid []string
+	for _, zone := range zones {
+		if _, ok := catalog[zone]; !ok {
+			invalid = append(invalid, zone)
+		}
+	}
+	if len(invalid) > 0 {
+		return errors.Errorf("%s does not offer the zones %s", p.Name(), strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// UniqueZones returns the distinct zones of the placements of a number of
+// VMs, in the order in which they first appear.
+func UniqueZones(placements []string) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, zone := range placements {
+		if !seen[zone] {
+			seen[zone] = true
+			ret = append(ret, zone)
+		}
+	}
+	return ret
+}
+
+// JoinZones returns the sorted zones of the set, separated by commas.
+func JoinZones(set map[string]bool) string {
+	zones := make([]string, 0, len(set))
+	for zone := range set {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return strings.Join(zones, ", ")
+}
+
+// catalogRegion returns the region of a zone if the catalog of the provider
+// has been loaded by CachedZoneCatalog.
+func catalogRegion(provider, zone string) (string, bool) {
+	zoneCatalogs.Lock()
+	defer zoneCatalogs.Unlock()
+	region, ok := zoneCatalogs.byProvider[provider][zone]
+	return region, ok
+}